@@ -16,9 +16,84 @@ write_timeout_sec             = 15
 read_timeout_sec              = 15
 idle_timeout_sec              = 15
 
+// responses to requests with an Idempotency-Key header are kept for
+// idempotency_key_ttl_sec. the requests are read whole to be compared with
+// their repeats, so their bodies can be at most idempotency_max_body_kb,
+// 32 MiB by default
+idempotency_key_ttl_sec = 86400
+//idempotency_max_body_kb = 32768
+
+// the ISO 4217 currency of items that are listed without one
+default_currency = "USD"
+
+// destinations are taxed and shipped to using their most specific country and
+// state match. an empty country or state matches all. tax rates are in basis
+// points, and shipping amounts are in the currency's minor units
+tax_rules = [
+  { country = "US", state = "CA", rate_bps = 725 },
+  { country = "US", state = "NY", rate_bps = 400 },
+]
+
+shipping_rates = [
+  { currency = "USD", base = 1500, per_item = 500 },
+  { country = "US", currency = "USD", base = 500, per_item = 100, free_over = 5000 },
+]
+
+// "fake" is an in-process provider whose every request has the
+// fake_payment_outcome: "success", "decline" or "timeout"
+payment_provider     = "fake"
+payment_timeout_sec  = 10
+fake_payment_outcome = "success"
+
+// uploaded item images are kept in image_store: "local" files under
+// image_dir, an "s3" compatible bucket, or "memory" until the server exits.
+// S3_ACCESS_KEY and S3_SECRET_KEY can be set in the environment instead
+image_store       = "local"
+image_dir         = "images"
+max_image_size_kb = 5120
+//s3_endpoint   = "http://localhost:9000"
+//s3_bucket     = "shipyard"
+//s3_region     = "us-east-1"
+//s3_access_key = "minioadmin"
+//s3_secret_key = "minioadmin"
+
+// back in stock notifications are sent by notifier: "log" only logs them,
+// "email" mails them through an SMTP server, and "webhook" POSTs them as JSON.
+// SMTP_PASSWORD can be set in the environment
+notifier = "log"
+//smtp_addr          = "localhost:1025"
+//smtp_username      = "shipyard"
+//smtp_password      = "shipyard"
+//mail_from          = "Shipyard <noreply@example.com>"
+//notify_webhook_url = "http://localhost:9090/notify"
+
+// shipments in transit are tracked with their carriers every
+// track_interval_sec. "fake" is an in-process tracker whose every package
+// stays in transit
+tracker            = "fake"
+track_interval_sec = 300
+
+// events are recorded along with the changes they describe, and given to
+// their subscribers every dispatch_interval_sec
+dispatch_interval_sec = 1
+
+// /api/events streams send a heartbeat every stream_heartbeat_sec, and end
+// shortly before write_timeout_sec for clients to reconnect with Last-Event-ID
+stream_heartbeat_sec = 5
+
+// deferred work, like back in stock notifications and webhook deliveries, is
+// queued in the database and run by job_workers workers, which look for due
+// jobs every job_interval_sec when there are none to run.
+// sqlite databases only ever have the one worker
+job_workers      = 4
+job_interval_sec = 1
+
 idp_password_salt = "00000"
 idp_client_id     = "idp_client_id"
 idp_client_secret = "idp_client_secret"
 
+// users with these emails can manage the marketplace, like its coupons
+//admin_emails = ["admin@example.com"]
+
 loglevel = "debug"
 developer_mode = true
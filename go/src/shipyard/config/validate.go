@@ -11,6 +11,10 @@ import (
 	"github.com/hashicorp/hcl"
 	"github.com/sirupsen/logrus"
 	"github.com/zeebo/errs"
+
+	"shipyard/money"
+	"shipyard/payment"
+	"shipyard/pricing"
 )
 
 var (
@@ -37,6 +41,13 @@ var (
 	publicIDPURLEnv = os.Getenv("PUBLIC_IDP_URL")
 	clientHostsEnv  = os.Getenv("CLIENT_HOSTS")
 
+	// image storage env var overrides
+	s3AccessKeyEnv = os.Getenv("S3_ACCESS_KEY")
+	s3SecretKeyEnv = os.Getenv("S3_SECRET_KEY")
+
+	// notification env var overrides
+	smtpPasswordEnv = os.Getenv("SMTP_PASSWORD")
+
 	configErr = errs.Class("configuration")
 )
 
@@ -51,6 +62,34 @@ type Configs struct {
 	WriteTimeout            time.Duration
 	ReadTimeout             time.Duration
 	IdleTimeout             time.Duration
+	IdempotencyKeyTTL       time.Duration
+	IdempotencyMaxBody      int64
+	DefaultCurrency         string
+	TaxRules                pricing.TaxRules
+	ShippingRates           pricing.ShippingRates
+	PaymentProvider         string
+	PaymentTimeout          time.Duration
+	FakePaymentOutcome      payment.Outcome
+	ImageStore              string
+	ImageDir                string
+	MaxImageSize            int64
+	S3Endpoint              *url.URL
+	S3Bucket                string
+	S3Region                string
+	S3AccessKey             string
+	S3SecretKey             string
+	Notifier                string
+	SMTPAddress             string
+	SMTPUsername            string
+	SMTPPassword            string
+	MailFrom                string
+	NotifyWebhookURL        *url.URL
+	Tracker                 string
+	TrackInterval           time.Duration
+	DispatchInterval        time.Duration
+	StreamHeartbeat         time.Duration
+	JobWorkers              int
+	JobInterval             time.Duration
 	IDPPasswordSalt         string
 	IDPClientID             string
 	IDPClientSecret         string
@@ -58,6 +97,7 @@ type Configs struct {
 	DeveloperMode           bool
 	InsecureRequestsMode    bool
 	ClientHosts             []*url.URL
+	AdminEmails             []string
 	PublicAPIURL            *url.URL
 	PublicIDPURL            *url.URL
 }
@@ -95,24 +135,68 @@ func Parse() (*Configs, error) {
 }
 
 type rawConfigs struct {
-	DBURL                   string   `hcl:"db_url"`
-	APISlug                 string   `hcl:"api_slug"`
-	APIAddress              string   `hcl:"api_addr"`
-	IDPAddress              string   `hcl:"idp_addr"`
-	MetricAddress           string   `hcl:"metric_addr"`
-	GracefulShutdownTimeout int      `hcl:"graceful_shutdown_timeout_sec"`
-	WriteTimeout            int      `hcl:"write_timeout_sec"`
-	ReadTimeout             int      `hcl:"read_timeout_sec"`
-	IdleTimeout             int      `hcl:"idle_timeout_sec"`
-	IDPPasswordSalt         string   `hcl:"idp_password_salt"`
-	IDPClientID             string   `hcl:"idp_client_id"`
-	IDPClientSecret         string   `hcl:"idp_client_secret"`
-	LogLevel                string   `hcl:"loglevel"`
-	DeveloperMode           bool     `hcl:"developer_mode"`
-	InsecureRequestsMode    bool     `hcl:"insecure_requests_mode"`
-	ClientHosts             []string `hcl:"client_hosts"`
-	PublicAPIURL            string   `hcl:"public_api_url"`
-	PublicIDPURL            string   `hcl:"public_idp_url"`
+	DBURL                   string            `hcl:"db_url"`
+	APISlug                 string            `hcl:"api_slug"`
+	APIAddress              string            `hcl:"api_addr"`
+	IDPAddress              string            `hcl:"idp_addr"`
+	MetricAddress           string            `hcl:"metric_addr"`
+	GracefulShutdownTimeout int               `hcl:"graceful_shutdown_timeout_sec"`
+	WriteTimeout            int               `hcl:"write_timeout_sec"`
+	ReadTimeout             int               `hcl:"read_timeout_sec"`
+	IdleTimeout             int               `hcl:"idle_timeout_sec"`
+	IdempotencyKeyTTL       int               `hcl:"idempotency_key_ttl_sec"`
+	IdempotencyMaxBodyKB    int               `hcl:"idempotency_max_body_kb"`
+	DefaultCurrency         string            `hcl:"default_currency"`
+	TaxRules                []rawTaxRule      `hcl:"tax_rules"`
+	ShippingRates           []rawShippingRate `hcl:"shipping_rates"`
+	PaymentProvider         string            `hcl:"payment_provider"`
+	PaymentTimeout          int               `hcl:"payment_timeout_sec"`
+	FakePaymentOutcome      string            `hcl:"fake_payment_outcome"`
+	ImageStore              string            `hcl:"image_store"`
+	ImageDir                string            `hcl:"image_dir"`
+	MaxImageSizeKB          int               `hcl:"max_image_size_kb"`
+	S3Endpoint              string            `hcl:"s3_endpoint"`
+	S3Bucket                string            `hcl:"s3_bucket"`
+	S3Region                string            `hcl:"s3_region"`
+	S3AccessKey             string            `hcl:"s3_access_key"`
+	S3SecretKey             string            `hcl:"s3_secret_key"`
+	Notifier                string            `hcl:"notifier"`
+	SMTPAddress             string            `hcl:"smtp_addr"`
+	SMTPUsername            string            `hcl:"smtp_username"`
+	SMTPPassword            string            `hcl:"smtp_password"`
+	MailFrom                string            `hcl:"mail_from"`
+	NotifyWebhookURL        string            `hcl:"notify_webhook_url"`
+	Tracker                 string            `hcl:"tracker"`
+	TrackInterval           int               `hcl:"track_interval_sec"`
+	DispatchInterval        int               `hcl:"dispatch_interval_sec"`
+	StreamHeartbeat         int               `hcl:"stream_heartbeat_sec"`
+	JobWorkers              int               `hcl:"job_workers"`
+	JobInterval             int               `hcl:"job_interval_sec"`
+	IDPPasswordSalt         string            `hcl:"idp_password_salt"`
+	IDPClientID             string            `hcl:"idp_client_id"`
+	IDPClientSecret         string            `hcl:"idp_client_secret"`
+	LogLevel                string            `hcl:"loglevel"`
+	DeveloperMode           bool              `hcl:"developer_mode"`
+	InsecureRequestsMode    bool              `hcl:"insecure_requests_mode"`
+	ClientHosts             []string          `hcl:"client_hosts"`
+	AdminEmails             []string          `hcl:"admin_emails"`
+	PublicAPIURL            string            `hcl:"public_api_url"`
+	PublicIDPURL            string            `hcl:"public_idp_url"`
+}
+
+type rawTaxRule struct {
+	Country string `hcl:"country"`
+	State   string `hcl:"state"`
+	RateBPS int    `hcl:"rate_bps"`
+}
+
+type rawShippingRate struct {
+	Country  string `hcl:"country"`
+	State    string `hcl:"state"`
+	Currency string `hcl:"currency"`
+	Base     int    `hcl:"base"`
+	PerItem  int    `hcl:"per_item"`
+	FreeOver int    `hcl:"free_over"`
 }
 
 // setConfigFiles will set all of the values provided in the config files,
@@ -198,6 +282,22 @@ func (raw *rawConfigs) setNoChangeEnvVars() error {
 		return err
 	}
 
+	err = setStringNoChange(&raw.S3AccessKey, s3AccessKeyEnv, "s3 access keys")
+	if err != nil {
+		return err
+	}
+
+	err = setStringNoChange(&raw.S3SecretKey, s3SecretKeyEnv, "s3 secret keys")
+	if err != nil {
+		return err
+	}
+
+	err = setStringNoChange(&raw.SMTPPassword, smtpPasswordEnv,
+		"smtp passwords")
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -312,6 +412,51 @@ func (raw *rawConfigs) validate() (*Configs, error) {
 	if raw.IdleTimeout == 0 {
 		return nil, configErr.New("idle_sec unconfigured")
 	}
+	if raw.IdempotencyKeyTTL == 0 {
+		return nil, configErr.New("idempotency_key_ttl_sec unconfigured")
+	}
+	if raw.IdempotencyMaxBodyKB < 0 {
+		return nil, configErr.New("idempotency_max_body_kb can't be negative")
+	}
+	if raw.DefaultCurrency == "" {
+		return nil, configErr.New("default_currency unconfigured")
+	}
+	if len(raw.ShippingRates) == 0 {
+		return nil, configErr.New("shipping_rates unconfigured")
+	}
+	if raw.PaymentProvider == "" {
+		return nil, configErr.New("payment_provider unconfigured")
+	}
+	if raw.PaymentTimeout == 0 {
+		return nil, configErr.New("payment_timeout_sec unconfigured")
+	}
+	if raw.ImageStore == "" {
+		return nil, configErr.New("image_store unconfigured")
+	}
+	if raw.MaxImageSizeKB <= 0 {
+		return nil, configErr.New("max_image_size_kb unconfigured")
+	}
+	if raw.Notifier == "" {
+		return nil, configErr.New("notifier unconfigured")
+	}
+	if raw.Tracker == "" {
+		return nil, configErr.New("tracker unconfigured")
+	}
+	if raw.TrackInterval <= 0 {
+		return nil, configErr.New("track_interval_sec unconfigured")
+	}
+	if raw.DispatchInterval <= 0 {
+		return nil, configErr.New("dispatch_interval_sec unconfigured")
+	}
+	if raw.StreamHeartbeat <= 0 {
+		return nil, configErr.New("stream_heartbeat_sec unconfigured")
+	}
+	if raw.JobWorkers <= 0 {
+		return nil, configErr.New("job_workers unconfigured")
+	}
+	if raw.JobInterval <= 0 {
+		return nil, configErr.New("job_interval_sec unconfigured")
+	}
 	if raw.IDPPasswordSalt == "" {
 		return nil, configErr.New("idp_password_salt unconfigured")
 	}
@@ -353,6 +498,91 @@ func (raw *rawConfigs) validate() (*Configs, error) {
 	write := time.Second * time.Duration(raw.WriteTimeout)
 	read := time.Second * time.Duration(raw.ReadTimeout)
 	idle := time.Second * time.Duration(raw.IdleTimeout)
+	idempotencyKeyTTL := time.Second * time.Duration(raw.IdempotencyKeyTTL)
+	paymentTimeout := time.Second * time.Duration(raw.PaymentTimeout)
+
+	defaultCurrency, err := money.ParseCurrency(raw.DefaultCurrency)
+	if err != nil {
+		return nil, configErr.Wrap(err)
+	}
+
+	taxRules := make(pricing.TaxRules, 0, len(raw.TaxRules))
+	for _, rule := range raw.TaxRules {
+		if rule.RateBPS < 0 {
+			return nil, configErr.New("tax_rules rate_bps can't be negative")
+		}
+		taxRules = append(taxRules, pricing.TaxRule(rule))
+	}
+
+	shippingRates := make(pricing.ShippingRates, 0, len(raw.ShippingRates))
+	for _, rate := range raw.ShippingRates {
+		currency, err := money.ParseCurrency(rate.Currency)
+		if err != nil {
+			return nil, configErr.Wrap(err)
+		}
+		rate.Currency = currency.Code
+		shippingRates = append(shippingRates, pricing.ShippingRate(rate))
+	}
+
+	// the fake is the only provider until a real gateway is integrated
+	if raw.PaymentProvider != "fake" {
+		return nil, configErr.New("unknown payment_provider %q",
+			raw.PaymentProvider)
+	}
+
+	fakePaymentOutcome := payment.Succeed
+	if raw.FakePaymentOutcome != "" {
+		fakePaymentOutcome, err = payment.ParseOutcome(raw.FakePaymentOutcome)
+		if err != nil {
+			return nil, configErr.Wrap(err)
+		}
+	}
+
+	var s3Endpoint *url.URL
+	switch raw.ImageStore {
+	case "memory":
+	case "local":
+		if raw.ImageDir == "" {
+			return nil, configErr.New("image_dir unconfigured")
+		}
+	case "s3":
+		if raw.S3Endpoint == "" || raw.S3Bucket == "" || raw.S3Region == "" ||
+			raw.S3AccessKey == "" || raw.S3SecretKey == "" {
+			return nil, configErr.New("s3_endpoint, s3_bucket, s3_region, " +
+				"s3_access_key and s3_secret_key must all be configured")
+		}
+		s3Endpoint, err = url.Parse(raw.S3Endpoint)
+		if err != nil {
+			return nil, configErr.Wrap(err)
+		}
+	default:
+		return nil, configErr.New("unknown image_store %q", raw.ImageStore)
+	}
+
+	// the fake is the only tracker until a real carrier is integrated
+	if raw.Tracker != "fake" {
+		return nil, configErr.New("unknown tracker %q", raw.Tracker)
+	}
+
+	var notifyWebhookURL *url.URL
+	switch raw.Notifier {
+	case "log":
+	case "email":
+		if raw.SMTPAddress == "" || raw.MailFrom == "" {
+			return nil, configErr.New("smtp_addr and mail_from must both be " +
+				"configured")
+		}
+	case "webhook":
+		if raw.NotifyWebhookURL == "" {
+			return nil, configErr.New("notify_webhook_url unconfigured")
+		}
+		notifyWebhookURL, err = url.Parse(raw.NotifyWebhookURL)
+		if err != nil {
+			return nil, configErr.Wrap(err)
+		}
+	default:
+		return nil, configErr.New("unknown notifier %q", raw.Notifier)
+	}
 
 	loglevel, err := logrus.ParseLevel(raw.LogLevel)
 	if err != nil {
@@ -379,6 +609,34 @@ func (raw *rawConfigs) validate() (*Configs, error) {
 		WriteTimeout:            write,
 		ReadTimeout:             read,
 		IdleTimeout:             idle,
+		IdempotencyKeyTTL:       idempotencyKeyTTL,
+		IdempotencyMaxBody:      int64(raw.IdempotencyMaxBodyKB) * 1024,
+		DefaultCurrency:         defaultCurrency.Code,
+		TaxRules:                taxRules,
+		ShippingRates:           shippingRates,
+		PaymentProvider:         raw.PaymentProvider,
+		PaymentTimeout:          paymentTimeout,
+		FakePaymentOutcome:      fakePaymentOutcome,
+		ImageStore:              raw.ImageStore,
+		ImageDir:                raw.ImageDir,
+		MaxImageSize:            int64(raw.MaxImageSizeKB) * 1024,
+		S3Endpoint:              s3Endpoint,
+		S3Bucket:                raw.S3Bucket,
+		S3Region:                raw.S3Region,
+		S3AccessKey:             raw.S3AccessKey,
+		S3SecretKey:             raw.S3SecretKey,
+		Notifier:                raw.Notifier,
+		SMTPAddress:             raw.SMTPAddress,
+		SMTPUsername:            raw.SMTPUsername,
+		SMTPPassword:            raw.SMTPPassword,
+		MailFrom:                raw.MailFrom,
+		NotifyWebhookURL:        notifyWebhookURL,
+		Tracker:                 raw.Tracker,
+		TrackInterval:           time.Second * time.Duration(raw.TrackInterval),
+		DispatchInterval:        time.Second * time.Duration(raw.DispatchInterval),
+		StreamHeartbeat:         time.Second * time.Duration(raw.StreamHeartbeat),
+		JobWorkers:              raw.JobWorkers,
+		JobInterval:             time.Second * time.Duration(raw.JobInterval),
 		IDPPasswordSalt:         raw.IDPPasswordSalt,
 		IDPClientID:             raw.IDPClientID,
 		IDPClientSecret:         raw.IDPClientSecret,
@@ -386,6 +644,7 @@ func (raw *rawConfigs) validate() (*Configs, error) {
 		DeveloperMode:           raw.DeveloperMode,
 		InsecureRequestsMode:    raw.InsecureRequestsMode,
 		ClientHosts:             clientHosts,
+		AdminEmails:             raw.AdminEmails,
 		PublicAPIURL:            publicAPIURL,
 		PublicIDPURL:            publicIDPURL,
 	}, nil
@@ -0,0 +1,167 @@
+package cron
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zeebo/errs"
+)
+
+// Invalid is returned for specs that can't be parsed
+var Invalid = errs.Class("invalid cron spec")
+
+// Schedule is when a cron spec runs, in UTC. a spec has the five usual
+// fields, "minute hour day-of-month month day-of-week", each a "*", a number,
+// a range like "1-5", or a comma separated list of them, with an optional
+// "/step". like cron, a day that matches either of the day fields runs when
+// both of them are restricted. @hourly, @daily, @weekly, @monthly and
+// @yearly are accepted too
+type Schedule struct {
+	spec                          string
+	minute, hour, dom, month, dow uint64
+	// anyDay is true when either day field is "*", so that both of them have
+	// to match, rather than either
+	anyDay bool
+}
+
+var shorthands = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// Parse parses a cron spec
+func Parse(spec string) (*Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if expanded, ok := shorthands[spec]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, Invalid.New("%q doesn't have 5 fields", spec)
+	}
+
+	// either day field starting with "*" has the other one decide the day
+	s := Schedule{spec: spec, anyDay: strings.HasPrefix(fields[2], "*") ||
+		strings.HasPrefix(fields[4], "*")}
+	var err error
+	for _, f := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dom, 1, 31},
+		{&s.month, 1, 12},
+		{&s.dow, 0, 7},
+	} {
+		*f.bits, err = parseField(fields[0], f.min, f.max)
+		if err != nil {
+			return nil, err
+		}
+		fields = fields[1:]
+	}
+
+	// sunday is both 0 and 7
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return &s, nil
+}
+
+// MustParse is like Parse, but panics if the spec can't be parsed. it's for
+// specs written into the code
+func MustParse(spec string) *Schedule {
+	s, err := Parse(spec)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// String is the spec the schedule was parsed from
+func (s *Schedule) String() string {
+	return s.spec
+}
+
+// parseField returns the bits of the values in the field
+func parseField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, Invalid.New("bad step in %q", part)
+			}
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, Invalid.New("bad value in %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, Invalid.New("bad range in %q", part)
+				}
+			} else if step > 1 {
+				// "5/15" is every 15 from 5 on
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, Invalid.New("%q is outside of %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// Next returns the first time after after that the schedule runs, or the
+// zero time if it never does, like on february 30th
+func (s *Schedule) Next(after time.Time) time.Time {
+	t := after.UTC().Truncate(time.Minute).Add(time.Minute)
+
+	// every schedule that runs at all does within a leap year cycle
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.anyDay {
+		return dom && dow
+	}
+	return dom || dow
+}
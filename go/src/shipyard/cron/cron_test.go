@@ -0,0 +1,55 @@
+package cron
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNext(t *testing.T) {
+	// a wednesday
+	from := time.Date(2020, 1, 15, 10, 30, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		spec     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2020, 1, 15, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2020, 1, 15, 10, 45, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2020, 1, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 * * * *", time.Date(2020, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2020, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{"30 9 * * 1-5", time.Date(2020, 1, 16, 9, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2020, 1, 19, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 29 2 *", time.Date(2020, 2, 29, 12, 0, 0, 0, time.UTC)},
+		{"0 3 1,15 * *", time.Date(2020, 2, 1, 3, 0, 0, 0, time.UTC)},
+		// either day field matching is enough when both are restricted
+		{"0 0 1 * 5", time.Date(2020, 1, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+	} {
+		s, err := Parse(tc.spec)
+		if assert.NoError(t, err, tc.spec) {
+			assert.Equal(t, tc.expected, s.Next(from), tc.spec)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"@often",
+	} {
+		_, err := Parse(spec)
+		assert.True(t, Invalid.Has(err), spec)
+	}
+}
@@ -0,0 +1,81 @@
+package database
+
+import (
+	"context"
+)
+
+// dbx can only set a column to a value, which loses any change made by
+// another transaction since the row was read. these add to the columns
+// instead, so concurrent changes are all kept. the rows have to be read
+// again for their new values
+
+// AdjustItemStock adds delta to the item's remaining quantity and bumps its
+// version
+func (tx *Tx) AdjustItemStock(ctx context.Context, itemPk int64,
+	delta int) error {
+
+	_, err := tx.Tx.ExecContext(ctx, tx.Rebind("UPDATE items SET "+
+		"remaining_quantity = remaining_quantity + ?, version = version + 1 "+
+		"WHERE pk = ?"), delta, itemPk)
+	return dbErr.Wrap(err)
+}
+
+// AdjustVariantStock adds delta to the variant's remaining quantity
+func (tx *Tx) AdjustVariantStock(ctx context.Context, variantPk int64,
+	delta int) error {
+
+	_, err := tx.Tx.ExecContext(ctx, tx.Rebind("UPDATE variants SET "+
+		"remaining_quantity = remaining_quantity + ? WHERE pk = ?"),
+		delta, variantPk)
+	return dbErr.Wrap(err)
+}
+
+// AdjustItemRating adds to the item's rating total and count, and bumps its
+// version
+func (tx *Tx) AdjustItemRating(ctx context.Context, itemPk int64,
+	totalDelta, countDelta int) error {
+
+	_, err := tx.Tx.ExecContext(ctx, tx.Rebind("UPDATE items SET "+
+		"rating_total = rating_total + ?, rating_count = rating_count + ?, "+
+		"version = version + 1 WHERE pk = ?"), totalDelta, countDelta, itemPk)
+	return dbErr.Wrap(err)
+}
+
+// UseCoupon counts a use of the coupon, and returns false without counting
+// it if the coupon has no uses left. a max_uses of 0 is unlimited
+func (tx *Tx) UseCoupon(ctx context.Context, couponPk int64) (bool, error) {
+	result, err := tx.Tx.ExecContext(ctx, tx.Rebind("UPDATE coupons SET "+
+		"uses = uses + 1 WHERE pk = ? AND (max_uses = 0 OR uses < max_uses)"),
+		couponPk)
+	if err != nil {
+		return false, dbErr.Wrap(err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, dbErr.Wrap(err)
+	}
+	return affected > 0, nil
+}
+
+// BumpVersion adds 1 to the version of the row of table with pk, and returns
+// false without changing it if the row is no longer at version. a versioned
+// row is bumped with this before the rest of its update is written by pk, so
+// that it's only updated if nothing else has been since it was read. the
+// version can't be compared by the update itself, since sqlite reads the row
+// back by the old values of the update's wheres
+func (tx *Tx) BumpVersion(ctx context.Context, table string, pk int64,
+	version int) (bool, error) {
+
+	result, err := tx.Tx.ExecContext(ctx, tx.Rebind("UPDATE "+table+" SET "+
+		"version = version + 1 WHERE pk = ? AND version = ?"), pk, version)
+	if err != nil {
+		return false, dbErr.Wrap(err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, dbErr.Wrap(err)
+	}
+	return affected > 0, nil
+}
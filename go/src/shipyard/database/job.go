@@ -0,0 +1,122 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// the statuses of a job. see the job model in schema.dbx
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobDead      = "dead"
+)
+
+const jobColumns = "pk, id, created, kind, payload, status, attempts, " +
+	"max_attempts, run_at, locked_until, last_error, finished"
+
+// claimable are the jobs due at ? that are pending, or whose worker's claim
+// ran out at ?
+const claimable = "(status = '" + JobPending + "' AND run_at <= ?) OR " +
+	"(status = '" + JobRunning + "' AND locked_until <= ?)"
+
+// Driver is the name of the driver the database was opened with
+func (db *DB) Driver() string {
+	switch db.dbMethods.(type) {
+	case *postgresDB:
+		return PostgresDriver
+	case *sqlite3DB:
+		return SqliteDriver
+	default:
+		return ""
+	}
+}
+
+// ClaimJobs marks up to limit of the claimable jobs, the longest due first,
+// as running until lockedUntil, counting an attempt for each, and returns
+// them.
+//
+// dbx can't generate this. on postgres, the rows are locked with SKIP LOCKED
+// so that any number of workers can claim at once without waiting on, or
+// taking, each other's jobs. sqlite has no row locks, but its writes are
+// serialized, so a job read in the transaction that claims it can't be
+// claimed by anyone else first. it only has the one worker all the same,
+// since it only has the one writer
+func (db *DB) ClaimJobs(ctx context.Context, now, lockedUntil time.Time,
+	limit int) (jobs []*Job, err error) {
+
+	now, lockedUntil = now.UTC(), lockedUntil.UTC()
+	switch db.Driver() {
+	case PostgresDriver:
+		query := db.Rebind("UPDATE jobs " +
+			"SET status = ?, attempts = attempts + 1, locked_until = ? " +
+			"WHERE pk IN (SELECT pk FROM jobs WHERE " + claimable + " " +
+			"ORDER BY run_at LIMIT ? FOR UPDATE SKIP LOCKED) " +
+			"RETURNING " + jobColumns)
+		rows, err := db.DB.QueryContext(ctx, query, JobRunning, lockedUntil,
+			now, now, limit)
+		if err != nil {
+			return nil, dbErr.Wrap(err)
+		}
+		return scanJobs(rows)
+
+	case SqliteDriver:
+		err = db.WithTx(ctx, func(ctx context.Context, tx *Tx) error {
+			rows, err := tx.Tx.QueryContext(ctx, "SELECT "+jobColumns+
+				" FROM jobs WHERE "+claimable+" ORDER BY run_at LIMIT ?",
+				now, now, limit)
+			if err != nil {
+				return dbErr.Wrap(err)
+			}
+			jobs, err = scanJobs(rows)
+			if err != nil {
+				return err
+			}
+
+			for _, job := range jobs {
+				job.Status, job.Attempts = JobRunning, job.Attempts+1
+				job.LockedUntil = &lockedUntil
+				_, err = tx.Tx.ExecContext(ctx, "UPDATE jobs "+
+					"SET status = ?, attempts = ?, locked_until = ? WHERE pk = ?",
+					job.Status, job.Attempts, lockedUntil, job.Pk)
+				if err != nil {
+					return dbErr.Wrap(err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return jobs, nil
+
+	default:
+		return nil, dbErr.New("unexpected driver")
+	}
+}
+
+func scanJobs(rows *sql.Rows) (jobs []*Job, err error) {
+	defer func() {
+		closeErr := rows.Close()
+		if err == nil && closeErr != nil {
+			err = dbErr.Wrap(closeErr)
+		}
+	}()
+
+	for rows.Next() {
+		job := &Job{}
+		err = rows.Scan(&job.Pk, &job.Id, &job.Created, &job.Kind, &job.Payload,
+			&job.Status, &job.Attempts, &job.MaxAttempts, &job.RunAt,
+			&job.LockedUntil, &job.LastError, &job.Finished)
+		if err != nil {
+			return nil, dbErr.Wrap(err)
+		}
+		jobs = append(jobs, job)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, dbErr.Wrap(err)
+	}
+	return jobs, nil
+}
@@ -0,0 +1,14 @@
+package database
+
+import (
+	"context"
+)
+
+// LockUser holds the user's row until the transaction ends, so that the
+// transactions adding something a user can only have one of take turns. it
+// rewrites a column with its own value, since sqlite has no SELECT FOR UPDATE
+func (tx *Tx) LockUser(ctx context.Context, userPk int64) error {
+	_, err := tx.Tx.ExecContext(ctx, tx.Rebind(
+		"UPDATE users SET email = email WHERE pk = ?"), userPk)
+	return dbErr.Wrap(err)
+}
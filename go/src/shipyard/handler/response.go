@@ -15,6 +15,9 @@ func jsonResponse(w http.ResponseWriter, obj interface{}, err error) {
 	writeJSONError := func(jsonErr error) {
 		statusCode := he.StatusCodeByError(jsonErr)
 		w.WriteHeader(statusCode)
+		if statusCode == http.StatusNotModified {
+			return // a 304 must not have a body
+		}
 
 		errStr := fmt.Sprintf("%s", jsonErr)
 		jsonErrObj := map[string]string{"error": errStr}
@@ -75,6 +78,12 @@ func rawResponse(w http.ResponseWriter, bi interface{}, err error) {
 		return
 	}
 
+	if len(b) == 0 {
+		// nothing is written for an empty body, which also leaves alone any
+		// connection the handler has taken over
+		return
+	}
+
 	_, err = w.Write(b)
 	if err != nil {
 		writeRawError(err)
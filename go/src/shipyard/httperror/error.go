@@ -7,23 +7,44 @@ import (
 )
 
 var (
-	BadRequest      = errs.Class("bad request")     // 400
-	Unauthenticated = errs.Class("unauthenticated") // 401
-	Unauthorized    = errs.Class("unauthorized")    // 403
-	NotFound        = errs.Class("not found")       // 404
-	Unexpected      = errs.Class("internal")        // 500
+	NotModified        = errs.Class("not modified")        // 304
+	BadRequest         = errs.Class("bad request")         // 400
+	Unauthenticated    = errs.Class("unauthenticated")     // 401
+	PaymentRequired    = errs.Class("payment required")    // 402
+	Unauthorized       = errs.Class("unauthorized")        // 403
+	NotFound           = errs.Class("not found")           // 404
+	Conflict           = errs.Class("conflict")            // 409
+	PreconditionFailed = errs.Class("precondition failed") // 412
+	TooLarge           = errs.Class("too large")           // 413
+	Unprocessable      = errs.Class("unprocessable")       // 422
+	Unexpected         = errs.Class("internal")            // 500
+	Unavailable        = errs.Class("unavailable")         // 503
 )
 
 func StatusCodeByError(err error) int {
 	switch {
+	case NotModified.Has(err):
+		return http.StatusNotModified
 	case BadRequest.Has(err):
 		return http.StatusBadRequest
 	case Unauthenticated.Has(err):
 		return http.StatusUnauthorized // not a typo
+	case PaymentRequired.Has(err):
+		return http.StatusPaymentRequired
 	case Unauthorized.Has(err):
 		return http.StatusForbidden
 	case NotFound.Has(err):
 		return http.StatusNotFound
+	case Conflict.Has(err):
+		return http.StatusConflict
+	case PreconditionFailed.Has(err):
+		return http.StatusPreconditionFailed
+	case TooLarge.Has(err):
+		return http.StatusRequestEntityTooLarge
+	case Unprocessable.Has(err):
+		return http.StatusUnprocessableEntity
+	case Unavailable.Has(err):
+		return http.StatusServiceUnavailable
 	}
 	return http.StatusInternalServerError
 }
@@ -82,6 +82,35 @@ func run() error {
 	wg.Add(1)
 	go gracefullyServe(ctx, &wg, apiServer, conf.GracefulShutdownTimeout)
 
+	// service 4 - track shipments with their carriers
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		apiClient.RunTracker(ctx)
+	}()
+
+	// service 5 - give recorded events to their subscribers
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		apiClient.RunDispatcher(ctx)
+	}()
+
+	// service 6 - end the event streams and inventory feeds when shutting down
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		apiClient.RunStreams(ctx)
+	}()
+
+	// service 7 - run queued and scheduled jobs, which send back in stock
+	// notifications and POST events to webhooks
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		apiClient.RunJobs(ctx)
+	}()
+
 	// listen for C-c interrupt
 	interruptWaiter := make(chan os.Signal, 1)
 	signal.Notify(interruptWaiter, os.Interrupt)
@@ -0,0 +1,122 @@
+package money
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/zeebo/errs"
+)
+
+var (
+	// Invalid is returned for unknown currencies and malformed amounts
+	Invalid = errs.Class("invalid money")
+
+	// Mismatch is returned when amounts in different currencies are combined
+	Mismatch = errs.Class("mixed currencies")
+)
+
+// Currency is an ISO 4217 currency
+type Currency struct {
+	// Code is the alphabetic code, like "USD"
+	Code string
+	// Exponent is the number of minor unit digits, like 2 for cents
+	Exponent int
+	// Symbol is prefixed to formatted amounts. when empty, the code is
+	// suffixed instead
+	Symbol string
+}
+
+// currencies are the ones items can be priced in. it's far from every
+// currency, and others are added as they're needed
+var currencies = map[string]Currency{
+	"AUD": {Code: "AUD", Exponent: 2, Symbol: "A$"},
+	"BHD": {Code: "BHD", Exponent: 3},
+	"BRL": {Code: "BRL", Exponent: 2, Symbol: "R$"},
+	"CAD": {Code: "CAD", Exponent: 2, Symbol: "CA$"},
+	"CHF": {Code: "CHF", Exponent: 2},
+	"CNY": {Code: "CNY", Exponent: 2, Symbol: "CN¥"},
+	"CZK": {Code: "CZK", Exponent: 2},
+	"DKK": {Code: "DKK", Exponent: 2},
+	"EUR": {Code: "EUR", Exponent: 2, Symbol: "€"},
+	"GBP": {Code: "GBP", Exponent: 2, Symbol: "£"},
+	"HKD": {Code: "HKD", Exponent: 2, Symbol: "HK$"},
+	"INR": {Code: "INR", Exponent: 2, Symbol: "₹"},
+	"ISK": {Code: "ISK", Exponent: 0},
+	"JPY": {Code: "JPY", Exponent: 0, Symbol: "¥"},
+	"KRW": {Code: "KRW", Exponent: 0, Symbol: "₩"},
+	"KWD": {Code: "KWD", Exponent: 3},
+	"MXN": {Code: "MXN", Exponent: 2, Symbol: "MX$"},
+	"NOK": {Code: "NOK", Exponent: 2},
+	"NZD": {Code: "NZD", Exponent: 2, Symbol: "NZ$"},
+	"PLN": {Code: "PLN", Exponent: 2},
+	"SEK": {Code: "SEK", Exponent: 2},
+	"SGD": {Code: "SGD", Exponent: 2},
+	"USD": {Code: "USD", Exponent: 2, Symbol: "$"},
+	"ZAR": {Code: "ZAR", Exponent: 2},
+}
+
+// ParseCurrency returns the currency for an ISO 4217 code
+func ParseCurrency(code string) (Currency, error) {
+	currency, ok := currencies[strings.ToUpper(code)]
+	if !ok {
+		return Currency{}, Invalid.New("unknown currency %q", code)
+	}
+	return currency, nil
+}
+
+// Money is an amount of a currency in its minor units, like cents. it's never
+// a float so that amounts add up exactly
+type Money struct {
+	Amount   int
+	Currency Currency
+}
+
+// New returns amount minor units of the currency with the ISO 4217 code
+func New(amount int, code string) (Money, error) {
+	currency, err := ParseCurrency(code)
+	if err != nil {
+		return Money{}, err
+	}
+	return Money{Amount: amount, Currency: currency}, nil
+}
+
+// Zero is no money in the currency
+func Zero(currency Currency) Money {
+	return Money{Currency: currency}
+}
+
+// Add returns the sum of m and o, which must be in the same currency
+func (m Money) Add(o Money) (Money, error) {
+	if m.Currency.Code != o.Currency.Code {
+		return Money{}, Mismatch.New("can't add %s to %s", o.Currency.Code,
+			m.Currency.Code)
+	}
+	return Money{Amount: m.Amount + o.Amount, Currency: m.Currency}, nil
+}
+
+// Times returns m multiplied by n, like the price of n items
+func (m Money) Times(n int) Money {
+	return Money{Amount: m.Amount * n, Currency: m.Currency}
+}
+
+// String formats m in its major units, like "$12.34" or "1.500 KWD"
+func (m Money) String() string {
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign, amount = "-", -amount
+	}
+
+	digits := strconv.Itoa(amount)
+	if exp := m.Currency.Exponent; exp > 0 {
+		if len(digits) <= exp {
+			digits = strings.Repeat("0", exp-len(digits)+1) + digits
+		}
+		digits = digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+	}
+
+	if m.Currency.Symbol != "" {
+		return sign + m.Currency.Symbol + digits
+	}
+	return sign + digits + " " + m.Currency.Code
+}
@@ -0,0 +1,48 @@
+package money
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestString(t *testing.T) {
+	for _, tc := range []struct {
+		amount   int
+		code     string
+		expected string
+	}{
+		{1234, "USD", "$12.34"},
+		{5, "USD", "$0.05"},
+		{0, "EUR", "€0.00"},
+		{-250, "GBP", "-£2.50"},
+		{1234, "JPY", "¥1234"},
+		{1500, "KWD", "1.500 KWD"},
+		{100, "chf", "1.00 CHF"},
+	} {
+		m, err := New(tc.amount, tc.code)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, m.String())
+	}
+}
+
+func TestAdd(t *testing.T) {
+	usd, err := New(100, "USD")
+	assert.NoError(t, err)
+	eur, err := New(100, "EUR")
+	assert.NoError(t, err)
+
+	sum, err := usd.Add(usd.Times(2))
+	assert.NoError(t, err)
+	assert.Equal(t, 300, sum.Amount)
+
+	_, err = usd.Add(eur)
+	assert.True(t, Mismatch.Has(err))
+}
+
+func TestParseCurrency(t *testing.T) {
+	_, err := ParseCurrency("XXX")
+	assert.True(t, Invalid.Has(err))
+	_, err = ParseCurrency("")
+	assert.True(t, Invalid.Has(err))
+}
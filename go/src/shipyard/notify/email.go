@@ -0,0 +1,99 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Mailer sends plain text email
+type Mailer interface {
+	Send(ctx context.Context, to, subject, body string) error
+}
+
+// Email delivers notifications by email to the user's address
+type Email struct {
+	Mailer Mailer
+}
+
+var _ Notifier = (*Email)(nil)
+
+func NewEmail(mailer Mailer) *Email {
+	return &Email{Mailer: mailer}
+}
+
+func (e *Email) Notify(ctx context.Context, n Notification) error {
+	if n.Email == "" {
+		return Error.New("%s notification has no email address", n.Kind)
+	}
+	return e.Mailer.Send(ctx, n.Email, n.Subject, n.Body)
+}
+
+// SMTP is a Mailer that sends through an SMTP server, authenticating with
+// PLAIN when there's a username. net/smtp can't be cancelled, so ctx is only
+// checked before sending
+type SMTP struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+
+	// now is replaced in tests
+	now func() time.Time
+}
+
+var _ Mailer = (*SMTP)(nil)
+
+func NewSMTP(addr, username, password, from string) *SMTP {
+	return &SMTP{
+		Addr:     addr,
+		Username: username,
+		Password: password,
+		From:     from,
+		now:      time.Now,
+	}
+}
+
+func (s *SMTP) Send(ctx context.Context, to, subject, body string) error {
+	if err := ctx.Err(); err != nil {
+		return Error.Wrap(err)
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return Error.Wrap(err)
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+
+	msg := message(s.From, to, subject, body, now())
+	return Error.Wrap(smtp.SendMail(s.Addr, auth, s.From, []string{to}, msg))
+}
+
+// message is a plain text email. newlines are removed from the headers so
+// that they can't add headers of their own
+func message(from, to, subject, body string, date time.Time) []byte {
+	header := strings.NewReplacer("\r", "", "\n", "")
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", header.Replace(from))
+	fmt.Fprintf(&buf, "To: %s\r\n", header.Replace(to))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", header.Replace(subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"),
+		"\n", "\r\n"))
+	return buf.Bytes()
+}
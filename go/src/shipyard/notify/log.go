@@ -0,0 +1,27 @@
+package notify
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Log writes notifications to the log instead of delivering them, for local
+// development
+type Log struct {
+	Log *logrus.Entry
+}
+
+var _ Notifier = (*Log)(nil)
+
+func NewLog(log *logrus.Entry) *Log {
+	return &Log{Log: log}
+}
+
+func (l *Log) Notify(ctx context.Context, n Notification) error {
+	l.Log.WithFields(logrus.Fields{
+		"kind":  n.Kind,
+		"email": n.Email,
+	}).Infof("notification: %s", n.Subject)
+	return nil
+}
@@ -0,0 +1,44 @@
+package notify
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory keeps notifications instead of delivering them, for tests. it fails
+// every notification while Fail is set
+type Memory struct {
+	mu            sync.Mutex
+	notifications []Notification
+	fail          bool
+}
+
+var _ Notifier = (*Memory)(nil)
+
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (m *Memory) Notify(ctx context.Context, n Notification) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail {
+		return Error.New("failing on purpose")
+	}
+	m.notifications = append(m.notifications, n)
+	return nil
+}
+
+// Fail sets whether notifications fail
+func (m *Memory) Fail(fail bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fail = fail
+}
+
+// Notifications returns what has been delivered, oldest first
+func (m *Memory) Notifications() []Notification {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Notification(nil), m.notifications...)
+}
@@ -0,0 +1,28 @@
+package notify
+
+import (
+	"context"
+
+	"github.com/zeebo/errs"
+)
+
+// Error is returned when a notification can't be delivered. it may succeed
+// if tried again later
+var Error = errs.Class("notify")
+
+// Notification is a message to a user, like that an item they're waiting for
+// is back in stock. Kind says what it's about, and Data holds what a webhook
+// receiver would need to act on it, like the item's id
+type Notification struct {
+	Kind    string            `json:"kind"`
+	UserID  string            `json:"user_id"`
+	Email   string            `json:"email"`
+	Subject string            `json:"subject"`
+	Body    string            `json:"body"`
+	Data    map[string]string `json:"data,omitempty"`
+}
+
+// Notifier delivers notifications to users, or to something that will
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
@@ -0,0 +1,92 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testNotification = Notification{
+	Kind:    "back_in_stock",
+	UserID:  "user",
+	Email:   "user@example.com",
+	Subject: "lamp is back in stock",
+	Body:    "lamp is back in stock.\n",
+	Data:    map[string]string{"item_id": "item"},
+}
+
+func TestWebhook(t *testing.T) {
+	ctx := context.Background()
+	status := http.StatusNoContent
+	var received []Notification
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, http.MethodPost, r.Method)
+			assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+			var n Notification
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&n))
+			received = append(received, n)
+			w.WriteHeader(status)
+		}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+	webhook := NewWebhook(u)
+
+	assert.NoError(t, webhook.Notify(ctx, testNotification))
+	assert.Equal(t, []Notification{testNotification}, received)
+
+	status = http.StatusBadGateway
+	err = webhook.Notify(ctx, testNotification)
+	assert.True(t, Error.Has(err))
+}
+
+type fakeMailer struct {
+	to, subject, body string
+}
+
+func (m *fakeMailer) Send(ctx context.Context, to, subject, body string) error {
+	m.to, m.subject, m.body = to, subject, body
+	return nil
+}
+
+func TestEmail(t *testing.T) {
+	ctx := context.Background()
+	mailer := &fakeMailer{}
+	email := NewEmail(mailer)
+
+	assert.NoError(t, email.Notify(ctx, testNotification))
+	assert.Equal(t, "user@example.com", mailer.to)
+	assert.Equal(t, "lamp is back in stock", mailer.subject)
+
+	n := testNotification
+	n.Email = ""
+	assert.True(t, Error.Has(email.Notify(ctx, n)))
+
+	// headers can't be added through the subject
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	msg := string(message("shop@example.com", "user@example.com",
+		"hi\r\nBcc: everyone@example.com", "one\ntwo", date))
+	assert.NotContains(t, msg, "\r\nBcc:")
+	assert.Contains(t, msg, "Subject: hiBcc: everyone@example.com\r\n")
+	assert.True(t, strings.HasSuffix(msg, "\r\n\r\none\r\ntwo"))
+}
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	memory := NewMemory()
+
+	assert.NoError(t, memory.Notify(ctx, testNotification))
+	memory.Fail(true)
+	assert.True(t, Error.Has(memory.Notify(ctx, testNotification)))
+	memory.Fail(false)
+	assert.Equal(t, []Notification{testNotification}, memory.Notifications())
+}
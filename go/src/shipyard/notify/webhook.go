@@ -0,0 +1,57 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Webhook delivers notifications by POSTing them as JSON to a URL, which is
+// expected to respond with a 2xx status
+type Webhook struct {
+	URL    *url.URL
+	Client *http.Client
+}
+
+var _ Notifier = (*Webhook)(nil)
+
+func NewWebhook(u *url.URL) *Webhook {
+	return &Webhook{
+		URL:    u,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (wh *Webhook) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return Error.Wrap(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, wh.URL.String(),
+		bytes.NewReader(body))
+	if err != nil {
+		return Error.Wrap(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := wh.Client.Do(req)
+	if err != nil {
+		return Error.Wrap(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return Error.New("webhook responded %s: %s", resp.Status,
+			strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package payment
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"shipyard/money"
+	"shipyard/util"
+)
+
+// Outcome is the result the Fake provider gives to every request
+type Outcome string
+
+const (
+	Succeed Outcome = "success"
+	Decline Outcome = "decline"
+	Timeout Outcome = "timeout"
+)
+
+// ParseOutcome validates a configured outcome
+func ParseOutcome(outcome string) (Outcome, error) {
+	switch o := Outcome(outcome); o {
+	case Succeed, Decline, Timeout:
+		return o, nil
+	}
+	return "", Invalid.New("unknown fake payment outcome %q", outcome)
+}
+
+// Fake is an in-process Provider for local development and tests. it keeps
+// track of the authorizations it has made, so it still rejects captures,
+// voids and refunds that a real gateway would
+type Fake struct {
+	mu sync.Mutex
+
+	// Outcome is how every request is answered. it can be changed at any time
+	Outcome Outcome
+
+	// Delay is how long a Timeout outcome waits before failing, unless the
+	// context is done first. when zero, it fails immediately
+	Delay time.Duration
+
+	authorizations map[string]*fakeAuthorization
+}
+
+type fakeAuthorization struct {
+	reference  string
+	currency   string
+	authorized int
+	captured   int
+	refunded   int
+	voided     bool
+}
+
+var _ Provider = (*Fake)(nil)
+
+func NewFake(outcome Outcome) *Fake {
+	return &Fake{Outcome: outcome}
+}
+
+func (f *Fake) Name() string { return "fake" }
+
+// outcome waits for, and returns the error of, the configured outcome
+func (f *Fake) outcome(ctx context.Context) error {
+	f.mu.Lock()
+	outcome, delay := f.Outcome, f.Delay
+	f.mu.Unlock()
+
+	switch outcome {
+	case Decline:
+		return Declined.New("declined by the fake provider")
+	case Timeout:
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return Unavailable.Wrap(ctx.Err())
+		case <-timer.C:
+			return Unavailable.New("fake provider timed out")
+		}
+	}
+	return nil
+}
+
+func (f *Fake) Authorize(ctx context.Context, reference string,
+	amount money.Money) (string, error) {
+
+	if amount.Amount < 0 {
+		return "", Invalid.New("can't authorize a negative amount")
+	}
+
+	if err := f.outcome(ctx); err != nil {
+		return "", err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.authorizations == nil {
+		f.authorizations = map[string]*fakeAuthorization{}
+	}
+
+	authorizationID := "fake_" + util.MustUUID4()
+	f.authorizations[authorizationID] = &fakeAuthorization{
+		reference:  reference,
+		currency:   amount.Currency.Code,
+		authorized: amount.Amount,
+	}
+	return authorizationID, nil
+}
+
+func (f *Fake) Capture(ctx context.Context, authorizationID string,
+	amount money.Money) error {
+
+	if err := f.outcome(ctx); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	auth, err := f.authorization(authorizationID)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case amount.Currency.Code != auth.currency:
+		return Invalid.New("authorized in %s, not %s", auth.currency,
+			amount.Currency.Code)
+	case auth.voided:
+		return Invalid.New("authorization was voided")
+	case auth.captured > 0:
+		return Invalid.New("authorization was already captured")
+	case amount.Amount < 0 || amount.Amount > auth.authorized:
+		return Invalid.New("can't capture %d of %d", amount.Amount,
+			auth.authorized)
+	}
+
+	auth.captured = amount.Amount
+	return nil
+}
+
+func (f *Fake) Void(ctx context.Context, authorizationID string) error {
+	if err := f.outcome(ctx); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	auth, err := f.authorization(authorizationID)
+	if err != nil {
+		return err
+	}
+
+	if auth.captured > 0 {
+		return Invalid.New("captured payments must be refunded")
+	}
+
+	auth.voided = true
+	return nil
+}
+
+func (f *Fake) Refund(ctx context.Context, authorizationID string,
+	amount money.Money) error {
+
+	if err := f.outcome(ctx); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	auth, err := f.authorization(authorizationID)
+	if err != nil {
+		return err
+	}
+
+	if amount.Currency.Code != auth.currency {
+		return Invalid.New("captured in %s, not %s", auth.currency,
+			amount.Currency.Code)
+	}
+
+	if amount.Amount < 0 || auth.refunded+amount.Amount > auth.captured {
+		return Invalid.New("can't refund %d of %d captured with %d refunded",
+			amount.Amount, auth.captured, auth.refunded)
+	}
+
+	auth.refunded += amount.Amount
+	return nil
+}
+
+// Captured returns the amount captured, less refunds, for the authorization
+func (f *Fake) Captured(authorizationID string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	auth, err := f.authorization(authorizationID)
+	if err != nil {
+		return 0
+	}
+	return auth.captured - auth.refunded
+}
+
+// authorization must be called with the lock held
+func (f *Fake) authorization(authorizationID string) (*fakeAuthorization,
+	error) {
+	auth, ok := f.authorizations[authorizationID]
+	if !ok {
+		return nil, Invalid.New("unknown authorization %q", authorizationID)
+	}
+	return auth, nil
+}
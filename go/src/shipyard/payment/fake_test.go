@@ -0,0 +1,69 @@
+package payment
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"shipyard/money"
+)
+
+func usd(t *testing.T, amount int) money.Money {
+	m, err := money.New(amount, "USD")
+	assert.NoError(t, err)
+	return m
+}
+
+func TestFakeSucceed(t *testing.T) {
+	ctx := context.Background()
+	f := NewFake(Succeed)
+
+	authID, err := f.Authorize(ctx, "ref", usd(t, 100))
+	assert.NoError(t, err)
+
+	assert.True(t, Invalid.Has(f.Capture(ctx, authID, usd(t, 101))))
+	eur, err := money.New(100, "EUR")
+	assert.NoError(t, err)
+	assert.True(t, Invalid.Has(f.Capture(ctx, authID, eur)))
+	assert.NoError(t, f.Capture(ctx, authID, usd(t, 100)))
+	assert.True(t, Invalid.Has(f.Capture(ctx, authID, usd(t, 100))))
+	assert.True(t, Invalid.Has(f.Void(ctx, authID)))
+
+	assert.NoError(t, f.Refund(ctx, authID, usd(t, 60)))
+	assert.True(t, Invalid.Has(f.Refund(ctx, authID, usd(t, 41))))
+	assert.NoError(t, f.Refund(ctx, authID, usd(t, 40)))
+	assert.Equal(t, 0, f.Captured(authID))
+
+	authID, err = f.Authorize(ctx, "ref2", usd(t, 100))
+	assert.NoError(t, err)
+	assert.NoError(t, f.Void(ctx, authID))
+	assert.True(t, Invalid.Has(f.Capture(ctx, authID, usd(t, 100))))
+}
+
+func TestFakeDecline(t *testing.T) {
+	f := NewFake(Decline)
+	_, err := f.Authorize(context.Background(), "ref", usd(t, 100))
+	assert.True(t, Declined.Has(err))
+}
+
+func TestFakeTimeout(t *testing.T) {
+	f := NewFake(Timeout)
+	f.Delay = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	_, err := f.Authorize(ctx, "ref", usd(t, 100))
+	assert.True(t, Unavailable.Has(err))
+}
+
+func TestParseOutcome(t *testing.T) {
+	outcome, err := ParseOutcome("decline")
+	assert.NoError(t, err)
+	assert.Equal(t, Decline, outcome)
+
+	_, err = ParseOutcome("maybe")
+	assert.Error(t, err)
+}
@@ -0,0 +1,59 @@
+package payment
+
+import (
+	"context"
+
+	"github.com/zeebo/errs"
+
+	"shipyard/money"
+)
+
+var (
+	// Declined is returned when the payer's funds can't be held or settled
+	Declined = errs.Class("payment declined")
+
+	// Unavailable is returned when the provider can't be reached in time.
+	// the outcome of the request is unknown
+	Unavailable = errs.Class("payment provider unavailable")
+
+	// Invalid is returned when an operation doesn't make sense for the
+	// authorization, like capturing more than was authorized
+	Invalid = errs.Class("invalid payment")
+)
+
+// Status is the state of a payment record
+type Status string
+
+const (
+	StatusAuthorized Status = "authorized"
+	StatusCaptured   Status = "captured"
+	StatusVoided     Status = "voided"
+	StatusRefunded   Status = "refunded"
+	StatusDeclined   Status = "declined"
+	StatusFailed     Status = "failed"
+)
+
+// Provider is a payment gateway. the flow of a successful payment is Authorize
+// then Capture. an authorization that won't be captured must be voided, and a
+// captured payment can be refunded, fully or in parts
+type Provider interface {
+	// Name identifies the provider on payment records
+	Name() string
+
+	// Authorize places a hold on the payer's funds and returns the
+	// authorization id used by every other call. reference is our own id for
+	// the payment
+	Authorize(ctx context.Context, reference string, amount money.Money) (
+		authorizationID string, err error)
+
+	// Capture settles the authorized amount, or less
+	Capture(ctx context.Context, authorizationID string,
+		amount money.Money) error
+
+	// Void releases an authorization that hasn't been captured
+	Void(ctx context.Context, authorizationID string) error
+
+	// Refund returns captured funds to the payer
+	Refund(ctx context.Context, authorizationID string,
+		amount money.Money) error
+}
@@ -0,0 +1,133 @@
+package pricing
+
+import (
+	"github.com/zeebo/errs"
+
+	"shipyard/money"
+)
+
+// Ineligible is returned when a coupon can't be used on an order
+var Ineligible = errs.Class("coupon not applicable")
+
+// CouponKind is how a coupon discounts an order
+type CouponKind string
+
+const (
+	// Percentage takes PercentOff percent off the eligible lines
+	Percentage CouponKind = "percentage"
+	// FixedAmount takes AmountOff off the eligible lines, but never more than
+	// they cost
+	FixedAmount CouponKind = "fixed"
+	// FreeShipping waives shipping to every destination
+	FreeShipping CouponKind = "free_shipping"
+)
+
+// ParseCouponKind validates a coupon kind
+func ParseCouponKind(kind string) (CouponKind, error) {
+	switch k := CouponKind(kind); k {
+	case Percentage, FixedAmount, FreeShipping:
+		return k, nil
+	}
+	return "", Ineligible.New("unknown coupon kind %q", kind)
+}
+
+// Coupon is the pricing rules of a discount code. whether it can still be
+// used, like its validity window and usage limits, is up to the caller
+type Coupon struct {
+	Code       string
+	Kind       CouponKind
+	PercentOff int
+	AmountOff  money.Money
+	// MinSubtotal is the least the whole order must cost before the discount.
+	// a zero amount has no minimum
+	MinSubtotal money.Money
+	// ItemID and SellerPk restrict the discount to lines of the item, or of
+	// the seller's items, when set
+	ItemID   string
+	SellerPk int64
+}
+
+func (c *Coupon) eligible(line Line) bool {
+	if c.ItemID != "" && c.ItemID != line.ItemID {
+		return false
+	}
+	if c.SellerPk != 0 && c.SellerPk != line.SellerPk {
+		return false
+	}
+	return true
+}
+
+// discounts returns the discount of each line, and whether shipping is waived
+func (c *Coupon) discounts(lines []Line, subtotal money.Money) (
+	lineDiscounts []money.Money, freeShipping bool, err error) {
+
+	if c.MinSubtotal.Amount > 0 {
+		if c.MinSubtotal.Currency.Code != subtotal.Currency.Code {
+			return nil, false, Ineligible.New("%s can only be used in %s",
+				c.Code, c.MinSubtotal.Currency.Code)
+		}
+		if subtotal.Amount < c.MinSubtotal.Amount {
+			return nil, false, Ineligible.New("%s needs a subtotal of at least %s",
+				c.Code, c.MinSubtotal)
+		}
+	}
+
+	eligible := money.Zero(subtotal.Currency)
+	for _, line := range lines {
+		if c.eligible(line) {
+			eligible, err = eligible.Add(line.Price())
+			if err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	if eligible.Amount <= 0 {
+		return nil, false, Ineligible.New("%s doesn't apply to anything in the "+
+			"order", c.Code)
+	}
+
+	discount := money.Zero(subtotal.Currency)
+	switch c.Kind {
+	case Percentage:
+		discount.Amount = applyBPS(eligible.Amount, c.PercentOff*100)
+	case FixedAmount:
+		if c.AmountOff.Currency.Code != subtotal.Currency.Code {
+			return nil, false, Ineligible.New("%s can only be used in %s",
+				c.Code, c.AmountOff.Currency.Code)
+		}
+		discount.Amount = c.AmountOff.Amount
+		if discount.Amount > eligible.Amount {
+			discount.Amount = eligible.Amount
+		}
+	case FreeShipping:
+		freeShipping = true
+	default:
+		return nil, false, Ineligible.New("unknown coupon kind %q", c.Kind)
+	}
+
+	// the discount is split between the eligible lines by their price. the
+	// last eligible line takes what's left so the split adds up exactly
+	lineDiscounts = make([]money.Money, len(lines))
+	last := -1
+	for i, line := range lines {
+		lineDiscounts[i] = money.Zero(subtotal.Currency)
+		if c.eligible(line) && line.Price().Amount > 0 {
+			last = i
+		}
+	}
+
+	remaining := discount.Amount
+	for i, line := range lines {
+		if !c.eligible(line) || line.Price().Amount <= 0 {
+			continue
+		}
+		share := discount.Amount * line.Price().Amount / eligible.Amount
+		if i == last {
+			share = remaining
+		}
+		lineDiscounts[i].Amount = share
+		remaining -= share
+	}
+
+	return lineDiscounts, freeShipping, nil
+}
@@ -0,0 +1,193 @@
+package pricing
+
+import (
+	"context"
+
+	"shipyard/money"
+)
+
+// Line is a quantity of one item bound for a destination
+type Line struct {
+	ItemID    string
+	SellerPk  int64
+	UnitPrice money.Money
+	Quantity  int
+	To        Destination
+}
+
+// Price is the price of the whole line
+func (l Line) Price() money.Money {
+	return l.UnitPrice.Times(l.Quantity)
+}
+
+// Quote is what an order of lines costs. Tax and Shipping are summed over
+// every destination. Discount is taken off the Subtotal and Shipping, and
+// LineDiscounts is the part of it taken off each line. LineTax and
+// LineShipping split each destination's tax and shipping between its lines,
+// so that an order can be divided up. LineShipping is what's paid for
+// shipping, so it's zero when the coupon waives it
+type Quote struct {
+	Subtotal      money.Money
+	Discount      money.Money
+	Tax           money.Money
+	Shipping      money.Money
+	Total         money.Money
+	LineDiscounts []money.Money
+	LineTax       []money.Money
+	LineShipping  []money.Money
+}
+
+// Quoter prices orders
+type Quoter struct {
+	Taxes    TaxEngine
+	Shipping ShippingRates
+}
+
+// Subtotal sums the prices of the lines, which must share a currency. an
+// empty order is free in the fallback currency
+func Subtotal(lines []Line, fallback money.Currency) (money.Money, error) {
+	subtotal := money.Zero(fallback)
+	if len(lines) > 0 {
+		subtotal = money.Zero(lines[0].UnitPrice.Currency)
+	}
+
+	for _, line := range lines {
+		var err error
+		subtotal, err = subtotal.Add(line.Price())
+		if err != nil {
+			return money.Money{}, err
+		}
+	}
+	return subtotal, nil
+}
+
+// Quote prices the lines, which must share a currency. each destination is
+// taxed, after any discount, and shipped to separately. coupon may be nil
+func (q *Quoter) Quote(ctx context.Context, lines []Line,
+	fallback money.Currency, coupon *Coupon) (*Quote, error) {
+
+	subtotal, err := Subtotal(lines, fallback)
+	if err != nil {
+		return nil, err
+	}
+
+	quote := &Quote{
+		Subtotal:      subtotal,
+		Discount:      money.Zero(subtotal.Currency),
+		Tax:           money.Zero(subtotal.Currency),
+		Shipping:      money.Zero(subtotal.Currency),
+		LineDiscounts: make([]money.Money, len(lines)),
+		LineTax:       make([]money.Money, len(lines)),
+		LineShipping:  make([]money.Money, len(lines)),
+	}
+	for i := range lines {
+		quote.LineDiscounts[i] = money.Zero(subtotal.Currency)
+		quote.LineTax[i] = money.Zero(subtotal.Currency)
+		quote.LineShipping[i] = money.Zero(subtotal.Currency)
+	}
+
+	freeShipping := false
+	if coupon != nil {
+		quote.LineDiscounts, freeShipping, err = coupon.discounts(lines, subtotal)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// group the lines by destination, keeping the order they were first seen
+	// in so that rounding is deterministic
+	var destinations []Destination
+	byDestination := map[Destination][]int{}
+	for i, line := range lines {
+		if _, ok := byDestination[line.To]; !ok {
+			destinations = append(destinations, line.To)
+		}
+		byDestination[line.To] = append(byDestination[line.To], i)
+	}
+
+	for _, to := range destinations {
+		items := 0
+		discounted := money.Zero(subtotal.Currency)
+		for _, i := range byDestination[to] {
+			items += lines[i].Quantity
+			discounted.Amount += lines[i].Price().Amount -
+				quote.LineDiscounts[i].Amount
+			quote.Discount.Amount += quote.LineDiscounts[i].Amount
+		}
+
+		tax, err := q.Taxes.Tax(ctx, discounted, to)
+		if err != nil {
+			return nil, err
+		}
+
+		shipping, err := q.Shipping.Shipping(discounted, items, to)
+		if err != nil {
+			return nil, err
+		}
+
+		if freeShipping {
+			quote.Discount.Amount += shipping.Amount
+		}
+		quote.Tax.Amount += tax.Amount
+		quote.Shipping.Amount += shipping.Amount
+
+		// split by what each line costs after its discount
+		shares := make([]int, 0, len(byDestination[to]))
+		for _, i := range byDestination[to] {
+			shares = append(shares, lines[i].Price().Amount-
+				quote.LineDiscounts[i].Amount)
+		}
+		paidShipping := shipping.Amount
+		if freeShipping {
+			paidShipping = 0
+		}
+		lineTax := split(tax.Amount, shares)
+		lineShipping := split(paidShipping, shares)
+		for j, i := range byDestination[to] {
+			quote.LineTax[i].Amount = lineTax[j]
+			quote.LineShipping[i].Amount = lineShipping[j]
+		}
+	}
+
+	quote.Total = money.Money{
+		Amount: quote.Subtotal.Amount - quote.Discount.Amount +
+			quote.Tax.Amount + quote.Shipping.Amount,
+		Currency: quote.Subtotal.Currency,
+	}
+	return quote, nil
+}
+
+// split divides amount in proportion to shares. the last positive share takes
+// what's left so the split adds up exactly, and without any, the last does
+func split(amount int, shares []int) []int {
+	parts := make([]int, len(shares))
+	if len(shares) == 0 {
+		return parts
+	}
+
+	total, last := 0, len(shares)-1
+	for _, share := range shares {
+		if share > 0 {
+			total += share
+		}
+	}
+	for i := len(shares) - 1; i >= 0; i-- {
+		if shares[i] > 0 {
+			last = i
+			break
+		}
+	}
+
+	remaining := amount
+	for i, share := range shares {
+		if i == last {
+			parts[i] = remaining
+			break
+		}
+		if share > 0 {
+			parts[i] = amount * share / total
+			remaining -= parts[i]
+		}
+	}
+	return parts
+}
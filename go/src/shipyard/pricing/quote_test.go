@@ -0,0 +1,159 @@
+package pricing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"shipyard/money"
+)
+
+func usd(t *testing.T, amount int) money.Money {
+	m, err := money.New(amount, "USD")
+	assert.NoError(t, err)
+	return m
+}
+
+func TestTaxRules(t *testing.T) {
+	ctx := context.Background()
+	rules := TaxRules{
+		{Country: "US", RateBPS: 500},
+		{Country: "US", State: "CA", RateBPS: 725},
+		{Country: "GB", RateBPS: 2000},
+	}
+
+	for _, tc := range []struct {
+		to       Destination
+		expected int
+	}{
+		{Destination{Country: "US", State: "CA"}, 73}, // 72.5 rounds up
+		{Destination{Country: "us", State: "ca"}, 73},
+		{Destination{Country: "US", State: "NY"}, 50},
+		{Destination{Country: "GB"}, 200},
+		{Destination{Country: "FR"}, 0},
+	} {
+		tax, err := rules.Tax(ctx, usd(t, 1000), tc.to)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, tax.Amount, tc.to)
+	}
+}
+
+func TestShippingRates(t *testing.T) {
+	rates := ShippingRates{
+		{Currency: "USD", Base: 1000, PerItem: 500},
+		{Country: "US", Currency: "USD", Base: 500, PerItem: 100, FreeOver: 5000},
+	}
+
+	shipping, err := rates.Shipping(usd(t, 1000), 3, Destination{Country: "US"})
+	assert.NoError(t, err)
+	assert.Equal(t, 700, shipping.Amount)
+
+	shipping, err = rates.Shipping(usd(t, 5000), 3, Destination{Country: "US"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, shipping.Amount)
+
+	shipping, err = rates.Shipping(usd(t, 1000), 2, Destination{Country: "CA"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1500, shipping.Amount)
+
+	eur, err := money.New(1000, "EUR")
+	assert.NoError(t, err)
+	_, err = rates.Shipping(eur, 1, Destination{Country: "US"})
+	assert.True(t, NoShipping.Has(err))
+}
+
+func TestQuote(t *testing.T) {
+	q := &Quoter{
+		Taxes:    TaxRules{{Country: "US", State: "CA", RateBPS: 1000}},
+		Shipping: ShippingRates{{Currency: "USD", Base: 500, PerItem: 100}},
+	}
+
+	ca := Destination{Country: "US", State: "CA"}
+	ny := Destination{Country: "US", State: "NY"}
+	quote, err := q.Quote(context.Background(), []Line{
+		{UnitPrice: usd(t, 1000), Quantity: 2, To: ca},
+		{UnitPrice: usd(t, 300), Quantity: 1, To: ny},
+		{UnitPrice: usd(t, 200), Quantity: 1, To: ca},
+	}, usd(t, 0).Currency, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2500, quote.Subtotal.Amount)
+	assert.Equal(t, 220, quote.Tax.Amount)
+	assert.Equal(t, 700+500, quote.Shipping.Amount)
+	assert.Equal(t, 2500+220+1200, quote.Total.Amount)
+
+	// each destination's tax and shipping is split between its lines
+	amounts := func(ms []money.Money) []int {
+		s := make([]int, 0, len(ms))
+		for _, m := range ms {
+			s = append(s, m.Amount)
+		}
+		return s
+	}
+	assert.Equal(t, []int{200, 0, 20}, amounts(quote.LineTax))
+	assert.Equal(t, []int{636, 500, 64}, amounts(quote.LineShipping))
+
+	eur, err := money.New(1000, "EUR")
+	assert.NoError(t, err)
+	_, err = q.Quote(context.Background(), []Line{
+		{UnitPrice: usd(t, 1000), Quantity: 1, To: ca},
+		{UnitPrice: eur, Quantity: 1, To: ca},
+	}, eur.Currency, nil)
+	assert.True(t, money.Mismatch.Has(err))
+}
+
+func TestQuoteCoupon(t *testing.T) {
+	ctx := context.Background()
+	q := &Quoter{
+		Taxes:    TaxRules{{RateBPS: 1000}},
+		Shipping: ShippingRates{{Currency: "USD", Base: 500}},
+	}
+
+	to := Destination{Country: "US"}
+	lines := []Line{
+		{ItemID: "a", SellerPk: 1, UnitPrice: usd(t, 1000), Quantity: 1, To: to},
+		{ItemID: "b", SellerPk: 2, UnitPrice: usd(t, 500), Quantity: 2, To: to},
+		{ItemID: "c", SellerPk: 2, UnitPrice: usd(t, 1000), Quantity: 1, To: to},
+	}
+
+	quote, err := q.Quote(ctx, lines, usd(t, 0).Currency,
+		&Coupon{Code: "TEN", Kind: Percentage, PercentOff: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, 300, quote.Discount.Amount)
+	assert.Equal(t, 270, quote.Tax.Amount)
+	assert.Equal(t, 3000-300+270+500, quote.Total.Amount)
+	assert.Equal(t, []int{90, 90, 90}, []int{quote.LineTax[0].Amount,
+		quote.LineTax[1].Amount, quote.LineTax[2].Amount})
+
+	// the discount is split between the seller's lines by price
+	quote, err = q.Quote(ctx, lines, usd(t, 0).Currency,
+		&Coupon{Code: "FIVE", Kind: FixedAmount, AmountOff: usd(t, 501),
+			SellerPk: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 501, quote.Discount.Amount)
+	assert.Equal(t, []int{0, 250, 251}, []int{quote.LineDiscounts[0].Amount,
+		quote.LineDiscounts[1].Amount, quote.LineDiscounts[2].Amount})
+
+	// a fixed amount never takes off more than the lines cost
+	quote, err = q.Quote(ctx, lines, usd(t, 0).Currency,
+		&Coupon{Code: "ALL", Kind: FixedAmount, AmountOff: usd(t, 5000),
+			ItemID: "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, quote.Discount.Amount)
+
+	quote, err = q.Quote(ctx, lines, usd(t, 0).Currency,
+		&Coupon{Code: "SHIP", Kind: FreeShipping})
+	assert.NoError(t, err)
+	assert.Equal(t, 500, quote.Discount.Amount)
+	assert.Equal(t, 3000+300, quote.Total.Amount)
+	assert.Equal(t, []int{0, 0, 0}, []int{quote.LineShipping[0].Amount,
+		quote.LineShipping[1].Amount, quote.LineShipping[2].Amount})
+
+	_, err = q.Quote(ctx, lines, usd(t, 0).Currency,
+		&Coupon{Code: "BIG", Kind: FreeShipping, MinSubtotal: usd(t, 5000)})
+	assert.True(t, Ineligible.Has(err))
+
+	_, err = q.Quote(ctx, lines, usd(t, 0).Currency,
+		&Coupon{Code: "NONE", Kind: Percentage, PercentOff: 10, ItemID: "d"})
+	assert.True(t, Ineligible.Has(err))
+}
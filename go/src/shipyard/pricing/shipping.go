@@ -0,0 +1,61 @@
+package pricing
+
+import (
+	"strings"
+
+	"github.com/zeebo/errs"
+
+	"shipyard/money"
+)
+
+// NoShipping is returned when no rate ships to a destination
+var NoShipping = errs.Class("no shipping")
+
+// ShippingRate is what it costs to ship to a country, or a state within it,
+// in a currency. like TaxRule, empty Country and State are wildcards
+type ShippingRate struct {
+	Country  string
+	State    string
+	Currency string
+	// Base is charged once per destination, and PerItem for every unit after
+	// the first. all amounts are in the currency's minor units
+	Base    int
+	PerItem int
+	// FreeOver waives shipping when the subtotal to the destination is at
+	// least this much. 0 never waives it
+	FreeOver int
+}
+
+// ShippingRates is a rate table. each destination uses its most specific rate
+// in the subtotal's currency
+type ShippingRates []ShippingRate
+
+// Shipping returns the cost of shipping items units with the subtotal to the
+// destination
+func (rates ShippingRates) Shipping(subtotal money.Money, items int,
+	to Destination) (money.Money, error) {
+
+	best, bestScore := ShippingRate{}, 0
+	for _, rate := range rates {
+		if !strings.EqualFold(rate.Currency, subtotal.Currency.Code) {
+			continue
+		}
+		score := matches(rate.Country, rate.State, to)
+		if score > bestScore {
+			best, bestScore = rate, score
+		}
+	}
+
+	if bestScore == 0 {
+		return money.Money{}, NoShipping.New("can't ship to %s %s in %s",
+			to.Country, to.State, subtotal.Currency.Code)
+	}
+
+	shipping := money.Zero(subtotal.Currency)
+	if items <= 0 || (best.FreeOver > 0 && subtotal.Amount >= best.FreeOver) {
+		return shipping, nil
+	}
+
+	shipping.Amount = best.Base + best.PerItem*(items-1)
+	return shipping, nil
+}
@@ -0,0 +1,78 @@
+package pricing
+
+import (
+	"context"
+	"strings"
+
+	"shipyard/money"
+)
+
+// Destination is where goods are shipped to, which decides their tax and
+// shipping costs
+type Destination struct {
+	Country string
+	State   string
+}
+
+// TaxEngine computes the tax owed on goods shipped to a destination
+type TaxEngine interface {
+	Tax(ctx context.Context, subtotal money.Money, to Destination) (
+		money.Money, error)
+}
+
+// TaxRule is a tax rate for a country, or a state within it. an empty Country
+// matches every destination and an empty State matches every state
+type TaxRule struct {
+	Country string
+	State   string
+	// RateBPS is the rate in basis points, so 725 is 7.25%
+	RateBPS int
+}
+
+// TaxRules is a TaxEngine that taxes each destination at the rate of its most
+// specific rule. destinations without a rule aren't taxed
+type TaxRules []TaxRule
+
+var _ TaxEngine = TaxRules(nil)
+
+func (rules TaxRules) Tax(ctx context.Context, subtotal money.Money,
+	to Destination) (money.Money, error) {
+
+	best, bestScore := TaxRule{}, 0
+	for _, rule := range rules {
+		score := matches(rule.Country, rule.State, to)
+		if score > bestScore {
+			best, bestScore = rule, score
+		}
+	}
+
+	return money.Money{
+		Amount:   applyBPS(subtotal.Amount, best.RateBPS),
+		Currency: subtotal.Currency,
+	}, nil
+}
+
+// matches scores how specifically a country and state match the destination.
+// 0 is no match, 1 is a wildcard, 2 is the country and 3 is the state
+func matches(country, state string, to Destination) int {
+	switch {
+	case country == "":
+		return 1
+	case !strings.EqualFold(country, to.Country):
+		return 0
+	case state == "":
+		return 2
+	case strings.EqualFold(state, to.State):
+		return 3
+	}
+	return 0
+}
+
+// applyBPS returns bps basis points of amount, rounding half away from zero
+func applyBPS(amount, bps int) int {
+	product := amount * bps
+	if product < 0 {
+		return -((-product + 5000) / 10000)
+	}
+	return (product + 5000) / 10000
+}
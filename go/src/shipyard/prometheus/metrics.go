@@ -63,6 +63,23 @@ var (
 			Help:    "A histogram of the update_cart db query latencies in seconds",
 			Buckets: []float64{0.01, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
 		})
+	JobQueueGauge = prom.NewGaugeVec(
+		prom.GaugeOpts{
+			Name: "job_queue_depth",
+			Help: "Gauge of the jobs in the queue, by status",
+		}, []string{"status"})
+	JobWaitHistogram = prom.NewHistogramVec(
+		prom.HistogramOpts{
+			Name:    "job_wait_seconds",
+			Help:    "A histogram of how long jobs were due before they were run",
+			Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900},
+		}, []string{"kind"})
+	JobDurationHistogram = prom.NewHistogramVec(
+		prom.HistogramOpts{
+			Name:    "job_duration_seconds",
+			Help:    "A histogram of how long jobs took to run, by kind and result",
+			Buckets: []float64{0.01, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"kind", "result"})
 )
 
 func init() {
@@ -81,5 +98,8 @@ func init() {
 		PurchasesGauge,
 		DatabaseQueryCounter,
 		UpdateCartDatabaseQueryLatencyHistogram,
+		JobQueueGauge,
+		JobWaitHistogram,
+		JobDurationHistogram,
 	)
 }
@@ -4,12 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
 
 	"shipyard/database"
 	he "shipyard/httperror"
+	"shipyard/money"
+	"shipyard/pricing"
 	monitor "shipyard/prometheus"
 	"shipyard/util"
 )
@@ -51,7 +54,68 @@ func (s *Server) UserProfile(ctx context.Context, w http.ResponseWriter,
 	return resp, nil
 }
 
-// AddAddress allows the user to add an address to their profile
+// ListAddress returns the user's address book
+func (s *Server) ListAddress(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses, err := s.DB.All_Address_By_UserPk(ctx,
+		database.Address_UserPk(userPk))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &RootJSON{
+		Addresses: apiAddresses(addresses),
+	}
+
+	return resp, nil
+}
+
+// GetAddress returns one of the user's addresses
+func (s *Server) GetAddress(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	var address *database.Address
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		address, err = findUserAddress(ctx, tx, chi.URLParam(r, "addressID"),
+			userPk)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	setETag(w, versionETag(address.Version))
+	resp := &RootJSON{
+		Address: apiAddress(address),
+	}
+
+	return resp, nil
+}
+
+// AddAddress allows the user to add an address to their profile. the user's
+// first address, or any address added with "default" set, becomes their
+// default shipping address
 func (s *Server) AddAddress(ctx context.Context, w http.ResponseWriter,
 	r *http.Request) (interface{}, error) {
 
@@ -68,24 +132,173 @@ func (s *Server) AddAddress(ctx context.Context, w http.ResponseWriter,
 		return nil, he.BadRequest.Wrap(err)
 	}
 
-	address, err := s.DB.Create_Address(ctx,
-		database.Address_Id(util.MustUUID4()),
-		database.Address_Line1(addressJSON.Line1),
-		database.Address_Line2(addressJSON.Line2),
-		database.Address_Line3(addressJSON.Line3),
-		database.Address_Country(addressJSON.Country),
-		database.Address_State(addressJSON.State),
-		database.Address_City(addressJSON.City),
-		database.Address_Zip(addressJSON.Zip),
-		database.Address_Phone(addressJSON.Phone),
-		database.Address_Notes(addressJSON.Notes),
-		database.Address_Create_Fields{
-			UserPk: database.Address_UserPk(*ss.UserPk), // TODO(sam): nil check
-		})
+	var address *database.Address
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		// TODO(sam): nil check
+		defaultAddress, err := tx.Find_Address_By_IsDefault_And_UserPk(ctx,
+			database.Address_IsDefault(true), database.Address_UserPk(*ss.UserPk))
+		if err != nil {
+			return err
+		}
+
+		// the user's first address is their default
+		isDefault := addressJSON.Default || defaultAddress == nil
+		if isDefault {
+			err = clearDefaultAddress(ctx, tx, *ss.UserPk)
+			if err != nil {
+				return err
+			}
+		}
+
+		address, err = tx.Create_Address(ctx,
+			database.Address_Id(util.MustUUID4()),
+			database.Address_Line1(addressJSON.Line1),
+			database.Address_Line2(addressJSON.Line2),
+			database.Address_Line3(addressJSON.Line3),
+			database.Address_Country(addressJSON.Country),
+			database.Address_State(addressJSON.State),
+			database.Address_City(addressJSON.City),
+			database.Address_Zip(addressJSON.Zip),
+			database.Address_Phone(addressJSON.Phone),
+			database.Address_Notes(addressJSON.Notes),
+			database.Address_Version(1),
+			database.Address_IsDefault(isDefault),
+			database.Address_Create_Fields{
+				UserPk: database.Address_UserPk(*ss.UserPk),
+			})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	setETag(w, versionETag(address.Version))
+	resp := &RootJSON{
+		Address: apiAddress(address),
+	}
+
+	return resp, nil
+}
+
+// addressFields are the address fields that can be patched by PatchAddress
+var addressFields = []string{"line1", "line2", "line3", "country", "state",
+	"city", "zip", "phone", "notes", "default"}
+
+// PatchAddress will update one of the user's addresses using JSON Merge
+// Patch. a null field is cleared and an absent field is left untouched. if the
+// If-Match header is set, the update is only made if it matches the address's
+// current ETag. setting "default" makes it the user's default shipping address
+func (s *Server) PatchAddress(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := decodeMergePatch(r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = patch.only(addressFields...)
+	if err != nil {
+		return nil, err
+	}
+
+	isDefault, setDefault, err := patch.bool("default")
+	if err != nil {
+		return nil, err
+	}
+
+	ups := database.Address_Update_Fields{}
+	if setDefault {
+		ups.IsDefault = database.Address_IsDefault(isDefault)
+	}
+
+	for _, field := range addressFields {
+		if field == "default" {
+			continue
+		}
+
+		v, ok, err := patch.string(field)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		switch field {
+		case "line1":
+			ups.Line1 = database.Address_Line1(v)
+		case "line2":
+			ups.Line2 = database.Address_Line2(v)
+		case "line3":
+			ups.Line3 = database.Address_Line3(v)
+		case "country":
+			ups.Country = database.Address_Country(v)
+		case "state":
+			ups.State = database.Address_State(v)
+		case "city":
+			ups.City = database.Address_City(v)
+		case "zip":
+			ups.Zip = database.Address_Zip(v)
+		case "phone":
+			ups.Phone = database.Address_Phone(v)
+		case "notes":
+			ups.Notes = database.Address_Notes(v)
+		}
+	}
+
+	var address *database.Address
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		existing, err := findUserAddress(ctx, tx, chi.URLParam(r, "addressID"),
+			userPk)
+		if err != nil {
+			return err
+		}
+
+		ifMatch := r.Header.Get("If-Match")
+		if ifMatch != "" && !etagMatches(ifMatch, versionETag(existing.Version)) {
+			return he.PreconditionFailed.New("address has been modified")
+		}
+
+		// the address is only cleared when it isn't already the default,
+		// since that would bump the version it's about to be compared by
+		if setDefault && isDefault && !existing.IsDefault {
+			err = clearDefaultAddress(ctx, tx, userPk)
+			if err != nil {
+				return err
+			}
+		}
+
+		bumped, err := tx.BumpVersion(ctx, "addresses", existing.Pk,
+			existing.Version)
+		if err != nil {
+			return err
+		}
+
+		if !bumped {
+			// another request updated the address since it was read
+			return he.PreconditionFailed.New("address has been modified")
+		}
+
+		ups.Version = database.Address_Version(existing.Version + 1)
+		address, err = tx.Update_Address_By_Pk(ctx,
+			database.Address_Pk(existing.Pk), ups)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	setETag(w, versionETag(address.Version))
 	resp := &RootJSON{
 		Address: apiAddress(address),
 	}
@@ -93,16 +306,93 @@ func (s *Server) AddAddress(ctx context.Context, w http.ResponseWriter,
 	return resp, nil
 }
 
-// ListItem will list all of the items available in the marketplace
+// DeleteAddress will remove one of the user's addresses. orders keep their
+// own copy of the address they were shipped to
+func (s *Server) DeleteAddress(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		address, err := findUserAddress(ctx, tx, chi.URLParam(r, "addressID"),
+			userPk)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Delete_Address_By_Pk(ctx, database.Address_Pk(address.Pk))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// findUserAddress returns the address, as long as it belongs to the user
+func findUserAddress(ctx context.Context, tx *database.Tx, addressID string,
+	userPk int64) (*database.Address, error) {
+	address, err := tx.Find_Address_By_Id(ctx, database.Address_Id(addressID))
+	if err != nil {
+		return nil, err
+	}
+
+	if address == nil || address.UserPk == nil || *address.UserPk != userPk {
+		return nil, he.NotFound.New("address not found")
+	}
+
+	return address, nil
+}
+
+// clearDefaultAddress unsets the user's default shipping address, if they
+// have one. it's a change to the address like any other, so its version is
+// bumped
+func clearDefaultAddress(ctx context.Context, tx *database.Tx,
+	userPk int64) error {
+	address, err := tx.Find_Address_By_IsDefault_And_UserPk(ctx,
+		database.Address_IsDefault(true), database.Address_UserPk(userPk))
+	if err != nil || address == nil {
+		return err
+	}
+
+	_, err = tx.Update_Address_By_Pk(ctx, database.Address_Pk(address.Pk),
+		database.Address_Update_Fields{
+			IsDefault: database.Address_IsDefault(false),
+			Version:   database.Address_Version(address.Version + 1),
+		})
+	return err
+}
+
+// ListItem will list all of the items available in the marketplace. clients
+// can cheaply poll for changes with If-None-Match
 func (s *Server) ListItem(ctx context.Context, w http.ResponseWriter,
 	r *http.Request) (interface{}, error) {
 
-	// TODO(sam): pagination
-	items, err := s.DB.All_Item(ctx)
+	p, err := parsePage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := s.DB.Limited_Item(ctx, p.limit, p.offset)
 	if err != nil {
 		return nil, he.Unexpected.Wrap(err)
 	}
 
+	etag := itemsETag(items)
+	setETag(w, etag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		return nil, he.NotModified.New("items")
+	}
+
 	resp := &RootJSON{
 		Items: apiItems(items),
 	}
@@ -110,7 +400,51 @@ func (s *Server) ListItem(ctx context.Context, w http.ResponseWriter,
 	return resp, nil
 }
 
-// AddItem will add an item to the available marketplace for all
+// GetItem returns a single item in the marketplace. its ETag can be used with
+// If-Match when updating the item
+func (s *Server) GetItem(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	item, err := s.DB.Find_Item_By_Id(ctx,
+		database.Item_Id(chi.URLParam(r, "itemID")))
+	if err != nil {
+		return nil, err
+	}
+
+	if item == nil {
+		return nil, he.NotFound.New("item not found")
+	}
+
+	etag := versionETag(item.Version)
+	setETag(w, etag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		return nil, he.NotModified.New("item")
+	}
+
+	variants, err := s.DB.All_Variant_By_ItemPk(ctx,
+		database.Variant_ItemPk(item.Pk))
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := s.DB.All_ItemImage_By_ItemPk(ctx,
+		database.ItemImage_ItemPk(item.Pk))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &RootJSON{
+		Item: apiItem(item),
+	}
+	resp.Item.Variants = apiVariants(item, variants)
+	resp.Item.Images = s.apiImages(item.Id, images)
+
+	return resp, nil
+}
+
+// AddItem will add an item to the available marketplace for all. an item added
+// without variants gets one that holds all of its remaining_quantity.
+// otherwise its remaining_quantity is the sum of its variants'
 func (s *Server) AddItem(ctx context.Context, w http.ResponseWriter,
 	r *http.Request) (interface{}, error) {
 
@@ -125,33 +459,109 @@ func (s *Server) AddItem(ctx context.Context, w http.ResponseWriter,
 		return nil, he.BadRequest.Wrap(err)
 	}
 
+	var dbItem *database.Item
+	var dbVariants []*database.Variant
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		// TODO(sam): nil check
+		dbItem, dbVariants, err = s.createItem(ctx, tx, *ss.UserPk, &item)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	setETag(w, versionETag(dbItem.Version))
+	resp := &RootJSON{
+		Item: apiItem(dbItem),
+	}
+	resp.Item.Variants = apiVariants(dbItem, dbVariants)
+
+	return resp, nil
+}
+
+// createItem adds the seller's item along with its variants, or the one
+// variant that holds its remaining_quantity
+func (s *Server) createItem(ctx context.Context, tx *database.Tx,
+	sellerPk int64, item *Item) (*database.Item, []*database.Variant, error) {
+
+	variants := item.Variants
+	if len(variants) == 0 {
+		variants = []*Variant{{RemainingQuantity: item.RemainingQuantity}}
+	} else {
+		item.RemainingQuantity = 0
+		for _, variant := range variants {
+			if variant == nil {
+				return nil, nil, he.BadRequest.New("variants can't be null")
+			}
+			item.RemainingQuantity += variant.RemainingQuantity
+		}
+	}
+
 	if item.RemainingQuantity <= 0 {
-		return nil, he.BadRequest.New("can't create an unavailable item")
+		return nil, nil, he.BadRequest.New("can't create an unavailable item")
+	}
+
+	price, err := s.parsePrice(item.Price)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tags, err := encodeTags(item.Tags)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	dbItem, err := s.DB.Create_Item(ctx,
+	attributes, err := encodeAttributes(item.Attributes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = checkCategory(ctx, tx, item.CategoryID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dbItem, err := tx.Create_Item(ctx,
 		database.Item_Id(util.MustUUID4()),
-		database.Item_Price(item.Price),
+		database.Item_Price(price.Amount),
+		database.Item_Currency(price.Currency.Code),
 		database.Item_Description(item.Description),
 		database.Item_ImageUrl(item.ImageURL),
 		database.Item_RemainingQuantity(item.RemainingQuantity),
+		database.Item_Version(1),
+		database.Item_Title(strings.TrimSpace(item.Title)),
+		database.Item_CategoryId(item.CategoryID),
+		database.Item_Tags(tags),
+		database.Item_Attributes(attributes),
+		database.Item_RatingTotal(0),
+		database.Item_RatingCount(0),
 		database.Item_Create_Fields{
-			OwningUserPk: database.Item_OwningUserPk(*ss.UserPk), // TODO(sam): nil check
+			OwningUserPk: database.Item_OwningUserPk(sellerPk),
 		})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	monitor.ItemGauge.Inc()
-
-	resp := &RootJSON{
-		Item: apiItem(dbItem),
+	dbVariants := make([]*database.Variant, 0, len(variants))
+	for _, variant := range variants {
+		dbVariant, err := addVariant(ctx, tx, dbItem, variant)
+		if err != nil {
+			return nil, nil, err
+		}
+		dbVariants = append(dbVariants, dbVariant)
 	}
 
-	return resp, nil
+	err = recordEvent(ctx, tx, EventItemCreated, dbItem.Id, &sellerPk,
+		apiItem(dbItem))
+	if err != nil {
+		return nil, nil, err
+	}
+	return dbItem, dbVariants, nil
 }
 
-// UpdateItem will update an item in the marketplace
+// UpdateItem will update an item in the marketplace. if the If-Match header
+// is set, the update is only made if it matches the item's current ETag. the
+// remaining_quantity can only be set here for items with one variant
 func (s *Server) UpdateItem(ctx context.Context, w http.ResponseWriter,
 	r *http.Request) (interface{}, error) {
 
@@ -168,38 +578,371 @@ func (s *Server) UpdateItem(ctx context.Context, w http.ResponseWriter,
 	}
 
 	ups := database.Item_Update_Fields{}
-	if item.Price != 0 {
-		ups.Price = database.Item_Price(item.Price)
+	if item.Price != nil {
+		// a price without a currency keeps the item's currency
+		price, err := s.parsePrice(item.Price)
+		if err != nil {
+			return nil, err
+		}
+		ups.Price = database.Item_Price(price.Amount)
+		if item.Price.Currency != "" {
+			ups.Currency = database.Item_Currency(price.Currency.Code)
+		}
 	}
 
 	if item.Description != "" {
 		ups.Description = database.Item_Description(item.Description)
 	}
 
-	if item.ImageURL != "" {
-		ups.ImageUrl = database.Item_ImageUrl(item.ImageURL)
-	}
+	if item.ImageURL != "" {
+		ups.ImageUrl = database.Item_ImageUrl(item.ImageURL)
+	}
+
+	if item.RemainingQuantity != 0 {
+		ups.RemainingQuantity = database.Item_RemainingQuantity(
+			item.RemainingQuantity)
+	}
+
+	if title := strings.TrimSpace(item.Title); title != "" {
+		ups.Title = database.Item_Title(title)
+	}
+
+	if item.CategoryID != "" {
+		ups.CategoryId = database.Item_CategoryId(item.CategoryID)
+	}
+
+	// tags and attributes are replaced as a whole when they're sent
+	if item.Tags != nil {
+		tags, err := encodeTags(item.Tags)
+		if err != nil {
+			return nil, err
+		}
+		ups.Tags = database.Item_Tags(tags)
+	}
+
+	if item.Attributes != nil {
+		attributes, err := encodeAttributes(item.Attributes)
+		if err != nil {
+			return nil, err
+		}
+		ups.Attributes = database.Item_Attributes(attributes)
+	}
+
+	// TODO(sam): nil check
+	dbItem, err := s.updateItem(ctx, r, itemID, *ss.UserPk,
+		func(ctx context.Context, tx *database.Tx, existing *database.Item) (
+			database.Item_Update_Fields, error) {
+			if item.RemainingQuantity != 0 {
+				err := setOnlyVariantQuantity(ctx, tx, existing,
+					item.RemainingQuantity)
+				if err != nil {
+					return ups, err
+				}
+			}
+			return ups, checkCategory(ctx, tx, item.CategoryID)
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	setETag(w, versionETag(dbItem.Version))
+	resp := &RootJSON{
+		Item: apiItem(dbItem),
+	}
+
+	return resp, nil
+}
+
+// PatchItem will update an item in the marketplace using JSON Merge Patch. a
+// null field is cleared and an absent field is left untouched. like
+// UpdateItem, it honors If-Match
+func (s *Server) PatchItem(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := decodeMergePatch(r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = patch.only("price", "description", "image_url", "remaining_quantity",
+		"title", "category_id", "tags", "attributes")
+	if err != nil {
+		return nil, err
+	}
+
+	ups := database.Item_Update_Fields{}
+	// price is merged like any other object, so either of its amount and
+	// currency can be patched on their own
+	price := struct {
+		Amount   *int    `json:"amount"`
+		Currency *string `json:"currency"`
+	}{}
+	if ok, err := patch.decode("price", &price); err != nil {
+		return nil, err
+	} else if ok {
+		if price.Amount == nil && price.Currency == nil {
+			return nil, he.BadRequest.New("price can't be cleared")
+		}
+
+		if price.Amount != nil {
+			if *price.Amount < 0 {
+				return nil, he.BadRequest.New("price can't be negative")
+			}
+			ups.Price = database.Item_Price(*price.Amount)
+		}
+
+		if price.Currency != nil {
+			currency, err := money.ParseCurrency(*price.Currency)
+			if err != nil {
+				return nil, he.BadRequest.Wrap(err)
+			}
+			ups.Currency = database.Item_Currency(currency.Code)
+		}
+	}
+
+	if description, ok, err := patch.string("description"); err != nil {
+		return nil, err
+	} else if ok {
+		ups.Description = database.Item_Description(description)
+	}
+
+	if imageURL, ok, err := patch.string("image_url"); err != nil {
+		return nil, err
+	} else if ok {
+		ups.ImageUrl = database.Item_ImageUrl(imageURL)
+	}
+
+	rq, rqOK, err := patch.int("remaining_quantity")
+	if err != nil {
+		return nil, err
+	} else if rqOK {
+		if rq < 0 {
+			return nil, he.BadRequest.New("remaining_quantity can't be negative")
+		}
+		ups.RemainingQuantity = database.Item_RemainingQuantity(rq)
+	}
+
+	if title, ok, err := patch.string("title"); err != nil {
+		return nil, err
+	} else if ok {
+		ups.Title = database.Item_Title(strings.TrimSpace(title))
+	}
+
+	categoryID, categoryOK, err := patch.string("category_id")
+	if err != nil {
+		return nil, err
+	} else if categoryOK {
+		ups.CategoryId = database.Item_CategoryId(categoryID)
+	}
+
+	var tags []string
+	if ok, err := patch.decode("tags", &tags); err != nil {
+		return nil, err
+	} else if ok {
+		encoded, err := encodeTags(tags)
+		if err != nil {
+			return nil, err
+		}
+		ups.Tags = database.Item_Tags(encoded)
+	}
+
+	// attributes are merged like any other object. see mergeAttributes
+	var attributesPatch map[string]interface{}
+	attributesOK, err := patch.decode("attributes", &attributesPatch)
+	if err != nil {
+		return nil, err
+	}
+
+	dbItem, err := s.updateItem(ctx, r, chi.URLParam(r, "itemID"), userPk,
+		func(ctx context.Context, tx *database.Tx, existing *database.Item) (
+			database.Item_Update_Fields, error) {
+			if rqOK {
+				err := setOnlyVariantQuantity(ctx, tx, existing, rq)
+				if err != nil {
+					return ups, err
+				}
+			}
+
+			if categoryOK {
+				err := checkCategory(ctx, tx, categoryID)
+				if err != nil {
+					return ups, err
+				}
+			}
+
+			if attributesOK {
+				encoded, err := mergeAttributes(existing.Attributes, attributesPatch)
+				if err != nil {
+					return ups, err
+				}
+				ups.Attributes = database.Item_Attributes(encoded)
+			}
+			return ups, nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	setETag(w, versionETag(dbItem.Version))
+	resp := &RootJSON{
+		Item: apiItem(dbItem),
+	}
+
+	return resp, nil
+}
+
+// updateItem applies the updates to the user's item, as long as it matches
+// the request's If-Match header, and bumps its version. the updates are made
+// by update from the item as it was before, inside the same transaction
+func (s *Server) updateItem(ctx context.Context, r *http.Request,
+	itemID string, userPk int64,
+	update func(ctx context.Context, tx *database.Tx, existing *database.Item) (
+		database.Item_Update_Fields, error)) (
+	dbItem *database.Item, err error) {
+
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		existing, err := tx.Find_Item_By_Id(ctx, database.Item_Id(itemID))
+		if err != nil {
+			return err
+		}
+
+		if existing == nil || existing.OwningUserPk == nil ||
+			*existing.OwningUserPk != userPk {
+			return he.NotFound.New("item not found")
+		}
+
+		ifMatch := r.Header.Get("If-Match")
+		if ifMatch != "" && !etagMatches(ifMatch, versionETag(existing.Version)) {
+			return he.PreconditionFailed.New("item has been modified")
+		}
+
+		ups, err := update(ctx, tx, existing)
+		if err != nil {
+			return err
+		}
+
+		bumped, err := tx.BumpVersion(ctx, "items", existing.Pk,
+			existing.Version)
+		if err != nil {
+			return err
+		}
+
+		if !bumped {
+			// another request updated the item since it was read
+			return he.PreconditionFailed.New("item has been modified")
+		}
+
+		ups.Version = database.Item_Version(existing.Version + 1)
+		dbItem, err = tx.Update_Item_By_Pk(ctx, database.Item_Pk(existing.Pk),
+			ups)
+		if err != nil {
+			return err
+		}
+
+		err = enqueueRestock(ctx, tx, existing, dbItem)
+		if err != nil {
+			return err
+		}
+		return recordEvent(ctx, tx, EventItemUpdated, dbItem.Id, &userPk,
+			apiItem(dbItem))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.publishInventory(dbItem)
+	return dbItem, nil
+}
+
+// DeleteItem will remove an item from the marketplace, and from any carts it
+// is in. items that have been ordered can't be deleted because the orders
+// still reference them. their remaining_quantity can be set to 0 instead
+func (s *Server) DeleteItem(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	itemID := chi.URLParam(r, "itemID")
+	var images []*database.ItemImage
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		item, err := tx.Find_Item_By_Id(ctx, database.Item_Id(itemID))
+		if err != nil {
+			return err
+		}
+
+		if item == nil || item.OwningUserPk == nil ||
+			*item.OwningUserPk != userPk {
+			return he.NotFound.New("item not found")
+		}
+
+		ifMatch := r.Header.Get("If-Match")
+		if ifMatch != "" && !etagMatches(ifMatch, versionETag(item.Version)) {
+			return he.PreconditionFailed.New("item has been modified")
+		}
+
+		orders, err := tx.Count_OrderedItem_By_ItemPk(ctx,
+			database.OrderedItem_ItemPk(item.Pk))
+		if err != nil {
+			return err
+		}
+
+		if orders > 0 {
+			return he.Conflict.New("item has been ordered. set its " +
+				"remaining_quantity to 0 instead")
+		}
 
-	if item.RemainingQuantity != 0 {
-		ups.RemainingQuantity = database.Item_RemainingQuantity(
-			item.RemainingQuantity)
-	}
+		_, err = tx.Delete_CartItem_By_ItemPk(ctx,
+			database.CartItem_ItemPk(item.Pk))
+		if err != nil {
+			return err
+		}
 
-	// TODO(sam): nil check
-	dbItem, err := s.DB.Update_Item_By_Id_And_OwningUserPk(ctx,
-		database.Item_Id(itemID), database.Item_OwningUserPk(*ss.UserPk), ups)
+		// the image rows go with the item, but their blobs are removed below
+		images, err = tx.All_ItemImage_By_ItemPk(ctx,
+			database.ItemImage_ItemPk(item.Pk))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Delete_Item_By_Pk(ctx, database.Item_Pk(item.Pk))
+		if err != nil {
+			return err
+		}
+		return recordEvent(ctx, tx, EventItemDeleted, item.Id, item.OwningUserPk,
+			apiItem(item))
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	resp := &RootJSON{
-		Item: apiItem(dbItem),
+	for _, image := range images {
+		s.deleteImageBlobs(image.BlobKey, image.ThumbnailKey)
 	}
 
-	return resp, nil
+	return nil, nil
 }
 
-// ListCart will return all of the items that are in the user's cart
+// ListCart will return all of the items that are in the user's cart, and
+// what they'd cost to order. the cart is priced for delivery to the
+// address_id query param, or the user's default address
 func (s *Server) ListCart(ctx context.Context, w http.ResponseWriter,
 	r *http.Request) (interface{}, error) {
 
@@ -208,20 +951,85 @@ func (s *Server) ListCart(ctx context.Context, w http.ResponseWriter,
 		return nil, err
 	}
 
-	cartItems, err := s.DB.All_CartItem_ItemId_By_SessionId(ctx,
-		database.Session_Id(ss.Id))
+	userPk, err := sessionUserPk(ss)
 	if err != nil {
 		return nil, err
 	}
 
-	resp := &RootJSON{
-		CartItems: apiCartItems(cartItems),
+	resp := &RootJSON{}
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		cartItems, err := tx.All_CartItem_ItemId_By_SessionId(ctx,
+			database.Session_Id(ss.Id))
+		if err != nil {
+			return err
+		}
+
+		items, err := tx.All_Item_By_CartItem_UserPk(ctx,
+			database.CartItem_UserPk(userPk))
+		if err != nil {
+			return err
+		}
+
+		itemsByPk := make(map[int64]*database.Item, len(items))
+		for _, item := range items {
+			itemsByPk[item.Pk] = item
+		}
+
+		variants, err := tx.All_Variant_By_CartItem_UserPk(ctx,
+			database.CartItem_UserPk(userPk))
+		if err != nil {
+			return err
+		}
+
+		variantsByPk := make(map[int64]*database.Variant, len(variants))
+		for _, variant := range variants {
+			variantsByPk[variant.Pk] = variant
+		}
+
+		lines := make([]orderLine, 0, len(cartItems))
+		for _, cartItem := range cartItems {
+			// TODO(sam): nil check
+			line := orderLine{
+				cartItem: &cartItem.CartItem,
+				item:     itemsByPk[*cartItem.CartItem.ItemPk],
+			}
+			if cartItem.CartItem.VariantPk != nil {
+				line.variant = variantsByPk[*cartItem.CartItem.VariantPk]
+			}
+			lines = append(lines, line)
+		}
+
+		var address *database.Address
+		if addressID := r.URL.Query().Get("address_id"); addressID != "" {
+			address, err = findUserAddress(ctx, tx, addressID, userPk)
+		} else {
+			address, err = tx.Find_Address_By_IsDefault_And_UserPk(ctx,
+				database.Address_IsDefault(true),
+				database.Address_UserPk(userPk))
+		}
+		if err != nil {
+			return err
+		}
+
+		resp.CartItems = apiCartItems(lines)
+		resp.CartSummary, err = s.summarizeCart(ctx, tx, userPk, lines,
+			address)
+		if he.Conflict.Has(err) {
+			// the items' currencies have changed since they were added, so
+			// there's no total until the cart is fixed
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return resp, nil
 }
 
-// AddCart will add the item to the user's cart
+// AddCart will add the item to the user's cart. items with more than one
+// variant need a variant_id to say which is being added
 func (s *Server) AddCart(ctx context.Context, w http.ResponseWriter,
 	r *http.Request) (interface{}, error) {
 
@@ -240,78 +1048,110 @@ func (s *Server) AddCart(ctx context.Context, w http.ResponseWriter,
 		return nil, he.BadRequest.New("can't add less than 1 thing to your cart")
 	}
 
+	var item *database.Item
 	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
-		item, err := tx.Find_Item_By_Id_And_RemainingQuantity_GreaterOrEqual(ctx,
-			database.Item_Id(cartItem.ItemID),
-			database.Item_RemainingQuantity(cartItem.Quantity))
+		found, variant, err := findCartVariant(ctx, tx, cartItem.ItemID,
+			cartItem.VariantID)
 		if err != nil {
 			return err
 		}
 
-		if item == nil {
-			return he.BadRequest.New("not enough items left")
-		}
+		// TODO(sam): nil check
+		item, err = addToCart(ctx, tx, *ss.UserPk, found, variant,
+			cartItem.Quantity)
+		return err
+	})
 
-		existingCartItem, err := tx.Find_CartItem_By_Item_Id_And_CartItem_UserPk(
-			ctx, database.Item_Id(cartItem.ItemID),
-			database.CartItem_UserPk(*ss.UserPk)) // TODO(sam): nil check
-		if err != nil {
-			return err
-		}
+	if err != nil {
+		return nil, err
+	}
 
-		if existingCartItem == nil {
-			// this item doesn't already exist in the cart
-			err = tx.CreateNoReturn_CartItem(ctx,
-				database.CartItem_Id(util.MustUUID4()),
-				database.CartItem_Quantity(cartItem.Quantity),
-				database.CartItem_Create_Fields{
-					UserPk: database.CartItem_UserPk(*ss.UserPk), // TODO(sam): nil check
-					ItemPk: database.CartItem_ItemPk(item.Pk),
-				})
-			if err != nil {
-				return err
-			}
-		} else {
-			// this item already exists in the cart, so increase the cart item's
-			// quantity
-			err = tx.UpdateNoReturn_CartItem_By_Pk(ctx,
-				database.CartItem_Pk(existingCartItem.Pk),
-				database.CartItem_Update_Fields{
-					Quantity: database.CartItem_Quantity(existingCartItem.Quantity +
-						cartItem.Quantity),
-				})
-			if err != nil {
-				return err
-			}
-		}
+	s.publishInventory(item)
+	return s.ListCart(ctx, w, r)
+}
+
+// addToCart adds quantity of the variant to the user's cart, taking it from
+// what remains of the variant. the item is returned with what remains of it
+func addToCart(ctx context.Context, tx *database.Tx, userPk int64,
+	item *database.Item, variant *database.Variant, quantity int) (
+	*database.Item, error) {
+
+	if variant.RemainingQuantity < quantity {
+		return nil, he.BadRequest.New("not enough items left")
+	}
+
+	err := checkCartCurrency(ctx, tx, userPk, item)
+	if err != nil {
+		return nil, err
+	}
 
-		rq := item.RemainingQuantity - cartItem.Quantity
-		item, err = tx.Update_Item_By_Pk(ctx, database.Item_Pk(item.Pk),
-			database.Item_Update_Fields{
-				RemainingQuantity: database.Item_RemainingQuantity(rq),
+	existingCartItem, err := tx.Find_CartItem_By_Variant_Id_And_CartItem_UserPk(
+		ctx, database.Variant_Id(variant.Id), database.CartItem_UserPk(userPk))
+	if err != nil {
+		return nil, err
+	}
+
+	inCart := quantity
+	if existingCartItem == nil {
+		// this variant doesn't already exist in the cart
+		err = tx.CreateNoReturn_CartItem(ctx,
+			database.CartItem_Id(util.MustUUID4()),
+			database.CartItem_Quantity(quantity),
+			database.CartItem_Create_Fields{
+				UserPk:    database.CartItem_UserPk(userPk),
+				ItemPk:    database.CartItem_ItemPk(item.Pk),
+				VariantPk: database.CartItem_VariantPk(variant.Pk),
 			})
 		if err != nil {
-			return err
+			return nil, err
 		}
-
-		// checking a racing situation within this transaction. another user must
-		// have swiped the item. returning an error here causes this transaction
-		// to rollback
-		if item.RemainingQuantity < 0 {
-			return he.Unexpected.New("this item is no longer available")
+	} else {
+		// this variant already exists in the cart, so increase the cart item's
+		// quantity
+		inCart += existingCartItem.Quantity
+		err = tx.UpdateNoReturn_CartItem_By_Pk(ctx,
+			database.CartItem_Pk(existingCartItem.Pk),
+			database.CartItem_Update_Fields{
+				Quantity: database.CartItem_Quantity(inCart),
+			})
+		if err != nil {
+			return nil, err
 		}
+	}
 
-		return nil
-	})
+	item, variant, err = adjustStock(ctx, tx, item, variant, -quantity)
+	if err != nil {
+		return nil, err
+	}
+
+	// checking a racing situation within this transaction. another user must
+	// have swiped the item. returning an error here causes this transaction
+	// to rollback
+	if variant.RemainingQuantity < 0 {
+		return nil, he.Unexpected.New("this item is no longer available")
+	}
 
+	err = recordCartEvent(ctx, tx, userPk, item, variant, inCart)
 	if err != nil {
 		return nil, err
 	}
+	return item, nil
+}
 
-	return s.ListCart(ctx, w, r)
+// recordCartEvent records that the user now has quantity of the variant in
+// their cart, which is 0 once it's been taken out
+func recordCartEvent(ctx context.Context, tx *database.Tx, userPk int64,
+	item *database.Item, variant *database.Variant, quantity int) error {
+
+	cartItem := &CartItem{ItemID: item.Id, Quantity: quantity}
+	if variant != nil {
+		cartItem.VariantID, cartItem.SKU = variant.Id, variant.Sku
+	}
+	return recordEvent(ctx, tx, EventCartUpdated, item.Id, &userPk, cartItem)
 }
 
-// UpdateCart will update the item in the user's cart
+// UpdateCart will update the item in the user's cart. the cart item is found
+// by its variant's id, or by its item's id for items with one variant
 func (s *Server) UpdateCart(ctx context.Context, w http.ResponseWriter,
 	r *http.Request) (interface{}, error) {
 
@@ -320,6 +1160,11 @@ func (s *Server) UpdateCart(ctx context.Context, w http.ResponseWriter,
 		return nil, err
 	}
 
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
 	cartItemID := chi.URLParam(r, "cartItemID")
 	cartItemUpdate := CartItem{}
 	err = json.NewDecoder(r.Body).Decode(&cartItemUpdate)
@@ -331,11 +1176,11 @@ func (s *Server) UpdateCart(ctx context.Context, w http.ResponseWriter,
 	// layer/package
 	// TODO(sam): this needs some unit testing
 	queryStartTime := time.Now()
+	var changed *database.Item
 	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
 		// get the item in the users cart
-		cartItem, err := tx.Get_CartItem_By_Item_Id_And_CartItem_UserPk(ctx,
-			database.Item_Id(cartItemID),
-			database.CartItem_UserPk(*ss.UserPk)) // TODO(sam): nil check
+		cartItem, err := findCartItem(ctx, tx, cartItemID,
+			userPk)
 		if err != nil {
 			return err
 		}
@@ -347,6 +1192,19 @@ func (s *Server) UpdateCart(ctx context.Context, w http.ResponseWriter,
 			return err
 		}
 
+		// items added to the cart before they had variants only have the item's
+		// quantity to take from
+		var variant *database.Variant
+		available := item.RemainingQuantity
+		if cartItem.VariantPk != nil {
+			variant, err = tx.Get_Variant_By_Pk(ctx,
+				database.Variant_Pk(*cartItem.VariantPk))
+			if err != nil {
+				return err
+			}
+			available = variant.RemainingQuantity
+		}
+
 		if cartItemUpdate.Quantity == cartItem.Quantity {
 			// the user is updating the item quantity to what's already in the cart.
 			// do nothing
@@ -372,16 +1230,9 @@ func (s *Server) UpdateCart(ctx context.Context, w http.ResponseWriter,
 				return err
 			}
 
-			// TODO(sam): this is racy because item quantity is being increased by
-			// the amont retrieved at the beginning of this transaction
-			//
-			// release the freed cart item quantity back to item.Quantity
-			rq := item.RemainingQuantity + (cartItem.Quantity -
-				cartItemUpdate.Quantity)
-			err = tx.UpdateNoReturn_Item_By_Pk(ctx, database.Item_Pk(item.Pk),
-				database.Item_Update_Fields{
-					RemainingQuantity: database.Item_RemainingQuantity(rq),
-				})
+			// release the freed cart item quantity back to the variant
+			changed, _, err = adjustStock(ctx, tx, item, variant,
+				cartItem.Quantity-cartItemUpdate.Quantity)
 			if err != nil {
 				return err
 			}
@@ -389,9 +1240,9 @@ func (s *Server) UpdateCart(ctx context.Context, w http.ResponseWriter,
 
 		if cartItemUpdate.Quantity > cartItem.Quantity {
 			// user is increasing quantity in cart
-			if item.RemainingQuantity < cartItemUpdate.Quantity-cartItem.Quantity {
+			if available < cartItemUpdate.Quantity-cartItem.Quantity {
 				return he.BadRequest.New("only %d items remain. not enough",
-					item.RemainingQuantity)
+					available)
 			}
 
 			err = tx.UpdateNoReturn_CartItem_By_Pk(ctx,
@@ -402,20 +1253,27 @@ func (s *Server) UpdateCart(ctx context.Context, w http.ResponseWriter,
 				return err
 			}
 
-			// TODO(sam): again this is racy
-			// consume the additional requested quantity from the marketplace items
-			rq := item.RemainingQuantity - (cartItemUpdate.Quantity -
-				cartItem.Quantity)
-			err = tx.UpdateNoReturn_Item_By_Pk(ctx, database.Item_Pk(item.Pk),
-				database.Item_Update_Fields{
-					RemainingQuantity: database.Item_RemainingQuantity(rq),
-				})
+			// consume the additional requested quantity from the variant
+			changed, variant, err = adjustStock(ctx, tx, item, variant,
+				cartItem.Quantity-cartItemUpdate.Quantity)
 			if err != nil {
 				return err
 			}
+
+			// the quantity available was read before taking the stock, so another
+			// user may have swiped it since. returning an error here causes this
+			// transaction to rollback
+			remaining := changed.RemainingQuantity
+			if variant != nil {
+				remaining = variant.RemainingQuantity
+			}
+			if remaining < 0 {
+				return he.Unexpected.New("this item is no longer available")
+			}
 		}
 
-		return nil
+		return recordCartEvent(ctx, tx, userPk, item, variant,
+			cartItemUpdate.Quantity)
 	})
 
 	if err != nil {
@@ -425,10 +1283,16 @@ func (s *Server) UpdateCart(ctx context.Context, w http.ResponseWriter,
 	monitor.UpdateCartDatabaseQueryLatencyHistogram.Observe(
 		time.Now().Sub(queryStartTime).Seconds())
 
+	// the stock is left alone when the quantity isn't changed
+	if changed != nil {
+		s.publishInventory(changed)
+	}
+
 	return s.ListCart(ctx, w, r)
 }
 
-// ListOrder will return all of the ordered items that have been made
+// ListOrder will return all of the ordered items that have been made, along
+// with any returns of them
 func (s *Server) ListOrder(ctx context.Context, w http.ResponseWriter,
 	r *http.Request) (interface{}, error) {
 
@@ -437,20 +1301,65 @@ func (s *Server) ListOrder(ctx context.Context, w http.ResponseWriter,
 		return nil, err
 	}
 
-	orderedItems, err := s.DB.All_OrderedItem_AddressId_ItemId_By_SessionId(ctx,
-		database.Session_Id(ss.Id))
+	userPk, err := sessionUserPk(ss)
 	if err != nil {
 		return nil, err
 	}
 
-	resp := &RootJSON{
-		OrderedItems: apiOrderedItems(orderedItems),
+	resp := &RootJSON{}
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		orderedItems, err := tx.All_OrderedItem_ItemId_By_SessionId(ctx,
+			database.Session_Id(ss.Id))
+		if err != nil {
+			return err
+		}
+
+		returns, err := tx.All_ReturnRequest_By_OrderedItem_UserPk(ctx,
+			database.OrderedItem_UserPk(userPk))
+		if err != nil {
+			return err
+		}
+
+		refunds, err := tx.All_Refund_By_OrderedItem_UserPk(ctx,
+			database.OrderedItem_UserPk(userPk))
+		if err != nil {
+			return err
+		}
+
+		refunded := map[int64]int{}
+		for _, refund := range refunds {
+			refunded[*refund.ReturnRequestPk] += refund.Amount
+		}
+
+		resp.OrderedItems = apiOrderedItems(orderedItems)
+		byPk := map[int64]int{}
+		for i, orderedItem := range orderedItems {
+			byPk[orderedItem.OrderedItem.Pk] = i
+		}
+		for _, ret := range returns {
+			i := byPk[ret.OrderedItemPk]
+			resp.OrderedItems[i].Returns = append(resp.OrderedItems[i].Returns,
+				apiReturn(&database.ReturnRequest_OrderedItem_Item_Id_Row{
+					ReturnRequest: *ret,
+					OrderedItem:   orderedItems[i].OrderedItem,
+					Item_Id:       orderedItems[i].Item_Id,
+				}, refunded[ret.Pk]))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
+
 	return resp, nil
 }
 
 // AddOrder will purchase everything that is in the user's cart then remove it
-// all from the cart
+// all from the cart. items without an address_id are shipped to the user's
+// default address. if an expected_total is sent, the order is only placed if
+// it's still the total, tax and shipping included. the payment is authorized
+// before the order's transaction, so a failed payment leaves the cart, and the
+// quantity it holds, as it was. it's captured once the order is placed
 func (s *Server) AddOrder(ctx context.Context, w http.ResponseWriter,
 	r *http.Request) (interface{}, error) {
 
@@ -459,46 +1368,118 @@ func (s *Server) AddOrder(ctx context.Context, w http.ResponseWriter,
 		return nil, err
 	}
 
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
 	order := PlaceOrder{}
 	err = json.NewDecoder(r.Body).Decode(&order)
 	if err != nil {
 		return nil, he.BadRequest.Wrap(err)
 	}
 
-	// TODO(sam): these queries could be massively optimized with a few manual
-	// "IN" db calls. This is horribly inefficient ATM
+	if len(order.Orders) == 0 {
+		return nil, he.BadRequest.New("no items to order")
+	}
+
+	c := newCharge(userPk)
+
+	// the order is priced on its own first, so that the payment provider isn't
+	// called with a transaction open
 	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
-		for _, o := range order.Orders {
-			// TODO(sam): nil check
-			cartItem, err := tx.Get_CartItem_By_Item_Id_And_CartItem_UserPk(ctx,
-				database.Item_Id(o.ItemID), database.CartItem_UserPk(*ss.UserPk))
-			if err != nil {
-				return err
-			}
+		priced, err := s.priceOrder(ctx, tx, userPk, order)
+		if err != nil {
+			return err
+		}
 
-			address, err := tx.Get_Address_By_Id(ctx,
-				database.Address_Id(o.AddressID))
-			if err != nil {
-				return err
-			}
+		// the client's total is checked so the user pays what they were shown
+		total := priced.quote.Total
+		expected := order.ExpectedTotal
+		if expected != nil && (expected.Amount != total.Amount ||
+			!strings.EqualFold(expected.Currency, total.Currency.Code)) {
+			return he.Conflict.New("the order total is now %s", total)
+		}
 
-			// TODO(sam): nil check
-			// get the item for it's current price
-			item, err := tx.Get_Item_By_Pk(ctx, database.Item_Pk(*cartItem.ItemPk))
-			if err != nil {
-				return err
+		c.amount = total
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.authorizePayment(ctx, c)
+	if err != nil {
+		s.failPayment(c, err)
+		return nil, paymentError(err)
+	}
+
+	var subOrders []*database.SubOrder
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		priced, err := s.priceOrder(ctx, tx, userPk, order)
+		if err != nil {
+			return err
+		}
+
+		// the cart, or the prices, may have changed since it was authorized
+		lines, quote := priced.lines, priced.quote
+		if quote.Total != c.amount {
+			return he.Conflict.New("the order total is now %s", quote.Total)
+		}
+
+		err = s.recordPayment(ctx, tx, c)
+		if err != nil {
+			return err
+		}
+
+		var lineSubOrders []*database.SubOrder
+		subOrders, lineSubOrders, err = createSubOrders(ctx, tx, userPk,
+			c.record, lines, quote)
+		if err != nil {
+			return err
+		}
+
+		for i, line := range lines {
+			cartItem, item, address := line.cartItem, line.item, line.address
+			discount, couponCode := quote.LineDiscounts[i].Amount, ""
+			if discount > 0 {
+				couponCode = priced.dbCoupon.Code
 			}
 
+			optional := database.OrderedItem_Create_Fields{
+				UserPk:     database.OrderedItem_UserPk(userPk),
+				AddressPk:  database.OrderedItem_AddressPk(address.Pk),
+				PaymentPk:  database.OrderedItem_PaymentPk(c.record.Pk),
+				SubOrderPk: database.OrderedItem_SubOrderPk(lineSubOrders[i].Pk),
+			}
+			variantID, sku := "", ""
+			if line.variant != nil {
+				variantID, sku = line.variant.Id, line.variant.Sku
+				optional.VariantPk = database.OrderedItem_VariantPk(line.variant.Pk)
+			}
 			err = tx.CreateNoReturn_OrderedItem(ctx,
 				database.OrderedItem_Id(util.MustUUID4()),
 				database.OrderedItem_Quantity(cartItem.Quantity),
 				database.OrderedItem_Delivered(false),
-				database.OrderedItem_Price(item.Price),
+				database.OrderedItem_Price(unitAmount(item, line.variant)),
+				database.OrderedItem_Currency(item.Currency),
+				database.OrderedItem_Discount(discount),
+				database.OrderedItem_Coupon(couponCode),
+				database.OrderedItem_Tax(quote.LineTax[i].Amount),
+				database.OrderedItem_VariantId(variantID),
+				database.OrderedItem_Sku(sku),
+				database.OrderedItem_AddressId(address.Id),
+				database.OrderedItem_AddressLine1(address.Line1),
+				database.OrderedItem_AddressLine2(address.Line2),
+				database.OrderedItem_AddressLine3(address.Line3),
+				database.OrderedItem_AddressCountry(address.Country),
+				database.OrderedItem_AddressState(address.State),
+				database.OrderedItem_AddressCity(address.City),
+				database.OrderedItem_AddressZip(address.Zip),
+				database.OrderedItem_AddressPhone(address.Phone),
+				database.OrderedItem_AddressNotes(address.Notes),
 				database.OrderedItem_ItemPk(item.Pk),
-				database.OrderedItem_AddressPk(address.Pk),
-				database.OrderedItem_Create_Fields{
-					UserPk: database.OrderedItem_UserPk(*ss.UserPk), // TODO(sam): nil check
-				})
+				optional)
 			if err != nil {
 				return err
 			}
@@ -509,13 +1490,141 @@ func (s *Server) AddOrder(ctx context.Context, w http.ResponseWriter,
 			}
 		}
 
-		return nil
+		if priced.coupon != nil {
+			err = redeemCoupon(ctx, tx, priced.dbCoupon, c, quote.Discount)
+			if err != nil {
+				return err
+			}
+		}
+
+		placement := orderPlacement{
+			PaymentID:   c.record.Id,
+			Total:       apiMoney(c.record.Amount, c.record.Currency),
+			Lines:       len(lines),
+			SubOrderIDs: make([]string, 0, len(subOrders)),
+		}
+		for _, subOrder := range subOrders {
+			placement.SubOrderIDs = append(placement.SubOrderIDs, subOrder.Id)
+		}
+		return recordEvent(ctx, tx, EventOrderPlaced, c.record.Id, ss.UserPk,
+			placement)
 	})
+	if err != nil {
+		s.failPayment(c, err)
+		return nil, paymentError(err)
+	}
+
+	// the order stands once it's placed. a capture that fails is tried again
+	// in a job, and the payment is left authorized until then
+	err = s.capturePayment(ctx, c.record)
+	if err != nil {
+		s.log.WithError(err).Warnf("failed to capture payment %s", c.id)
+		err = s.retryCapture(ctx, c.record)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &RootJSON{
+		Payment:   apiPayment(c.record),
+		SubOrders: apiSubOrders(subOrders),
+	}, nil
+}
+
+// pricedOrder is what an order would be placed as. dbCoupon and coupon are
+// the coupon in the user's cart, if any
+type pricedOrder struct {
+	lines    []orderLine
+	dbCoupon *database.Coupon
+	coupon   *pricing.Coupon
+	quote    *pricing.Quote
+}
+
+// priceOrder reads the cart items, addresses and coupon of an order and
+// quotes it
+func (s *Server) priceOrder(ctx context.Context, tx *database.Tx,
+	userPk int64, order PlaceOrder) (*pricedOrder, error) {
+
+	// TODO(sam): these queries could be massively optimized with a few manual
+	// "IN" db calls. This is horribly inefficient ATM
+	defaultAddress, err := tx.Find_Address_By_IsDefault_And_UserPk(ctx,
+		database.Address_IsDefault(true), database.Address_UserPk(userPk))
 	if err != nil {
 		return nil, err
 	}
 
-	monitor.PurchasesGauge.Add(float64(len(order.Orders)))
+	priced := &pricedOrder{lines: make([]orderLine, 0, len(order.Orders))}
+	ordered := map[int64]bool{}
+	for _, o := range order.Orders {
+		id := o.VariantID
+		if id == "" {
+			id = o.ItemID
+		}
 
-	return nil, nil
+		cartItem, err := findCartItem(ctx, tx, id, userPk)
+		if err != nil {
+			return nil, err
+		}
+
+		// each cart item is ordered, and paid for, once
+		if ordered[cartItem.Pk] {
+			return nil, he.BadRequest.New("%s is ordered more than once", id)
+		}
+		ordered[cartItem.Pk] = true
+
+		address := defaultAddress
+		if o.AddressID != "" {
+			address, err = findUserAddress(ctx, tx, o.AddressID, userPk)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if address == nil {
+			return nil, he.BadRequest.New("no address to ship %s to", o.ItemID)
+		}
+
+		// TODO(sam): nil check
+		// get the item for it's current price
+		item, err := tx.Get_Item_By_Pk(ctx, database.Item_Pk(*cartItem.ItemPk))
+		if err != nil {
+			return nil, err
+		}
+
+		var variant *database.Variant
+		if cartItem.VariantPk != nil {
+			variant, err = tx.Get_Variant_By_Pk(ctx,
+				database.Variant_Pk(*cartItem.VariantPk))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		priced.lines = append(priced.lines, orderLine{
+			cartItem: cartItem,
+			item:     item,
+			variant:  variant,
+			address:  address,
+		})
+	}
+
+	// a coupon in the cart that can't be used fails the order rather than
+	// charging more than the user expects
+	priced.dbCoupon, err = tx.Find_Coupon_By_CartCoupon_UserPk(ctx,
+		database.CartCoupon_UserPk(userPk))
+	if err != nil {
+		return nil, err
+	}
+	if priced.dbCoupon != nil {
+		priced.coupon, err = s.usableCoupon(ctx, tx, priced.dbCoupon, userPk)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	priced.quote, err = s.quote(ctx, priced.lines, priced.coupon)
+	if err != nil {
+		return nil, quoteError(err)
+	}
+	return priced, nil
 }
@@ -1,12 +1,15 @@
 package server
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
+	"shipyard/database"
 	he "shipyard/httperror"
 )
 
@@ -50,7 +53,7 @@ func TestAddItem(baseTest *testing.T) {
 	ctx = t.addNewSession(ctx, email)
 
 	w := httptest.NewRecorder()
-	item := Item{Price: 10, Description: "very good"}
+	item := Item{Price: &Money{Amount: 10}, Description: "very good"}
 	r := jsonPostRequest(t, "/api/item", item)
 	_, err := t.server.AddItem(ctx, w, r)
 	assert.Error(t, err)
@@ -63,7 +66,8 @@ func TestAddItem(baseTest *testing.T) {
 
 	json, ok := resp.(*RootJSON)
 	assert.True(t, ok)
-	assert.Equal(t, json.Item.Price, 10)
+	assert.Equal(t, &Money{Amount: 10, Currency: "USD", Formatted: "$0.10"},
+		json.Item.Price)
 	assert.Equal(t, json.Item.Description, "very good")
 	assert.Equal(t, json.Item.ImageURL, "")
 }
@@ -96,3 +100,344 @@ func TestAddCart(baseTest *testing.T) {
 	assert.Equal(t, json.CartItems[0].ItemID, i2.Id)
 	assert.Equal(t, json.CartItems[0].Quantity, 1)
 }
+
+func TestUpdateItemIfMatch(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	ctx = t.addNewSession(ctx, "user@example.com")
+
+	w := httptest.NewRecorder()
+	r := jsonPostRequest(t, "/api/item",
+		Item{Price: &Money{Amount: 10}, Description: "very good", RemainingQuantity: 1})
+	resp, err := t.server.AddItem(ctx, w, r)
+	assert.NoError(t, err)
+	itemID := resp.(*RootJSON).Item.ID
+	etag := w.Header().Get("ETag")
+	assert.Equal(t, `"1"`, etag)
+
+	w = httptest.NewRecorder()
+	r = jsonPostRequest(t, "/api/item/"+itemID, Item{Price: &Money{Amount: 11}})
+	r.Header.Set("If-Match", etag)
+	resp, err = t.server.UpdateItem(ctx, w, withURLParams(r, "itemID", itemID))
+	assert.NoError(t, err)
+	assert.Equal(t, 11, resp.(*RootJSON).Item.Price.Amount)
+	assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+	// the stale etag is rejected
+	r = jsonPostRequest(t, "/api/item/"+itemID, Item{Price: &Money{Amount: 12}})
+	r.Header.Set("If-Match", etag)
+	_, err = t.server.UpdateItem(ctx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", itemID))
+	assert.True(t, he.PreconditionFailed.Has(err))
+
+	// other users can't update the item
+	otherCtx := t.addNewSession(context.Background(), "other@example.com")
+	r = jsonPostRequest(t, "/api/item/"+itemID, Item{Price: &Money{Amount: 12}})
+	_, err = t.server.UpdateItem(otherCtx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", itemID))
+	assert.True(t, he.NotFound.Has(err))
+}
+
+func TestListItemIfNoneMatch(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	i1 := newItem(ctx, t, "x", 1)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/item", nil)
+	_, err := t.server.ListItem(ctx, w, r)
+	assert.NoError(t, err)
+	etag := w.Header().Get("ETag")
+	assert.NotEqual(t, "", etag)
+
+	r = httptest.NewRequest(http.MethodGet, "/api/item", nil)
+	r.Header.Set("If-None-Match", etag)
+	_, err = t.server.ListItem(ctx, httptest.NewRecorder(), r)
+	assert.True(t, he.NotModified.Has(err))
+	assert.Equal(t, http.StatusNotModified, he.StatusCodeByError(err))
+
+	// any change to an item changes the etag
+	_, err = t.server.DB.Update_Item_By_Pk(ctx, database.Item_Pk(i1.Pk),
+		database.Item_Update_Fields{
+			Version: database.Item_Version(i1.Version + 1),
+		})
+	assert.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/api/item", nil)
+	r.Header.Set("If-None-Match", etag)
+	_, err = t.server.ListItem(ctx, w, r)
+	assert.NoError(t, err)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+}
+
+func TestPatchItem(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	ctx = t.addNewSession(ctx, "user@example.com")
+
+	r := jsonPostRequest(t, "/api/item", Item{Price: &Money{Amount: 10},
+		Description: "very good", ImageURL: "http://x", RemainingQuantity: 1})
+	resp, err := t.server.AddItem(ctx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	itemID := resp.(*RootJSON).Item.ID
+
+	// null clears, absent is untouched, and 0 is a real value
+	r = httptest.NewRequest(http.MethodPatch, "/api/item/"+itemID,
+		strings.NewReader(`{"image_url": null, "remaining_quantity": 0}`))
+	r.Header.Set("Content-Type", "application/merge-patch+json")
+	resp, err = t.server.PatchItem(ctx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", itemID))
+	assert.NoError(t, err)
+
+	item := resp.(*RootJSON).Item
+	assert.Equal(t, "", item.ImageURL)
+	assert.Equal(t, 0, item.RemainingQuantity)
+	assert.Equal(t, "very good", item.Description)
+	assert.Equal(t, 10, item.Price.Amount)
+	assert.Equal(t, 2, item.Version)
+
+	r = httptest.NewRequest(http.MethodPatch, "/api/item/"+itemID,
+		strings.NewReader(`{"id": "abc"}`))
+	_, err = t.server.PatchItem(ctx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", itemID))
+	assert.True(t, he.BadRequest.Has(err))
+}
+
+func TestDeleteItem(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	ctx = t.addNewSession(ctx, "user@example.com")
+	ss, err := GetCtxSession(ctx)
+	assert.NoError(t, err)
+
+	addItem := func() *database.Item {
+		r := jsonPostRequest(t, "/api/item",
+			Item{Price: &Money{Amount: 10}, Description: "x", RemainingQuantity: 2})
+		resp, err := t.server.AddItem(ctx, httptest.NewRecorder(), r)
+		assert.NoError(t, err)
+		item, err := t.server.DB.Find_Item_By_Id(ctx,
+			database.Item_Id(resp.(*RootJSON).Item.ID))
+		assert.NoError(t, err)
+		return item
+	}
+	deleteItem := func(itemID string) error {
+		r := httptest.NewRequest(http.MethodDelete, "/api/item/"+itemID, nil)
+		_, err := t.server.DeleteItem(ctx, httptest.NewRecorder(),
+			withURLParams(r, "itemID", itemID))
+		return err
+	}
+
+	// items in carts can be deleted
+	i1 := addItem()
+	t.addCart(ctx, i1.Id, 1)
+	assert.NoError(t, deleteItem(i1.Id))
+	assert.True(t, he.NotFound.Has(deleteItem(i1.Id)))
+
+	// ordered items can't be
+	i2 := addItem()
+	address, err := t.server.DB.Find_Address_By_Id(ctx,
+		database.Address_Id(t.addAddress(ctx).ID))
+	assert.NoError(t, err)
+	err = t.server.DB.CreateNoReturn_OrderedItem(ctx,
+		database.OrderedItem_Id("ordered"),
+		database.OrderedItem_Quantity(1),
+		database.OrderedItem_Delivered(false),
+		database.OrderedItem_Price(i2.Price),
+		database.OrderedItem_Currency(i2.Currency),
+		database.OrderedItem_Discount(0),
+		database.OrderedItem_Coupon(""),
+		database.OrderedItem_Tax(0),
+		database.OrderedItem_VariantId(""),
+		database.OrderedItem_Sku(""),
+		database.OrderedItem_AddressId(address.Id),
+		database.OrderedItem_AddressLine1(address.Line1),
+		database.OrderedItem_AddressLine2(address.Line2),
+		database.OrderedItem_AddressLine3(address.Line3),
+		database.OrderedItem_AddressCountry(address.Country),
+		database.OrderedItem_AddressState(address.State),
+		database.OrderedItem_AddressCity(address.City),
+		database.OrderedItem_AddressZip(address.Zip),
+		database.OrderedItem_AddressPhone(address.Phone),
+		database.OrderedItem_AddressNotes(address.Notes),
+		database.OrderedItem_ItemPk(i2.Pk),
+		database.OrderedItem_Create_Fields{
+			UserPk:    database.OrderedItem_UserPk(*ss.UserPk),
+			AddressPk: database.OrderedItem_AddressPk(address.Pk),
+		})
+	assert.NoError(t, err)
+	assert.True(t, he.Conflict.Has(deleteItem(i2.Id)))
+}
+
+func TestPatchAddress(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	ctx = t.addNewSession(ctx, "user@example.com")
+
+	w := httptest.NewRecorder()
+	r := jsonPostRequest(t, "/api/address",
+		Address{Line1: "1 street", Line2: "apt 2", City: "city"})
+	resp, err := t.server.AddAddress(ctx, w, r)
+	assert.NoError(t, err)
+	addressID := resp.(*RootJSON).Address.ID
+	etag := w.Header().Get("ETag")
+
+	r = httptest.NewRequest(http.MethodPatch, "/api/address/"+addressID,
+		strings.NewReader(`{"line1": "2 street", "line2": null}`))
+	r.Header.Set("If-Match", etag)
+	resp, err = t.server.PatchAddress(ctx, httptest.NewRecorder(),
+		withURLParams(r, "addressID", addressID))
+	assert.NoError(t, err)
+
+	address := resp.(*RootJSON).Address
+	assert.Equal(t, "2 street", address.Line1)
+	assert.Equal(t, "", address.Line2)
+	assert.Equal(t, "city", address.City)
+
+	r = httptest.NewRequest(http.MethodPatch, "/api/address/"+addressID,
+		strings.NewReader(`{"line1": "3 street"}`))
+	r.Header.Set("If-Match", etag)
+	_, err = t.server.PatchAddress(ctx, httptest.NewRecorder(),
+		withURLParams(r, "addressID", addressID))
+	assert.True(t, he.PreconditionFailed.Has(err))
+
+	// other users can't see the address
+	otherCtx := t.addNewSession(context.Background(), "other@example.com")
+	r = httptest.NewRequest(http.MethodDelete, "/api/address/"+addressID, nil)
+	_, err = t.server.DeleteAddress(otherCtx, httptest.NewRecorder(),
+		withURLParams(r, "addressID", addressID))
+	assert.True(t, he.NotFound.Has(err))
+
+	r = httptest.NewRequest(http.MethodDelete, "/api/address/"+addressID, nil)
+	_, err = t.server.DeleteAddress(ctx, httptest.NewRecorder(),
+		withURLParams(r, "addressID", addressID))
+	assert.NoError(t, err)
+}
+
+func TestAddressBook(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	ctx = t.addNewSession(ctx, "user@example.com")
+
+	addAddress := func(address Address) *Address {
+		r := jsonPostRequest(t, "/api/address", address)
+		resp, err := t.server.AddAddress(ctx, httptest.NewRecorder(), r)
+		assert.NoError(t, err)
+		return resp.(*RootJSON).Address
+	}
+
+	// the first address is the default until another is made the default
+	a1 := addAddress(Address{Line1: "1 street"})
+	assert.True(t, a1.Default)
+	a2 := addAddress(Address{Line1: "2 street"})
+	assert.False(t, a2.Default)
+
+	r := httptest.NewRequest(http.MethodPatch, "/api/address/"+a2.ID,
+		strings.NewReader(`{"default": true}`))
+	resp, err := t.server.PatchAddress(ctx, httptest.NewRecorder(),
+		withURLParams(r, "addressID", a2.ID))
+	assert.NoError(t, err)
+	assert.True(t, resp.(*RootJSON).Address.Default)
+
+	r = httptest.NewRequest(http.MethodGet, "/api/address", nil)
+	resp, err = t.server.ListAddress(ctx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	defaults := map[string]bool{}
+	versions := map[string]int{}
+	for _, address := range resp.(*RootJSON).Addresses {
+		defaults[address.ID] = address.Default
+		versions[address.ID] = address.Version
+	}
+	assert.Equal(t, map[string]bool{a1.ID: false, a2.ID: true}, defaults)
+	// the address that's no longer the default has changed too
+	assert.Equal(t, a1.Version+1, versions[a1.ID])
+
+	// making the default the default again leaves the other address alone
+	r = httptest.NewRequest(http.MethodPatch, "/api/address/"+a2.ID,
+		strings.NewReader(`{"default": true}`))
+	r.Header.Set("If-Match", versionETag(versions[a2.ID]))
+	resp, err = t.server.PatchAddress(ctx, httptest.NewRecorder(),
+		withURLParams(r, "addressID", a2.ID))
+	assert.NoError(t, err)
+	assert.True(t, resp.(*RootJSON).Address.Default)
+	r = httptest.NewRequest(http.MethodGet, "/api/address/"+a1.ID, nil)
+	resp, err = t.server.GetAddress(ctx, httptest.NewRecorder(),
+		withURLParams(r, "addressID", a1.ID))
+	assert.NoError(t, err)
+	assert.Equal(t, versions[a1.ID], resp.(*RootJSON).Address.Version)
+
+	// other users can't read it
+	otherCtx := t.addNewSession(context.Background(), "other@example.com")
+	r = httptest.NewRequest(http.MethodGet, "/api/address/"+a1.ID, nil)
+	_, err = t.server.GetAddress(otherCtx, httptest.NewRecorder(),
+		withURLParams(r, "addressID", a1.ID))
+	assert.True(t, he.NotFound.Has(err))
+}
+
+func TestAddOrderAddress(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	ctx = t.addNewSession(ctx, "user@example.com")
+	i1 := newItem(ctx, t, "x", 2)
+
+	addToCart := func() {
+		t.addCart(ctx, i1.Id, 1)
+	}
+	placeOrder := func(ctx context.Context, addressID string) error {
+		r := jsonPostRequest(t, "/api/order", PlaceOrder{
+			Orders: []OrderedItem{{ItemID: i1.Id, AddressID: addressID}}})
+		_, err := t.server.AddOrder(ctx, httptest.NewRecorder(), r)
+		return err
+	}
+
+	addToCart()
+	assert.True(t, he.BadRequest.Has(placeOrder(ctx, ""))) // no default address
+
+	// another user's address can't be used
+	otherCtx := t.addNewSession(context.Background(), "other@example.com")
+	r := jsonPostRequest(t, "/api/address", Address{Line1: "other street"})
+	resp, err := t.server.AddAddress(otherCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	otherAddress := resp.(*RootJSON).Address
+	assert.True(t, he.NotFound.Has(placeOrder(ctx, otherAddress.ID)))
+
+	r = jsonPostRequest(t, "/api/address", Address{Line1: "1 street"})
+	resp, err = t.server.AddAddress(ctx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	address := resp.(*RootJSON).Address
+	assert.NoError(t, placeOrder(ctx, "")) // shipped to the default
+
+	// later edits and deletes don't rewrite the order
+	r = httptest.NewRequest(http.MethodPatch, "/api/address/"+address.ID,
+		strings.NewReader(`{"line1": "2 street"}`))
+	_, err = t.server.PatchAddress(ctx, httptest.NewRecorder(),
+		withURLParams(r, "addressID", address.ID))
+	assert.NoError(t, err)
+
+	r = httptest.NewRequest(http.MethodGet, "/api/order", nil)
+	resp, err = t.server.ListOrder(ctx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	orders := resp.(*RootJSON).OrderedItems
+	assert.Len(t, orders, 1)
+	assert.Equal(t, address.ID, orders[0].AddressID)
+	assert.Equal(t, "1 street", orders[0].Address.Line1)
+
+	r = httptest.NewRequest(http.MethodDelete, "/api/address/"+address.ID, nil)
+	_, err = t.server.DeleteAddress(ctx, httptest.NewRecorder(),
+		withURLParams(r, "addressID", address.ID))
+	assert.NoError(t, err)
+
+	r = httptest.NewRequest(http.MethodGet, "/api/order", nil)
+	resp, err = t.server.ListOrder(ctx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	orders = resp.(*RootJSON).OrderedItems
+	assert.Len(t, orders, 1)
+	assert.Equal(t, "1 street", orders[0].Address.Line1)
+}
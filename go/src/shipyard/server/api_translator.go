@@ -1,6 +1,12 @@
 package server
 
-import "shipyard/database"
+import (
+	"encoding/json"
+	"strings"
+
+	"shipyard/database"
+	"shipyard/money"
+)
 
 func apiUser(m *database.User) *User {
 	return &User{
@@ -39,6 +45,8 @@ func apiAddress(m *database.Address) *Address {
 		Zip:     m.Zip,
 		Phone:   m.Phone,
 		Notes:   m.Notes,
+		Version: m.Version,
+		Default: m.IsDefault,
 	}
 }
 
@@ -54,11 +62,89 @@ func apiItem(m *database.Item) *Item {
 	return &Item{
 		ID:                m.Id,
 		Created:           UnixTS(m.Created),
-		Price:             m.Price,
+		Title:             m.Title,
+		Price:             apiMoney(m.Price, m.Currency),
 		RemainingQuantity: m.RemainingQuantity,
 		Description:       m.Description,
 		ImageURL:          m.ImageUrl,
+		CategoryID:        m.CategoryId,
+		Tags:              decodeTags(m.Tags),
+		Attributes:        decodeAttributes(m.Attributes),
+		Rating:            averageRating(m),
+		ReviewCount:       m.RatingCount,
+		Version:           m.Version,
+	}
+}
+
+func (s *Server) apiImage(itemID string, m *database.ItemImage) *Image {
+	url := s.imageURL(itemID, m.Id)
+	return &Image{
+		ID:           m.Id,
+		ItemID:       itemID,
+		URL:          url,
+		ThumbnailURL: url + "?size=thumbnail",
+		ContentType:  m.ContentType,
+		Size:         m.Size,
+		Width:        m.Width,
+		Height:       m.Height,
+		Position:     m.Position,
+		Created:      UnixTS(m.Created),
+	}
+}
+
+func (s *Server) apiImages(itemID string, ms []*database.ItemImage) []*Image {
+	images := make([]*Image, 0, len(ms))
+	for _, m := range ms {
+		images = append(images, s.apiImage(itemID, m))
+	}
+	return images
+}
+
+func apiVariant(item *database.Item, m *database.Variant) *Variant {
+	return &Variant{
+		ID:                m.Id,
+		ItemID:            item.Id,
+		SKU:               m.Sku,
+		Price:             apiMoney(unitAmount(item, m), item.Currency),
+		RemainingQuantity: m.RemainingQuantity,
+		Attributes:        decodeAttributes(m.Attributes),
+		Created:           UnixTS(m.Created),
+	}
+}
+
+func apiVariants(item *database.Item, ms []*database.Variant) []*Variant {
+	s := make([]*Variant, 0, len(ms))
+	for _, m := range ms {
+		s = append(s, apiVariant(item, m))
+	}
+	return s
+}
+
+func apiCategory(m *database.Category, parentID string) *Category {
+	return &Category{
+		ID:       m.Id,
+		Name:     m.Name,
+		ParentID: parentID,
+		Created:  UnixTS(m.Created),
+	}
+}
+
+// apiCategories needs every category's parent to be in ms
+func apiCategories(ms []*database.Category) []*Category {
+	ids := make(map[int64]string, len(ms))
+	for _, m := range ms {
+		ids[m.Pk] = m.Id
+	}
+
+	s := make([]*Category, 0, len(ms))
+	for _, m := range ms {
+		parentID := ""
+		if m.ParentPk != nil {
+			parentID = ids[*m.ParentPk]
+		}
+		s = append(s, apiCategory(m, parentID))
 	}
+	return s
 }
 
 func apiItems(ms []*database.Item) []*Item {
@@ -69,14 +155,22 @@ func apiItems(ms []*database.Item) []*Item {
 	return s
 }
 
-func apiCartItem(m *database.CartItem_Item_Id_Row) *CartItem {
-	return &CartItem{
-		ItemID:   m.Item_Id,
-		Quantity: m.CartItem.Quantity,
+func apiCartItem(m orderLine) *CartItem {
+	unit := unitAmount(m.item, m.variant)
+	cartItem := &CartItem{
+		ItemID:    m.item.Id,
+		Quantity:  m.cartItem.Quantity,
+		UnitPrice: apiMoney(unit, m.item.Currency),
+		Price:     apiMoney(unit*m.cartItem.Quantity, m.item.Currency),
 	}
+	if m.variant != nil {
+		cartItem.VariantID = m.variant.Id
+		cartItem.SKU = m.variant.Sku
+	}
+	return cartItem
 }
 
-func apiCartItems(ms []*database.CartItem_Item_Id_Row) []*CartItem {
+func apiCartItems(ms []orderLine) []*CartItem {
 	s := make([]*CartItem, 0, len(ms))
 	for _, m := range ms {
 		s = append(s, apiCartItem(m))
@@ -84,19 +178,39 @@ func apiCartItems(ms []*database.CartItem_Item_Id_Row) []*CartItem {
 	return s
 }
 
-func apiOrderedItem(m *database.OrderedItem_Address_Id_Item_Id_Row) (
-	_ *OrderedItem) {
-	return &OrderedItem{
+func apiOrderedItem(m *database.OrderedItem_Item_Id_Row) (_ *OrderedItem) {
+	orderedItem := &OrderedItem{
 		ID:        m.OrderedItem.Id,
 		ItemID:    m.Item_Id,
-		AddressID: m.Address_Id,
+		VariantID: m.OrderedItem.VariantId,
+		SKU:       m.OrderedItem.Sku,
+		AddressID: m.OrderedItem.AddressId,
+		Address: &Address{
+			ID:      m.OrderedItem.AddressId,
+			Line1:   m.OrderedItem.AddressLine1,
+			Line2:   m.OrderedItem.AddressLine2,
+			Line3:   m.OrderedItem.AddressLine3,
+			Country: m.OrderedItem.AddressCountry,
+			State:   m.OrderedItem.AddressState,
+			City:    m.OrderedItem.AddressCity,
+			Zip:     m.OrderedItem.AddressZip,
+			Phone:   m.OrderedItem.AddressPhone,
+			Notes:   m.OrderedItem.AddressNotes,
+		},
+		Price:     apiMoney(m.OrderedItem.Price, m.OrderedItem.Currency),
 		Quantity:  m.OrderedItem.Quantity,
+		Coupon:    m.OrderedItem.Coupon,
 		Delivered: m.OrderedItem.Delivered,
 		Created:   UnixTS(m.OrderedItem.Created),
 	}
+	if m.OrderedItem.Discount > 0 {
+		orderedItem.Discount = apiMoney(m.OrderedItem.Discount,
+			m.OrderedItem.Currency)
+	}
+	return orderedItem
 }
 
-func apiOrderedItems(ms []*database.OrderedItem_Address_Id_Item_Id_Row) (
+func apiOrderedItems(ms []*database.OrderedItem_Item_Id_Row) (
 	_ []*OrderedItem) {
 	s := make([]*OrderedItem, 0, len(ms))
 	for _, m := range ms {
@@ -104,3 +218,321 @@ func apiOrderedItems(ms []*database.OrderedItem_Address_Id_Item_Id_Row) (
 	}
 	return s
 }
+
+// apiSubOrder translates a sub order. items is nil when they weren't read
+func apiSubOrder(m *database.SubOrder,
+	items []*database.OrderedItem_Item_Id_Row) *SubOrder {
+	subOrder := &SubOrder{
+		ID:        m.Id,
+		PaymentID: m.PaymentId,
+		SellerID:  m.SellerId,
+		Status:    m.Status,
+		Subtotal:  apiMoney(m.Subtotal, m.Currency),
+		Discount:  apiMoney(m.Discount, m.Currency),
+		Tax:       apiMoney(m.Tax, m.Currency),
+		Shipping:  apiMoney(m.Shipping, m.Currency),
+		Total:     apiMoney(m.Total, m.Currency),
+		Created:   UnixTS(m.Created),
+		Updated:   UnixTS(m.Updated),
+	}
+	if items != nil {
+		subOrder.Items = apiOrderedItems(items)
+	}
+	if m.Shipped != nil {
+		subOrder.Shipped = UnixTS(*m.Shipped)
+	}
+	if m.Delivered != nil {
+		subOrder.Delivered = UnixTS(*m.Delivered)
+	}
+	return subOrder
+}
+
+func apiSubOrders(ms []*database.SubOrder) []*SubOrder {
+	s := make([]*SubOrder, 0, len(ms))
+	for _, m := range ms {
+		s = append(s, apiSubOrder(m, nil))
+	}
+	return s
+}
+
+// apiShipment translates a shipment. items may include the items of other
+// shipments, which are left out
+func apiShipment(subOrderID string, m *database.Shipment,
+	items []*database.ShipmentItem_OrderedItem_Id_Row) *Shipment {
+	shipment := &Shipment{
+		ID:             m.Id,
+		SubOrderID:     subOrderID,
+		Carrier:        m.Carrier,
+		TrackingNumber: m.TrackingNumber,
+		Status:         m.Status,
+		Detail:         m.Detail,
+		Items:          []*ShipmentItem{},
+		Created:        UnixTS(m.Created),
+		Updated:        UnixTS(m.Updated),
+	}
+	for _, item := range items {
+		if item.ShipmentItem.ShipmentPk == m.Pk {
+			shipment.Items = append(shipment.Items, &ShipmentItem{
+				OrderedItemID: item.OrderedItem_Id,
+				Quantity:      item.ShipmentItem.Quantity,
+			})
+		}
+	}
+	if m.Shipped != nil {
+		shipment.Shipped = UnixTS(*m.Shipped)
+	}
+	if m.Delivered != nil {
+		shipment.Delivered = UnixTS(*m.Delivered)
+	}
+	if m.Tracked != nil {
+		shipment.Tracked = UnixTS(*m.Tracked)
+	}
+	return shipment
+}
+
+func apiPayment(m *database.Payment) (_ *Payment) {
+	return &Payment{
+		ID:       m.Id,
+		Amount:   apiMoney(m.Amount, m.Currency),
+		Refunded: apiMoney(m.Refunded, m.Currency),
+		Status:   m.Status,
+		Created:  UnixTS(m.Created),
+	}
+}
+
+func apiCoupon(m *database.Coupon) (_ *Coupon) {
+	coupon := &Coupon{
+		ID:             m.Id,
+		Code:           m.Code,
+		Kind:           m.Kind,
+		PercentOff:     m.PercentOff,
+		ItemID:         m.ItemId,
+		SellerID:       m.SellerId,
+		MaxUses:        m.MaxUses,
+		MaxUsesPerUser: m.MaxUsesPerUser,
+		Uses:           m.Uses,
+		Active:         m.Active,
+		Created:        UnixTS(m.Created),
+	}
+	if m.AmountOff > 0 {
+		coupon.AmountOff = apiMoney(m.AmountOff, m.Currency)
+	}
+	if m.MinSubtotal > 0 {
+		coupon.MinSubtotal = apiMoney(m.MinSubtotal, m.Currency)
+	}
+	if m.Starts != nil {
+		coupon.Starts = UnixTS(*m.Starts)
+	}
+	if m.Expires != nil {
+		coupon.Expires = UnixTS(*m.Expires)
+	}
+	return coupon
+}
+
+func apiCoupons(ms []*database.Coupon) (_ []*Coupon) {
+	s := make([]*Coupon, 0, len(ms))
+	for _, m := range ms {
+		s = append(s, apiCoupon(m))
+	}
+	return s
+}
+
+func apiReturn(m *database.ReturnRequest_OrderedItem_Item_Id_Row,
+	refunded int) (_ *Return) {
+	ret := &Return{
+		ID:            m.ReturnRequest.Id,
+		OrderedItemID: m.OrderedItem.Id,
+		ItemID:        m.Item_Id,
+		Quantity:      m.ReturnRequest.Quantity,
+		Reason:        m.ReturnRequest.Reason,
+		Status:        m.ReturnRequest.Status,
+		Response:      m.ReturnRequest.Response,
+		Created:       UnixTS(m.ReturnRequest.Created),
+	}
+	if refunded > 0 {
+		ret.Refund = apiMoney(refunded, m.OrderedItem.Currency)
+	}
+	if m.ReturnRequest.Resolved != nil {
+		ret.Resolved = UnixTS(*m.ReturnRequest.Resolved)
+	}
+	return ret
+}
+
+func apiReview(itemID string, m *database.Review) *Review {
+	review := &Review{
+		ID:      m.Id,
+		ItemID:  itemID,
+		Rating:  m.Rating,
+		Body:    m.Body,
+		Reply:   m.Reply,
+		Created: UnixTS(m.Created),
+	}
+	if m.Edited != nil {
+		review.Edited = UnixTS(*m.Edited)
+	}
+	if m.Replied != nil {
+		review.Replied = UnixTS(*m.Replied)
+	}
+	return review
+}
+
+func apiReviews(itemID string, ms []*database.Review) []*Review {
+	s := make([]*Review, 0, len(ms))
+	for _, m := range ms {
+		s = append(s, apiReview(itemID, m))
+	}
+	return s
+}
+
+func apiSeller(m *database.User, items []*database.Item) *Seller {
+	return &Seller{
+		ID:         m.Id,
+		Name:       m.FullName,
+		ProfileURL: m.ProfileUrl,
+		Joined:     UnixTS(m.Created),
+		Items:      apiItems(items),
+	}
+}
+
+func apiSubscription(itemID string,
+	m *database.StockSubscription) *Subscription {
+	subscription := &Subscription{
+		ID:      m.Id,
+		ItemID:  itemID,
+		Status:  m.Status,
+		Created: UnixTS(m.Created),
+	}
+	if m.Sent != nil {
+		subscription.Sent = UnixTS(*m.Sent)
+	}
+	return subscription
+}
+
+func (s *Server) apiWishlist(m *database.Wishlist,
+	items []*database.WishlistItem_Variant_Item_Row) *Wishlist {
+	wishlist := &Wishlist{
+		ID:            m.Id,
+		Name:          m.Name,
+		Public:        m.Public,
+		SavedForLater: m.Kind == wishlistSaved,
+		Items:         make([]*WishlistItem, 0, len(items)),
+		Created:       UnixTS(m.Created),
+	}
+	if m.Public {
+		wishlist.ShareURL = s.wishlistURL(m.ShareToken)
+	}
+	for _, item := range items {
+		wishlist.Items = append(wishlist.Items, &WishlistItem{
+			ID:        item.WishlistItem.Id,
+			ItemID:    item.Item.Id,
+			VariantID: item.Variant.Id,
+			SKU:       item.Variant.Sku,
+			Title:     item.Item.Title,
+			Quantity:  item.WishlistItem.Quantity,
+			UnitPrice: apiMoney(unitAmount(&item.Item, &item.Variant),
+				item.Item.Currency),
+			Available: item.Variant.RemainingQuantity >= item.WishlistItem.Quantity,
+			Created:   UnixTS(item.WishlistItem.Created),
+		})
+	}
+	return wishlist
+}
+
+func apiMoney(amount int, currency string) *Money {
+	m, err := money.New(amount, currency)
+	if err != nil {
+		// the currency was valid when it was stored, so this is only a currency
+		// that has since been removed. it can still be shown, just not nicely
+		m = money.Money{Amount: amount, Currency: money.Currency{Code: currency}}
+	}
+	return &Money{
+		Amount:    m.Amount,
+		Currency:  m.Currency.Code,
+		Formatted: m.String(),
+	}
+}
+
+func apiPrice(m money.Money) *Money {
+	return apiMoney(m.Amount, m.Currency.Code)
+}
+
+func apiInventoryUpdate(m *database.Item) *InventoryUpdate {
+	return &InventoryUpdate{
+		ItemID:            m.Id,
+		RemainingQuantity: m.RemainingQuantity,
+		Price:             apiMoney(m.Price, m.Currency),
+		Version:           m.Version,
+	}
+}
+
+func apiEvent(m *database.Event) *Event {
+	return &Event{
+		ID:        m.Id,
+		Kind:      m.Kind,
+		SubjectID: m.SubjectId,
+		Data:      json.RawMessage(m.Payload),
+		Created:   UnixTS(m.Created),
+	}
+}
+
+func apiWebhook(m *database.Webhook) *Webhook {
+	webhook := &Webhook{
+		ID:       m.Id,
+		URL:      m.Url,
+		Events:   strings.Split(m.Events, ","),
+		Active:   m.Active,
+		Failures: m.Failures,
+		Created:  UnixTS(m.Created),
+		Updated:  UnixTS(m.Updated),
+	}
+	if m.Disabled != nil {
+		webhook.Disabled = UnixTS(*m.Disabled)
+	}
+	return webhook
+}
+
+func apiWebhooks(ms []*database.Webhook) []*Webhook {
+	webhooks := make([]*Webhook, 0, len(ms))
+	for _, m := range ms {
+		webhooks = append(webhooks, apiWebhook(m))
+	}
+	return webhooks
+}
+
+func apiJob(m *database.Job) *Job {
+	job := &Job{
+		ID:          m.Id,
+		Kind:        m.Kind,
+		Data:        json.RawMessage(m.Payload),
+		Status:      m.Status,
+		Attempts:    m.Attempts,
+		MaxAttempts: m.MaxAttempts,
+		LastError:   m.LastError,
+		Created:     UnixTS(m.Created),
+		RunAt:       UnixTS(m.RunAt),
+	}
+	if m.Finished != nil {
+		job.Finished = UnixTS(*m.Finished)
+	}
+	return job
+}
+
+func apiDelivery(m *database.WebhookDelivery) *Delivery {
+	delivery := &Delivery{
+		ID:           m.Id,
+		EventID:      m.EventId,
+		EventKind:    m.EventKind,
+		Status:       m.Status,
+		Attempts:     m.Attempts,
+		ResponseCode: m.ResponseCode,
+		LastError:    m.LastError,
+		Created:      UnixTS(m.Created),
+	}
+	if m.Status == deliveryPending {
+		delivery.NextAttempt = UnixTS(m.NextAttempt)
+	}
+	if m.Delivered != nil {
+		delivery.Delivered = UnixTS(*m.Delivered)
+	}
+	return delivery
+}
@@ -1,24 +1,56 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"time"
 )
 
 type RootJSON struct {
-	User         *User          `json:"user,omitempty"`
-	Session      *Session       `json:"session,omitempty"`
-	Sessions     []*Session     `json:"sessions,omitempty"`
-	Address      *Address       `json:"address,omitempty"`
-	Addresses    []*Address     `json:"addresses,omitempty"`
-	Item         *Item          `json:"item,omitempty"`
-	Items        []*Item        `json:"items,omitempty"`
-	CartItem     *CartItem      `json:"cart_item,omitempty"`
-	CartItems    []*CartItem    `json:"cart_items,omitempty"`
-	OrderedItem  *OrderedItem   `json:"ordered_item,omitempty"`
-	OrderedItems []*OrderedItem `json:"ordered_items,omitempty"`
-	Response     string         `json:"response,omitempty"`
+	User          *User           `json:"user,omitempty"`
+	Session       *Session        `json:"session,omitempty"`
+	Sessions      []*Session      `json:"sessions,omitempty"`
+	Address       *Address        `json:"address,omitempty"`
+	Addresses     []*Address      `json:"addresses,omitempty"`
+	Item          *Item           `json:"item,omitempty"`
+	Items         []*Item         `json:"items,omitempty"`
+	Image         *Image          `json:"image,omitempty"`
+	Images        []*Image        `json:"images,omitempty"`
+	Variant       *Variant        `json:"variant,omitempty"`
+	Variants      []*Variant      `json:"variants,omitempty"`
+	Category      *Category       `json:"category,omitempty"`
+	Categories    []*Category     `json:"categories,omitempty"`
+	CartItem      *CartItem       `json:"cart_item,omitempty"`
+	CartItems     []*CartItem     `json:"cart_items,omitempty"`
+	CartSummary   *CartSummary    `json:"cart_summary,omitempty"`
+	OrderedItem   *OrderedItem    `json:"ordered_item,omitempty"`
+	OrderedItems  []*OrderedItem  `json:"ordered_items,omitempty"`
+	Payment       *Payment        `json:"payment,omitempty"`
+	SubOrder      *SubOrder       `json:"sub_order,omitempty"`
+	SubOrders     []*SubOrder     `json:"sub_orders,omitempty"`
+	Shipment      *Shipment       `json:"shipment,omitempty"`
+	Shipments     []*Shipment     `json:"shipments,omitempty"`
+	Coupon        *Coupon         `json:"coupon,omitempty"`
+	Coupons       []*Coupon       `json:"coupons,omitempty"`
+	Import        *ImportResult   `json:"import,omitempty"`
+	Return        *Return         `json:"return,omitempty"`
+	Review        *Review         `json:"review,omitempty"`
+	Reviews       []*Review       `json:"reviews,omitempty"`
+	Seller        *Seller         `json:"seller,omitempty"`
+	Dashboard     *Dashboard      `json:"dashboard,omitempty"`
+	Subscription  *Subscription   `json:"subscription,omitempty"`
+	Subscriptions []*Subscription `json:"subscriptions,omitempty"`
+	Wishlist      *Wishlist       `json:"wishlist,omitempty"`
+	Wishlists     []*Wishlist     `json:"wishlists,omitempty"`
+	Webhook       *Webhook        `json:"webhook,omitempty"`
+	Webhooks      []*Webhook      `json:"webhooks,omitempty"`
+	Deliveries    []*Delivery     `json:"deliveries,omitempty"`
+	Delivery      *Delivery       `json:"delivery,omitempty"`
+	Job           *Job            `json:"job,omitempty"`
+	Jobs          []*Job          `json:"jobs,omitempty"`
+	Returns       []*Return       `json:"returns,omitempty"`
+	Response      string          `json:"response,omitempty"`
 }
 
 type User struct {
@@ -45,33 +77,395 @@ type Address struct {
 	Zip     string `json:"zip"`
 	Phone   string `json:"phone"`
 	Notes   string `json:"notes"`
+	Version int    `json:"version"`
+	Default bool   `json:"default"`
 }
 
 type Item struct {
-	ID                string   `json:"id"`
-	Created           UnixTime `json:"created"`
-	Price             int      `json:"price"`
-	RemainingQuantity int      `json:"remaining_quantity"`
-	Description       string   `json:"description"`
-	ImageURL          string   `json:"image_url"`
+	ID                string                 `json:"id"`
+	Created           UnixTime               `json:"created"`
+	Title             string                 `json:"title"`
+	Price             *Money                 `json:"price"`
+	RemainingQuantity int                    `json:"remaining_quantity"`
+	Description       string                 `json:"description"`
+	ImageURL          string                 `json:"image_url"`
+	CategoryID        string                 `json:"category_id,omitempty"`
+	Tags              []string               `json:"tags"`
+	Attributes        map[string]interface{} `json:"attributes"`
+	Images            []*Image               `json:"images,omitempty"`
+	Variants          []*Variant             `json:"variants,omitempty"`
+	Rating            float64                `json:"rating"`
+	ReviewCount       int                    `json:"review_count"`
+	Version           int                    `json:"version"`
+}
+
+// Image is an image uploaded for an item. images are shown in order of
+// Position, from 0
+type Image struct {
+	ID           string   `json:"id"`
+	ItemID       string   `json:"item_id"`
+	URL          string   `json:"url"`
+	ThumbnailURL string   `json:"thumbnail_url"`
+	ContentType  string   `json:"content_type"`
+	Size         int      `json:"size"`
+	Width        int      `json:"width"`
+	Height       int      `json:"height"`
+	Position     int      `json:"position"`
+	Created      UnixTime `json:"created"`
+}
+
+// Variant is one version of an item, like a size, with its own stock. Price
+// is the item's price unless the variant overrides it
+type Variant struct {
+	ID                string                 `json:"id"`
+	ItemID            string                 `json:"item_id"`
+	SKU               string                 `json:"sku"`
+	Price             *Money                 `json:"price,omitempty"`
+	RemainingQuantity int                    `json:"remaining_quantity"`
+	Attributes        map[string]interface{} `json:"attributes"`
+	Created           UnixTime               `json:"created"`
+}
+
+// CatalogRow is one variant of a seller's catalog, as exported and imported.
+// rows are matched to the seller's variants by SKU. on import, a field that is
+// absent or empty leaves what's stored alone
+type CatalogRow struct {
+	SKU               string                 `json:"sku"`
+	ItemID            string                 `json:"item_id,omitempty"`
+	VariantID         string                 `json:"variant_id,omitempty"`
+	Title             *string                `json:"title,omitempty"`
+	Description       *string                `json:"description,omitempty"`
+	ImageURL          *string                `json:"image_url,omitempty"`
+	Price             *Money                 `json:"price,omitempty"`
+	VariantPrice      *Money                 `json:"variant_price,omitempty"`
+	RemainingQuantity *int                   `json:"remaining_quantity,omitempty"`
+	CategoryID        *string                `json:"category_id,omitempty"`
+	Tags              []string               `json:"tags,omitempty"`
+	Attributes        map[string]interface{} `json:"attributes,omitempty"`
+	VariantAttributes map[string]interface{} `json:"variant_attributes,omitempty"`
+}
+
+// ImportResult is what an import did, or would have done for a dry run. an
+// import is only applied when none of its rows have errors
+type ImportResult struct {
+	DryRun  bool           `json:"dry_run"`
+	Applied bool           `json:"applied"`
+	Rows    int            `json:"rows"`
+	Created int            `json:"created"`
+	Updated int            `json:"updated"`
+	Errors  []*ImportError `json:"errors"`
+}
+
+// ImportError is why a row couldn't be imported. rows are counted from 1,
+// not counting a CSV header or blank lines
+type ImportError struct {
+	Row   int    `json:"row"`
+	SKU   string `json:"sku,omitempty"`
+	Error string `json:"error"`
+}
+
+type Category struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	ParentID string   `json:"parent_id,omitempty"`
+	Created  UnixTime `json:"created"`
+}
+
+// Money is an amount in the minor units of an ISO 4217 currency, like cents.
+// Formatted is only ever set in responses
+type Money struct {
+	Amount    int    `json:"amount"`
+	Currency  string `json:"currency"`
+	Formatted string `json:"formatted,omitempty"`
 }
 
 type CartItem struct {
-	ItemID   string `json:"item_id"`
-	Quantity int    `json:"quantity"`
+	ItemID    string `json:"item_id"`
+	VariantID string `json:"variant_id,omitempty"`
+	SKU       string `json:"sku,omitempty"`
+	Quantity  int    `json:"quantity"`
+	UnitPrice *Money `json:"unit_price,omitempty"`
+	Price     *Money `json:"price,omitempty"`
 }
 
-type OrderedItem struct {
+// Wishlist is a user's named list of items. a public list can be seen by
+// anyone with its share_url. the one list that is saved_for_later holds what
+// the user moved out of their cart
+type Wishlist struct {
+	ID            string          `json:"id"`
+	Name          string          `json:"name"`
+	Public        bool            `json:"public"`
+	SavedForLater bool            `json:"saved_for_later"`
+	ShareURL      string          `json:"share_url,omitempty"`
+	Items         []*WishlistItem `json:"items"`
+	Created       UnixTime        `json:"created"`
+}
+
+// WishlistItem is a variant on a wishlist. Available is whether Quantity of it
+// can be added to the cart
+type WishlistItem struct {
 	ID        string   `json:"id"`
 	ItemID    string   `json:"item_id"`
-	AddressID string   `json:"address_id"`
+	VariantID string   `json:"variant_id,omitempty"`
+	SKU       string   `json:"sku,omitempty"`
+	Title     string   `json:"title"`
 	Quantity  int      `json:"quantity"`
-	Delivered bool     `json:"delivered"`
+	UnitPrice *Money   `json:"unit_price,omitempty"`
+	Available bool     `json:"available"`
 	Created   UnixTime `json:"created"`
 }
 
+// CartSummary is what the cart would cost to order to the address. Tax,
+// Shipping and Total are only set when there's an address that can be
+// shipped to
+type CartSummary struct {
+	AddressID     string `json:"address_id,omitempty"`
+	Coupon        string `json:"coupon,omitempty"`
+	Subtotal      *Money `json:"subtotal"`
+	Discount      *Money `json:"discount,omitempty"`
+	Tax           *Money `json:"tax,omitempty"`
+	Shipping      *Money `json:"shipping,omitempty"`
+	Total         *Money `json:"total,omitempty"`
+	ShippingError string `json:"shipping_error,omitempty"`
+	CouponError   string `json:"coupon_error,omitempty"`
+}
+
+type OrderedItem struct {
+	ID        string    `json:"id"`
+	ItemID    string    `json:"item_id"`
+	VariantID string    `json:"variant_id,omitempty"`
+	SKU       string    `json:"sku,omitempty"`
+	AddressID string    `json:"address_id"`
+	Address   *Address  `json:"address,omitempty"`
+	Price     *Money    `json:"price,omitempty"`
+	Discount  *Money    `json:"discount,omitempty"`
+	Coupon    string    `json:"coupon,omitempty"`
+	Quantity  int       `json:"quantity"`
+	Delivered bool      `json:"delivered"`
+	Returns   []*Return `json:"returns,omitempty"`
+	Created   UnixTime  `json:"created"`
+}
+
+// SubOrder is the part of an order sold by one seller. its totals are its
+// share of the order's payment. Status is placed, processing, shipped or
+// delivered
+type SubOrder struct {
+	ID        string         `json:"id"`
+	PaymentID string         `json:"payment_id"`
+	SellerID  string         `json:"seller_id,omitempty"`
+	Status    string         `json:"status"`
+	Subtotal  *Money         `json:"subtotal"`
+	Discount  *Money         `json:"discount"`
+	Tax       *Money         `json:"tax"`
+	Shipping  *Money         `json:"shipping"`
+	Total     *Money         `json:"total"`
+	Items     []*OrderedItem `json:"items,omitempty"`
+	Created   UnixTime       `json:"created"`
+	Updated   UnixTime       `json:"updated"`
+	Shipped   UnixTime       `json:"shipped"`
+	Delivered UnixTime       `json:"delivered"`
+}
+
+// Shipment is a package sent for a sub order. Status is pending, in_transit,
+// delivered or exception, and Detail is what the carrier last said about it
+type Shipment struct {
+	ID             string          `json:"id"`
+	SubOrderID     string          `json:"sub_order_id"`
+	Carrier        string          `json:"carrier"`
+	TrackingNumber string          `json:"tracking_number"`
+	Status         string          `json:"status"`
+	Detail         string          `json:"detail,omitempty"`
+	Items          []*ShipmentItem `json:"items"`
+	Created        UnixTime        `json:"created"`
+	Updated        UnixTime        `json:"updated"`
+	Shipped        UnixTime        `json:"shipped"`
+	Delivered      UnixTime        `json:"delivered"`
+	Tracked        UnixTime        `json:"tracked"`
+}
+
+// ShipmentItem is how much of an ordered item is in a shipment
+type ShipmentItem struct {
+	OrderedItemID string `json:"ordered_item_id"`
+	Quantity      int    `json:"quantity"`
+}
+
+// InventoryUpdate is sent over the inventory feed with an item's remaining
+// quantity and price. an update with a Version no later than one already
+// sent for the item is never sent after it
+type InventoryUpdate struct {
+	ItemID            string `json:"item_id"`
+	RemainingQuantity int    `json:"remaining_quantity"`
+	Price             *Money `json:"price"`
+	Version           int    `json:"version"`
+}
+
+// InventorySubscription is sent over the inventory feed to change which
+// items it sends updates of
+type InventorySubscription struct {
+	Subscribe   []string `json:"subscribe"`
+	Unsubscribe []string `json:"unsubscribe"`
+}
+
+// Event is something that happened, as it's POSTed to webhooks. Data is
+// what it's about, which depends on its Kind
+type Event struct {
+	ID        string          `json:"id"`
+	Kind      string          `json:"kind"`
+	SubjectID string          `json:"subject_id"`
+	Data      json.RawMessage `json:"data"`
+	Created   UnixTime        `json:"created"`
+}
+
+// Webhook is a URL that events of its kinds are POSTed to. its Secret is only
+// shown when it's added, or when it's changed
+type Webhook struct {
+	ID       string   `json:"id"`
+	URL      string   `json:"url"`
+	Secret   string   `json:"secret,omitempty"`
+	Events   []string `json:"events"`
+	Active   bool     `json:"active"`
+	Failures int      `json:"failures"`
+	Created  UnixTime `json:"created"`
+	Updated  UnixTime `json:"updated"`
+	Disabled UnixTime `json:"disabled"`
+}
+
+// Delivery is an event being POSTed to a webhook. Status is pending until it's
+// delivered, or failed once it's run out of attempts. ResponseCode is from
+// the last attempt, and 0 when there was no response
+type Delivery struct {
+	ID           string   `json:"id"`
+	EventID      string   `json:"event_id"`
+	EventKind    string   `json:"event_kind"`
+	Status       string   `json:"status"`
+	Attempts     int      `json:"attempts"`
+	ResponseCode int      `json:"response_code"`
+	LastError    string   `json:"last_error,omitempty"`
+	Created      UnixTime `json:"created"`
+	NextAttempt  UnixTime `json:"next_attempt"`
+	Delivered    UnixTime `json:"delivered"`
+}
+
+// Job is deferred work of a Kind, with Data depending on it. a failed job is
+// retried with a backoff until it's out of attempts, when it's dead
+type Job struct {
+	ID          string          `json:"id"`
+	Kind        string          `json:"kind"`
+	Data        json.RawMessage `json:"data"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	Created     UnixTime        `json:"created"`
+	RunAt       UnixTime        `json:"run_at"`
+	Finished    UnixTime        `json:"finished"`
+}
+
+type Return struct {
+	ID            string   `json:"id"`
+	OrderedItemID string   `json:"ordered_item_id"`
+	ItemID        string   `json:"item_id"`
+	Quantity      int      `json:"quantity"`
+	Reason        string   `json:"reason"`
+	Status        string   `json:"status"`
+	Response      string   `json:"response,omitempty"`
+	Refund        *Money   `json:"refund,omitempty"`
+	Created       UnixTime `json:"created"`
+	Resolved      UnixTime `json:"resolved"`
+}
+
+// Review is a user's rating of an item they ordered, from 1 to 5 stars, and
+// the seller's reply to it
+type Review struct {
+	ID      string   `json:"id"`
+	ItemID  string   `json:"item_id"`
+	Rating  int      `json:"rating"`
+	Body    string   `json:"body"`
+	Reply   string   `json:"reply,omitempty"`
+	Created UnixTime `json:"created"`
+	Edited  UnixTime `json:"edited"`
+	Replied UnixTime `json:"replied"`
+}
+
+// Seller is a user's public profile, with the items they have available
+type Seller struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	ProfileURL string   `json:"profile_url,omitempty"`
+	Joined     UnixTime `json:"joined"`
+	Items      []*Item  `json:"items"`
+}
+
+// Dashboard is a summary of a seller's sales. LowStock is the items with at
+// most LowStockThreshold remaining
+type Dashboard struct {
+	Orders            int              `json:"orders"`
+	UnitsSold         int              `json:"units_sold"`
+	Revenue           []*Money         `json:"revenue"`
+	Items             []*DashboardItem `json:"items"`
+	LowStock          []*DashboardItem `json:"low_stock"`
+	LowStockThreshold int              `json:"low_stock_threshold"`
+}
+
+// DashboardItem is the sales of one of a seller's items. its Revenue has an
+// amount for each currency it was sold in
+type DashboardItem struct {
+	ItemID            string   `json:"item_id"`
+	Title             string   `json:"title"`
+	RemainingQuantity int      `json:"remaining_quantity"`
+	UnitsSold         int      `json:"units_sold"`
+	Revenue           []*Money `json:"revenue"`
+}
+
+// Subscription is a user waiting for an item to be back in stock. its Status
+// is waiting, queued to be notified, sent, or failed
+type Subscription struct {
+	ID      string   `json:"id"`
+	ItemID  string   `json:"item_id"`
+	Status  string   `json:"status"`
+	Created UnixTime `json:"created"`
+	Sent    UnixTime `json:"sent"`
+}
+
+type ResolveReturn struct {
+	Status   string `json:"status"`
+	Response string `json:"response"`
+	Refund   *Money `json:"refund,omitempty"`
+}
+
+type Payment struct {
+	ID       string   `json:"id"`
+	Amount   *Money   `json:"amount"`
+	Refunded *Money   `json:"refunded"`
+	Status   string   `json:"status"`
+	Created  UnixTime `json:"created"`
+}
+
+type Coupon struct {
+	ID             string   `json:"id"`
+	Code           string   `json:"code"`
+	Kind           string   `json:"kind"`
+	PercentOff     int      `json:"percent_off,omitempty"`
+	AmountOff      *Money   `json:"amount_off,omitempty"`
+	MinSubtotal    *Money   `json:"min_subtotal,omitempty"`
+	ItemID         string   `json:"item_id,omitempty"`
+	SellerID       string   `json:"seller_id,omitempty"`
+	MaxUses        int      `json:"max_uses"`
+	MaxUsesPerUser int      `json:"max_uses_per_user"`
+	Uses           int      `json:"uses"`
+	Active         bool     `json:"active"`
+	Starts         UnixTime `json:"starts"`
+	Expires        UnixTime `json:"expires"`
+	Created        UnixTime `json:"created"`
+}
+
+type ApplyCoupon struct {
+	Code string `json:"code"`
+}
+
 type PlaceOrder struct {
-	Orders []OrderedItem `json:"ordered_items"`
+	Orders        []OrderedItem `json:"ordered_items"`
+	ExpectedTotal *Money        `json:"expected_total,omitempty"`
 }
 
 type UnixTime struct {
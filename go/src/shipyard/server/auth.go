@@ -32,6 +32,15 @@ func GetCtxSession(ctx context.Context) (*database.Session, error) {
 	return ss, nil
 }
 
+// sessionUserPk is the pk of the session's user. the column is nullable, so a
+// session left without its user can't act as anyone
+func sessionUserPk(ss *database.Session) (int64, error) {
+	if ss.UserPk == nil {
+		return 0, he.Unauthorized.New("session has no user")
+	}
+	return *ss.UserPk, nil
+}
+
 func (s *Server) Unauthenticated(h handler.Handler) handler.Handler {
 	return handler.Handler(func(ctx context.Context, w http.ResponseWriter,
 		r *http.Request) (interface{}, error) {
@@ -117,3 +126,36 @@ func (s *Server) Authenticated(h handler.Handler) handler.Handler {
 		return h(ctx, w, r)
 	})
 }
+
+// Admin only allows users whose email is one of the configured admin_emails.
+// it must be used after Authenticated
+func (s *Server) Admin(h handler.Handler) handler.Handler {
+	return handler.Handler(func(ctx context.Context, w http.ResponseWriter,
+		r *http.Request) (interface{}, error) {
+
+		ss, err := GetCtxSession(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		user, err := s.DB.Find_User_By_Session_Id(ctx, database.Session_Id(ss.Id))
+		if err != nil {
+			return nil, he.Unexpected.Wrap(err)
+		}
+
+		if user == nil || !s.isAdmin(user.Email) {
+			return nil, he.Unauthorized.New("only admins can do that")
+		}
+
+		return h(ctx, w, r)
+	})
+}
+
+func (s *Server) isAdmin(email string) bool {
+	for _, admin := range s.Config.AdminEmails {
+		if strings.EqualFold(admin, email) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,481 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/util"
+)
+
+const (
+	maxTags          = 32
+	maxTagLength     = 64
+	maxAttributes    = 32
+	maxAttributeName = 64
+)
+
+// ListCategory will return every category. they form a tree through their
+// parent_id
+func (s *Server) ListCategory(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	categories, err := s.DB.All_Category_OrderBy_Asc_Name(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &RootJSON{
+		Categories: apiCategories(categories),
+	}
+
+	return resp, nil
+}
+
+// GetCategory returns a single category
+func (s *Server) GetCategory(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	var category *Category
+	err := s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		dbCategory, err := findCategory(ctx, tx, chi.URLParam(r, "categoryID"))
+		if err != nil {
+			return err
+		}
+
+		category, err = categoryWithParent(ctx, tx, dbCategory)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &RootJSON{
+		Category: category,
+	}
+
+	return resp, nil
+}
+
+// AddCategory will add a category, under parent_id if it's set. admins only
+func (s *Server) AddCategory(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	category := Category{}
+	err := json.NewDecoder(r.Body).Decode(&category)
+	if err != nil {
+		return nil, he.BadRequest.Wrap(err)
+	}
+
+	category.Name = strings.TrimSpace(category.Name)
+	if category.Name == "" {
+		return nil, he.BadRequest.New("a category needs a name")
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		optional := database.Category_Create_Fields{}
+		if category.ParentID != "" {
+			parent, err := findCategory(ctx, tx, category.ParentID)
+			if he.NotFound.Has(err) {
+				return he.BadRequest.New("parent category %s not found",
+					category.ParentID)
+			}
+			if err != nil {
+				return err
+			}
+			optional.ParentPk = database.Category_ParentPk(parent.Pk)
+		}
+
+		dbCategory, err := tx.Create_Category(ctx,
+			database.Category_Id(util.MustUUID4()),
+			database.Category_Name(category.Name),
+			optional)
+		if err != nil {
+			return err
+		}
+
+		err = linkCategories(ctx, tx, dbCategory.Pk)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Category: apiCategory(dbCategory, category.ParentID)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// PatchCategory will rename a category or move it, along with everything
+// under it, using JSON Merge Patch. a null parent_id moves it to the top.
+// admins only
+func (s *Server) PatchCategory(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	patch, err := decodeMergePatch(r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = patch.only("name", "parent_id")
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		category, err := findCategory(ctx, tx, chi.URLParam(r, "categoryID"))
+		if err != nil {
+			return err
+		}
+
+		ups := database.Category_Update_Fields{}
+		if name, ok, err := patch.string("name"); err != nil {
+			return err
+		} else if ok {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				return he.BadRequest.New("a category needs a name")
+			}
+			ups.Name = database.Category_Name(name)
+		}
+
+		parentID, moved, err := patch.string("parent_id")
+		if err != nil {
+			return err
+		}
+		if moved {
+			ups.ParentPk = database.Category_ParentPk_Null()
+			if parentID != "" {
+				parent, err := findCategory(ctx, tx, parentID)
+				if he.NotFound.Has(err) {
+					return he.BadRequest.New("parent category %s not found",
+						parentID)
+				}
+				if err != nil {
+					return err
+				}
+
+				below, err := tx.Has_CategoryAncestor_By_AncestorPk_And_DescendantPk(
+					ctx, database.CategoryAncestor_AncestorPk(category.Pk),
+					database.CategoryAncestor_DescendantPk(parent.Pk))
+				if err != nil {
+					return err
+				}
+
+				if below {
+					return he.BadRequest.New("a category can't be moved under " +
+						"itself")
+				}
+				ups.ParentPk = database.Category_ParentPk(parent.Pk)
+			}
+		}
+
+		category, err = tx.Update_Category_By_Pk(ctx,
+			database.Category_Pk(category.Pk), ups)
+		if err != nil {
+			return err
+		}
+
+		if moved {
+			// everything under the category has new ancestors too
+			descendants, err := tx.All_CategoryAncestor_By_AncestorPk(ctx,
+				database.CategoryAncestor_AncestorPk(category.Pk))
+			if err != nil {
+				return err
+			}
+
+			pks := make([]int64, 0, len(descendants))
+			for _, descendant := range descendants {
+				pks = append(pks, descendant.DescendantPk)
+			}
+
+			err = linkCategories(ctx, tx, pks...)
+			if err != nil {
+				return err
+			}
+		}
+
+		apiCategory, err := categoryWithParent(ctx, tx, category)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Category: apiCategory}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// DeleteCategory will remove a category. categories with subcategories or
+// items can't be removed until they're moved elsewhere. admins only
+func (s *Server) DeleteCategory(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	err := s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		category, err := findCategory(ctx, tx, chi.URLParam(r, "categoryID"))
+		if err != nil {
+			return err
+		}
+
+		children, err := tx.Has_Category_By_ParentPk(ctx,
+			database.Category_ParentPk(category.Pk))
+		if err != nil {
+			return err
+		}
+
+		if children {
+			return he.Conflict.New("category has subcategories")
+		}
+
+		items, err := tx.Has_Item_By_CategoryId(ctx,
+			database.Item_CategoryId(category.Id))
+		if err != nil {
+			return err
+		}
+
+		if items {
+			return he.Conflict.New("category has items")
+		}
+
+		_, err = tx.Delete_Category_By_Pk(ctx, database.Category_Pk(category.Pk))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ListCategoryItem will return the items in a category and its
+// subcategories, newest first, a page at a time like ListItem
+func (s *Server) ListCategoryItem(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	p, err := parsePage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []*database.Item
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		category, err := findCategory(ctx, tx, chi.URLParam(r, "categoryID"))
+		if err != nil {
+			return err
+		}
+
+		items, err = tx.Limited_Item_By_AncestorPk(ctx,
+			database.CategoryAncestor_AncestorPk(category.Pk), p.limit, p.offset)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	etag := itemsETag(items)
+	setETag(w, etag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		return nil, he.NotModified.New("items")
+	}
+
+	resp := &RootJSON{
+		Items: apiItems(items),
+	}
+
+	return resp, nil
+}
+
+func findCategory(ctx context.Context, tx *database.Tx,
+	categoryID string) (*database.Category, error) {
+	category, err := tx.Find_Category_By_Id(ctx, database.Category_Id(categoryID))
+	if err != nil {
+		return nil, err
+	}
+
+	if category == nil {
+		return nil, he.NotFound.New("category not found")
+	}
+	return category, nil
+}
+
+func categoryWithParent(ctx context.Context, tx *database.Tx,
+	category *database.Category) (*Category, error) {
+	if category.ParentPk == nil {
+		return apiCategory(category, ""), nil
+	}
+
+	parent, err := tx.Get_Category_By_Pk(ctx,
+		database.Category_Pk(*category.ParentPk))
+	if err != nil {
+		return nil, err
+	}
+	return apiCategory(category, parent.Id), nil
+}
+
+// linkCategories records the ancestors of each category, which must already
+// be under their new parents
+func linkCategories(ctx context.Context, tx *database.Tx,
+	categoryPks ...int64) error {
+
+	// every category is read to walk up the tree, since there are few enough
+	// of them
+	categories, err := tx.All_Category_OrderBy_Asc_Name(ctx)
+	if err != nil {
+		return err
+	}
+
+	parents := make(map[int64]*int64, len(categories))
+	for _, category := range categories {
+		parents[category.Pk] = category.ParentPk
+	}
+
+	for _, pk := range categoryPks {
+		_, err = tx.Delete_CategoryAncestor_By_DescendantPk(ctx,
+			database.CategoryAncestor_DescendantPk(pk))
+		if err != nil {
+			return err
+		}
+
+		for ancestor := &pk; ancestor != nil; ancestor = parents[*ancestor] {
+			err = tx.CreateNoReturn_CategoryAncestor(ctx,
+				database.CategoryAncestor_AncestorPk(*ancestor),
+				database.CategoryAncestor_DescendantPk(pk))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkCategory ensures an item's category exists. an empty id is no category
+func checkCategory(ctx context.Context, tx *database.Tx,
+	categoryID string) error {
+	if categoryID == "" {
+		return nil
+	}
+
+	category, err := tx.Find_Category_By_Id(ctx, database.Category_Id(categoryID))
+	if err != nil {
+		return err
+	}
+
+	if category == nil {
+		return he.BadRequest.New("category %s not found", categoryID)
+	}
+	return nil
+}
+
+// encodeTags cleans up tags for storing. they're lowercased, and repeats are
+// dropped
+func encodeTags(tags []string) (string, error) {
+	if len(tags) > maxTags {
+		return "", he.BadRequest.New("an item can have at most %d tags", maxTags)
+	}
+
+	cleaned := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+
+		if len(tag) > maxTagLength {
+			return "", he.BadRequest.New("tags can be at most %d characters",
+				maxTagLength)
+		}
+		seen[tag] = true
+		cleaned = append(cleaned, tag)
+	}
+
+	encoded, err := json.Marshal(cleaned)
+	if err != nil {
+		return "", he.Unexpected.Wrap(err)
+	}
+	return string(encoded), nil
+}
+
+// encodeAttributes checks that every attribute is a string, number or bool
+// before storing them
+func encodeAttributes(attributes map[string]interface{}) (string, error) {
+	if len(attributes) > maxAttributes {
+		return "", he.BadRequest.New("an item can have at most %d attributes",
+			maxAttributes)
+	}
+
+	for name, value := range attributes {
+		if strings.TrimSpace(name) == "" || len(name) > maxAttributeName {
+			return "", he.BadRequest.New("attribute names must be from 1 to %d "+
+				"characters", maxAttributeName)
+		}
+
+		switch value.(type) {
+		case string, float64, bool:
+		default:
+			return "", he.BadRequest.New("attribute %s must be a string, number "+
+				"or bool", name)
+		}
+	}
+
+	if attributes == nil {
+		attributes = map[string]interface{}{}
+	}
+
+	encoded, err := json.Marshal(attributes)
+	if err != nil {
+		return "", he.Unexpected.Wrap(err)
+	}
+	return string(encoded), nil
+}
+
+// mergeAttributes applies a merge patch to the encoded attributes, so a null
+// attribute is removed and the rest are left as they are. a nil patch, from a
+// null attributes, clears them all
+func mergeAttributes(encoded string, patch map[string]interface{}) (
+	string, error) {
+	attributes := map[string]interface{}{}
+	if patch != nil {
+		attributes = decodeAttributes(encoded)
+	}
+	for name, value := range patch {
+		if value == nil {
+			delete(attributes, name)
+		} else {
+			attributes[name] = value
+		}
+	}
+	return encodeAttributes(attributes)
+}
+
+// decodeTags and decodeAttributes read what was stored by encodeTags and
+// encodeAttributes. items from before they existed have neither
+func decodeTags(encoded string) []string {
+	tags := []string{}
+	if encoded != "" {
+		_ = json.Unmarshal([]byte(encoded), &tags)
+	}
+	return tags
+}
+
+func decodeAttributes(encoded string) map[string]interface{} {
+	attributes := map[string]interface{}{}
+	if encoded != "" {
+		_ = json.Unmarshal([]byte(encoded), &attributes)
+	}
+	return attributes
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	he "shipyard/httperror"
+	"shipyard/util"
+)
+
+func TestCatalog(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	t.server.Config.AdminEmails = []string{"admin@example.com"}
+	adminCtx := t.addNewSession(ctx, "admin@example.com")
+	ctx = t.addNewSession(ctx, "user@example.com")
+
+	addCategory := func(ctx context.Context, name, parentID string) (
+		*Category, error) {
+		r := jsonPostRequest(t, "/api/category",
+			Category{Name: name, ParentID: parentID})
+		resp, err := t.server.Admin(t.server.AddCategory)(ctx,
+			httptest.NewRecorder(), r)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Category, nil
+	}
+	patchCategory := func(id, patch string) (*Category, error) {
+		r := httptest.NewRequest(http.MethodPatch, "/api/category/"+id,
+			strings.NewReader(patch))
+		resp, err := t.server.Admin(t.server.PatchCategory)(adminCtx,
+			httptest.NewRecorder(), withURLParams(r, "categoryID", id))
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Category, nil
+	}
+	listCategoryItem := func(id, query string) []*Item {
+		r := httptest.NewRequest(http.MethodGet,
+			"/api/category/"+id+"/item"+query, nil)
+		resp, err := t.server.ListCategoryItem(ctx, httptest.NewRecorder(),
+			withURLParams(r, "categoryID", id))
+		assert.NoError(t, err)
+		return resp.(*RootJSON).Items
+	}
+
+	_, err := addCategory(ctx, "clothing", "")
+	assert.True(t, he.Unauthorized.Has(err))
+	clothing, err := addCategory(adminCtx, "clothing", "")
+	assert.NoError(t, err)
+	shirts, err := addCategory(adminCtx, "shirts", clothing.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, clothing.ID, shirts.ParentID)
+	hats, err := addCategory(adminCtx, "hats", "")
+	assert.NoError(t, err)
+	_, err = addCategory(adminCtx, "socks", "nope")
+	assert.True(t, he.BadRequest.Has(err))
+
+	addItem := func(item Item) (*Item, error) {
+		item.Price = &Money{Amount: 100}
+		item.RemainingQuantity = 1
+		r := jsonPostRequest(t, "/api/item", item)
+		resp, err := t.server.AddItem(ctx, httptest.NewRecorder(), r)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Item, nil
+	}
+
+	shirt, err := addItem(Item{Title: "shirt", CategoryID: shirts.ID,
+		Tags: []string{"Cotton", "summer", "cotton"},
+		Attributes: map[string]interface{}{
+			"size": "M", "color": "blue", "chest": 40.5, "organic": true}})
+	assert.NoError(t, err)
+	assert.Equal(t, "shirt", shirt.Title)
+	assert.Equal(t, []string{"cotton", "summer"}, shirt.Tags)
+	assert.Equal(t, 40.5, shirt.Attributes["chest"])
+	_, err = addItem(Item{Title: "cap", CategoryID: clothing.ID})
+	assert.NoError(t, err)
+	_, err = addItem(Item{Title: "sock", CategoryID: "nope"})
+	assert.True(t, he.BadRequest.Has(err))
+	_, err = addItem(Item{Title: "sock", Attributes: map[string]interface{}{
+		"size": map[string]interface{}{"eu": 40}}})
+	assert.True(t, he.BadRequest.Has(err))
+
+	// a category's items include its subcategories'
+	assert.Len(t, listCategoryItem(clothing.ID, ""), 2)
+	assert.Len(t, listCategoryItem(shirts.ID, ""), 1)
+	assert.Len(t, listCategoryItem(hats.ID, ""), 0)
+	second := listCategoryItem(clothing.ID, "?limit=1&offset=1")
+	assert.Len(t, second, 1)
+	assert.Equal(t, "shirt", second[0].Title)
+
+	// items created at the same time are each on one page
+	_, err = t.server.DB.ExecContext(ctx, "UPDATE items SET created = ?",
+		util.UTCNow())
+	assert.NoError(t, err)
+	first := listCategoryItem(clothing.ID, "?limit=1")
+	second = listCategoryItem(clothing.ID, "?limit=1&offset=1")
+	assert.Len(t, first, 1)
+	assert.Len(t, second, 1)
+	assert.NotEqual(t, first[0].ID, second[0].ID)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/item?limit=0", nil)
+	_, err = t.server.ListItem(ctx, httptest.NewRecorder(), r)
+	assert.True(t, he.BadRequest.Has(err))
+
+	r = httptest.NewRequest(http.MethodPatch, "/api/item/"+shirt.ID,
+		strings.NewReader(`{"tags": null,
+			"attributes": {"size": "L", "organic": null}}`))
+	resp, err := t.server.PatchItem(ctx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", shirt.ID))
+	assert.NoError(t, err)
+	patched := resp.(*RootJSON).Item
+	assert.Equal(t, []string{}, patched.Tags)
+	assert.Equal(t, map[string]interface{}{
+		"size": "L", "color": "blue", "chest": 40.5}, patched.Attributes)
+
+	// moving shirts moves its items with it
+	_, err = patchCategory(clothing.ID, `{"parent_id": "`+shirts.ID+`"}`)
+	assert.True(t, he.BadRequest.Has(err))
+	moved, err := patchCategory(shirts.ID, `{"parent_id": "`+hats.ID+`"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, hats.ID, moved.ParentID)
+	assert.Len(t, listCategoryItem(clothing.ID, ""), 1)
+	assert.Len(t, listCategoryItem(hats.ID, ""), 1)
+	moved, err = patchCategory(shirts.ID, `{"parent_id": null, "name": "tops"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "", moved.ParentID)
+	assert.Equal(t, "tops", moved.Name)
+	assert.Len(t, listCategoryItem(hats.ID, ""), 0)
+
+	deleteCategory := func(id string) error {
+		r := httptest.NewRequest(http.MethodDelete, "/api/category/"+id, nil)
+		_, err := t.server.Admin(t.server.DeleteCategory)(adminCtx,
+			httptest.NewRecorder(), withURLParams(r, "categoryID", id))
+		return err
+	}
+	assert.True(t, he.Conflict.Has(deleteCategory(shirts.ID)))
+	assert.NoError(t, deleteCategory(hats.ID))
+
+	r = httptest.NewRequest(http.MethodGet, "/api/category", nil)
+	resp, err = t.server.ListCategory(ctx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	assert.Len(t, resp.(*RootJSON).Categories, 2)
+}
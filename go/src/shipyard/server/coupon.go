@@ -0,0 +1,378 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/money"
+	"shipyard/pricing"
+	"shipyard/util"
+)
+
+// ListCoupon will return every coupon, including inactive ones. admins only
+func (s *Server) ListCoupon(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	coupons, err := s.DB.All_Coupon_OrderBy_Desc_Created(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &RootJSON{
+		Coupons: apiCoupons(coupons),
+	}
+
+	return resp, nil
+}
+
+// AddCoupon will create a coupon that anyone can apply to their cart while
+// it's valid. admins only
+func (s *Server) AddCoupon(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	coupon := Coupon{}
+	err := json.NewDecoder(r.Body).Decode(&coupon)
+	if err != nil {
+		return nil, he.BadRequest.Wrap(err)
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(coupon.Code))
+	if code == "" {
+		return nil, he.BadRequest.New("a coupon needs a code")
+	}
+
+	kind, err := pricing.ParseCouponKind(coupon.Kind)
+	if err != nil {
+		return nil, he.BadRequest.New("unknown coupon kind %q", coupon.Kind)
+	}
+
+	// the amounts of a coupon share a currency
+	var amountOff, minSubtotal money.Money
+	currency := ""
+	for _, m := range []*Money{coupon.AmountOff, coupon.MinSubtotal} {
+		if m != nil && m.Currency != "" {
+			if currency != "" && !strings.EqualFold(currency, m.Currency) {
+				return nil, he.BadRequest.New("amount_off and min_subtotal must " +
+					"be in the same currency")
+			}
+			currency = m.Currency
+		}
+	}
+	amountOff, err = s.parsePrice(&Money{Currency: currency})
+	if err != nil {
+		return nil, err
+	}
+	minSubtotal = amountOff
+	if coupon.AmountOff != nil {
+		amountOff, err = s.parsePrice(&Money{Amount: coupon.AmountOff.Amount,
+			Currency: currency})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if coupon.MinSubtotal != nil {
+		minSubtotal, err = s.parsePrice(&Money{Amount: coupon.MinSubtotal.Amount,
+			Currency: currency})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case kind == pricing.Percentage &&
+		(coupon.PercentOff < 1 || coupon.PercentOff > 100):
+		return nil, he.BadRequest.New("percent_off must be from 1 to 100")
+	case kind == pricing.FixedAmount && amountOff.Amount <= 0:
+		return nil, he.BadRequest.New("amount_off must be more than 0")
+	case coupon.MaxUses < 0 || coupon.MaxUsesPerUser < 0:
+		return nil, he.BadRequest.New("usage limits can't be negative")
+	case !coupon.Starts.IsZero() && !coupon.Expires.IsZero() &&
+		!coupon.Starts.Before(coupon.Expires.Time):
+		return nil, he.BadRequest.New("a coupon must start before it expires")
+	}
+
+	optional := database.Coupon_Create_Fields{}
+	if !coupon.Starts.IsZero() {
+		optional.Starts = database.Coupon_Starts(coupon.Starts.UTC())
+	}
+	if !coupon.Expires.IsZero() {
+		optional.Expires = database.Coupon_Expires(coupon.Expires.UTC())
+	}
+
+	var dbCoupon *database.Coupon
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		existing, err := tx.Find_Coupon_By_Code(ctx, database.Coupon_Code(code))
+		if err != nil {
+			return err
+		}
+
+		if existing != nil {
+			return he.Conflict.New("coupon %s already exists", code)
+		}
+
+		if coupon.ItemID != "" {
+			item, err := tx.Find_Item_By_Id(ctx, database.Item_Id(coupon.ItemID))
+			if err != nil {
+				return err
+			}
+			if item == nil {
+				return he.BadRequest.New("item %s not found", coupon.ItemID)
+			}
+		}
+
+		if coupon.SellerID != "" {
+			seller, err := tx.Find_User_By_Id(ctx, database.User_Id(coupon.SellerID))
+			if err != nil {
+				return err
+			}
+			if seller == nil {
+				return he.BadRequest.New("seller %s not found", coupon.SellerID)
+			}
+		}
+
+		dbCoupon, err = tx.Create_Coupon(ctx,
+			database.Coupon_Id(util.MustUUID4()),
+			database.Coupon_Code(code),
+			database.Coupon_Kind(string(kind)),
+			database.Coupon_PercentOff(coupon.PercentOff),
+			database.Coupon_AmountOff(amountOff.Amount),
+			database.Coupon_Currency(amountOff.Currency.Code),
+			database.Coupon_MinSubtotal(minSubtotal.Amount),
+			database.Coupon_ItemId(coupon.ItemID),
+			database.Coupon_SellerId(coupon.SellerID),
+			database.Coupon_MaxUses(coupon.MaxUses),
+			database.Coupon_MaxUsesPerUser(coupon.MaxUsesPerUser),
+			database.Coupon_Uses(0),
+			database.Coupon_Active(true),
+			optional)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &RootJSON{
+		Coupon: apiCoupon(dbCoupon),
+	}
+
+	return resp, nil
+}
+
+// DeleteCoupon will deactivate a coupon so it can't be used again. it's kept
+// for the orders that have used it. admins only
+func (s *Server) DeleteCoupon(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	couponID := chi.URLParam(r, "couponID")
+	err := s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		coupon, err := tx.Find_Coupon_By_Id(ctx, database.Coupon_Id(couponID))
+		if err != nil {
+			return err
+		}
+
+		if coupon == nil {
+			return he.NotFound.New("coupon not found")
+		}
+
+		return tx.UpdateNoReturn_Coupon_By_Pk(ctx, database.Coupon_Pk(coupon.Pk),
+			database.Coupon_Update_Fields{
+				Active: database.Coupon_Active(false),
+			})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ApplyCartCoupon will apply a coupon to the user's cart, replacing any that
+// was already applied. it's used when the cart is ordered
+func (s *Server) ApplyCartCoupon(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	apply := ApplyCoupon{}
+	err = json.NewDecoder(r.Body).Decode(&apply)
+	if err != nil {
+		return nil, he.BadRequest.Wrap(err)
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(apply.Code))
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		coupon, err := tx.Find_Coupon_By_Code(ctx, database.Coupon_Code(code))
+		if err != nil {
+			return err
+		}
+
+		if coupon == nil {
+			return he.NotFound.New("coupon %s not found", code)
+		}
+
+		_, err = s.usableCoupon(ctx, tx, coupon, userPk)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Delete_CartCoupon_By_UserPk(ctx,
+			database.CartCoupon_UserPk(userPk))
+		if err != nil {
+			return err
+		}
+
+		return tx.CreateNoReturn_CartCoupon(ctx,
+			database.CartCoupon_UserPk(userPk),
+			database.CartCoupon_CouponPk(coupon.Pk))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.ListCart(ctx, w, r)
+}
+
+// RemoveCartCoupon will remove the coupon from the user's cart
+func (s *Server) RemoveCartCoupon(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.DB.Delete_CartCoupon_By_UserPk(ctx,
+		database.CartCoupon_UserPk(userPk))
+	if err != nil {
+		return nil, err
+	}
+
+	return s.ListCart(ctx, w, r)
+}
+
+// usableCoupon checks that the user can still use the coupon, and returns its
+// pricing rules. whether it applies to what's in the order is up to the
+// pricing.Quoter
+func (s *Server) usableCoupon(ctx context.Context, tx *database.Tx,
+	coupon *database.Coupon, userPk int64) (*pricing.Coupon, error) {
+
+	now := util.UTCNow()
+	switch {
+	case !coupon.Active:
+		return nil, he.BadRequest.New("coupon %s is no longer active",
+			coupon.Code)
+	case coupon.Starts != nil && now.Before(*coupon.Starts):
+		return nil, he.BadRequest.New("coupon %s can't be used until %s",
+			coupon.Code, coupon.Starts.Format(time.RFC3339))
+	case coupon.Expires != nil && !now.Before(*coupon.Expires):
+		return nil, he.BadRequest.New("coupon %s has expired", coupon.Code)
+	case coupon.MaxUses > 0 && coupon.Uses >= coupon.MaxUses:
+		return nil, he.BadRequest.New("coupon %s has been used up", coupon.Code)
+	}
+
+	if coupon.MaxUsesPerUser > 0 {
+		// the user is locked so that their orders can't both count the uses
+		// before either has redeemed it
+		err := tx.LockUser(ctx, userPk)
+		if err != nil {
+			return nil, err
+		}
+
+		uses, err := tx.Count_CouponRedemption_By_CouponPk_And_UserPk(ctx,
+			database.CouponRedemption_CouponPk(coupon.Pk),
+			database.CouponRedemption_UserPk(userPk))
+		if err != nil {
+			return nil, err
+		}
+
+		if uses >= int64(coupon.MaxUsesPerUser) {
+			return nil, he.BadRequest.New("you've already used coupon %s",
+				coupon.Code)
+		}
+	}
+
+	amountOff, err := money.New(coupon.AmountOff, coupon.Currency)
+	if err != nil {
+		return nil, he.Unexpected.Wrap(err)
+	}
+
+	minSubtotal := money.Money{Amount: coupon.MinSubtotal,
+		Currency: amountOff.Currency}
+	pricingCoupon := &pricing.Coupon{
+		Code:        coupon.Code,
+		Kind:        pricing.CouponKind(coupon.Kind),
+		PercentOff:  coupon.PercentOff,
+		AmountOff:   amountOff,
+		MinSubtotal: minSubtotal,
+		ItemID:      coupon.ItemId,
+	}
+
+	if coupon.SellerId != "" {
+		seller, err := tx.Find_User_By_Id(ctx, database.User_Id(coupon.SellerId))
+		if err != nil {
+			return nil, err
+		}
+
+		if seller == nil {
+			return nil, he.BadRequest.New("coupon %s is no longer active",
+				coupon.Code)
+		}
+		pricingCoupon.SellerPk = seller.Pk
+	}
+
+	return pricingCoupon, nil
+}
+
+// redeemCoupon records that the coupon was used on the order paid for by c,
+// and removes it from the user's cart. the use is only counted if the coupon
+// still has one left, since another order may have taken the last one since
+// the coupon was checked
+func redeemCoupon(ctx context.Context, tx *database.Tx,
+	coupon *database.Coupon, c *charge, discount money.Money) error {
+
+	used, err := tx.UseCoupon(ctx, coupon.Pk)
+	if err != nil {
+		return err
+	}
+
+	if !used {
+		return he.BadRequest.New("coupon %s has been used up", coupon.Code)
+	}
+
+	err = tx.CreateNoReturn_CouponRedemption(ctx,
+		database.CouponRedemption_Id(util.MustUUID4()),
+		database.CouponRedemption_Discount(discount.Amount),
+		database.CouponRedemption_Currency(discount.Currency.Code),
+		database.CouponRedemption_CouponPk(coupon.Pk),
+		database.CouponRedemption_Create_Fields{
+			UserPk:    database.CouponRedemption_UserPk(c.userPk),
+			PaymentPk: database.CouponRedemption_PaymentPk(c.record.Pk),
+		})
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Delete_CartCoupon_By_UserPk(ctx,
+		database.CartCoupon_UserPk(c.userPk))
+	return err
+}
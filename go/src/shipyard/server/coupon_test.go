@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+)
+
+func TestCoupon(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	t.server.Config.AdminEmails = []string{"admin@example.com"}
+	adminCtx := t.addNewSession(ctx, "admin@example.com")
+	ctx = t.addNewSession(ctx, "user@example.com")
+
+	addCoupon := func(ctx context.Context, coupon Coupon) (*Coupon, error) {
+		r := jsonPostRequest(t, "/api/coupon", coupon)
+		resp, err := t.server.Admin(t.server.AddCoupon)(ctx,
+			httptest.NewRecorder(), r)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Coupon, nil
+	}
+
+	_, err := addCoupon(ctx, Coupon{Code: "ten", Kind: "percentage",
+		PercentOff: 10})
+	assert.True(t, he.Unauthorized.Has(err))
+	_, err = addCoupon(adminCtx, Coupon{Code: "ten", Kind: "percentage"})
+	assert.True(t, he.BadRequest.Has(err))
+
+	ten, err := addCoupon(adminCtx, Coupon{Code: "ten", Kind: "percentage",
+		PercentOff: 10, MaxUsesPerUser: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, "TEN", ten.Code)
+	_, err = addCoupon(adminCtx, Coupon{Code: "TEN", Kind: "free_shipping"})
+	assert.True(t, he.Conflict.Has(err))
+
+	_, err = addCoupon(adminCtx, Coupon{Code: "OLD", Kind: "free_shipping",
+		Expires: UnixTS(time.Now().Add(-time.Hour))})
+	assert.NoError(t, err)
+	_, err = addCoupon(adminCtx, Coupon{Code: "BIG", Kind: "fixed",
+		AmountOff:   &Money{Amount: 20},
+		MinSubtotal: &Money{Amount: 1000, Currency: "USD"}})
+	assert.NoError(t, err)
+
+	i1 := newItem(ctx, t, "x", 10)
+	t.addCart(ctx, i1.Id, 5)
+	r := jsonPostRequest(t, "/api/address", Address{Line1: "1 street",
+		Country: "US"})
+	_, err = t.server.AddAddress(ctx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+
+	applyCoupon := func(code string) (*CartSummary, error) {
+		r := jsonPostRequest(t, "/api/cart/coupon", ApplyCoupon{Code: code})
+		resp, err := t.server.ApplyCartCoupon(ctx, httptest.NewRecorder(), r)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).CartSummary, nil
+	}
+
+	_, err = applyCoupon("nope")
+	assert.True(t, he.NotFound.Has(err))
+	_, err = applyCoupon("old")
+	assert.True(t, he.BadRequest.Has(err))
+
+	// the subtotal of 50 is too little for BIG, so the cart is priced without
+	// it until more is added
+	summary, err := applyCoupon("big")
+	assert.NoError(t, err)
+	assert.Equal(t, "BIG", summary.Coupon)
+	assert.NotEmpty(t, summary.CouponError)
+	assert.Equal(t, 50, summary.Total.Amount)
+
+	summary, err = applyCoupon("ten")
+	assert.NoError(t, err)
+	assert.Equal(t, "TEN", summary.Coupon)
+	assert.Empty(t, summary.CouponError)
+	assert.Equal(t, 5, summary.Discount.Amount)
+	assert.Equal(t, 45, summary.Total.Amount)
+
+	r = httptest.NewRequest(http.MethodDelete, "/api/cart/coupon", nil)
+	resp, err := t.server.RemoveCartCoupon(ctx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	assert.Empty(t, resp.(*RootJSON).CartSummary.Coupon)
+	assert.Equal(t, 50, resp.(*RootJSON).CartSummary.Total.Amount)
+
+	_, err = applyCoupon("ten")
+	assert.NoError(t, err)
+	r = jsonPostRequest(t, "/api/order", PlaceOrder{
+		Orders:        []OrderedItem{{ItemID: i1.Id}},
+		ExpectedTotal: &Money{Amount: 45, Currency: "USD"},
+	})
+	resp, err = t.server.AddOrder(ctx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	assert.Equal(t, 45, resp.(*RootJSON).Payment.Amount.Amount)
+
+	r = httptest.NewRequest(http.MethodGet, "/api/order", nil)
+	resp, err = t.server.ListOrder(ctx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	orders := resp.(*RootJSON).OrderedItems
+	assert.Len(t, orders, 1)
+	assert.Equal(t, "TEN", orders[0].Coupon)
+	assert.Equal(t, 5, orders[0].Discount.Amount)
+
+	// the coupon was used up by the order, and can only be used once per user
+	r = httptest.NewRequest(http.MethodGet, "/api/cart", nil)
+	resp, err = t.server.ListCart(ctx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	assert.Empty(t, resp.(*RootJSON).CartSummary.Coupon)
+	_, err = applyCoupon("ten")
+	assert.True(t, he.BadRequest.Has(err))
+
+	r = httptest.NewRequest(http.MethodDelete, "/api/coupon/"+ten.ID, nil)
+	_, err = t.server.Admin(t.server.DeleteCoupon)(adminCtx,
+		httptest.NewRecorder(), withURLParams(r, "couponID", ten.ID))
+	assert.NoError(t, err)
+
+	r = httptest.NewRequest(http.MethodGet, "/api/coupon", nil)
+	resp, err = t.server.Admin(t.server.ListCoupon)(adminCtx,
+		httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	for _, coupon := range resp.(*RootJSON).Coupons {
+		if coupon.Code == "TEN" {
+			assert.Equal(t, 1, coupon.Uses)
+			assert.False(t, coupon.Active)
+		}
+	}
+
+	// a coupon's last use can only be taken once, however many orders saw it
+	// as available
+	once, err := addCoupon(adminCtx, Coupon{Code: "ONCE",
+		Kind: "free_shipping", MaxUses: 1})
+	assert.NoError(t, err)
+	dbOnce, err := t.server.DB.Find_Coupon_By_Id(ctx, database.Coupon_Id(once.ID))
+	assert.NoError(t, err)
+	for _, expected := range []bool{true, false} {
+		err = t.server.DB.WithTx(ctx, func(ctx context.Context,
+			tx *database.Tx) error {
+			used, err := tx.UseCoupon(ctx, dbOnce.Pk)
+			assert.Equal(t, expected, used)
+			return err
+		})
+		assert.NoError(t, err)
+	}
+	dbOnce, err = t.server.DB.Find_Coupon_By_Id(ctx, database.Coupon_Id(once.ID))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dbOnce.Uses)
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"shipyard/database"
+)
+
+// versionETag is the entity tag of a single versioned row, like an item or an
+// address. it changes every time the row is updated
+func versionETag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// itemsETag is the entity tag of a list of items. it changes when any item is
+// added, removed or updated
+func itemsETag(items []*database.Item) string {
+	hash := sha256.New()
+	for _, item := range items {
+		fmt.Fprintf(hash, "%s:%d\n", item.Id, item.Version)
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil))[:32] + `"`
+}
+
+// etagMatches reports whether the If-Match or If-None-Match header value
+// lists the etag. weak validators are compared as if they were strong
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func setETag(w http.ResponseWriter, etag string) {
+	w.Header().Set("ETag", etag)
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/zeebo/errs"
+
+	"shipyard/database"
+	monitor "shipyard/prometheus"
+	"shipyard/util"
+)
+
+// the kinds of events recorded. an event's subject is the thing it's about,
+// and its user whose it is, if it's anyone's
+const (
+	EventUserSignedUp     = "user.signed_up"
+	EventItemCreated      = "item.created"
+	EventItemUpdated      = "item.updated"
+	EventItemDeleted      = "item.deleted"
+	EventStockChanged     = "item.stock_changed"
+	EventCartUpdated      = "cart.updated"
+	EventOrderPlaced      = "order.placed"
+	EventSubOrderAdvanced = "sub_order.advanced"
+	allEvents             = ""
+	eventPending          = "pending"
+	eventDispatched       = "dispatched"
+	eventDead             = "dead"
+	eventBatchSize        = 100
+	maxEventAttempts      = 10
+)
+
+// eventKinds are the kinds of events that can be subscribed to by name
+var eventKinds = map[string]bool{
+	EventUserSignedUp:     true,
+	EventItemCreated:      true,
+	EventItemUpdated:      true,
+	EventItemDeleted:      true,
+	EventStockChanged:     true,
+	EventCartUpdated:      true,
+	EventOrderPlaced:      true,
+	EventSubOrderAdvanced: true,
+}
+
+// EventHandler is given each event of the kinds it subscribed to at least
+// once. an event that any handler fails is given to all of them again later,
+// so a handler must be able to see the same event more than once
+type EventHandler func(ctx context.Context, event *database.Event) error
+
+// Subscribe has handler given every event of kind, or of every kind when kind
+// is empty
+func (s *Server) Subscribe(kind string, handler EventHandler) {
+	s.subscribersMu.Lock()
+	defer s.subscribersMu.Unlock()
+	if s.subscribers == nil {
+		s.subscribers = map[string][]EventHandler{}
+	}
+	s.subscribers[kind] = append(s.subscribers[kind], handler)
+}
+
+func (s *Server) eventHandlers(kind string) []EventHandler {
+	s.subscribersMu.RLock()
+	defer s.subscribersMu.RUnlock()
+	handlers := append([]EventHandler(nil), s.subscribers[allEvents]...)
+	return append(handlers, s.subscribers[kind]...)
+}
+
+// recordEvent adds an event to the outbox. it's written in the transaction
+// making the change, so the event exists exactly when the change does
+func recordEvent(ctx context.Context, tx *database.Tx, kind, subjectID string,
+	userPk *int64, data interface{}) error {
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+
+	optional := database.Event_Create_Fields{}
+	if userPk != nil {
+		optional.UserPk = database.Event_UserPk(*userPk)
+	}
+	return tx.CreateNoReturn_Event(ctx,
+		database.Event_Id(util.MustUUID4()),
+		database.Event_Kind(kind),
+		database.Event_SubjectId(subjectID),
+		database.Event_Payload(string(payload)),
+		database.Event_Status(eventPending),
+		database.Event_Attempts(0),
+		database.Event_LastError(""),
+		optional)
+}
+
+// the payloads of the events that aren't an api type
+type (
+	stockChange struct {
+		ItemID            string `json:"item_id"`
+		VariantID         string `json:"variant_id,omitempty"`
+		RemainingQuantity int    `json:"remaining_quantity"`
+		VariantQuantity   int    `json:"variant_remaining_quantity,omitempty"`
+	}
+
+	orderPlacement struct {
+		PaymentID   string   `json:"payment_id"`
+		Total       *Money   `json:"total"`
+		Lines       int      `json:"lines"`
+		SubOrderIDs []string `json:"sub_order_ids"`
+	}
+
+	subOrderAdvance struct {
+		SubOrderID string `json:"sub_order_id"`
+		From       string `json:"from"`
+		To         string `json:"to"`
+	}
+)
+
+// RunDispatcher dispatches pending events every DispatchInterval until ctx is
+// cancelled
+func (s *Server) RunDispatcher(ctx context.Context) {
+	ticker := time.NewTicker(s.Config.DispatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.DispatchEvents(ctx)
+			if err != nil {
+				s.log.WithError(err).Errorf("failed to dispatch events")
+			}
+		}
+	}
+}
+
+// DispatchEvents gives the pending events, oldest first, to their
+// subscribers. an event stays pending until all of them have taken it, and
+// is tried again the next time events are dispatched, until it has failed
+// maxEventAttempts times and is dead. an event can be given
+// to a subscriber more than once, when one of the others failed or when more
+// than one server dispatches at once, so subscribers have to be idempotent
+func (s *Server) DispatchEvents(ctx context.Context) error {
+	offset := int64(0)
+	for {
+		events, err := s.DB.Limited_Event_By_Status(ctx,
+			database.Event_Status(eventPending), eventBatchSize, offset)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			dispatched, err := s.dispatchEvent(ctx, event)
+			if err != nil {
+				return err
+			}
+			if !dispatched {
+				offset++
+			}
+		}
+
+		if len(events) < eventBatchSize {
+			return nil
+		}
+	}
+}
+
+// dispatchEvent gives one event to its subscribers, and returns whether it's
+// no longer pending
+func (s *Server) dispatchEvent(ctx context.Context,
+	event *database.Event) (bool, error) {
+
+	var group errs.Group
+	for _, handler := range s.eventHandlers(event.Kind) {
+		group.Add(handler(ctx, event))
+	}
+
+	pk := database.Event_Pk(event.Pk)
+	handlerErr := group.Err()
+	if handlerErr == nil {
+		return true, s.DB.UpdateNoReturn_Event_By_Pk(ctx, pk,
+			database.Event_Update_Fields{
+				Status:     database.Event_Status(eventDispatched),
+				Dispatched: database.Event_Dispatched(util.UTCNow()),
+			})
+	}
+
+	attempts := event.Attempts + 1
+	ups := database.Event_Update_Fields{
+		Attempts:  database.Event_Attempts(attempts),
+		LastError: database.Event_LastError(handlerErr.Error()),
+	}
+	if attempts >= maxEventAttempts {
+		s.log.WithError(handlerErr).Errorf("giving up on %s event %s after "+
+			"%d attempts", event.Kind, event.Id, attempts)
+		ups.Status = database.Event_Status(eventDead)
+		return true, s.DB.UpdateNoReturn_Event_By_Pk(ctx, pk, ups)
+	}
+
+	s.log.WithError(handlerErr).Warnf("failed to dispatch %s event %s "+
+		"(attempt %d)", event.Kind, event.Id, attempts)
+	return false, s.DB.UpdateNoReturn_Event_By_Pk(ctx, pk, ups)
+}
+
+// countEvent sets the gauges of what the event changed to the database's
+// counts. they're counted rather than added to so that an event given to it
+// again isn't counted twice
+func (s *Server) countEvent(ctx context.Context, event *database.Event) error {
+	var count func(context.Context) (int64, error)
+	var gauge prometheus.Gauge
+	switch event.Kind {
+	case EventUserSignedUp:
+		count, gauge = s.DB.Count_User, monitor.UserGauge
+	case EventItemCreated, EventItemDeleted:
+		count, gauge = s.DB.Count_Item, monitor.ItemGauge
+	case EventOrderPlaced:
+		count, gauge = s.DB.Count_OrderedItem, monitor.PurchasesGauge
+	default:
+		return nil
+	}
+
+	n, err := count(ctx)
+	if err != nil {
+		return err
+	}
+	gauge.Set(float64(n))
+	return nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"shipyard/database"
+	"shipyard/payment"
+	monitor "shipyard/prometheus"
+)
+
+func TestEvents(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	t.server.Payments = payment.NewFake(payment.Succeed)
+	sellerCtx := t.addNewSession(ctx, "seller@example.com")
+	buyerCtx := t.addNewSession(ctx, "buyer@example.com")
+
+	var dispatched []*database.Event
+	t.server.Subscribe("", func(ctx context.Context,
+		event *database.Event) error {
+		dispatched = append(dispatched, event)
+		return nil
+	})
+	failing := true
+	t.server.Subscribe(EventItemCreated, func(ctx context.Context,
+		event *database.Event) error {
+		if failing {
+			return fmt.Errorf("subscriber is down")
+		}
+		return nil
+	})
+	kinds := func() (kinds []string) {
+		for _, event := range dispatched {
+			kinds = append(kinds, event.Kind)
+		}
+		dispatched = nil
+		return kinds
+	}
+
+	r := jsonPostRequest(t, "/api/item", Item{Price: &Money{Amount: 100,
+		Currency: "USD"}, RemainingQuantity: 10})
+	resp, err := t.server.AddItem(sellerCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	itemID := resp.(*RootJSON).Item.ID
+
+	t.addAddress(buyerCtx)
+	t.addCart(buyerCtx, itemID, 2)
+
+	// nothing is given to subscribers of a change that was rolled back
+	t.server.Payments = payment.NewFake(payment.Decline)
+	r = jsonPostRequest(t, "/api/order",
+		PlaceOrder{Orders: []OrderedItem{{ItemID: itemID}}})
+	_, err = t.server.AddOrder(buyerCtx, httptest.NewRecorder(), r)
+	assert.Error(t, err)
+
+	t.server.Payments = payment.NewFake(payment.Succeed)
+	r = jsonPostRequest(t, "/api/order",
+		PlaceOrder{Orders: []OrderedItem{{ItemID: itemID}}})
+	resp, err = t.server.AddOrder(buyerCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	paymentID := resp.(*RootJSON).Payment.ID
+
+	assert.NoError(t, t.server.DispatchEvents(ctx))
+	assert.Equal(t, []string{EventItemCreated, EventStockChanged,
+		EventCartUpdated, EventOrderPlaced}, kinds())
+
+	// the event a subscriber failed is given to every subscriber again
+	assert.NoError(t, t.server.DispatchEvents(ctx))
+	assert.Equal(t, []string{EventItemCreated}, kinds())
+	failing = false
+	assert.NoError(t, t.server.DispatchEvents(ctx))
+	assert.Equal(t, []string{EventItemCreated}, kinds())
+	assert.NoError(t, t.server.DispatchEvents(ctx))
+	assert.Empty(t, kinds())
+	// which doesn't count the item it was about more than once
+	assert.Equal(t, 1.0, testutil.ToFloat64(monitor.ItemGauge))
+	assert.Equal(t, 1.0, testutil.ToFloat64(monitor.PurchasesGauge))
+
+	t.addCart(buyerCtx, itemID, 1)
+	r = jsonPostRequest(t, "/api/order",
+		PlaceOrder{Orders: []OrderedItem{{ItemID: itemID}}})
+	resp, err = t.server.AddOrder(buyerCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	assert.NoError(t, t.server.DispatchEvents(ctx))
+	events := dispatched
+	assert.Equal(t, []string{EventStockChanged, EventCartUpdated,
+		EventOrderPlaced}, kinds())
+
+	var change stockChange
+	assert.NoError(t, json.Unmarshal([]byte(events[0].Payload), &change))
+	assert.Equal(t, 7, change.RemainingQuantity)
+	var cartItem CartItem
+	assert.NoError(t, json.Unmarshal([]byte(events[1].Payload), &cartItem))
+	assert.Equal(t, itemID, cartItem.ItemID)
+	assert.Equal(t, 1, cartItem.Quantity)
+	var placement orderPlacement
+	assert.NoError(t, json.Unmarshal([]byte(events[2].Payload), &placement))
+	assert.Equal(t, resp.(*RootJSON).Payment.ID, placement.PaymentID)
+	assert.NotEqual(t, paymentID, placement.PaymentID)
+	assert.Equal(t, 1, placement.Lines)
+	assert.Equal(t, resp.(*RootJSON).Payment.ID, events[2].SubjectId)
+
+	// an event that keeps failing is given up on
+	failing = true
+	r = jsonPostRequest(t, "/api/item", Item{Price: &Money{Amount: 100,
+		Currency: "USD"}, RemainingQuantity: 1})
+	resp, err = t.server.AddItem(sellerCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	for i := 0; i < maxEventAttempts; i++ {
+		assert.NoError(t, t.server.DispatchEvents(ctx))
+		assert.Equal(t, []string{EventItemCreated}, kinds())
+	}
+	assert.NoError(t, t.server.DispatchEvents(ctx))
+	assert.Empty(t, kinds())
+
+	dead, err := t.server.DB.Limited_Event_By_Status(ctx,
+		database.Event_Status(eventDead), 10, 0)
+	assert.NoError(t, err)
+	assert.Len(t, dead, 1)
+	assert.Equal(t, resp.(*RootJSON).Item.ID, dead[0].SubjectId)
+	assert.Equal(t, "subscriber is down", dead[0].LastError)
+}
@@ -4,16 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
 	"time"
 
+	"github.com/go-chi/chi"
 	"github.com/stretchr/testify/assert"
 
 	"shipyard/config"
 	"shipyard/database"
+	"shipyard/pricing"
 	"shipyard/util"
 )
 
@@ -32,11 +35,17 @@ func newServerTest(t *testing.T) (context.Context, *serverTest) {
 	testDB, err := database.Connect(testDBURL, nil)
 	assert.NoError(t, err)
 	c := &config.Configs{
-		IDPPasswordSalt: "salt",
-		IDPClientID:     "idpid",
-		IDPClientSecret: "idpsecret",
-		DeveloperMode:   false,
-		ClientHosts:     nil,
+		IDPPasswordSalt:   "salt",
+		IDPClientID:       "idpid",
+		IDPClientSecret:   "idpsecret",
+		DeveloperMode:     false,
+		ClientHosts:       nil,
+		IdempotencyKeyTTL: time.Hour,
+		DefaultCurrency:   "USD",
+		ShippingRates: pricing.ShippingRates{
+			{Currency: "USD"}, // free shipping everywhere
+		},
+		PaymentTimeout: time.Second,
 	}
 	return context.Background(), &serverTest{
 		T:      t,
@@ -54,6 +63,68 @@ func (st *serverTest) cleanup() {
 	assert.NoError(st, st.server.DB.Close())
 }
 
+// workJobs runs the jobs that are due until there are none left
+func (st *serverTest) workJobs(ctx context.Context) {
+	for {
+		worked, err := st.server.WorkJob(ctx)
+		assert.NoError(st, err)
+		if !worked {
+			return
+		}
+	}
+}
+
+// dueJobs has every pending job due now, as if their backoffs were over
+func (st *serverTest) dueJobs(ctx context.Context) {
+	jobs, err := st.server.DB.Limited_Job_By_Status(ctx,
+		database.Job_Status(database.JobPending), 1000, 0)
+	assert.NoError(st, err)
+	for _, job := range jobs {
+		assert.NoError(st, st.server.DB.UpdateNoReturn_Job_By_Pk(ctx,
+			database.Job_Pk(job.Pk), database.Job_Update_Fields{
+				RunAt: database.Job_RunAt(util.UTCNow()),
+			}))
+	}
+}
+
+// addItem adds an item for sale by the session's user
+func (st *serverTest) addItem(ctx context.Context, item Item) *Item {
+	r := jsonPostRequest(st, "/api/item", item)
+	resp, err := st.server.AddItem(ctx, httptest.NewRecorder(), r)
+	assert.NoError(st, err)
+	return resp.(*RootJSON).Item
+}
+
+// addAddress gives the session's user a default address to ship to
+func (st *serverTest) addAddress(ctx context.Context) *Address {
+	r := jsonPostRequest(st, "/api/address", Address{Line1: "1 street"})
+	resp, err := st.server.AddAddress(ctx, httptest.NewRecorder(), r)
+	assert.NoError(st, err)
+	return resp.(*RootJSON).Address
+}
+
+// addCart puts quantity of the item in the session's user's cart
+func (st *serverTest) addCart(ctx context.Context, itemID string,
+	quantity int) {
+	r := jsonPostRequest(st, "/api/cart", CartItem{ItemID: itemID,
+		Quantity: quantity})
+	_, err := st.server.AddCart(ctx, httptest.NewRecorder(), r)
+	assert.NoError(st, err)
+}
+
+// placeOrder orders the items in the session's user's cart
+func (st *serverTest) placeOrder(ctx context.Context,
+	itemIDs ...string) *RootJSON {
+	order := PlaceOrder{}
+	for _, itemID := range itemIDs {
+		order.Orders = append(order.Orders, OrderedItem{ItemID: itemID})
+	}
+	r := jsonPostRequest(st, "/api/order", order)
+	resp, err := st.server.AddOrder(ctx, httptest.NewRecorder(), r)
+	assert.NoError(st, err)
+	return resp.(*RootJSON)
+}
+
 // newSessionUser manually creates a user with an active session and returns
 // their access token
 func newSessionUser(ctx context.Context, st *serverTest,
@@ -85,14 +156,48 @@ func newItem(ctx context.Context, st *serverTest,
 	item, err := st.server.DB.Create_Item(ctx,
 		database.Item_Id(util.MustUUID4()),
 		database.Item_Price(10),
+		database.Item_Currency("USD"),
 		database.Item_Description(description),
 		database.Item_ImageUrl(""),
 		database.Item_RemainingQuantity(rq),
+		database.Item_Version(1),
+		database.Item_Title(description),
+		database.Item_CategoryId(""),
+		database.Item_Tags(""),
+		database.Item_Attributes(""),
+		database.Item_RatingTotal(0),
+		database.Item_RatingCount(0),
 		database.Item_Create_Fields{})
 	assert.NoError(st, err)
+
+	// like AddItem, an item without variants has one holding its quantity
+	_, err = st.server.DB.Create_Variant(ctx,
+		database.Variant_Id(util.MustUUID4()),
+		database.Variant_Sku(""),
+		database.Variant_RemainingQuantity(rq),
+		database.Variant_Attributes(""),
+		database.Variant_ItemPk(item.Pk),
+		database.Variant_Create_Fields{})
+	assert.NoError(st, err)
 	return item
 }
 
+// imagePostRequest uploads data as the image field of a multipart form
+func imagePostRequest(st *serverTest, target string,
+	data []byte) *http.Request {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	part, err := mw.CreateFormFile("image", "image")
+	assert.NoError(st, err)
+	_, err = part.Write(data)
+	assert.NoError(st, err)
+	assert.NoError(st, mw.Close())
+
+	r := httptest.NewRequest(http.MethodPost, target, &buf)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
 func jsonPostRequest(st *serverTest, target string,
 	body interface{}) *http.Request {
 	buf, err := json.Marshal(body)
@@ -101,3 +206,13 @@ func jsonPostRequest(st *serverTest, target string,
 	r.Header.Set("Content-Type", "application/json")
 	return r
 }
+
+// withURLParams sets the chi url params that the router would have parsed
+// from the route pattern, as key value pairs
+func withURLParams(r *http.Request, kvs ...string) *http.Request {
+	rctx := chi.NewRouteContext()
+	for i := 0; i+1 < len(kvs); i += 2 {
+		rctx.URLParams.Add(kvs[i], kvs[i+1])
+	}
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"shipyard/database"
+	"shipyard/handler"
+	he "shipyard/httperror"
+	"shipyard/util"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+
+	// defaultIdempotencyMaxBody leaves room for the largest catalog import,
+	// and an image upload of the default size
+	defaultIdempotencyMaxBody = 32 << 20
+)
+
+func (s *Server) idempotencyMaxBody() int64 {
+	if s.Config.IdempotencyMaxBody > 0 {
+		return s.Config.IdempotencyMaxBody
+	}
+	return defaultIdempotencyMaxBody
+}
+
+// Idempotent allows clients to safely retry authenticated POST requests. if
+// the request has an Idempotency-Key header, the successful response is
+// stored, along with its status and the headers the handler set, and replayed
+// for any repeat request with the same key. a repeat with a different body is
+// rejected. the body is read to be compared, so it can be at most
+// IdempotencyMaxBody bytes, whatever the handler would allow. it must be
+// chained after Authenticated
+func (s *Server) Idempotent(h handler.Handler) handler.Handler {
+	return handler.Handler(func(ctx context.Context, w http.ResponseWriter,
+		r *http.Request) (interface{}, error) {
+
+		token := r.Header.Get(idempotencyKeyHeader)
+		if token == "" {
+			return h(ctx, w, r)
+		}
+
+		ss, err := GetCtxSession(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		userPk, err := sessionUserPk(ss)
+		if err != nil {
+			return nil, err
+		}
+
+		maxBody := s.idempotencyMaxBody()
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+		if err != nil {
+			if int64(len(body)) >= maxBody {
+				return nil, he.TooLarge.New("an idempotent request can be at "+
+					"most %d bytes", maxBody)
+			}
+			return nil, he.BadRequest.Wrap(err)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		requestHash := hashRequest(r, body)
+
+		key, err := s.claimIdempotencyKey(ctx, userPk, token, requestHash)
+		if err != nil {
+			return nil, err
+		}
+
+		if key != nil {
+			// this is a repeat request
+			if key.RequestHash != requestHash {
+				return nil, he.Unprocessable.New(
+					"idempotency key was used with a different request")
+			}
+
+			if !key.Completed {
+				return nil, he.Conflict.New(
+					"a request with this idempotency key is in progress")
+			}
+
+			logrus.Debugf("replaying response for idempotency key %q", token)
+			return replayIdempotencyKey(w, key)
+		}
+
+		// the headers set before the handler runs, like by other middleware,
+		// aren't stored, since they're set again for the repeat request
+		before := w.Header().Clone()
+		sw := &statusWriter{ResponseWriter: w}
+		resp, err := h(ctx, sw, r)
+		if err != nil {
+			// only successful responses are stored. release the key so that the
+			// request can be retried
+			_, delErr := s.DB.Delete_IdempotencyKey_By_UserPk_And_Token(ctx,
+				database.IdempotencyKey_UserPk(userPk),
+				database.IdempotencyKey_Token(token))
+			if delErr != nil {
+				logrus.Warningf("failed to release idempotency key: %s", delErr)
+			}
+			return nil, err
+		}
+
+		stored := resp
+		if stored == nil {
+			// matches the default response written by the json handler
+			stored = map[string]string{"response": "okay!"}
+		}
+
+		respBytes, err := json.Marshal(stored)
+		if err != nil {
+			return nil, he.Unexpected.Wrap(err)
+		}
+
+		headers := http.Header{}
+		for name, values := range w.Header() {
+			if !reflect.DeepEqual(before[name], values) {
+				headers[name] = values
+			}
+		}
+		headerBytes, err := json.Marshal(headers)
+		if err != nil {
+			return nil, he.Unexpected.Wrap(err)
+		}
+
+		// the handler's changes are committed by now, so its response is
+		// returned even if it can't be stored. the key would then stay in
+		// progress until it expires, so storing it is retried, and isn't given
+		// up on just because the client has gone away
+		err = s.completeIdempotencyKey(userPk, token, sw.status, headerBytes,
+			respBytes)
+		if err != nil {
+			logrus.Errorf("failed to store response for idempotency key %q: %s",
+				token, err)
+		}
+
+		return resp, nil
+	})
+}
+
+// idempotencyCompleteAttempts is how many times a response is tried to be
+// stored
+const idempotencyCompleteAttempts = 3
+
+func (s *Server) completeIdempotencyKey(userPk int64, token string,
+	status int, headers, response []byte) (err error) {
+
+	for attempt := 0; attempt < idempotencyCompleteAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+		err = s.DB.UpdateNoReturn_IdempotencyKey_By_UserPk_And_Token(
+			context.Background(),
+			database.IdempotencyKey_UserPk(userPk),
+			database.IdempotencyKey_Token(token),
+			database.IdempotencyKey_Update_Fields{
+				Completed: database.IdempotencyKey_Completed(true),
+				Status:    database.IdempotencyKey_Status(status),
+				Headers:   database.IdempotencyKey_Headers(string(headers)),
+				Response:  database.IdempotencyKey_Response(response),
+			})
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// replayIdempotencyKey responds with the stored response of a completed key
+func replayIdempotencyKey(w http.ResponseWriter,
+	key *database.IdempotencyKey) (interface{}, error) {
+
+	if key.Headers != "" {
+		var headers http.Header
+		err := json.Unmarshal([]byte(key.Headers), &headers)
+		if err != nil {
+			return nil, he.Unexpected.Wrap(err)
+		}
+		for name, values := range headers {
+			w.Header()[name] = values
+		}
+	}
+	w.Header().Set(idempotencyReplayedHeader, "true")
+
+	// the status is only written here when the handler wrote one of its own.
+	// headers can't be set once it has been, so the json handler's content
+	// type is set first
+	if key.Status != 0 && key.Status != http.StatusOK {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(key.Status)
+	}
+	return json.RawMessage(key.Response), nil
+}
+
+// statusWriter keeps the status code written through it
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// claimIdempotencyKey returns the unexpired key previously stored for the
+// user. if there isn't one, a new incomplete key is stored and nil is
+// returned
+func (s *Server) claimIdempotencyKey(ctx context.Context, userPk int64,
+	token, requestHash string) (key *database.IdempotencyKey, err error) {
+
+	expiry := util.UTCNow().Add(-s.Config.IdempotencyKeyTTL)
+
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		_, err := tx.Delete_IdempotencyKey_By_Created_Less(ctx,
+			database.IdempotencyKey_Created(expiry))
+		if err != nil {
+			return err
+		}
+
+		key, err = tx.Find_IdempotencyKey_By_UserPk_And_Token(ctx,
+			database.IdempotencyKey_UserPk(userPk),
+			database.IdempotencyKey_Token(token))
+		if err != nil || key != nil {
+			return err
+		}
+
+		return tx.CreateNoReturn_IdempotencyKey(ctx,
+			database.IdempotencyKey_Token(token),
+			database.IdempotencyKey_RequestHash(requestHash),
+			database.IdempotencyKey_Completed(false),
+			database.IdempotencyKey_Status(0),
+			database.IdempotencyKey_Headers(""),
+			database.IdempotencyKey_Response([]byte{}),
+			database.IdempotencyKey_UserPk(userPk))
+	})
+	if err != nil {
+		// the key may have been claimed by a concurrent request
+		key, findErr := s.DB.Find_IdempotencyKey_By_UserPk_And_Token(ctx,
+			database.IdempotencyKey_UserPk(userPk),
+			database.IdempotencyKey_Token(token))
+		if findErr != nil || key == nil {
+			return nil, err
+		}
+		return key, nil
+	}
+
+	return key, nil
+}
+
+// hashRequest identifies a request by its method, path and body
+func hashRequest(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	he "shipyard/httperror"
+)
+
+func TestIdempotent(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	ctx = t.addNewSession(ctx, "user@example.com")
+	addItem := t.server.Idempotent(t.server.AddItem)
+
+	item := Item{Price: &Money{Amount: 10}, Description: "very good", RemainingQuantity: 1}
+	r := jsonPostRequest(t, "/api/item", item)
+	r.Header.Set(idempotencyKeyHeader, "key1")
+	w := httptest.NewRecorder()
+	resp, err := addItem(ctx, w, r)
+	assert.NoError(t, err)
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	json1, ok := resp.(*RootJSON)
+	assert.True(t, ok)
+
+	// the retry is replayed instead of creating a second item
+	w = httptest.NewRecorder()
+	r = jsonPostRequest(t, "/api/item", item)
+	r.Header.Set(idempotencyKeyHeader, "key1")
+	resp, err = addItem(ctx, w, r)
+	assert.NoError(t, err)
+	assert.Equal(t, "true", w.Header().Get(idempotencyReplayedHeader))
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+
+	raw, ok := resp.(json.RawMessage)
+	assert.True(t, ok)
+	json2 := RootJSON{}
+	assert.NoError(t, json.Unmarshal(raw, &json2))
+	assert.Equal(t, json1.Item.ID, json2.Item.ID)
+
+	items, err := t.server.DB.All_Item(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, items, 1)
+
+	// the same key with a different body is rejected
+	item.Price = &Money{Amount: 11}
+	r = jsonPostRequest(t, "/api/item", item)
+	r.Header.Set(idempotencyKeyHeader, "key1")
+	_, err = addItem(ctx, httptest.NewRecorder(), r)
+	assert.True(t, he.Unprocessable.Has(err))
+
+	// failed requests aren't stored, so they can be retried
+	item.RemainingQuantity = 0
+	r = jsonPostRequest(t, "/api/item", item)
+	r.Header.Set(idempotencyKeyHeader, "key2")
+	_, err = addItem(ctx, httptest.NewRecorder(), r)
+	assert.True(t, he.BadRequest.Has(err))
+
+	item.RemainingQuantity = 1
+	r = jsonPostRequest(t, "/api/item", item)
+	r.Header.Set(idempotencyKeyHeader, "key2")
+	_, err = addItem(ctx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+
+	// expired keys are forgotten
+	t.server.Config.IdempotencyKeyTTL = 0
+	r = jsonPostRequest(t, "/api/item", item)
+	r.Header.Set(idempotencyKeyHeader, "key2")
+	w = httptest.NewRecorder()
+	_, err = addItem(ctx, w, r)
+	assert.NoError(t, err)
+	assert.Equal(t, "", w.Header().Get(idempotencyReplayedHeader))
+
+	items, err = t.server.DB.All_Item(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, items, 3)
+
+	// a status the handler writes is replayed too
+	t.server.Config.IdempotencyKeyTTL = time.Hour
+	created := t.server.Idempotent(func(ctx context.Context,
+		w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		w.Header().Set("Location", "/api/thing/1")
+		w.WriteHeader(http.StatusCreated)
+		return map[string]string{"id": "1"}, nil
+	})
+	for _, replayed := range []string{"", "true"} {
+		r = jsonPostRequest(t, "/api/thing", nil)
+		r.Header.Set(idempotencyKeyHeader, "key3")
+		w = httptest.NewRecorder()
+		_, err = created(ctx, w, r)
+		assert.NoError(t, err)
+		assert.Equal(t, replayed, w.Header().Get(idempotencyReplayedHeader))
+		assert.Equal(t, http.StatusCreated, w.Code)
+		assert.Equal(t, "/api/thing/1", w.Header().Get("Location"))
+	}
+
+	// the response is stored even when the client has gone away by the time
+	// the handler is done, so that its retry is replayed
+	cancelCtx, cancel := context.WithCancel(ctx)
+	abandoned := t.server.Idempotent(func(ctx context.Context,
+		w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		resp, err := t.server.AddItem(ctx, w, r)
+		cancel()
+		return resp, err
+	})
+	r = jsonPostRequest(t, "/api/item", item)
+	r.Header.Set(idempotencyKeyHeader, "key4")
+	_, err = abandoned(cancelCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+
+	r = jsonPostRequest(t, "/api/item", item)
+	r.Header.Set(idempotencyKeyHeader, "key4")
+	w = httptest.NewRecorder()
+	_, err = addItem(ctx, w, r)
+	assert.NoError(t, err)
+	assert.Equal(t, "true", w.Header().Get(idempotencyReplayedHeader))
+
+	// bodies over the cap are refused before the handler's own limits apply
+	t.server.Config.IdempotencyMaxBody = 64
+	item.Description = strings.Repeat("long ", 20)
+	r = jsonPostRequest(t, "/api/item", item)
+	r.Header.Set(idempotencyKeyHeader, "key5")
+	_, err = addItem(ctx, httptest.NewRecorder(), r)
+	assert.True(t, he.TooLarge.Has(err))
+
+	// without having claimed the key
+	t.server.Config.IdempotencyMaxBody = 0
+	r = jsonPostRequest(t, "/api/item", item)
+	r.Header.Set(idempotencyKeyHeader, "key5")
+	w = httptest.NewRecorder()
+	_, err = addItem(ctx, w, r)
+	assert.NoError(t, err)
+	assert.Equal(t, "", w.Header().Get(idempotencyReplayedHeader))
+}
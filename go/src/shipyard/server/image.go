@@ -0,0 +1,557 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif" // for image.Decode
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+
+	"github.com/go-chi/chi"
+
+	"shipyard/config"
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/storage"
+	"shipyard/util"
+)
+
+const (
+	maxItemImages       = 10
+	defaultMaxImageSize = 5 << 20
+	maxImagePixels      = 50 * 1000 * 1000
+	thumbnailSize       = 256
+)
+
+// imageFormats are the content types that can be uploaded, as sniffed from
+// the image rather than what the client says it is
+var imageFormats = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+func newImageStore(configs *config.Configs) storage.BlobStore {
+	switch configs.ImageStore {
+	case "local":
+		return storage.NewLocal(configs.ImageDir)
+	case "s3":
+		return storage.NewS3(configs.S3Endpoint, configs.S3Bucket,
+			configs.S3Region, configs.S3AccessKey, configs.S3SecretKey)
+	}
+	return storage.NewMemory()
+}
+
+func (s *Server) maxImageSize() int64 {
+	if s.Config.MaxImageSize > 0 {
+		return s.Config.MaxImageSize
+	}
+	return defaultMaxImageSize
+}
+
+// imageURL is where the image is served by GetItemImage
+func (s *Server) imageURL(itemID, imageID string) string {
+	p := path.Join("/api/item", itemID, "image", imageID)
+	if s.Config.PublicAPIURL == nil {
+		return p
+	}
+
+	root := s.PublicAPIURL()
+	root.Path = path.Join(root.Path, p)
+	return root.String()
+}
+
+// ListItemImage will return an item's images in order
+func (s *Server) ListItemImage(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	var resp *RootJSON
+	err := s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		item, err := tx.Find_Item_By_Id(ctx,
+			database.Item_Id(chi.URLParam(r, "itemID")))
+		if err != nil {
+			return err
+		}
+
+		if item == nil {
+			return he.NotFound.New("item not found")
+		}
+
+		images, err := tx.All_ItemImage_By_ItemPk(ctx,
+			database.ItemImage_ItemPk(item.Pk))
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Images: s.apiImages(item.Id, images)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// AddItemImage will upload an image for an item owned by the active user. the
+// image is the "image" field of a multipart/form-data body, and is added
+// after the item's other images. a thumbnail is made for it
+func (s *Server) AddItemImage(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := readImageUpload(w, r, s.maxImageSize())
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := http.DetectContentType(data)
+	if !imageFormats[contentType] {
+		return nil, he.BadRequest.New("images must be JPEG, PNG or GIF, "+
+			"not %s", contentType)
+	}
+
+	// the size is checked before decoding so a small file can't claim to be
+	// huge and use up the memory
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, he.BadRequest.New("can't read the image: %s", err)
+	}
+
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return nil, he.BadRequest.New("images can be at most %d pixels",
+			maxImagePixels)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, he.BadRequest.New("can't read the image: %s", err)
+	}
+
+	thumb, err := encodeThumbnail(img, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	itemID := chi.URLParam(r, "itemID")
+	imageID := util.MustUUID4()
+	blobKey := path.Join("items", itemID, imageID)
+	thumbnailKey := blobKey + "-thumbnail"
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		item, err := findOwnedItem(ctx, tx, itemID, userPk)
+		if err != nil {
+			return err
+		}
+
+		count, err := tx.Count_ItemImage_By_ItemPk(ctx,
+			database.ItemImage_ItemPk(item.Pk))
+		if err != nil {
+			return err
+		}
+
+		if count >= maxItemImages {
+			return he.Conflict.New("an item can have at most %d images",
+				maxItemImages)
+		}
+
+		// the blobs are stored before the row so there's never a row without
+		// them. if the transaction fails, they're removed below
+		err = s.Images.Put(ctx, blobKey, data, contentType)
+		if err != nil {
+			return he.Unavailable.Wrap(err)
+		}
+
+		err = s.Images.Put(ctx, thumbnailKey, thumb,
+			thumbnailContentType(contentType))
+		if err != nil {
+			return he.Unavailable.Wrap(err)
+		}
+
+		dbImage, err := tx.Create_ItemImage(ctx,
+			database.ItemImage_Id(imageID),
+			database.ItemImage_Position(int(count)),
+			database.ItemImage_ContentType(contentType),
+			database.ItemImage_Size(len(data)),
+			database.ItemImage_Width(cfg.Width),
+			database.ItemImage_Height(cfg.Height),
+			database.ItemImage_BlobKey(blobKey),
+			database.ItemImage_ThumbnailKey(thumbnailKey),
+			database.ItemImage_ItemPk(item.Pk))
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Image: s.apiImage(item.Id, dbImage)}
+		return nil
+	})
+	if err != nil {
+		s.deleteImageBlobs(blobKey, thumbnailKey)
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// GetItemImage serves an image's bytes, or its thumbnail's with the size
+// query param set to "thumbnail". an image never changes once uploaded, so it
+// can be cached forever
+func (s *Server) GetItemImage(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	size := r.URL.Query().Get("size")
+	if size != "" && size != "thumbnail" {
+		return nil, he.BadRequest.New("size must be thumbnail or unset")
+	}
+
+	var dbImage *database.ItemImage
+	err := s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) (
+		err error) {
+		_, dbImage, err = findItemImage(ctx, tx, chi.URLParam(r, "itemID"),
+			chi.URLParam(r, "imageID"))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	key, contentType := dbImage.BlobKey, dbImage.ContentType
+	etag := fmt.Sprintf(`"%s"`, dbImage.Id)
+	if size == "thumbnail" {
+		key, contentType = dbImage.ThumbnailKey,
+			thumbnailContentType(dbImage.ContentType)
+		etag = fmt.Sprintf(`"%s-thumbnail"`, dbImage.Id)
+	}
+
+	setETag(w, etag)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		return nil, he.NotModified.New("image")
+	}
+
+	data, err := s.Images.Get(ctx, key)
+	if storage.NotFound.Has(err) {
+		return nil, he.NotFound.Wrap(err)
+	}
+	if err != nil {
+		return nil, he.Unavailable.Wrap(err)
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	return data, nil
+}
+
+// PatchItemImage will move an image of an item owned by the active user to
+// another position using JSON Merge Patch. the item's other images move up
+// or down to make room
+func (s *Server) PatchItemImage(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := decodeMergePatch(r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = patch.only("position")
+	if err != nil {
+		return nil, err
+	}
+
+	position, ok, err := patch.int("position")
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok || position < 0 {
+		return nil, he.BadRequest.New("position must be 0 or more")
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		item, dbImage, err := findItemImage(ctx, tx, chi.URLParam(r, "itemID"),
+			chi.URLParam(r, "imageID"))
+		if err != nil {
+			return err
+		}
+
+		if item.OwningUserPk == nil || *item.OwningUserPk != userPk {
+			return he.NotFound.New("item not found")
+		}
+
+		images, err := tx.All_ItemImage_By_ItemPk(ctx,
+			database.ItemImage_ItemPk(item.Pk))
+		if err != nil {
+			return err
+		}
+
+		ordered := make([]*database.ItemImage, 0, len(images))
+		for _, other := range images {
+			if other.Pk != dbImage.Pk {
+				ordered = append(ordered, other)
+			}
+		}
+		if position > len(ordered) {
+			position = len(ordered)
+		}
+		ordered = append(ordered[:position],
+			append([]*database.ItemImage{dbImage}, ordered[position:]...)...)
+
+		err = positionImages(ctx, tx, ordered)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Images: s.apiImages(item.Id, ordered)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// DeleteItemImage will remove an image of an item owned by the active user
+func (s *Server) DeleteItemImage(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	var dbImage *database.ItemImage
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		var item *database.Item
+		item, dbImage, err = findItemImage(ctx, tx, chi.URLParam(r, "itemID"),
+			chi.URLParam(r, "imageID"))
+		if err != nil {
+			return err
+		}
+
+		if item.OwningUserPk == nil || *item.OwningUserPk != userPk {
+			return he.NotFound.New("item not found")
+		}
+
+		_, err = tx.Delete_ItemImage_By_Pk(ctx,
+			database.ItemImage_Pk(dbImage.Pk))
+		if err != nil {
+			return err
+		}
+
+		images, err := tx.All_ItemImage_By_ItemPk(ctx,
+			database.ItemImage_ItemPk(item.Pk))
+		if err != nil {
+			return err
+		}
+		return positionImages(ctx, tx, images)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.deleteImageBlobs(dbImage.BlobKey, dbImage.ThumbnailKey)
+
+	return nil, nil
+}
+
+func findItemImage(ctx context.Context, tx *database.Tx, itemID,
+	imageID string) (*database.Item, *database.ItemImage, error) {
+	item, err := tx.Find_Item_By_Id(ctx, database.Item_Id(itemID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if item == nil {
+		return nil, nil, he.NotFound.New("item not found")
+	}
+
+	dbImage, err := tx.Find_ItemImage_By_Id(ctx, database.ItemImage_Id(imageID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if dbImage == nil || dbImage.ItemPk != item.Pk {
+		return nil, nil, he.NotFound.New("image not found")
+	}
+	return item, dbImage, nil
+}
+
+// positionImages numbers the images from 0 in the order given
+func positionImages(ctx context.Context, tx *database.Tx,
+	images []*database.ItemImage) error {
+	for i, dbImage := range images {
+		if dbImage.Position == i {
+			continue
+		}
+
+		err := tx.UpdateNoReturn_ItemImage_By_Pk(ctx,
+			database.ItemImage_Pk(dbImage.Pk),
+			database.ItemImage_Update_Fields{
+				Position: database.ItemImage_Position(i),
+			})
+		if err != nil {
+			return err
+		}
+		dbImage.Position = i
+	}
+	return nil
+}
+
+// deleteImageBlobs removes blobs that are no longer used. a failure only
+// leaves them behind, so it's logged rather than failing the request
+func (s *Server) deleteImageBlobs(keys ...string) {
+	for _, key := range keys {
+		err := s.Images.Delete(context.Background(), key)
+		if err != nil {
+			s.log.WithError(err).Errorf("deleting image blob %s", key)
+		}
+	}
+}
+
+// readImageUpload reads the "image" field of a multipart/form-data body. it
+// can be at most maxSize bytes
+func readImageUpload(w http.ResponseWriter, r *http.Request,
+	maxSize int64) ([]byte, error) {
+
+	// leave some room for the rest of the form
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1<<20)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, he.BadRequest.New("images must be uploaded as " +
+			"multipart/form-data")
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, he.BadRequest.New("no image field in the form")
+		}
+		if err != nil {
+			return nil, he.BadRequest.Wrap(err)
+		}
+
+		if part.FormName() != "image" {
+			continue
+		}
+
+		data, err := ioutil.ReadAll(io.LimitReader(part, maxSize+1))
+		if err != nil {
+			return nil, he.BadRequest.Wrap(err)
+		}
+
+		if int64(len(data)) > maxSize {
+			return nil, he.BadRequest.New("images can be at most %d KB",
+				maxSize/1024)
+		}
+		return data, nil
+	}
+}
+
+// thumbnailContentType is the format of a thumbnail. JPEGs stay JPEGs, and
+// the rest are made PNGs to keep their transparency
+func thumbnailContentType(contentType string) string {
+	if contentType == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+// encodeThumbnail shrinks the image to fit in a thumbnailSize square. images
+// that already fit are only re-encoded
+func encodeThumbnail(img image.Image, contentType string) ([]byte, error) {
+	thumb := shrink(img, thumbnailSize)
+
+	var buf bytes.Buffer
+	var err error
+	if thumbnailContentType(contentType) == "image/jpeg" {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, thumb)
+	}
+	if err != nil {
+		return nil, he.Unexpected.Wrap(err)
+	}
+	return buf.Bytes(), nil
+}
+
+// shrink scales the image down to fit in a size square, keeping its aspect
+// ratio. each pixel is the average of the pixels it covers
+func shrink(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	thumb := image.NewNRGBA(image.Rect(0, 0, tw, th))
+	for ty := 0; ty < th; ty++ {
+		y0 := bounds.Min.Y + ty*h/th
+		y1 := bounds.Min.Y + (ty+1)*h/th
+		for tx := 0; tx < tw; tx++ {
+			x0 := bounds.Min.X + tx*w/tw
+			x1 := bounds.Min.X + (tx+1)*w/tw
+
+			var r, g, b, a, n uint64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					b += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			thumb.Set(tx, ty, color.NRGBA64{
+				R: uint16(r / n), G: uint16(g / n), B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return thumb
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	he "shipyard/httperror"
+	"shipyard/storage"
+)
+
+func TestItemImages(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	sellerCtx := t.addNewSession(ctx, "seller@example.com")
+	ctx = t.addNewSession(ctx, "user@example.com")
+	store := storage.NewMemory()
+	t.server.Images = store
+
+	r := jsonPostRequest(t, "/api/item",
+		Item{Title: "shirt", Price: &Money{Amount: 10}, RemainingQuantity: 1})
+	resp, err := t.server.AddItem(sellerCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	itemID := resp.(*RootJSON).Item.ID
+
+	encode := func(format string, w, h int) []byte {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		var buf bytes.Buffer
+		if format == "png" {
+			assert.NoError(t, png.Encode(&buf, img))
+		} else {
+			assert.NoError(t, jpeg.Encode(&buf, img, nil))
+		}
+		return buf.Bytes()
+	}
+	upload := func(ctx context.Context, data []byte) (*Image, error) {
+		r := imagePostRequest(t, "/api/item/"+itemID+"/image", data)
+		resp, err := t.server.AddItemImage(ctx, httptest.NewRecorder(),
+			withURLParams(r, "itemID", itemID))
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Image, nil
+	}
+	download := func(id, query string) (*httptest.ResponseRecorder, []byte) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet,
+			"/api/item/"+itemID+"/image/"+id+query, nil)
+		resp, err := t.server.GetItemImage(ctx, w,
+			withURLParams(r, "itemID", itemID, "imageID", id))
+		assert.NoError(t, err)
+		return w, resp.([]byte)
+	}
+
+	wide := encode("png", 600, 300)
+	first, err := upload(sellerCtx, wide)
+	assert.NoError(t, err)
+	assert.Equal(t, "image/png", first.ContentType)
+	assert.Equal(t, 600, first.Width)
+	assert.Equal(t, 0, first.Position)
+	assert.Equal(t, "/api/item/"+itemID+"/image/"+first.ID, first.URL)
+
+	w, data := download(first.ID, "")
+	assert.Equal(t, wide, data)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	_, data = download(first.ID, "?size=thumbnail")
+	thumb, err := png.DecodeConfig(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, 256, thumb.Width)
+	assert.Equal(t, 128, thumb.Height)
+
+	r = httptest.NewRequest(http.MethodGet,
+		"/api/item/"+itemID+"/image/"+first.ID, nil)
+	r.Header.Set("If-None-Match", w.Header().Get("ETag"))
+	_, err = t.server.GetItemImage(ctx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", itemID, "imageID", first.ID))
+	assert.True(t, he.NotModified.Has(err))
+
+	second, err := upload(sellerCtx, encode("jpeg", 10, 10))
+	assert.NoError(t, err)
+	assert.Equal(t, "image/jpeg", second.ContentType)
+	assert.Equal(t, 1, second.Position)
+	assert.Equal(t, 4, store.Len())
+
+	// only images of the seller's items, sniffed as images, under the limit
+	_, err = upload(ctx, wide)
+	assert.True(t, he.NotFound.Has(err))
+	_, err = upload(sellerCtx, []byte("<html>not an image</html>"))
+	assert.True(t, he.BadRequest.Has(err))
+	t.server.Config.MaxImageSize = 100
+	_, err = upload(sellerCtx, wide)
+	assert.True(t, he.BadRequest.Has(err))
+	assert.Equal(t, 4, store.Len())
+
+	r = httptest.NewRequest(http.MethodPatch,
+		"/api/item/"+itemID+"/image/"+second.ID,
+		strings.NewReader(`{"position": 0}`))
+	resp, err = t.server.PatchItemImage(sellerCtx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", itemID, "imageID", second.ID))
+	assert.NoError(t, err)
+	images := resp.(*RootJSON).Images
+	assert.Equal(t, []string{second.ID, first.ID},
+		[]string{images[0].ID, images[1].ID})
+
+	r = httptest.NewRequest(http.MethodDelete,
+		"/api/item/"+itemID+"/image/"+second.ID, nil)
+	_, err = t.server.DeleteItemImage(sellerCtx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", itemID, "imageID", second.ID))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, store.Len())
+
+	r = httptest.NewRequest(http.MethodGet, "/api/item/"+itemID, nil)
+	resp, err = t.server.GetItem(ctx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", itemID))
+	assert.NoError(t, err)
+	images = resp.(*RootJSON).Item.Images
+	assert.Len(t, images, 1)
+	assert.Equal(t, first.ID, images[0].ID)
+	assert.Equal(t, 0, images[0].Position)
+}
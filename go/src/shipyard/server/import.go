@@ -0,0 +1,751 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/money"
+)
+
+const (
+	maxImportSize    = 16 << 20
+	maxImportRows    = 5000
+	maxImportLine    = 1 << 20
+	exportPageSize   = 500
+	catalogCSV       = "csv"
+	catalogNDJSON    = "ndjson"
+	catalogTagsSplit = ";"
+)
+
+// catalogColumns are the columns of a CSV catalog. price and variant_price are
+// amounts in the currency's minor units, tags are separated by semicolons, and
+// attributes and variant_attributes are JSON objects
+var catalogColumns = []string{"sku", "item_id", "variant_id", "title",
+	"description", "image_url", "price", "currency", "variant_price",
+	"remaining_quantity", "category_id", "tags", "attributes",
+	"variant_attributes"}
+
+// errImportRolledBack rolls back an import that is a dry run or has errors
+var errImportRolledBack = errors.New("import rolled back")
+
+// ImportItem will add or update the active user's items from a CSV or JSON
+// Lines catalog, one variant per row. rows are matched to the user's variants
+// by sku, or by variant_id for the default variants that have none. a new sku
+// is added as a variant of the row's item_id, or as a new item when there is
+// none. every row is imported in one transaction, which is
+// only committed if none of them have errors and it isn't a dry run
+func (s *Server) ImportItem(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := catalogFormat(r)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ImportResult{}
+	if dryRun := r.URL.Query().Get("dry_run"); dryRun != "" {
+		result.DryRun, err = strconv.ParseBool(dryRun)
+		if err != nil {
+			return nil, he.BadRequest.New("dry_run must be true or false")
+		}
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxImportSize)
+	var rows []*CatalogRow
+	var rowErrs []error
+	if format == catalogCSV {
+		rows, rowErrs, err = readCatalogCSV(body)
+	} else {
+		rows, rowErrs, err = readCatalogNDJSON(body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Rows = len(rows)
+
+	rowError := func(i int, err error) {
+		result.Errors = append(result.Errors, &ImportError{
+			Row:   i + 1,
+			SKU:   rows[i].SKU,
+			Error: err.Error(),
+		})
+	}
+
+	// the items the rows changed, as they were left by the last row that
+	// changed each of them
+	changed := map[int64]*database.Item{}
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		seen := make(map[string]bool, len(rows))
+		for i, row := range rows {
+			if rowErrs[i] != nil {
+				rowError(i, rowErrs[i])
+				continue
+			}
+
+			row.SKU = strings.TrimSpace(row.SKU)
+			key := "sku " + row.SKU
+			if row.SKU == "" {
+				key = "variant " + row.VariantID
+			}
+			if seen[key] {
+				rowError(i, he.Conflict.New("%s is in more than one row", key))
+				continue
+			}
+			seen[key] = true
+
+			item, created, err := s.importRow(ctx, tx, userPk, row)
+			if err != nil {
+				if !isRowError(err) {
+					return err
+				}
+				rowError(i, err)
+				continue
+			}
+			if item != nil {
+				changed[item.Pk] = item
+			}
+
+			if !created {
+				result.Updated++
+				continue
+			}
+			result.Created++
+		}
+
+		if result.DryRun || len(result.Errors) > 0 {
+			return errImportRolledBack
+		}
+		return nil
+	})
+	if err != nil && err != errImportRolledBack {
+		return nil, err
+	}
+
+	if err == nil {
+		result.Applied = true
+		for _, item := range changed {
+			s.publishInventory(item)
+		}
+	}
+
+	if result.Errors == nil {
+		result.Errors = []*ImportError{}
+	}
+
+	return &RootJSON{Import: result}, nil
+}
+
+// ExportItem will stream every variant of the active user's items as CSV or
+// JSON Lines, in the format ImportItem takes. it is written a page at a time,
+// so an error part way through can only be logged
+func (s *Server) ExportItem(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	format, err := catalogFormat(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var writeRow func(row *CatalogRow) error
+	var flush func() error
+	if format == catalogCSV {
+		cw := csv.NewWriter(w)
+		writeRow = func(row *CatalogRow) error {
+			return cw.Write(catalogRecord(row))
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	} else {
+		enc := json.NewEncoder(w)
+		writeRow = func(row *CatalogRow) error {
+			return enc.Encode(row)
+		}
+		flush = func() error { return nil }
+	}
+
+	for offset := int64(0); ; offset += exportPageSize {
+		page, err := s.DB.Limited_Variant_Item_By_SellerPk(ctx,
+			database.Item_OwningUserPk(userPk), exportPageSize, offset)
+		if err != nil {
+			if offset == 0 {
+				return nil, err
+			}
+			s.log.WithError(err).Errorf("failed to export catalog")
+			return []byte{}, nil
+		}
+
+		if offset == 0 {
+			w.Header().Set("Content-Type", catalogContentType(format))
+			w.Header().Set("Content-Disposition",
+				`attachment; filename="catalog.`+format+`"`)
+			if format == catalogCSV {
+				err = writeRow(nil)
+				if err != nil {
+					s.log.WithError(err).Errorf("failed to export catalog")
+					return []byte{}, nil
+				}
+			}
+		}
+
+		for _, row := range page {
+			err = writeRow(catalogRowOf(&row.Item, &row.Variant))
+			if err != nil {
+				s.log.WithError(err).Errorf("failed to export catalog")
+				return []byte{}, nil
+			}
+		}
+
+		err = flush()
+		if err != nil {
+			s.log.WithError(err).Errorf("failed to export catalog")
+			return []byte{}, nil
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+
+		if len(page) < exportPageSize {
+			return []byte{}, nil
+		}
+	}
+}
+
+// importRow adds or updates the variant with the row's sku, or the row's
+// variant_id when it has no sku. item is the existing item it changed, if any,
+// and created is whether a variant was added
+func (s *Server) importRow(ctx context.Context, tx *database.Tx,
+	sellerPk int64, row *CatalogRow) (
+	item *database.Item, created bool, err error) {
+
+	var variant *database.Variant
+	if row.SKU == "" {
+		// an item's default variant is exported without a sku, so it can only
+		// be updated in place
+		if row.ItemID == "" || row.VariantID == "" {
+			return nil, false, he.BadRequest.New(
+				"a row without a sku needs an item_id and variant_id")
+		}
+
+		_, variant, err = findOwnedVariant(ctx, tx, row.ItemID, row.VariantID,
+			sellerPk)
+	} else {
+		variant, err = tx.Find_Variant_By_Sku_And_SellerPk(ctx,
+			database.Variant_Sku(row.SKU), database.Item_OwningUserPk(sellerPk))
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if variant == nil {
+		if row.VariantID != "" {
+			return nil, false, he.NotFound.New("variant %s doesn't have sku %s",
+				row.VariantID, row.SKU)
+		}
+
+		if row.ItemID == "" {
+			return nil, true, s.importItem(ctx, tx, sellerPk, row)
+		}
+
+		item, err = findOwnedItem(ctx, tx, row.ItemID, sellerPk)
+		if err != nil {
+			return nil, false, err
+		}
+
+		item, err = importItemFields(ctx, tx, item, row)
+		if err != nil {
+			return nil, false, err
+		}
+
+		added := &Variant{
+			SKU:        row.SKU,
+			Price:      row.VariantPrice,
+			Attributes: row.VariantAttributes,
+		}
+		if row.RemainingQuantity != nil {
+			added.RemainingQuantity = *row.RemainingQuantity
+		}
+
+		dbVariant, err := addVariant(ctx, tx, item, added)
+		if err != nil {
+			return nil, false, err
+		}
+
+		item, _, err = adjustStock(ctx, tx, item, nil,
+			dbVariant.RemainingQuantity)
+		return item, true, err
+	}
+
+	if row.VariantID != "" && row.VariantID != variant.Id {
+		return nil, false, he.Conflict.New("sku %s belongs to another variant",
+			row.SKU)
+	}
+
+	item, err = tx.Get_Item_By_Pk(ctx, database.Item_Pk(variant.ItemPk))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if row.ItemID != "" && row.ItemID != item.Id {
+		return nil, false, he.Conflict.New("sku %s belongs to another item",
+			row.SKU)
+	}
+
+	item, err = importItemFields(ctx, tx, item, row)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ups := database.Variant_Update_Fields{}
+	changed := false
+	if row.VariantPrice != nil {
+		override, err := variantPriceOverride(item, row.VariantPrice)
+		if err != nil {
+			return nil, false, err
+		}
+		ups.Price = database.Variant_Price_Raw(override)
+		changed = true
+	}
+
+	if row.VariantAttributes != nil {
+		merged, err := mergeAttributes(variant.Attributes, row.VariantAttributes)
+		if err != nil {
+			return nil, false, err
+		}
+		ups.Attributes = database.Variant_Attributes(merged)
+		changed = true
+	}
+
+	if changed {
+		variant, err = tx.Update_Variant_By_Pk(ctx,
+			database.Variant_Pk(variant.Pk), ups)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	if row.RemainingQuantity != nil {
+		if *row.RemainingQuantity < 0 {
+			return nil, false, he.BadRequest.New(
+				"remaining_quantity can't be negative")
+		}
+
+		item, _, err = adjustStock(ctx, tx, item, variant,
+			*row.RemainingQuantity-variant.RemainingQuantity)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return item, false, nil
+}
+
+// importItem adds an item with the row's variant as its only one
+func (s *Server) importItem(ctx context.Context, tx *database.Tx,
+	sellerPk int64, row *CatalogRow) error {
+
+	item := &Item{
+		Price:      row.Price,
+		Tags:       row.Tags,
+		Attributes: row.Attributes,
+		Variants: []*Variant{{
+			SKU:        row.SKU,
+			Price:      row.VariantPrice,
+			Attributes: row.VariantAttributes,
+		}},
+	}
+	if row.Title != nil {
+		item.Title = *row.Title
+	}
+	if row.Description != nil {
+		item.Description = *row.Description
+	}
+	if row.ImageURL != nil {
+		item.ImageURL = *row.ImageURL
+	}
+	if row.CategoryID != nil {
+		item.CategoryID = *row.CategoryID
+	}
+	if row.RemainingQuantity != nil {
+		item.Variants[0].RemainingQuantity = *row.RemainingQuantity
+	}
+
+	_, _, err := s.createItem(ctx, tx, sellerPk, item)
+	return err
+}
+
+// importItemFields updates the item with the row's item fields, like
+// PatchItem would. a price without a currency keeps the item's currency
+func importItemFields(ctx context.Context, tx *database.Tx,
+	item *database.Item, row *CatalogRow) (*database.Item, error) {
+
+	ups := database.Item_Update_Fields{}
+	changed := false
+	if row.Title != nil {
+		ups.Title = database.Item_Title(strings.TrimSpace(*row.Title))
+		changed = true
+	}
+
+	if row.Description != nil {
+		ups.Description = database.Item_Description(*row.Description)
+		changed = true
+	}
+
+	if row.ImageURL != nil {
+		ups.ImageUrl = database.Item_ImageUrl(*row.ImageURL)
+		changed = true
+	}
+
+	if row.Price != nil {
+		if row.Price.Amount < 0 {
+			return nil, he.BadRequest.New("price can't be negative")
+		}
+		ups.Price = database.Item_Price(row.Price.Amount)
+
+		if row.Price.Currency != "" {
+			currency, err := money.ParseCurrency(row.Price.Currency)
+			if err != nil {
+				return nil, he.BadRequest.Wrap(err)
+			}
+			ups.Currency = database.Item_Currency(currency.Code)
+		}
+		changed = true
+	}
+
+	if row.CategoryID != nil {
+		err := checkCategory(ctx, tx, *row.CategoryID)
+		if err != nil {
+			return nil, err
+		}
+		ups.CategoryId = database.Item_CategoryId(*row.CategoryID)
+		changed = true
+	}
+
+	if row.Tags != nil {
+		encoded, err := encodeTags(row.Tags)
+		if err != nil {
+			return nil, err
+		}
+		ups.Tags = database.Item_Tags(encoded)
+		changed = true
+	}
+
+	if row.Attributes != nil {
+		merged, err := mergeAttributes(item.Attributes, row.Attributes)
+		if err != nil {
+			return nil, err
+		}
+		ups.Attributes = database.Item_Attributes(merged)
+		changed = true
+	}
+
+	if !changed {
+		return item, nil
+	}
+
+	ups.Version = database.Item_Version(item.Version + 1)
+	return tx.Update_Item_By_Pk(ctx, database.Item_Pk(item.Pk), ups)
+}
+
+// isRowError is whether err is only wrong with the row being imported, rather
+// than with the import as a whole
+func isRowError(err error) bool {
+	return he.BadRequest.Has(err) || he.NotFound.Has(err) ||
+		he.Conflict.Has(err)
+}
+
+// catalogFormat is the format of the catalog being imported or exported, from
+// the format query parameter, or else the request's Content-Type. exports are
+// CSV by default
+func catalogFormat(r *http.Request) (string, error) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		if r.Method == http.MethodGet {
+			return catalogCSV, nil
+		}
+		format, _, _ = mime.ParseMediaType(r.Header.Get("Content-Type"))
+	}
+
+	switch strings.ToLower(format) {
+	case "csv", "text/csv":
+		return catalogCSV, nil
+	case "ndjson", "jsonl", "application/x-ndjson", "application/jsonl",
+		"application/x-jsonlines":
+		return catalogNDJSON, nil
+	}
+	return "", he.BadRequest.New("a catalog must be CSV (text/csv) or " +
+		"JSON Lines (application/x-ndjson)")
+}
+
+func catalogContentType(format string) string {
+	if format == catalogCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
+
+// readCatalogCSV reads a CSV catalog, which starts with a header naming its
+// columns. a row that can't be read has an error in rowErrs instead
+func readCatalogCSV(body io.Reader) (rows []*CatalogRow, rowErrs []error,
+	err error) {
+
+	reader := csv.NewReader(body)
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil, he.BadRequest.New("a CSV catalog needs a header")
+	}
+	if err != nil {
+		return nil, nil, he.BadRequest.Wrap(err)
+	}
+	header = append([]string(nil), header...)
+
+	known := make(map[string]bool, len(catalogColumns))
+	for _, column := range catalogColumns {
+		known[column] = true
+	}
+	hasSKU := false
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+		if !known[column] {
+			return nil, nil, he.BadRequest.New("unknown column %q", column)
+		}
+		hasSKU = hasSKU || column == "sku"
+		header[i] = column
+	}
+	if !hasSKU {
+		return nil, nil, he.BadRequest.New("a CSV catalog needs a sku column")
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, he.BadRequest.Wrap(err)
+		}
+
+		if len(rows) == maxImportRows {
+			return nil, nil, he.BadRequest.New("a catalog can have at most %d "+
+				"rows", maxImportRows)
+		}
+
+		row, err := parseCatalogRecord(header, record)
+		rows = append(rows, row)
+		rowErrs = append(rowErrs, err)
+	}
+	return rows, rowErrs, nil
+}
+
+func parseCatalogRecord(header, record []string) (*CatalogRow, error) {
+	row := &CatalogRow{}
+	var currency string
+	for i, column := range header {
+		value := record[i]
+		if value == "" {
+			continue
+		}
+
+		switch column {
+		case "sku":
+			row.SKU = value
+		case "item_id":
+			row.ItemID = strings.TrimSpace(value)
+		case "variant_id":
+			row.VariantID = strings.TrimSpace(value)
+		case "title":
+			row.Title = &value
+		case "description":
+			row.Description = &value
+		case "image_url":
+			row.ImageURL = &value
+		case "currency":
+			currency = strings.TrimSpace(value)
+		case "price", "variant_price", "remaining_quantity":
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return row, he.BadRequest.New("%s must be a whole number",
+					column)
+			}
+			switch column {
+			case "price":
+				row.Price = &Money{Amount: n}
+			case "variant_price":
+				row.VariantPrice = &Money{Amount: n}
+			default:
+				row.RemainingQuantity = &n
+			}
+		case "category_id":
+			value = strings.TrimSpace(value)
+			row.CategoryID = &value
+		case "tags":
+			row.Tags = strings.Split(value, catalogTagsSplit)
+		case "attributes", "variant_attributes":
+			attributes := map[string]interface{}{}
+			err := json.Unmarshal([]byte(value), &attributes)
+			if err != nil {
+				return row, he.BadRequest.New("%s must be a JSON object", column)
+			}
+			if column == "attributes" {
+				row.Attributes = attributes
+			} else {
+				row.VariantAttributes = attributes
+			}
+		}
+	}
+
+	if currency != "" {
+		if row.Price == nil {
+			return row, he.BadRequest.New("currency needs a price")
+		}
+		row.Price.Currency = currency
+		if row.VariantPrice != nil {
+			row.VariantPrice.Currency = currency
+		}
+	}
+	return row, nil
+}
+
+// readCatalogNDJSON reads a JSON Lines catalog of CatalogRows. blank lines
+// are skipped. a row that can't be read has an error in rowErrs instead
+func readCatalogNDJSON(body io.Reader) (rows []*CatalogRow, rowErrs []error,
+	err error) {
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxImportLine)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		if len(rows) == maxImportRows {
+			return nil, nil, he.BadRequest.New("a catalog can have at most %d "+
+				"rows", maxImportRows)
+		}
+
+		row := &CatalogRow{}
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(row)
+		if err != nil {
+			err = he.BadRequest.Wrap(err)
+		}
+		rows = append(rows, row)
+		rowErrs = append(rowErrs, err)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, nil, he.BadRequest.Wrap(err)
+	}
+	return rows, rowErrs, nil
+}
+
+// catalogRowOf is a variant as it's exported
+func catalogRowOf(item *database.Item, variant *database.Variant) *CatalogRow {
+	row := &CatalogRow{
+		SKU:               variant.Sku,
+		ItemID:            item.Id,
+		VariantID:         variant.Id,
+		Title:             &item.Title,
+		Description:       &item.Description,
+		ImageURL:          &item.ImageUrl,
+		Price:             apiMoney(item.Price, item.Currency),
+		RemainingQuantity: &variant.RemainingQuantity,
+		CategoryID:        &item.CategoryId,
+		Tags:              decodeTags(item.Tags),
+		Attributes:        decodeAttributes(item.Attributes),
+		VariantAttributes: decodeAttributes(variant.Attributes),
+	}
+	if variant.Price != nil {
+		row.VariantPrice = apiMoney(*variant.Price, item.Currency)
+	}
+	return row
+}
+
+// catalogRecord is a row as a CSV record, or the header for nil
+func catalogRecord(row *CatalogRow) []string {
+	if row == nil {
+		return catalogColumns
+	}
+
+	optional := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+
+	object := func(m map[string]interface{}) string {
+		if len(m) == 0 {
+			return ""
+		}
+		encoded, err := json.Marshal(m)
+		if err != nil {
+			return ""
+		}
+		return string(encoded)
+	}
+
+	var price, currency, variantPrice, remainingQuantity string
+	if row.Price != nil {
+		price = strconv.Itoa(row.Price.Amount)
+		currency = row.Price.Currency
+	}
+	if row.VariantPrice != nil {
+		variantPrice = strconv.Itoa(row.VariantPrice.Amount)
+	}
+	if row.RemainingQuantity != nil {
+		remainingQuantity = strconv.Itoa(*row.RemainingQuantity)
+	}
+
+	return []string{
+		row.SKU,
+		row.ItemID,
+		row.VariantID,
+		optional(row.Title),
+		optional(row.Description),
+		optional(row.ImageURL),
+		price,
+		currency,
+		variantPrice,
+		remainingQuantity,
+		optional(row.CategoryID),
+		strings.Join(row.Tags, catalogTagsSplit),
+		object(row.Attributes),
+		object(row.VariantAttributes),
+	}
+}
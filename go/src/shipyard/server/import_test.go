@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	he "shipyard/httperror"
+)
+
+func TestImportExport(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	ctx = t.addNewSession(ctx, "seller@example.com")
+
+	importCatalog := func(contentType, query, body string) (*ImportResult,
+		error) {
+		r := httptest.NewRequest(http.MethodPost, "/api/item/import"+query,
+			strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		resp, err := t.server.ImportItem(ctx, httptest.NewRecorder(), r)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Import, nil
+	}
+	exportCatalog := func(query string) string {
+		r := httptest.NewRequest(http.MethodGet, "/api/item/export"+query, nil)
+		w := httptest.NewRecorder()
+		b, err := t.server.ExportItem(ctx, w, r)
+		assert.NoError(t, err)
+		assert.Empty(t, b)
+		return w.Body.String()
+	}
+
+	catalog := "sku,title,price,currency,remaining_quantity,tags,attributes\n" +
+		"MUG-1,mug,500,USD,3,kitchen;blue,\"{\"\"color\"\":\"\"blue\"\"}\"\n" +
+		"CUP-1,cup,300,,2,,\n"
+
+	// a dry run changes nothing
+	result, err := importCatalog("text/csv", "?dry_run=true", catalog)
+	assert.NoError(t, err)
+	assert.True(t, result.DryRun)
+	assert.False(t, result.Applied)
+	assert.Equal(t, 2, result.Created)
+	assert.Empty(t, result.Errors)
+	assert.Equal(t, "sku,item_id,variant_id,title,description,image_url,"+
+		"price,currency,variant_price,remaining_quantity,category_id,tags,"+
+		"attributes,variant_attributes\n", exportCatalog(""))
+
+	result, err = importCatalog("text/csv", "", catalog)
+	assert.NoError(t, err)
+	assert.True(t, result.Applied)
+	assert.Equal(t, 2, result.Created)
+
+	var rows []*CatalogRow
+	for _, line := range strings.Split(strings.TrimSpace(
+		exportCatalog("?format=ndjson")), "\n") {
+		row := &CatalogRow{}
+		assert.NoError(t, json.Unmarshal([]byte(line), row))
+		rows = append(rows, row)
+	}
+	assert.Len(t, rows, 2)
+	mug := rows[0]
+	assert.Equal(t, "MUG-1", mug.SKU)
+	assert.Equal(t, "mug", *mug.Title)
+	assert.Equal(t, 500, mug.Price.Amount)
+	assert.Equal(t, 3, *mug.RemainingQuantity)
+	assert.Equal(t, []string{"kitchen", "blue"}, mug.Tags)
+	assert.Equal(t, "blue", mug.Attributes["color"])
+
+	// rows are upserted by sku, and a new sku with an item_id is another
+	// variant of that item
+	result, err = importCatalog("application/x-ndjson", "",
+		`{"sku": "MUG-1", "remaining_quantity": 5}`+"\n\n"+
+			`{"sku": "MUG-2", "item_id": "`+mug.ItemID+`", `+
+			`"remaining_quantity": 1, "variant_price": {"amount": 700}}`+"\n")
+	assert.NoError(t, err)
+	assert.True(t, result.Applied)
+	assert.Equal(t, 1, result.Created)
+	assert.Equal(t, 1, result.Updated)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/item/"+mug.ItemID, nil)
+	resp, err := t.server.GetItem(ctx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", mug.ItemID))
+	assert.NoError(t, err)
+	item := resp.(*RootJSON).Item
+	assert.Equal(t, "mug", item.Title)
+	assert.Equal(t, 6, item.RemainingQuantity)
+	assert.Len(t, item.Variants, 2)
+	assert.Equal(t, 700, item.Variants[1].Price.Amount)
+
+	// nothing is applied when any row has an error
+	result, err = importCatalog("text/csv", "",
+		"sku,remaining_quantity,price\n"+
+			"MUG-1,9,\n"+
+			",1,100\n"+
+			"CUP-1,lots,\n"+
+			"MUG-1,1,\n"+
+			"HAT-1,0,100\n")
+	assert.NoError(t, err)
+	assert.False(t, result.Applied)
+	assert.Equal(t, 5, result.Rows)
+	assert.Len(t, result.Errors, 4)
+	for i, row := range []int{2, 3, 4, 5} {
+		assert.Equal(t, row, result.Errors[i].Row)
+	}
+	assert.Contains(t, exportCatalog(""), "MUG-1,"+mug.ItemID+","+
+		mug.VariantID+",mug,,,500,USD,,5,")
+
+	// an item added without variants exports its default variant with no sku,
+	// which is matched by its variant_id when it's imported again
+	plain := t.addItem(ctx, Item{Title: "plain",
+		Price: &Money{Amount: 100, Currency: "USD"}, RemainingQuantity: 4})
+	exported := exportCatalog("")
+	assert.Contains(t, exported, "\n,"+plain.ID+",")
+	result, err = importCatalog("text/csv", "", exported)
+	assert.NoError(t, err)
+	assert.True(t, result.Applied)
+	assert.Empty(t, result.Errors)
+	assert.Equal(t, 0, result.Created)
+	assert.Equal(t, 4, result.Updated)
+	assert.Equal(t, exported, exportCatalog(""))
+
+	plainVariant := plain.Variants[0].ID
+	result, err = importCatalog("application/x-ndjson", "",
+		`{"item_id": "`+plain.ID+`", "variant_id": "`+plainVariant+`", `+
+			`"remaining_quantity": 7}`+"\n")
+	assert.NoError(t, err)
+	assert.True(t, result.Applied)
+	assert.Equal(t, 1, result.Updated)
+	assert.Contains(t, exportCatalog(""), ","+plain.ID+","+plainVariant+
+		",plain,")
+	assert.Contains(t, exportCatalog(""), ",7,")
+
+	_, err = importCatalog("text/csv", "", "title\nmug\n")
+	assert.True(t, he.BadRequest.Has(err))
+	_, err = importCatalog("application/json", "", `{"sku": "MUG-1"}`)
+	assert.True(t, he.BadRequest.Has(err))
+}
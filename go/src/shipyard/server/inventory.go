@@ -0,0 +1,259 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+)
+
+const (
+	// inventoryBuffer is how many updates a feed can fall behind by before
+	// its client is disconnected
+	inventoryBuffer = 32
+	// maxInventoryItems is how many items one feed can be subscribed to
+	maxInventoryItems = 100
+)
+
+// inventoryHub has the open inventory feeds, and hands them the updates of
+// the items they're subscribed to. unlike the event streams, updates are
+// published as soon as the change is made rather than when its event is
+// dispatched, and aren't kept for anyone not connected at the time
+type inventoryHub struct {
+	mu     sync.Mutex
+	feeds  map[*inventoryFeed]bool
+	closed bool
+}
+
+type inventoryFeed struct {
+	// items maps the subscribed item ids to the version last queued for
+	// each, or 0 before any has been. they're guarded by the hub's mu
+	items   map[string]int
+	updates chan *InventoryUpdate
+	done    chan struct{}
+	once    sync.Once
+	code    int
+	reason  string
+}
+
+// end disconnects the feed's client with the close code and reason. only the
+// first of them is used
+func (feed *inventoryFeed) end(code int, reason string) {
+	feed.once.Do(func() {
+		feed.code, feed.reason = code, reason
+		close(feed.done)
+	})
+}
+
+// open adds a feed with no subscriptions, or returns nil once the hub is
+// closed
+func (hub *inventoryHub) open() *inventoryFeed {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.closed {
+		return nil
+	}
+	if hub.feeds == nil {
+		hub.feeds = map[*inventoryFeed]bool{}
+	}
+
+	feed := &inventoryFeed{
+		items:   map[string]int{},
+		updates: make(chan *InventoryUpdate, inventoryBuffer),
+		done:    make(chan struct{}),
+	}
+	hub.feeds[feed] = true
+	return feed
+}
+
+func (hub *inventoryHub) remove(feed *inventoryFeed) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	delete(hub.feeds, feed)
+}
+
+// subscribe adds the items to the feed's subscriptions, returning the ones
+// that are new to it
+func (hub *inventoryHub) subscribe(feed *inventoryFeed,
+	itemIDs []string) ([]string, error) {
+
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	var added []string
+	for _, itemID := range itemIDs {
+		if _, ok := feed.items[itemID]; ok {
+			continue
+		}
+		if len(feed.items) >= maxInventoryItems {
+			return added, &wsError{wsClosePolicy,
+				"too many items subscribed to"}
+		}
+		feed.items[itemID] = 0
+		added = append(added, itemID)
+	}
+	return added, nil
+}
+
+func (hub *inventoryHub) unsubscribe(feed *inventoryFeed, itemIDs []string) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for _, itemID := range itemIDs {
+		delete(feed.items, itemID)
+	}
+}
+
+// publish gives the update to the feeds subscribed to its item. a feed that
+// already has the item's version, or a later one, skips it, and a feed too
+// far behind to take it is ended
+func (hub *inventoryHub) publish(update *InventoryUpdate) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for feed := range hub.feeds {
+		hub.offer(feed, update)
+	}
+}
+
+// send gives the update to the one feed, like publish
+func (hub *inventoryHub) send(feed *inventoryFeed, update *InventoryUpdate) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.offer(feed, update)
+}
+
+func (hub *inventoryHub) offer(feed *inventoryFeed, update *InventoryUpdate) {
+	version, ok := feed.items[update.ItemID]
+	if !ok || update.Version <= version {
+		return
+	}
+
+	select {
+	case feed.updates <- update:
+		feed.items[update.ItemID] = update.Version
+	default:
+		feed.end(wsClosePolicy, "too far behind")
+	}
+}
+
+// close ends every feed, and any opened after
+func (hub *inventoryHub) close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.closed = true
+	for feed := range hub.feeds {
+		feed.end(wsCloseGoingAway, "the server is shutting down")
+	}
+}
+
+// publishInventory sends the item as it now is to the inventory feeds. it's
+// only called once the change has been committed
+func (s *Server) publishInventory(item *database.Item) {
+	s.inventory.publish(apiInventoryUpdate(item))
+}
+
+// InventoryFeed will upgrade the request to a websocket that is sent the
+// remaining quantity and price of items as they change. the client sends
+// {"subscribe": [...]} and {"unsubscribe": [...]} messages of item ids, and
+// is sent each item as it is when it's subscribed to, then as it changes.
+// items that don't exist are ignored. a client that falls too far behind is
+// disconnected, and can reconnect and subscribe again
+func (s *Server) InventoryFeed(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	feed := s.inventory.open()
+	if feed == nil {
+		return nil, he.Unavailable.New("the server is shutting down")
+	}
+	defer s.inventory.remove(feed)
+
+	// the client is pinged every heartbeat, so one that hasn't been heard
+	// from for a few of them has gone
+	ws, err := acceptWebsocket(w, r, 3*s.Config.StreamHeartbeat)
+	if err != nil {
+		return nil, err
+	}
+	defer ws.Close()
+
+	// the client's messages are read while updates are written to it, and
+	// whichever side finishes first has the other finish too
+	read := make(chan error, 1)
+	go func() {
+		read <- s.readInventorySubscriptions(ctx, ws, feed)
+	}()
+
+	heartbeat := time.NewTicker(s.Config.StreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return []byte{}, nil
+		case <-feed.done:
+			_ = ws.close(feed.code, feed.reason)
+			return []byte{}, nil
+		case err := <-read:
+			if wsErr, ok := err.(*wsError); ok {
+				_ = ws.close(wsErr.code, wsErr.reason)
+			} else if err != io.EOF {
+				s.log.WithError(err).Debugf("ending inventory feed")
+			}
+			return []byte{}, nil
+		case <-heartbeat.C:
+			err = ws.writeFrame(wsOpPing, nil)
+			if err != nil {
+				return []byte{}, nil
+			}
+		case update := <-feed.updates:
+			data, err := json.Marshal(update)
+			if err != nil {
+				s.log.WithError(err).Errorf("failed to encode inventory update")
+				return []byte{}, nil
+			}
+			err = ws.writeFrame(wsOpText, data)
+			if err != nil {
+				return []byte{}, nil
+			}
+		}
+	}
+}
+
+// readInventorySubscriptions changes the feed's subscriptions as the client
+// asks, until it closes the websocket or breaks the protocol
+func (s *Server) readInventorySubscriptions(ctx context.Context, ws *wsConn,
+	feed *inventoryFeed) error {
+
+	for {
+		message, err := ws.readMessage()
+		if err != nil {
+			return err
+		}
+
+		var subscription InventorySubscription
+		err = json.Unmarshal(message, &subscription)
+		if err != nil {
+			return &wsError{wsCloseInvalidData, "invalid subscription"}
+		}
+
+		s.inventory.unsubscribe(feed, subscription.Unsubscribe)
+		added, err := s.inventory.subscribe(feed, subscription.Subscribe)
+		if err != nil {
+			return err
+		}
+
+		for _, itemID := range added {
+			item, err := s.DB.Find_Item_By_Id(ctx, database.Item_Id(itemID))
+			if err != nil {
+				return err
+			}
+			if item == nil {
+				s.inventory.unsubscribe(feed, []string{itemID})
+				continue
+			}
+			s.inventory.send(feed, apiInventoryUpdate(item))
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInventoryFeed(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	// the feed looks subscribed items up while the test changes them
+	t.server.DB.DB.SetMaxOpenConns(1)
+	t.server.Config.StreamHeartbeat = time.Minute
+	srv := httptest.NewServer(t.server)
+	defer srv.Close()
+
+	sellerCtx := t.addNewSession(ctx, "seller@example.com")
+	buyerCtx := t.addNewSession(ctx, "buyer@example.com")
+	r := jsonPostRequest(t, "/api/item", Item{Price: &Money{Amount: 10},
+		Description: "lamp", RemainingQuantity: 10})
+	resp, err := t.server.AddItem(sellerCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	lampID := resp.(*RootJSON).Item.ID
+	chair := newItem(ctx, t, "chair", 5)
+
+	// a bare websocket client. its own frames are small enough to always
+	// have a 7 bit length
+	dial := func() (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+		assert.NoError(t, err)
+		_, err = fmt.Fprintf(conn, "GET /api/inventory HTTP/1.1\r\n"+
+			"Host: example.com\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+			"Sec-WebSocket-Version: 13\r\n\r\n")
+		assert.NoError(t, err)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		assert.NoError(t, err)
+		return conn, br, resp
+	}
+	send := func(conn net.Conn, opcode byte, payload []byte) {
+		mask := []byte{1, 2, 3, 4}
+		frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))},
+			mask...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+		_, err := conn.Write(frame)
+		assert.NoError(t, err)
+	}
+	subscribe := func(conn net.Conn, sub InventorySubscription) {
+		data, err := json.Marshal(sub)
+		assert.NoError(t, err)
+		send(conn, wsOpText, data)
+	}
+	receive := func(conn net.Conn, br *bufio.Reader) (byte, []byte) {
+		assert.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		header := make([]byte, 2)
+		_, err := io.ReadFull(br, header)
+		assert.NoError(t, err)
+		length := int(header[1] & 0x7f)
+		if length == 126 {
+			extended := make([]byte, 2)
+			_, err = io.ReadFull(br, extended)
+			assert.NoError(t, err)
+			length = int(binary.BigEndian.Uint16(extended))
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(br, payload)
+		assert.NoError(t, err)
+		return header[0] & 0x0f, payload
+	}
+	next := func(conn net.Conn, br *bufio.Reader) InventoryUpdate {
+		opcode, payload := receive(conn, br)
+		assert.Equal(t, byte(wsOpText), opcode)
+		var update InventoryUpdate
+		assert.NoError(t, json.Unmarshal(payload, &update))
+		return update
+	}
+
+	conn, br, upgrade := dial()
+	defer conn.Close()
+	assert.Equal(t, http.StatusSwitchingProtocols, upgrade.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=",
+		upgrade.Header.Get("Sec-WebSocket-Accept"))
+
+	// subscribing sends the item as it is. missing items are skipped
+	subscribe(conn, InventorySubscription{Subscribe: []string{"missing", lampID}})
+	update := next(conn, br)
+	assert.Equal(t, lampID, update.ItemID)
+	assert.Equal(t, 10, update.RemainingQuantity)
+	assert.Equal(t, 10, update.Price.Amount)
+
+	// carts taking and returning stock, and the seller changing the price, are
+	// sent. the chair isn't subscribed to
+	t.addCart(buyerCtx, lampID, 3)
+	t.addCart(buyerCtx, chair.Id, 1)
+	update = next(conn, br)
+	assert.Equal(t, lampID, update.ItemID)
+	assert.Equal(t, 7, update.RemainingQuantity)
+
+	r = jsonPostRequest(t, "/api/item/"+lampID, Item{Price: &Money{Amount: 8}})
+	_, err = t.server.UpdateItem(sellerCtx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", lampID))
+	assert.NoError(t, err)
+	update = next(conn, br)
+	assert.Equal(t, 8, update.Price.Amount)
+	assert.Equal(t, 7, update.RemainingQuantity)
+
+	r = jsonPostRequest(t, "/api/cart/"+lampID, CartItem{Quantity: 1})
+	_, err = t.server.UpdateCart(buyerCtx, httptest.NewRecorder(),
+		withURLParams(r, "cartItemID", lampID))
+	assert.NoError(t, err)
+	update = next(conn, br)
+	assert.Equal(t, 9, update.RemainingQuantity)
+
+	// so are the seller's changes to the stock of its variants
+	r = jsonPostRequest(t, "/api/item/"+lampID+"/variant", Variant{
+		SKU: "LAMP-RED", RemainingQuantity: 5})
+	resp, err = t.server.AddVariant(sellerCtx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", lampID))
+	assert.NoError(t, err)
+	redID := resp.(*RootJSON).Variant.ID
+	assert.Equal(t, 14, next(conn, br).RemainingQuantity)
+
+	r = httptest.NewRequest(http.MethodPatch,
+		"/api/item/"+lampID+"/variant/"+redID,
+		strings.NewReader(`{"remaining_quantity": 2}`))
+	_, err = t.server.PatchVariant(sellerCtx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", lampID, "variantID", redID))
+	assert.NoError(t, err)
+	assert.Equal(t, 11, next(conn, br).RemainingQuantity)
+
+	r = httptest.NewRequest(http.MethodPost, "/api/item/import",
+		strings.NewReader(`{"sku": "LAMP-RED", "remaining_quantity": 4}`))
+	r.Header.Set("Content-Type", "application/x-ndjson")
+	_, err = t.server.ImportItem(sellerCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	assert.Equal(t, 13, next(conn, br).RemainingQuantity)
+
+	r = httptest.NewRequest(http.MethodDelete,
+		"/api/item/"+lampID+"/variant/"+redID, nil)
+	_, err = t.server.DeleteVariant(sellerCtx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", lampID, "variantID", redID))
+	assert.NoError(t, err)
+	assert.Equal(t, 9, next(conn, br).RemainingQuantity)
+
+	subscribe(conn, InventorySubscription{Subscribe: []string{chair.Id},
+		Unsubscribe: []string{lampID}})
+	update = next(conn, br)
+	assert.Equal(t, chair.Id, update.ItemID)
+	assert.Equal(t, 4, update.RemainingQuantity)
+
+	send(conn, wsOpPing, []byte("hi"))
+	opcode, payload := receive(conn, br)
+	assert.Equal(t, byte(wsOpPong), opcode)
+	assert.Equal(t, "hi", string(payload))
+
+	// a feed is only sent newer versions of an item, and one too far behind
+	// is ended
+	feed := t.server.inventory.open()
+	_, err = t.server.inventory.subscribe(feed, []string{lampID})
+	assert.NoError(t, err)
+	t.server.inventory.publish(&InventoryUpdate{ItemID: lampID, Version: 2})
+	t.server.inventory.publish(&InventoryUpdate{ItemID: lampID, Version: 1})
+	assert.Len(t, feed.updates, 1)
+	for version := 3; version <= inventoryBuffer+2; version++ {
+		t.server.inventory.publish(&InventoryUpdate{ItemID: lampID,
+			Version: version})
+	}
+	<-feed.done
+	assert.Equal(t, wsClosePolicy, feed.code)
+	t.server.inventory.remove(feed)
+
+	// shutting down closes the feed, and no more can be opened
+	shutdownCtx, shutdown := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		t.server.RunStreams(shutdownCtx)
+		close(done)
+	}()
+	shutdown()
+	<-done
+	opcode, payload = receive(conn, br)
+	assert.Equal(t, byte(wsOpClose), opcode)
+	assert.Equal(t, wsCloseGoingAway, int(binary.BigEndian.Uint16(payload)))
+
+	closed, _, upgrade := dial()
+	defer closed.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, upgrade.StatusCode)
+}
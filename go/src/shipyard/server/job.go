@@ -0,0 +1,450 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/zeebo/errs"
+
+	"shipyard/cron"
+	"shipyard/database"
+	he "shipyard/httperror"
+	monitor "shipyard/prometheus"
+	"shipyard/util"
+)
+
+// the kinds of jobs run by the server itself
+const (
+	JobPruneJobs      = "jobs.prune"
+	JobNotifyRestock  = "restock.notify"
+	JobDeliverWebhook = "webhook.deliver"
+	JobRefundPayment  = "payment.refund"
+	JobCapturePayment = "payment.capture"
+)
+
+// a claimed job is its worker's for jobLease, which is as long as its handler
+// is given. a job that fails is tried again after a backoff that doubles each
+// time, up to maxJobBackoff, until it has failed maxJobAttempts times and is
+// dead. succeeded jobs are kept for jobRetention
+const (
+	jobLease       = 5 * time.Minute
+	jobBackoff     = 30 * time.Second
+	maxJobBackoff  = time.Hour
+	maxJobAttempts = 5
+	jobRetention   = 7 * 24 * time.Hour
+)
+
+// JobHandler runs a job. a job whose handler fails, or whose worker went away
+// before it finished, is run again, so a handler must be able to run the same
+// job more than once
+type JobHandler func(ctx context.Context, job *database.Job) error
+
+// jobSchedule enqueues a job of kind with payload whenever schedule comes up
+type jobSchedule struct {
+	name     string
+	schedule *cron.Schedule
+	kind     string
+	payload  interface{}
+}
+
+// HandleJobs has handler run the jobs of kind, in place of any handler it had
+func (s *Server) HandleJobs(kind string, handler JobHandler) {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	if s.jobHandlers == nil {
+		s.jobHandlers = map[string]JobHandler{}
+	}
+	s.jobHandlers[kind] = handler
+}
+
+// ScheduleJob has a job of kind enqueued with payload each time the schedule
+// comes up. the name keeps track of the schedule across restarts, and across
+// servers, so that each of its runs is only enqueued once
+func (s *Server) ScheduleJob(name string, schedule *cron.Schedule,
+	kind string, payload interface{}) {
+
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	s.jobSchedules = append(s.jobSchedules, jobSchedule{
+		name:     name,
+		schedule: schedule,
+		kind:     kind,
+		payload:  payload,
+	})
+}
+
+func (s *Server) jobHandler(kind string) JobHandler {
+	s.jobsMu.RLock()
+	defer s.jobsMu.RUnlock()
+	return s.jobHandlers[kind]
+}
+
+// enqueueJob adds a job to the queue, to be run at runAt or soon after. like
+// an event, it's written in the transaction making the change that needs it
+func enqueueJob(ctx context.Context, tx *database.Tx, kind string,
+	data interface{}, runAt time.Time) error {
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+
+	return tx.CreateNoReturn_Job(ctx,
+		database.Job_Id(util.MustUUID4()),
+		database.Job_Kind(kind),
+		database.Job_Payload(string(payload)),
+		database.Job_Status(database.JobPending),
+		database.Job_Attempts(0),
+		database.Job_MaxAttempts(maxJobAttempts),
+		database.Job_RunAt(runAt.UTC()),
+		database.Job_LastError(""),
+		database.Job_Create_Fields{})
+}
+
+// RunJobs runs the queued jobs with JobWorkers workers, and enqueues the
+// scheduled ones, until ctx is cancelled. it returns once the workers have
+// finished the jobs they were running
+func (s *Server) RunJobs(ctx context.Context) {
+	workers := s.Config.JobWorkers
+	if s.DB.Driver() == database.SqliteDriver && workers > 1 {
+		s.log.Infof("running jobs with 1 worker instead of %d on sqlite",
+			workers)
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runJobWorker(ctx)
+		}()
+	}
+	defer wg.Wait()
+
+	ticker := time.NewTicker(s.Config.JobInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.ScheduleJobs(ctx)
+			if err != nil {
+				s.log.WithError(err).Errorf("failed to schedule jobs")
+			}
+
+			err = s.countJobs(ctx)
+			if err != nil {
+				s.log.WithError(err).Errorf("failed to count jobs")
+			}
+		}
+	}
+}
+
+// runJobWorker works one job after another, and waits for JobInterval when
+// there are none to work
+func (s *Server) runJobWorker(ctx context.Context) {
+	for ctx.Err() == nil {
+		worked, err := s.WorkJob(ctx)
+		if err != nil {
+			s.log.WithError(err).Errorf("failed to work job")
+		}
+		if worked && err == nil {
+			continue
+		}
+
+		timer := time.NewTimer(s.Config.JobInterval)
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// WorkJob claims the job that has been due longest and runs it, and returns
+// whether there was one to run
+func (s *Server) WorkJob(ctx context.Context) (bool, error) {
+	now := util.UTCNow()
+	jobs, err := s.DB.ClaimJobs(ctx, now, now.Add(jobLease), 1)
+	if err != nil || len(jobs) == 0 {
+		return false, err
+	}
+
+	job := jobs[0]
+	monitor.JobWaitHistogram.WithLabelValues(job.Kind).Observe(
+		now.Sub(job.RunAt).Seconds())
+
+	start := time.Now()
+	runErr := s.runJob(ctx, job)
+	result := database.JobSucceeded
+	if runErr != nil {
+		result = "failed"
+	}
+	monitor.JobDurationHistogram.WithLabelValues(job.Kind, result).Observe(
+		time.Now().Sub(start).Seconds())
+
+	return true, s.finishJob(ctx, job, runErr)
+}
+
+// runJob gives the job to its handler, turning a panic into an error
+func (s *Server) runJob(ctx context.Context, job *database.Job) (err error) {
+	handler := s.jobHandler(job.Kind)
+	if handler == nil {
+		return errs.New("no handler for %s jobs", job.Kind)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = errs.New("panic: %v", r)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, jobLease)
+	defer cancel()
+	return handler(ctx, job)
+}
+
+// finishJob records how the job went. a failed job is pending again until
+// it's out of attempts. one that failed because the server is shutting down
+// doesn't use up an attempt
+func (s *Server) finishJob(ctx context.Context, job *database.Job,
+	runErr error) error {
+
+	now := util.UTCNow()
+	ups := database.Job_Update_Fields{
+		LockedUntil: database.Job_LockedUntil_Null(),
+	}
+	switch {
+	case runErr == nil:
+		ups.Status = database.Job_Status(database.JobSucceeded)
+		ups.Finished = database.Job_Finished(now)
+	case ctx.Err() != nil:
+		ups.Status = database.Job_Status(database.JobPending)
+		ups.Attempts = database.Job_Attempts(job.Attempts - 1)
+		ups.RunAt = database.Job_RunAt(now)
+	case job.Attempts >= job.MaxAttempts:
+		s.log.WithError(runErr).Warnf("%s job %s is dead after %d attempts",
+			job.Kind, job.Id, job.Attempts)
+		ups.Status = database.Job_Status(database.JobDead)
+		ups.LastError = database.Job_LastError(runErr.Error())
+		ups.Finished = database.Job_Finished(now)
+	default:
+		backoff := jobBackoff << uint(job.Attempts-1)
+		if backoff > maxJobBackoff {
+			backoff = maxJobBackoff
+		}
+		ups.Status = database.Job_Status(database.JobPending)
+		ups.LastError = database.Job_LastError(runErr.Error())
+		ups.RunAt = database.Job_RunAt(now.Add(backoff))
+	}
+
+	// the job is finished even once ctx is cancelled, so that it isn't left
+	// waiting out its lease. a job whose lease ran out may have been claimed
+	// by another worker since, which counted another attempt, and is left to
+	// that worker. like a schedule's next_run, attempts is only compared here,
+	// and changed below, so that the updated row can still be found by it
+	return s.DB.WithTx(context.Background(), func(ctx context.Context,
+		tx *database.Tx) error {
+
+		claimed, err := tx.Update_Job_By_Pk_And_Attempts(ctx,
+			database.Job_Pk(job.Pk), database.Job_Attempts(job.Attempts),
+			database.Job_Update_Fields{
+				Attempts: database.Job_Attempts(job.Attempts),
+			})
+		if err != nil {
+			return err
+		}
+
+		if claimed == nil {
+			s.log.Warnf("%s job %s was claimed again before it finished",
+				job.Kind, job.Id)
+			return nil
+		}
+
+		return tx.UpdateNoReturn_Job_By_Pk(ctx, database.Job_Pk(job.Pk), ups)
+	})
+}
+
+// ScheduleJobs enqueues the jobs of the schedules that have come up. a
+// schedule that came up more than once since it was last enqueued, like
+// while the servers were down, is only enqueued the once
+func (s *Server) ScheduleJobs(ctx context.Context) error {
+	s.jobsMu.RLock()
+	schedules := append([]jobSchedule(nil), s.jobSchedules...)
+	s.jobsMu.RUnlock()
+
+	now := util.UTCNow()
+	var group errs.Group
+	for _, schedule := range schedules {
+		group.Add(s.scheduleJob(ctx, schedule, now))
+	}
+	return group.Err()
+}
+
+func (s *Server) scheduleJob(ctx context.Context, schedule jobSchedule,
+	now time.Time) error {
+
+	next := schedule.schedule.Next(now)
+	if next.IsZero() {
+		return errs.New("schedule %s never comes up", schedule.name)
+	}
+	spec := schedule.schedule.String()
+
+	return s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		existing, err := tx.Find_JobSchedule_By_Name(ctx,
+			database.JobSchedule_Name(schedule.name))
+		if err != nil {
+			return err
+		}
+
+		// a new schedule, or one whose spec has changed, first comes up at its
+		// next time from now
+		if existing == nil {
+			return tx.CreateNoReturn_JobSchedule(ctx,
+				database.JobSchedule_Name(schedule.name),
+				database.JobSchedule_Spec(spec),
+				database.JobSchedule_NextRun(next))
+		}
+
+		due := !existing.NextRun.After(now)
+		if existing.Spec == spec && !due {
+			return nil
+		}
+
+		// whichever server moves next_run along from what it read enqueues
+		// the job. next_run is only compared here, and moved below, since
+		// sqlite reads an updated row back by the old values of its wheres
+		updated, err := tx.Update_JobSchedule_By_Pk_And_NextRun(ctx,
+			database.JobSchedule_Pk(existing.Pk),
+			database.JobSchedule_NextRun(existing.NextRun),
+			database.JobSchedule_Update_Fields{
+				NextRun: database.JobSchedule_NextRun(existing.NextRun),
+			})
+		if err != nil || updated == nil {
+			return err
+		}
+
+		err = tx.UpdateNoReturn_JobSchedule_By_Pk(ctx,
+			database.JobSchedule_Pk(existing.Pk),
+			database.JobSchedule_Update_Fields{
+				Spec:    database.JobSchedule_Spec(spec),
+				NextRun: database.JobSchedule_NextRun(next),
+			})
+		if err != nil || existing.Spec != spec {
+			return err
+		}
+		return enqueueJob(ctx, tx, schedule.kind, schedule.payload, now)
+	})
+}
+
+// countJobs sets the queue depth gauge to the number of jobs that haven't
+// succeeded, by status
+func (s *Server) countJobs(ctx context.Context) error {
+	for _, status := range []string{database.JobPending, database.JobRunning,
+		database.JobDead} {
+
+		count, err := s.DB.Count_Job_By_Status(ctx, database.Job_Status(status))
+		if err != nil {
+			return err
+		}
+		monitor.JobQueueGauge.WithLabelValues(status).Set(float64(count))
+	}
+	return nil
+}
+
+// pruneJobs deletes the jobs that succeeded more than jobRetention ago. dead
+// jobs are kept until they're retried
+func (s *Server) pruneJobs(ctx context.Context, job *database.Job) error {
+	_, err := s.DB.Delete_Job_By_Status_And_Finished_Less(ctx,
+		database.Job_Status(database.JobSucceeded),
+		database.Job_Finished(util.UTCNow().Add(-jobRetention)))
+	return err
+}
+
+// jobStatuses are the statuses jobs can be listed by
+var jobStatuses = map[string]bool{
+	database.JobPending:   true,
+	database.JobRunning:   true,
+	database.JobSucceeded: true,
+	database.JobDead:      true,
+}
+
+// ListJob will return the jobs with the status given by the status query
+// parameter, newest first. it lists the dead jobs by default. admins only
+func (s *Server) ListJob(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	p, err := parsePage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = database.JobDead
+	}
+	if !jobStatuses[status] {
+		return nil, he.BadRequest.New("unknown status %q", status)
+	}
+
+	jobs, err := s.DB.Limited_Job_By_Status(ctx, database.Job_Status(status),
+		p.limit, p.offset)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &RootJSON{Jobs: make([]*Job, 0, len(jobs))}
+	for _, job := range jobs {
+		resp.Jobs = append(resp.Jobs, apiJob(job))
+	}
+	return resp, nil
+}
+
+// RetryJob will have a dead job run again right away, starting over with all
+// of its attempts. admins only
+func (s *Server) RetryJob(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	jobID := chi.URLParam(r, "jobID")
+	var job *database.Job
+	err := s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		existing, err := tx.Find_Job_By_Id(ctx, database.Job_Id(jobID))
+		if err != nil {
+			return err
+		}
+
+		if existing == nil {
+			return he.NotFound.New("job not found")
+		}
+
+		if existing.Status != database.JobDead {
+			return he.Conflict.New("job is %s, not dead", existing.Status)
+		}
+
+		err = tx.UpdateNoReturn_Job_By_Pk(ctx, database.Job_Pk(existing.Pk),
+			database.Job_Update_Fields{
+				Status:   database.Job_Status(database.JobPending),
+				Attempts: database.Job_Attempts(0),
+				RunAt:    database.Job_RunAt(util.UTCNow()),
+				Finished: database.Job_Finished_Null(),
+			})
+		if err != nil {
+			return err
+		}
+
+		job, err = tx.Find_Job_By_Id(ctx, database.Job_Id(jobID))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &RootJSON{Job: apiJob(job)}, nil
+}
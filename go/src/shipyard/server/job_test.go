@@ -0,0 +1,241 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/zeebo/errs"
+
+	"shipyard/cron"
+	"shipyard/database"
+	he "shipyard/httperror"
+	monitor "shipyard/prometheus"
+	"shipyard/util"
+)
+
+func TestJobs(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	t.server.Config.AdminEmails = []string{"admin@example.com"}
+	adminCtx := t.addNewSession(ctx, "admin@example.com")
+	userCtx := t.addNewSession(ctx, "user@example.com")
+
+	var ran []string
+	failures := 0
+	t.server.HandleJobs("test.record", func(ctx context.Context,
+		job *database.Job) error {
+		ran = append(ran, job.Payload)
+		return nil
+	})
+	t.server.HandleJobs("test.fail", func(ctx context.Context,
+		job *database.Job) error {
+		failures++
+		return errs.New("failure %d", failures)
+	})
+	t.server.HandleJobs("test.panic", func(ctx context.Context,
+		job *database.Job) error {
+		panic("oops")
+	})
+
+	enqueue := func(kind string, data interface{}) *database.Job {
+		err := t.server.DB.WithTx(ctx, func(ctx context.Context,
+			tx *database.Tx) error {
+			return enqueueJob(ctx, tx, kind, data, util.UTCNow())
+		})
+		assert.NoError(t, err)
+		jobs, err := t.server.DB.Limited_Job_By_Status(ctx,
+			database.Job_Status(database.JobPending), 1, 0)
+		assert.NoError(t, err)
+		assert.Len(t, jobs, 1)
+		return jobs[0]
+	}
+	find := func(job *database.Job) *database.Job {
+		found, err := t.server.DB.Find_Job_By_Id(ctx, database.Job_Id(job.Id))
+		assert.NoError(t, err)
+		return found
+	}
+	work := func() bool {
+		worked, err := t.server.WorkJob(ctx)
+		assert.NoError(t, err)
+		return worked
+	}
+	// makeDue has a job's backoff over with
+	makeDue := func(job *database.Job) {
+		assert.NoError(t, t.server.DB.UpdateNoReturn_Job_By_Pk(ctx,
+			database.Job_Pk(job.Pk), database.Job_Update_Fields{
+				RunAt: database.Job_RunAt(util.UTCNow()),
+			}))
+	}
+
+	assert.False(t, work())
+	job := enqueue("test.record", map[string]string{"hello": "world"})
+	assert.True(t, work())
+	assert.Equal(t, []string{`{"hello":"world"}`}, ran)
+	job = find(job)
+	assert.Equal(t, database.JobSucceeded, job.Status)
+	assert.Equal(t, 1, job.Attempts)
+	assert.NotNil(t, job.Finished)
+	assert.False(t, work())
+
+	// a failed job is retried after a backoff, until it's dead
+	job = enqueue("test.fail", nil)
+	assert.True(t, work())
+	job = find(job)
+	assert.Equal(t, database.JobPending, job.Status)
+	assert.Equal(t, "failure 1", job.LastError)
+	assert.True(t, job.RunAt.After(util.UTCNow().Add(jobBackoff/2)))
+	assert.False(t, work())
+	for attempt := 2; attempt <= maxJobAttempts; attempt++ {
+		makeDue(job)
+		assert.True(t, work())
+	}
+	job = find(job)
+	assert.Equal(t, database.JobDead, job.Status)
+	assert.Equal(t, maxJobAttempts, job.Attempts)
+	makeDue(job)
+	assert.False(t, work())
+
+	// jobs without a handler, or whose handler panics, fail
+	unknown := enqueue("test.unknown", nil)
+	assert.True(t, work())
+	assert.Contains(t, find(unknown).LastError, "no handler")
+	panicked := enqueue("test.panic", nil)
+	assert.True(t, work())
+	assert.Contains(t, find(panicked).LastError, "oops")
+
+	// the dead jobs are listed and can be retried by admins
+	_, err := t.server.Admin(t.server.ListJob)(userCtx, httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "/api/job", nil))
+	assert.True(t, he.Unauthorized.Has(err))
+	resp, err := t.server.Admin(t.server.ListJob)(adminCtx,
+		httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/job",
+			nil))
+	assert.NoError(t, err)
+	jobs := resp.(*RootJSON).Jobs
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, job.Id, jobs[0].ID)
+	assert.Equal(t, "failure 5", jobs[0].LastError)
+	_, err = t.server.ListJob(adminCtx, httptest.NewRecorder(),
+		httptest.NewRequest(http.MethodGet, "/api/job?status=lost", nil))
+	assert.True(t, he.BadRequest.Has(err))
+
+	retry := func(jobID string) (*Job, error) {
+		r := withURLParams(httptest.NewRequest(http.MethodPost,
+			"/api/job/"+jobID+"/retry", nil), "jobID", jobID)
+		resp, err := t.server.RetryJob(adminCtx, httptest.NewRecorder(), r)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Job, nil
+	}
+	retried, err := retry(job.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, database.JobPending, retried.Status)
+	assert.Equal(t, 0, retried.Attempts)
+	_, err = retry(job.Id)
+	assert.True(t, he.Conflict.Has(err))
+	_, err = retry("missing")
+	assert.True(t, he.NotFound.Has(err))
+	assert.True(t, work())
+	assert.Equal(t, 1, find(job).Attempts)
+
+	// a job whose worker went away is claimed again once its lease is up
+	leased := enqueue("test.record", "leased")
+	now := util.UTCNow()
+	claimed, err := t.server.DB.ClaimJobs(ctx, now, now.Add(-time.Second), 1)
+	assert.NoError(t, err)
+	assert.Len(t, claimed, 1)
+	assert.Equal(t, leased.Id, claimed[0].Id)
+	assert.True(t, work())
+	leased = find(leased)
+	assert.Equal(t, database.JobSucceeded, leased.Status)
+	assert.Equal(t, 2, leased.Attempts)
+
+	// and a worker whose lease ran out leaves the job to the worker that
+	// claimed it next
+	t.server.HandleJobs("test.slow", func(ctx context.Context,
+		job *database.Job) error {
+		later := util.UTCNow().Add(time.Hour)
+		return t.server.DB.UpdateNoReturn_Job_By_Pk(ctx,
+			database.Job_Pk(job.Pk), database.Job_Update_Fields{
+				Attempts:    database.Job_Attempts(job.Attempts + 1),
+				LockedUntil: database.Job_LockedUntil(later),
+			})
+	})
+	slow := enqueue("test.slow", nil)
+	assert.True(t, work())
+	slow = find(slow)
+	assert.Equal(t, database.JobRunning, slow.Status)
+	assert.Equal(t, 2, slow.Attempts)
+	assert.Nil(t, slow.Finished)
+
+	// while a job interrupted by the server shutting down gives its attempt
+	// back
+	cancelCtx, cancel := context.WithCancel(ctx)
+	t.server.HandleJobs("test.block", func(ctx context.Context,
+		job *database.Job) error {
+		cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	blocked := enqueue("test.block", nil)
+	worked, err := t.server.WorkJob(cancelCtx)
+	assert.NoError(t, err)
+	assert.True(t, worked)
+	blocked = find(blocked)
+	assert.Equal(t, database.JobPending, blocked.Status)
+	assert.Equal(t, 0, blocked.Attempts)
+	assert.Nil(t, blocked.LockedUntil)
+
+	// a new schedule first comes up at its next time, and each time it comes
+	// up after that is enqueued once
+	t.server.ScheduleJob("test", cron.MustParse("* * * * *"), "test.record",
+		"scheduled")
+	countPending := func() int64 {
+		count, err := t.server.DB.Count_Job_By_Status(ctx,
+			database.Job_Status(database.JobPending))
+		assert.NoError(t, err)
+		return count
+	}
+	pending := countPending()
+	assert.NoError(t, t.server.ScheduleJobs(ctx))
+	assert.Equal(t, pending, countPending())
+	schedule, err := t.server.DB.Find_JobSchedule_By_Name(ctx,
+		database.JobSchedule_Name("test"))
+	assert.NoError(t, err)
+	assert.True(t, schedule.NextRun.After(util.UTCNow()))
+
+	_, err = t.server.DB.Update_JobSchedule_By_Pk_And_NextRun(ctx,
+		database.JobSchedule_Pk(schedule.Pk),
+		database.JobSchedule_NextRun(schedule.NextRun),
+		database.JobSchedule_Update_Fields{
+			NextRun: database.JobSchedule_NextRun(
+				util.UTCNow().Add(-time.Hour)),
+		})
+	assert.NoError(t, err)
+	assert.NoError(t, t.server.ScheduleJobs(ctx))
+	assert.NoError(t, t.server.ScheduleJobs(ctx))
+	assert.Equal(t, pending+1, countPending())
+
+	// the queue depth is exported by status
+	assert.NoError(t, t.server.countJobs(ctx))
+	assert.Equal(t, float64(pending+1),
+		testutil.ToFloat64(monitor.JobQueueGauge.WithLabelValues(
+			database.JobPending)))
+
+	// succeeded jobs are pruned once they're old enough
+	assert.NoError(t, t.server.DB.UpdateNoReturn_Job_By_Pk(ctx,
+		database.Job_Pk(leased.Pk), database.Job_Update_Fields{
+			Finished: database.Job_Finished(
+				util.UTCNow().Add(-jobRetention - time.Hour)),
+		}))
+	assert.NoError(t, t.server.pruneJobs(ctx, nil))
+	assert.Nil(t, find(leased))
+	assert.NotNil(t, find(job))
+}
@@ -14,7 +14,6 @@ import (
 
 	"shipyard/database"
 	he "shipyard/httperror"
-	monitor "shipyard/prometheus"
 	"shipyard/util"
 )
 
@@ -97,15 +96,21 @@ func (s *Server) SignupComplete(ctx context.Context, w http.ResponseWriter,
 	r *http.Request) (interface{}, error) {
 
 	makeUser := func(ctx context.Context, email string) (*database.User, error) {
-		u, err := s.DB.Create_User(ctx, database.User_Id(util.MustUUID4()),
-			database.User_Email(email), database.User_ProfileUrl(""),
-			database.User_FullName(""))
+		var u *database.User
+		err := s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) (
+			err error) {
+			u, err = tx.Create_User(ctx, database.User_Id(util.MustUUID4()),
+				database.User_Email(email), database.User_ProfileUrl(""),
+				database.User_FullName(""))
+			if err != nil {
+				return err
+			}
+			return recordEvent(ctx, tx, EventUserSignedUp, u.Id, &u.Pk, apiUser(u))
+		})
 		if err != nil {
 			return nil, errs.Wrap(err)
 		}
 
-		monitor.UserGauge.Inc()
-
 		return u, nil
 	}
 
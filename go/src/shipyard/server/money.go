@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/money"
+)
+
+// parsePrice validates a price sent by the client. a price without a currency
+// is in the configured default currency
+func (s *Server) parsePrice(p *Money) (money.Money, error) {
+	if p == nil {
+		p = &Money{}
+	}
+
+	if p.Amount < 0 {
+		return money.Money{}, he.BadRequest.New("price can't be negative")
+	}
+
+	currency := p.Currency
+	if currency == "" {
+		currency = s.Config.DefaultCurrency
+	}
+
+	price, err := money.New(p.Amount, currency)
+	if err != nil {
+		return money.Money{}, he.BadRequest.Wrap(err)
+	}
+	return price, nil
+}
+
+// unitAmount is what one of the variant costs, in the item's currency.
+// variant may be nil for items that were added to carts before variants
+func unitAmount(item *database.Item, variant *database.Variant) int {
+	if variant != nil && variant.Price != nil {
+		return *variant.Price
+	}
+	return item.Price
+}
+
+// variantPrice is unitAmount in the item's currency
+func variantPrice(item *database.Item, variant *database.Variant) (
+	money.Money, error) {
+	price, err := money.New(unitAmount(item, variant), item.Currency)
+	if err != nil {
+		return money.Money{}, he.Unexpected.Wrap(err)
+	}
+	return price, nil
+}
+
+// checkCartCurrency ensures that adding the item to the user's cart won't mix
+// currencies, which can't be paid for together
+func checkCartCurrency(ctx context.Context, tx *database.Tx, userPk int64,
+	item *database.Item) error {
+
+	cartItems, err := tx.All_Item_By_CartItem_UserPk(ctx,
+		database.CartItem_UserPk(userPk))
+	if err != nil {
+		return err
+	}
+
+	for _, cartItem := range cartItems {
+		if cartItem.Currency != item.Currency {
+			return he.Conflict.New("item is priced in %s but your cart is in %s",
+				item.Currency, cartItem.Currency)
+		}
+	}
+	return nil
+}
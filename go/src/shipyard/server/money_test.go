@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	he "shipyard/httperror"
+)
+
+func TestItemCurrency(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	ctx = t.addNewSession(ctx, "user@example.com")
+
+	addItem := func(price *Money) (*Item, error) {
+		r := jsonPostRequest(t, "/api/item",
+			Item{Price: price, Description: "x", RemainingQuantity: 2})
+		resp, err := t.server.AddItem(ctx, httptest.NewRecorder(), r)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Item, nil
+	}
+
+	_, err := addItem(&Money{Amount: 100, Currency: "XYZ"})
+	assert.True(t, he.BadRequest.Has(err))
+
+	usdItem, err := addItem(&Money{Amount: 1250})
+	assert.NoError(t, err)
+	assert.Equal(t, &Money{Amount: 1250, Currency: "USD", Formatted: "$12.50"},
+		usdItem.Price)
+
+	eurItem, err := addItem(&Money{Amount: 1250, Currency: "eur"})
+	assert.NoError(t, err)
+	assert.Equal(t, "EUR", eurItem.Price.Currency)
+
+	// a price of 0 is an update, not a missing price
+	r := jsonPostRequest(t, "/api/item/"+usdItem.ID,
+		Item{Price: &Money{Amount: 0}})
+	resp, err := t.server.UpdateItem(ctx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", usdItem.ID))
+	assert.NoError(t, err)
+	assert.Equal(t, &Money{Amount: 0, Currency: "USD", Formatted: "$0.00"},
+		resp.(*RootJSON).Item.Price)
+
+	// the currency can be patched without the amount
+	r = httptest.NewRequest(http.MethodPatch, "/api/item/"+usdItem.ID,
+		strings.NewReader(`{"price": {"currency": "JPY"}}`))
+	resp, err = t.server.PatchItem(ctx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", usdItem.ID))
+	assert.NoError(t, err)
+	assert.Equal(t, "¥0", resp.(*RootJSON).Item.Price.Formatted)
+
+	// carts can't mix currencies
+	t.addCart(ctx, usdItem.ID, 1)
+	r = jsonPostRequest(t, "/api/cart", CartItem{ItemID: eurItem.ID, Quantity: 1})
+	_, err = t.server.AddCart(ctx, httptest.NewRecorder(), r)
+	assert.True(t, he.Conflict.Has(err))
+}
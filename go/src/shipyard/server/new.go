@@ -2,6 +2,7 @@ package server
 
 import (
 	"net/http"
+	"sync"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -9,15 +10,36 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"shipyard/config"
+	"shipyard/cron"
 	"shipyard/database"
 	h "shipyard/handler"
+	"shipyard/notify"
+	"shipyard/payment"
+	"shipyard/pricing"
+	"shipyard/storage"
+	"shipyard/tracking"
 )
 
 type Server struct {
-	DB     *database.DB
-	Config *config.Configs
-	log    *logrus.Entry
-	router http.Handler
+	DB       *database.DB
+	Config   *config.Configs
+	Payments payment.Provider
+	Taxes    pricing.TaxEngine
+	Images   storage.BlobStore
+	Notifier notify.Notifier
+	Tracker  tracking.Tracker
+	log      *logrus.Entry
+	router   http.Handler
+
+	subscribersMu sync.RWMutex
+	subscribers   map[string][]EventHandler
+	webhookClient *http.Client
+	streams       streamHub
+	inventory     inventoryHub
+
+	jobsMu       sync.RWMutex
+	jobHandlers  map[string]JobHandler
+	jobSchedules []jobSchedule
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -26,11 +48,27 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func New(db *database.DB, configs *config.Configs) *Server {
 	s := &Server{
-		DB:     db,
-		Config: configs,
-		log:    logrus.WithField("version", configs.Version),
+		DB:       db,
+		Config:   configs,
+		Payments: newPaymentProvider(configs),
+		Taxes:    configs.TaxRules,
+		Images:   newImageStore(configs),
+		Notifier: newNotifier(configs),
+		Tracker:  newTracker(configs),
+		log:      logrus.WithField("version", configs.Version),
+
+		webhookClient: &http.Client{Timeout: webhookTimeout},
 	}
 	s.router = router(s)
+	s.Subscribe(allEvents, s.countEvent)
+	s.Subscribe(allEvents, s.queueWebhooks)
+	s.Subscribe(allEvents, s.publishStream)
+	s.HandleJobs(JobPruneJobs, s.pruneJobs)
+	s.HandleJobs(JobNotifyRestock, s.notifyRestockJob)
+	s.HandleJobs(JobDeliverWebhook, s.deliverWebhookJob)
+	s.HandleJobs(JobRefundPayment, s.refundPaymentJob)
+	s.HandleJobs(JobCapturePayment, s.capturePaymentJob)
+	s.ScheduleJob("prune jobs", cron.MustParse("@daily"), JobPruneJobs, nil)
 	return s
 }
 
@@ -50,16 +88,18 @@ func router(s *Server) http.Handler {
 
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins: clientHosts,
-		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE",
+			"OPTIONS"},
 		AllowedHeaders: []string{"Accept", "Authorization", "Content-Type",
-			"X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+			"X-CSRF-Token", "If-Match", "If-None-Match", idempotencyKeyHeader},
+		ExposedHeaders:   []string{"Link", "ETag", idempotencyReplayedHeader},
 		AllowCredentials: true,
 		MaxAge:           300, // Maximum value not ignored by any major browsers
 	}))
 
 	mw := h.MiddlewareChain()
 	r.Method("GET", "/", mw.JSON(s.Health))
+	r.Method("GET", "/openapi.json", mw.JSON(s.OpenAPI))
 
 	// all authentication routes must be performed unauthenticated
 	authRoutes := chi.NewRouter()
@@ -73,17 +113,129 @@ func router(s *Server) http.Handler {
 
 	// all api routes must be performed authenticated
 	apiRoutes := chi.NewRouter()
-	apiMW := mw.Append(s.Authenticated) // add middleware
+	apiMW := mw.Append(s.Authenticated)  // add middleware
+	postMW := apiMW.Append(s.Idempotent) // POSTs can be safely retried
+	adminMW := apiMW.Append(s.Admin)
 	apiRoutes.Method("GET", "/", apiMW.JSON(s.UserProfile))
-	apiRoutes.Method("POST", "/address", apiMW.JSON(s.AddAddress))
+	apiRoutes.Method("GET", "/address", apiMW.JSON(s.ListAddress))
+	apiRoutes.Method("POST", "/address", postMW.JSON(s.AddAddress))
+	apiRoutes.Method("GET", "/address/{addressID}", apiMW.JSON(s.GetAddress))
+	apiRoutes.Method("PATCH", "/address/{addressID}", apiMW.JSON(s.PatchAddress))
+	apiRoutes.Method("DELETE", "/address/{addressID}",
+		apiMW.JSON(s.DeleteAddress))
 	apiRoutes.Method("GET", "/item", mw.JSON(s.ListItem)) // no auth
-	apiRoutes.Method("POST", "/item", apiMW.JSON(s.AddItem))
-	apiRoutes.Method("POST", "/item/{itemID}", apiMW.JSON(s.UpdateItem))
+	apiRoutes.Method("POST", "/item", postMW.JSON(s.AddItem))
+	apiRoutes.Method("POST", "/item/import", postMW.JSON(s.ImportItem))
+	apiRoutes.Method("GET", "/item/export", apiMW.Bytes(s.ExportItem))
+	apiRoutes.Method("GET", "/item/{itemID}", mw.JSON(s.GetItem)) // no auth
+	apiRoutes.Method("POST", "/item/{itemID}", postMW.JSON(s.UpdateItem))
+	apiRoutes.Method("PATCH", "/item/{itemID}", apiMW.JSON(s.PatchItem))
+	apiRoutes.Method("DELETE", "/item/{itemID}", apiMW.JSON(s.DeleteItem))
+	apiRoutes.Method("GET", "/item/{itemID}/image",
+		mw.JSON(s.ListItemImage)) // no auth
+	apiRoutes.Method("POST", "/item/{itemID}/image", postMW.JSON(s.AddItemImage))
+	apiRoutes.Method("GET", "/item/{itemID}/image/{imageID}",
+		mw.Bytes(s.GetItemImage)) // no auth
+	apiRoutes.Method("PATCH", "/item/{itemID}/image/{imageID}",
+		apiMW.JSON(s.PatchItemImage))
+	apiRoutes.Method("DELETE", "/item/{itemID}/image/{imageID}",
+		apiMW.JSON(s.DeleteItemImage))
+	apiRoutes.Method("GET", "/item/{itemID}/variant",
+		mw.JSON(s.ListVariant)) // no auth
+	apiRoutes.Method("POST", "/item/{itemID}/variant", postMW.JSON(s.AddVariant))
+	apiRoutes.Method("PATCH", "/item/{itemID}/variant/{variantID}",
+		apiMW.JSON(s.PatchVariant))
+	apiRoutes.Method("DELETE", "/item/{itemID}/variant/{variantID}",
+		apiMW.JSON(s.DeleteVariant))
+	apiRoutes.Method("POST", "/item/{itemID}/subscription",
+		postMW.JSON(s.SubscribeItem))
+	apiRoutes.Method("DELETE", "/item/{itemID}/subscription",
+		apiMW.JSON(s.UnsubscribeItem))
+	apiRoutes.Method("GET", "/item/{itemID}/review",
+		mw.JSON(s.ListReview)) // no auth
+	apiRoutes.Method("POST", "/item/{itemID}/review", postMW.JSON(s.AddReview))
+	apiRoutes.Method("PATCH", "/item/{itemID}/review/{reviewID}",
+		apiMW.JSON(s.PatchReview))
+	apiRoutes.Method("DELETE", "/item/{itemID}/review/{reviewID}",
+		apiMW.JSON(s.DeleteReview))
+	apiRoutes.Method("POST", "/item/{itemID}/review/{reviewID}/reply",
+		postMW.JSON(s.ReplyReview))
+	apiRoutes.Method("GET", "/category", mw.JSON(s.ListCategory)) // no auth
+	apiRoutes.Method("POST", "/category",
+		adminMW.Append(s.Idempotent).JSON(s.AddCategory))
+	apiRoutes.Method("GET", "/category/{categoryID}",
+		mw.JSON(s.GetCategory)) // no auth
+	apiRoutes.Method("PATCH", "/category/{categoryID}",
+		adminMW.JSON(s.PatchCategory))
+	apiRoutes.Method("DELETE", "/category/{categoryID}",
+		adminMW.JSON(s.DeleteCategory))
+	apiRoutes.Method("GET", "/category/{categoryID}/item",
+		mw.JSON(s.ListCategoryItem)) // no auth
 	apiRoutes.Method("GET", "/cart", apiMW.JSON(s.ListCart))
-	apiRoutes.Method("POST", "/cart", apiMW.JSON(s.AddCart))
-	apiRoutes.Method("POST", "/cart/{cartItemID}", apiMW.JSON(s.UpdateCart))
+	apiRoutes.Method("POST", "/cart", postMW.JSON(s.AddCart))
+	apiRoutes.Method("POST", "/cart/coupon", postMW.JSON(s.ApplyCartCoupon))
+	apiRoutes.Method("DELETE", "/cart/coupon", apiMW.JSON(s.RemoveCartCoupon))
+	apiRoutes.Method("POST", "/cart/{cartItemID}", postMW.JSON(s.UpdateCart))
+	apiRoutes.Method("POST", "/cart/{cartItemID}/save", postMW.JSON(s.SaveCart))
+	apiRoutes.Method("GET", "/seller/dashboard", apiMW.JSON(s.SellerDashboard))
+	apiRoutes.Method("GET", "/seller/order", apiMW.JSON(s.ListSellerOrder))
+	apiRoutes.Method("GET", "/seller/suborder", apiMW.JSON(s.ListSellerSubOrder))
+	apiRoutes.Method("POST", "/seller/suborder/{subOrderID}",
+		postMW.JSON(s.AdvanceSubOrder))
+	apiRoutes.Method("POST", "/seller/suborder/{subOrderID}/shipment",
+		postMW.JSON(s.AddShipment))
+	apiRoutes.Method("PATCH", "/seller/shipment/{shipmentID}",
+		apiMW.JSON(s.PatchShipment))
+	apiRoutes.Method("POST", "/seller/shipment/{shipmentID}/track",
+		postMW.JSON(s.TrackShipment))
+	apiRoutes.Method("GET", "/seller/{userID}", mw.JSON(s.GetSeller)) // no auth
+	apiRoutes.Method("GET", "/subscription", apiMW.JSON(s.ListSubscription))
+	apiRoutes.Method("GET", "/events", apiMW.Bytes(s.Events))
+	apiRoutes.Method("GET", "/inventory", mw.Bytes(s.InventoryFeed)) // no auth
+	apiRoutes.Method("GET", "/wishlist", apiMW.JSON(s.ListWishlist))
+	apiRoutes.Method("POST", "/wishlist", postMW.JSON(s.AddWishlist))
+	apiRoutes.Method("GET", "/wishlist/shared/{shareToken}",
+		mw.JSON(s.GetSharedWishlist)) // no auth
+	apiRoutes.Method("GET", "/wishlist/{wishlistID}", apiMW.JSON(s.GetWishlist))
+	apiRoutes.Method("PATCH", "/wishlist/{wishlistID}",
+		apiMW.JSON(s.PatchWishlist))
+	apiRoutes.Method("DELETE", "/wishlist/{wishlistID}",
+		apiMW.JSON(s.DeleteWishlist))
+	apiRoutes.Method("POST", "/wishlist/{wishlistID}/item",
+		postMW.JSON(s.AddWishlistItem))
+	apiRoutes.Method("DELETE", "/wishlist/{wishlistID}/item/{wishlistItemID}",
+		apiMW.JSON(s.DeleteWishlistItem))
+	apiRoutes.Method("POST", "/wishlist/{wishlistID}/item/{wishlistItemID}/cart",
+		postMW.JSON(s.CartWishlistItem))
 	apiRoutes.Method("GET", "/order", apiMW.JSON(s.ListOrder))
-	apiRoutes.Method("POST", "/order", apiMW.JSON(s.AddOrder))
+	apiRoutes.Method("POST", "/order", postMW.JSON(s.AddOrder))
+	apiRoutes.Method("POST", "/order/{orderedItemID}/return",
+		postMW.JSON(s.AddReturn))
+	apiRoutes.Method("GET", "/suborder", apiMW.JSON(s.ListSubOrder))
+	apiRoutes.Method("GET", "/suborder/{subOrderID}", apiMW.JSON(s.GetSubOrder))
+	apiRoutes.Method("GET", "/suborder/{subOrderID}/shipment",
+		apiMW.JSON(s.ListShipment))
+	apiRoutes.Method("GET", "/return", apiMW.JSON(s.ListReturn))
+	apiRoutes.Method("POST", "/return/{returnID}", postMW.JSON(s.ResolveReturn))
+	apiRoutes.Method("GET", "/coupon", adminMW.JSON(s.ListCoupon))
+	apiRoutes.Method("POST", "/coupon",
+		adminMW.Append(s.Idempotent).JSON(s.AddCoupon))
+	apiRoutes.Method("DELETE", "/coupon/{couponID}", adminMW.JSON(s.DeleteCoupon))
+	apiRoutes.Method("GET", "/webhook", adminMW.JSON(s.ListWebhook))
+	apiRoutes.Method("POST", "/webhook",
+		adminMW.Append(s.Idempotent).JSON(s.AddWebhook))
+	apiRoutes.Method("GET", "/webhook/{webhookID}", adminMW.JSON(s.GetWebhook))
+	apiRoutes.Method("PATCH", "/webhook/{webhookID}",
+		adminMW.JSON(s.PatchWebhook))
+	apiRoutes.Method("DELETE", "/webhook/{webhookID}",
+		adminMW.JSON(s.DeleteWebhook))
+	apiRoutes.Method("GET", "/webhook/{webhookID}/delivery",
+		adminMW.JSON(s.ListWebhookDelivery))
+	apiRoutes.Method("POST", "/webhook/{webhookID}/delivery/{deliveryID}",
+		adminMW.Append(s.Idempotent).JSON(s.RedeliverWebhook))
+	apiRoutes.Method("GET", "/job", adminMW.JSON(s.ListJob))
+	apiRoutes.Method("POST", "/job/{jobID}/retry",
+		adminMW.Append(s.Idempotent).JSON(s.RetryJob))
 	r.Mount("/api", apiRoutes)
 
 	return r
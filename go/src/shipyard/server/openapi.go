@@ -0,0 +1,1072 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi"
+
+	he "shipyard/httperror"
+)
+
+// operation documents a single route served by the router. every route
+// registered in router must have an entry in operations, keyed by
+// "<METHOD> <chi route pattern>", or TestOpenAPICoverage will fail
+type operation struct {
+	Summary string
+	// Auth is true when the route requires a "Bearer <access_token>"
+	// authorization header
+	Auth bool
+	// Request is a zero value of the JSON body expected by the route, or nil
+	// if the route doesn't expect one
+	Request interface{}
+	// Patch is true when the Request is a JSON Merge Patch of its fields
+	Patch bool
+	// Upload is the name of the file field when the route expects a
+	// multipart/form-data body instead of JSON
+	Upload string
+	// RawRequest lists the content types of the body when the route expects
+	// a file rather than JSON
+	RawRequest []string
+	// Response lists the RootJSON fields, by json name, populated on success
+	Response []string
+	// Redirect is true when the route responds with a 302 redirect instead
+	// of JSON on success
+	Redirect bool
+	// Websocket is true when the route upgrades the connection to a websocket,
+	// responding with a 101 instead of JSON on success
+	Websocket bool
+	// Raw is the content type of the successful response when it's a file
+	// rather than JSON
+	Raw string
+	// ETag is true when the successful response has an ETag header.
+	// IfNoneMatch and IfMatch are true when the route honors those headers
+	ETag        bool
+	IfNoneMatch bool
+	IfMatch     bool
+	// Errors documents any other error responses, by status code
+	Errors map[string]string
+	// Query documents the optional query params, by name
+	Query map[string]string
+}
+
+var operations = map[string]operation{
+	"GET /": {
+		Summary:  "Health check",
+		Response: []string{"response"},
+	},
+	"GET /openapi.json": {
+		Summary: "This OpenAPI specification",
+	},
+
+	"GET /auth/signup": {
+		Summary:  "Begin signing up with the identity provider",
+		Redirect: true,
+	},
+	"GET /auth/signupcomplete": {
+		Summary:  "Complete sign up with the identity provider's code",
+		Response: []string{"user", "session"},
+	},
+	"GET /auth/login": {
+		Summary:  "Begin logging in with the identity provider",
+		Redirect: true,
+	},
+	"GET /auth/logincomplete": {
+		Summary:  "Complete log in with the identity provider's code",
+		Response: []string{"user", "session"},
+	},
+	"GET /auth/logout": {
+		Summary:  "End the active session",
+		Auth:     true,
+		Response: []string{"response"},
+	},
+
+	"GET /api/": {
+		Summary:  "The active user, their session and addresses",
+		Auth:     true,
+		Response: []string{"user", "session", "addresses"},
+	},
+	"GET /api/address": {
+		Summary:  "List the active user's address book",
+		Auth:     true,
+		Response: []string{"addresses"},
+	},
+	"GET /api/address/{addressID}": {
+		Summary:  "Get one of the active user's addresses",
+		Auth:     true,
+		Response: []string{"address"},
+		ETag:     true,
+	},
+	"POST /api/address": {
+		Summary: "Add an address to the active user's profile. the first " +
+			"address added becomes the default shipping address",
+		Auth:     true,
+		Request:  Address{},
+		Response: []string{"address"},
+		ETag:     true,
+	},
+	"PATCH /api/address/{addressID}": {
+		Summary:  "Update the active user's address with a JSON Merge Patch",
+		Auth:     true,
+		Request:  Address{},
+		Patch:    true,
+		Response: []string{"address"},
+		ETag:     true,
+		IfMatch:  true,
+	},
+	"DELETE /api/address/{addressID}": {
+		Summary:  "Delete the active user's address",
+		Auth:     true,
+		Response: []string{"response"},
+	},
+	"GET /api/item": {
+		Summary:     "List the items in the marketplace, newest first",
+		Response:    []string{"items"},
+		ETag:        true,
+		IfNoneMatch: true,
+		Query:       pageQuery,
+	},
+	"POST /api/item": {
+		Summary:  "Add an item to the marketplace",
+		Auth:     true,
+		Request:  Item{},
+		Response: []string{"item"},
+		ETag:     true,
+	},
+	"POST /api/item/import": {
+		Summary: "Add or update the active user's items from a CSV or JSON " +
+			"Lines catalog, one variant per row, matched by sku, or by " +
+			"variant_id when there's none. nothing is applied unless every " +
+			"row can be",
+		Auth:       true,
+		RawRequest: []string{"text/csv", "application/x-ndjson"},
+		Response:   []string{"import"},
+		Query: map[string]string{
+			"format":  "csv or ndjson, instead of the Content-Type",
+			"dry_run": "true to check the catalog without applying it",
+		},
+	},
+	"GET /api/item/export": {
+		Summary: "Download every variant of the active user's items as a " +
+			"catalog that can be imported",
+		Auth: true,
+		Raw:  "text/csv",
+		Query: map[string]string{
+			"format": "ndjson for JSON Lines instead of CSV",
+		},
+	},
+	"GET /api/item/{itemID}": {
+		Summary:     "Get an item in the marketplace",
+		Response:    []string{"item"},
+		ETag:        true,
+		IfNoneMatch: true,
+	},
+	"POST /api/item/{itemID}": {
+		Summary:  "Update an item owned by the active user. zero values are ignored",
+		Auth:     true,
+		Request:  Item{},
+		Response: []string{"item"},
+		ETag:     true,
+		IfMatch:  true,
+	},
+	"PATCH /api/item/{itemID}": {
+		Summary:  "Update an item owned by the active user with a JSON Merge Patch",
+		Auth:     true,
+		Request:  Item{},
+		Patch:    true,
+		Response: []string{"item"},
+		ETag:     true,
+		IfMatch:  true,
+	},
+	"DELETE /api/item/{itemID}": {
+		Summary:  "Delete an item owned by the active user. fails if it has been ordered",
+		Auth:     true,
+		Response: []string{"response"},
+		IfMatch:  true,
+	},
+	"GET /api/item/{itemID}/image": {
+		Summary:  "List an item's images in order",
+		Response: []string{"images"},
+	},
+	"POST /api/item/{itemID}/image": {
+		Summary: "Upload a JPEG, PNG or GIF image for an item owned by the " +
+			"active user. it's added after the item's other images",
+		Auth:     true,
+		Upload:   "image",
+		Response: []string{"image"},
+		Errors:   map[string]string{"409": "the item has too many images"},
+	},
+	"GET /api/item/{itemID}/image/{imageID}": {
+		Summary:     "Download an image, or its thumbnail",
+		Raw:         "image/*",
+		ETag:        true,
+		IfNoneMatch: true,
+		Query: map[string]string{
+			"size": "thumbnail for an image no bigger than 256 pixels square",
+		},
+	},
+	"PATCH /api/item/{itemID}/image/{imageID}": {
+		Summary:  "Move an image to another position with a JSON Merge Patch",
+		Auth:     true,
+		Request:  Image{},
+		Patch:    true,
+		Response: []string{"images"},
+	},
+	"DELETE /api/item/{itemID}/image/{imageID}": {
+		Summary:  "Delete an image of an item owned by the active user",
+		Auth:     true,
+		Response: []string{"response"},
+	},
+	"GET /api/item/{itemID}/variant": {
+		Summary:  "List an item's variants, each with its own sku, price and stock",
+		Response: []string{"variants"},
+	},
+	"POST /api/item/{itemID}/variant": {
+		Summary:  "Add a variant to an item owned by the active user",
+		Auth:     true,
+		Request:  Variant{},
+		Response: []string{"variant"},
+		Errors:   map[string]string{"409": "the sku is already used"},
+	},
+	"PATCH /api/item/{itemID}/variant/{variantID}": {
+		Summary:  "Update a variant with a JSON Merge Patch. a null price uses the item's",
+		Auth:     true,
+		Request:  Variant{},
+		Patch:    true,
+		Response: []string{"variant"},
+		Errors:   map[string]string{"409": "the sku is already used"},
+	},
+	"DELETE /api/item/{itemID}/variant/{variantID}": {
+		Summary:  "Delete a variant. fails if it has been ordered or is the item's last",
+		Auth:     true,
+		Response: []string{"response"},
+	},
+	"POST /api/item/{itemID}/subscription": {
+		Summary: "Notify the active user when an out of stock item is back. " +
+			"subscribing again after being notified waits for the next restock",
+		Auth:     true,
+		Response: []string{"subscription"},
+		Errors:   map[string]string{"409": "the item is in stock"},
+	},
+	"DELETE /api/item/{itemID}/subscription": {
+		Summary:  "Stop notifying the active user about an item",
+		Auth:     true,
+		Response: []string{"response"},
+	},
+	"GET /api/item/{itemID}/review": {
+		Summary:  "List the reviews of an item, newest first",
+		Response: []string{"reviews"},
+		Query:    pageQuery,
+	},
+	"POST /api/item/{itemID}/review": {
+		Summary: "Review an item the active user ordered with a rating from " +
+			"1 to 5. an item can only be reviewed once by each user",
+		Auth:     true,
+		Request:  Review{},
+		Response: []string{"review"},
+		Errors: map[string]string{
+			"403": "the active user hasn't ordered the item",
+			"409": "the active user has already reviewed the item",
+		},
+	},
+	"PATCH /api/item/{itemID}/review/{reviewID}": {
+		Summary:  "Edit the active user's review with a JSON Merge Patch",
+		Auth:     true,
+		Request:  Review{},
+		Patch:    true,
+		Response: []string{"review"},
+	},
+	"DELETE /api/item/{itemID}/review/{reviewID}": {
+		Summary:  "Delete the active user's review",
+		Auth:     true,
+		Response: []string{"response"},
+	},
+	"POST /api/item/{itemID}/review/{reviewID}/reply": {
+		Summary: "Reply to a review of an item owned by the active user. an " +
+			"empty reply removes it",
+		Auth:     true,
+		Request:  Review{},
+		Response: []string{"review"},
+		Errors:   map[string]string{"403": "the active user isn't the seller"},
+	},
+	"GET /api/inventory": {
+		Summary: "Open a websocket that sends the remaining quantity and price " +
+			"of items as they change, each an InventoryUpdate. the client " +
+			"sends InventorySubscription messages of the item ids it wants, " +
+			"and is sent each newly subscribed item as it is. a client that " +
+			"falls too far behind is disconnected",
+		Websocket: true,
+		Errors: map[string]string{
+			"400": "the request isn't a websocket upgrade",
+			"503": "the server is shutting down",
+		},
+	},
+	"GET /api/category": {
+		Summary:  "List every category. they nest through their parent_id",
+		Response: []string{"categories"},
+	},
+	"POST /api/category": {
+		Summary:  "Add a category, under parent_id if it's set. admins only",
+		Auth:     true,
+		Request:  Category{},
+		Response: []string{"category"},
+		Errors:   map[string]string{"403": "the active user isn't an admin"},
+	},
+	"GET /api/category/{categoryID}": {
+		Summary:  "Get a category",
+		Response: []string{"category"},
+	},
+	"PATCH /api/category/{categoryID}": {
+		Summary: "Rename or move a category with a JSON Merge Patch. a null " +
+			"parent_id moves it to the top. admins only",
+		Auth:     true,
+		Request:  Category{},
+		Patch:    true,
+		Response: []string{"category"},
+		Errors: map[string]string{
+			"400": "the category would be moved under itself",
+			"403": "the active user isn't an admin",
+		},
+	},
+	"DELETE /api/category/{categoryID}": {
+		Summary:  "Delete a category. admins only",
+		Auth:     true,
+		Response: []string{"response"},
+		Errors: map[string]string{
+			"403": "the active user isn't an admin",
+			"409": "the category has subcategories or items",
+		},
+	},
+	"GET /api/category/{categoryID}/item": {
+		Summary: "List the items in a category and its subcategories, " +
+			"newest first",
+		Response:    []string{"items"},
+		ETag:        true,
+		IfNoneMatch: true,
+		Query:       pageQuery,
+	},
+	"GET /api/cart": {
+		Summary: "List the items in the active user's cart, and what they " +
+			"would cost to order with tax and shipping",
+		Auth:     true,
+		Response: []string{"cart_items", "cart_summary"},
+		Query: map[string]string{
+			"address_id": "price the cart for this address instead of the " +
+				"default address",
+		},
+	},
+	"POST /api/cart": {
+		Summary:  "Add an item to the active user's cart",
+		Auth:     true,
+		Request:  CartItem{},
+		Response: []string{"cart_items", "cart_summary"},
+	},
+	"POST /api/cart/coupon": {
+		Summary: "Apply a coupon code to the active user's cart, replacing " +
+			"any already applied. it's used when the cart is ordered",
+		Auth:     true,
+		Request:  ApplyCoupon{},
+		Response: []string{"cart_items", "cart_summary"},
+		Errors: map[string]string{
+			"400": "the coupon can't be used",
+			"404": "there's no coupon with the code",
+		},
+	},
+	"DELETE /api/cart/coupon": {
+		Summary:  "Remove the coupon from the active user's cart",
+		Auth:     true,
+		Response: []string{"cart_items", "cart_summary"},
+	},
+	"POST /api/cart/{cartItemID}": {
+		Summary: "Set the quantity of an item in the active user's cart. " +
+			"cartItemID is the item's id. a quantity of 0 removes it",
+		Auth:     true,
+		Request:  CartItem{},
+		Response: []string{"cart_items", "cart_summary"},
+	},
+	"POST /api/cart/{cartItemID}/save": {
+		Summary: "Move an item out of the active user's cart onto their saved " +
+			"for later list. cartItemID is found as when setting its quantity",
+		Auth:     true,
+		Response: []string{"cart_items", "cart_summary", "wishlist"},
+	},
+	"GET /api/seller/dashboard": {
+		Summary: "Summarize the active user's sales: orders, units sold and " +
+			"revenue per item, and the items low on stock",
+		Auth:     true,
+		Response: []string{"dashboard"},
+		Query: map[string]string{
+			"low_stock": "items with at most this many remaining are low on " +
+				"stock. defaults to 5",
+		},
+	},
+	"GET /api/seller/order": {
+		Summary:  "List the ordered items of the active user's items, newest first",
+		Auth:     true,
+		Response: []string{"ordered_items"},
+		Query:    pageQuery,
+	},
+	"GET /api/seller/suborder": {
+		Summary:  "List the sub orders the active user is selling, newest first",
+		Auth:     true,
+		Response: []string{"sub_orders"},
+		Query: map[string]string{
+			"status": "only list sub orders with this status",
+			"limit":  pageQuery["limit"],
+			"offset": pageQuery["offset"],
+		},
+	},
+	"POST /api/seller/suborder/{subOrderID}": {
+		Summary: "Advance a sub order the active user is selling to processing, " +
+			"shipped or delivered. it can't go back, and sub orders with " +
+			"shipments are delivered with them",
+		Auth:     true,
+		Request:  SubOrder{},
+		Response: []string{"sub_order"},
+		Errors: map[string]string{
+			"409": "the sub order is already at or past the status, or has shipments",
+		},
+	},
+	"POST /api/seller/suborder/{subOrderID}/shipment": {
+		Summary: "Add a package the active user is sending for a sub order. " +
+			"without items, it holds everything not already in a shipment",
+		Auth:     true,
+		Request:  Shipment{},
+		Response: []string{"shipment"},
+		Errors: map[string]string{
+			"409": "the sub order has been delivered, or everything has been shipped",
+		},
+	},
+	"PATCH /api/seller/shipment/{shipmentID}": {
+		Summary: "Change a shipment's carrier, tracking_number or status with " +
+			"a JSON Merge Patch. its ordered items are delivered with it",
+		Auth:     true,
+		Request:  Shipment{},
+		Patch:    true,
+		Response: []string{"shipment"},
+		Errors:   map[string]string{"409": "the shipment has been delivered"},
+	},
+	"POST /api/seller/shipment/{shipmentID}/track": {
+		Summary:  "Update a shipment with what its carrier says about it",
+		Auth:     true,
+		Response: []string{"shipment"},
+		Errors: map[string]string{
+			"409": "the carrier doesn't know the tracking number",
+			"503": "the carrier is unavailable",
+		},
+	},
+	"GET /api/seller/{userID}": {
+		Summary:  "Get a seller's profile and the items they have available",
+		Response: []string{"seller"},
+	},
+	"GET /api/events": {
+		Summary: "Stream the active user's cart changes, order status changes " +
+			"and the stock changes of items in their cart as server-sent " +
+			"events, each an event. the stream ends before the write timeout, " +
+			"and a client that reconnects with Last-Event-ID is sent what it " +
+			"missed",
+		Auth: true,
+		Raw:  "text/event-stream",
+		Errors: map[string]string{
+			"404": "the Last-Event-ID isn't an event",
+			"503": "the server is shutting down",
+		},
+	},
+	"GET /api/subscription": {
+		Summary:  "List the items the active user is waiting for, newest first",
+		Auth:     true,
+		Response: []string{"subscriptions"},
+	},
+	"GET /api/wishlist": {
+		Summary:  "List the active user's wishlists, including saved for later",
+		Auth:     true,
+		Response: []string{"wishlists"},
+	},
+	"POST /api/wishlist": {
+		Summary:  "Add a named wishlist. it's private unless public is set",
+		Auth:     true,
+		Request:  Wishlist{},
+		Response: []string{"wishlist"},
+		Errors:   map[string]string{"409": "the active user has too many wishlists"},
+	},
+	"GET /api/wishlist/shared/{shareToken}": {
+		Summary:  "Get a public wishlist by its share_url",
+		Response: []string{"wishlist"},
+	},
+	"GET /api/wishlist/{wishlistID}": {
+		Summary:  "Get one of the active user's wishlists",
+		Auth:     true,
+		Response: []string{"wishlist"},
+	},
+	"PATCH /api/wishlist/{wishlistID}": {
+		Summary:  "Rename a wishlist or change who can see it with a JSON Merge Patch",
+		Auth:     true,
+		Request:  Wishlist{},
+		Patch:    true,
+		Response: []string{"wishlist"},
+	},
+	"DELETE /api/wishlist/{wishlistID}": {
+		Summary:  "Delete a wishlist. saved for later can't be deleted",
+		Auth:     true,
+		Response: []string{"response"},
+	},
+	"POST /api/wishlist/{wishlistID}/item": {
+		Summary: "Add an item to a wishlist. items with more than one variant " +
+			"need a variant_id",
+		Auth:     true,
+		Request:  WishlistItem{},
+		Response: []string{"wishlist"},
+		Errors:   map[string]string{"409": "the wishlist has too many items"},
+	},
+	"DELETE /api/wishlist/{wishlistID}/item/{wishlistItemID}": {
+		Summary:  "Remove an item from a wishlist",
+		Auth:     true,
+		Response: []string{"wishlist"},
+	},
+	"POST /api/wishlist/{wishlistID}/item/{wishlistItemID}/cart": {
+		Summary: "Add a wishlist item's quantity to the active user's cart, if " +
+			"that many remain. saved for later items are moved off of the list",
+		Auth:     true,
+		Response: []string{"cart_items", "cart_summary", "wishlist"},
+	},
+	"GET /api/order": {
+		Summary:  "List the active user's ordered items and their returns",
+		Auth:     true,
+		Response: []string{"ordered_items"},
+	},
+	"POST /api/order": {
+		Summary: "Order items from the active user's cart. items without an " +
+			"address_id are shipped to the default address",
+		Auth:     true,
+		Request:  PlaceOrder{},
+		Response: []string{"payment", "sub_orders"},
+		Errors: map[string]string{
+			"402": "the payment was declined",
+			"400": "the cart's coupon can't be used",
+			"409": "the expected_total or an item's currency has changed",
+			"503": "the payment provider is unavailable",
+		},
+	},
+	"POST /api/order/{orderedItemID}/return": {
+		Summary: "Ask to return some of an ordered item. orderedItemID is the " +
+			"ordered item's id",
+		Auth:     true,
+		Request:  Return{},
+		Response: []string{"return"},
+		Errors: map[string]string{
+			"400": "more is being returned than was ordered",
+			"404": "the active user didn't order the item",
+		},
+	},
+	"GET /api/suborder": {
+		Summary: "List the active user's sub orders, newest first. each order " +
+			"is split into a sub order for each seller",
+		Auth:     true,
+		Response: []string{"sub_orders"},
+		Query:    pageQuery,
+	},
+	"GET /api/suborder/{subOrderID}": {
+		Summary:  "Get a sub order the active user bought or is selling",
+		Auth:     true,
+		Response: []string{"sub_order"},
+	},
+	"GET /api/suborder/{subOrderID}/shipment": {
+		Summary:  "List the shipments of a sub order the active user bought or is selling",
+		Auth:     true,
+		Response: []string{"shipments"},
+	},
+	"GET /api/return": {
+		Summary:  "List the returns of the active user's items, newest first",
+		Auth:     true,
+		Response: []string{"returns"},
+	},
+	"POST /api/return/{returnID}": {
+		Summary: "Approve or reject a return of the active user's item. " +
+			"approved returns are restocked and refunded, by default what the " +
+			"items were paid for with their tax",
+		Auth:     true,
+		Request:  ResolveReturn{},
+		Response: []string{"return"},
+		Errors: map[string]string{
+			"400": "the refund is more than is left of the payment",
+			"404": "the return isn't of the active user's item",
+			"409": "the return has already been resolved",
+		},
+	},
+	"GET /api/coupon": {
+		Summary:  "List every coupon. admins only",
+		Auth:     true,
+		Response: []string{"coupons"},
+		Errors:   map[string]string{"403": "the active user isn't an admin"},
+	},
+	"POST /api/coupon": {
+		Summary: "Add a coupon. kind is percentage, fixed or free_shipping. " +
+			"limits of 0 are unlimited. admins only",
+		Auth:     true,
+		Request:  Coupon{},
+		Response: []string{"coupon"},
+		Errors: map[string]string{
+			"403": "the active user isn't an admin",
+			"409": "a coupon with the code already exists",
+		},
+	},
+	"DELETE /api/coupon/{couponID}": {
+		Summary:  "Deactivate a coupon. admins only",
+		Auth:     true,
+		Response: []string{"response"},
+		Errors:   map[string]string{"403": "the active user isn't an admin"},
+	},
+	"GET /api/webhook": {
+		Summary:  "List every webhook. admins only",
+		Auth:     true,
+		Response: []string{"webhooks"},
+		Errors:   map[string]string{"403": "the active user isn't an admin"},
+	},
+	"POST /api/webhook": {
+		Summary: "Add a webhook that the events listed are POSTed to. each " +
+			"is signed in the X-Shipyard-Signature header with sha256= and " +
+			"the hex HMAC-SHA256, keyed by the secret, of the " +
+			"X-Shipyard-Timestamp header, a \".\" and the body. a secret is " +
+			"made up if one isn't given. admins only",
+		Auth:     true,
+		Request:  Webhook{},
+		Response: []string{"webhook"},
+		Errors: map[string]string{
+			"400": "the url or an event isn't valid",
+			"403": "the active user isn't an admin",
+		},
+	},
+	"GET /api/webhook/{webhookID}": {
+		Summary:  "Get a webhook. admins only",
+		Auth:     true,
+		Response: []string{"webhook"},
+		Errors:   map[string]string{"403": "the active user isn't an admin"},
+	},
+	"PATCH /api/webhook/{webhookID}": {
+		Summary: "Change a webhook's url, secret, events or whether it's " +
+			"active with a JSON Merge Patch. an empty secret makes up a new " +
+			"one. admins only",
+		Auth:     true,
+		Request:  Webhook{},
+		Patch:    true,
+		Response: []string{"webhook"},
+		Errors: map[string]string{
+			"400": "the url or an event isn't valid",
+			"403": "the active user isn't an admin",
+		},
+	},
+	"DELETE /api/webhook/{webhookID}": {
+		Summary:  "Remove a webhook and its deliveries. admins only",
+		Auth:     true,
+		Response: []string{"response"},
+		Errors:   map[string]string{"403": "the active user isn't an admin"},
+	},
+	"GET /api/webhook/{webhookID}/delivery": {
+		Summary: "List the deliveries of events to a webhook, newest " +
+			"first. admins only",
+		Auth:     true,
+		Response: []string{"deliveries"},
+		Query:    pageQuery,
+		Errors:   map[string]string{"403": "the active user isn't an admin"},
+	},
+	"POST /api/webhook/{webhookID}/delivery/{deliveryID}": {
+		Summary: "Send a delivery to its webhook again right away, starting " +
+			"its attempts over. admins only",
+		Auth:     true,
+		Response: []string{"delivery"},
+		Errors: map[string]string{
+			"403": "the active user isn't an admin",
+			"409": "the webhook isn't active",
+		},
+	},
+	"GET /api/job": {
+		Summary: "List the jobs with a status, newest first. the dead jobs, " +
+			"which failed every attempt they had, are listed by default. " +
+			"admins only",
+		Auth:     true,
+		Response: []string{"jobs"},
+		Query: map[string]string{
+			"status": "pending, running, succeeded or dead",
+			"limit":  pageQuery["limit"],
+			"offset": pageQuery["offset"],
+		},
+		Errors: map[string]string{"403": "the active user isn't an admin"},
+	},
+	"POST /api/job/{jobID}/retry": {
+		Summary: "Run a dead job again right away, starting its attempts " +
+			"over. admins only",
+		Auth:     true,
+		Response: []string{"job"},
+		Errors: map[string]string{
+			"403": "the active user isn't an admin",
+			"404": "the job doesn't exist",
+			"409": "the job isn't dead",
+		},
+	},
+}
+
+// OpenAPI serves an OpenAPI 3 specification describing every route in the
+// router
+func (s *Server) OpenAPI(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	routes, ok := s.router.(chi.Routes)
+	if !ok {
+		return nil, he.Unexpected.New("router can't be walked")
+	}
+
+	spec, err := openAPISpec(routes, s.Config.Version)
+	if err != nil {
+		return nil, he.Unexpected.Wrap(err)
+	}
+	return spec, nil
+}
+
+var pathParamRE = regexp.MustCompile(`{([^}:]+)(:[^}]*)?}`)
+
+// openAPISpec walks the routes to build the specification. routes without
+// an entry in operations are still listed, just undocumented
+func openAPISpec(routes chi.Routes, version string) (map[string]interface{},
+	error) {
+
+	schemas := map[string]interface{}{
+		"Error": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"error": map[string]interface{}{"type": "string"},
+			},
+		},
+	}
+	schemaOf(reflect.TypeOf(RootJSON{}), schemas)
+	// the inventory feed's messages aren't the body of any response, but are
+	// referred to by name
+	schemaOf(reflect.TypeOf(InventoryUpdate{}), schemas)
+	schemaOf(reflect.TypeOf(InventorySubscription{}), schemas)
+	rootSchema := schemas["RootJSON"].(map[string]interface{})
+	rootProps := rootSchema["properties"].(map[string]interface{})
+
+	paths := map[string]map[string]interface{}{}
+	err := chi.Walk(routes, func(method, route string, _ http.Handler,
+		_ ...func(http.Handler) http.Handler) error {
+
+		op := operations[method+" "+route]
+
+		path := route
+		if len(path) > 1 {
+			path = strings.TrimSuffix(path, "/")
+		}
+
+		spec := map[string]interface{}{
+			"summary":   op.Summary,
+			"responses": responsesOf(method, op, rootProps),
+		}
+
+		var params []interface{}
+		for _, match := range pathParamRE.FindAllStringSubmatch(route, -1) {
+			params = append(params, map[string]interface{}{
+				"name":     match[1],
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		queryNames := make([]string, 0, len(op.Query))
+		for name := range op.Query {
+			queryNames = append(queryNames, name)
+		}
+		sort.Strings(queryNames)
+		for _, name := range queryNames {
+			params = append(params, map[string]interface{}{
+				"name":        name,
+				"in":          "query",
+				"description": op.Query[name],
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+		if op.IfMatch {
+			params = append(params, map[string]interface{}{
+				"name":        "If-Match",
+				"in":          "header",
+				"description": "only update if the ETag still matches",
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+		if op.IfNoneMatch {
+			params = append(params, map[string]interface{}{
+				"name":        "If-None-Match",
+				"in":          "header",
+				"description": "respond 304 if the ETag still matches",
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+		if method == "POST" && op.Auth {
+			// see Idempotent
+			params = append(params, map[string]interface{}{
+				"name":        idempotencyKeyHeader,
+				"in":          "header",
+				"description": "replays the stored response of a repeated request",
+				"schema":      map[string]interface{}{"type": "string"},
+			})
+		}
+		if params != nil {
+			spec["parameters"] = params
+		}
+		path = pathParamRE.ReplaceAllString(path, "{$1}")
+
+		if op.Request != nil {
+			contentType := "application/json"
+			if op.Patch {
+				contentType = "application/merge-patch+json"
+			}
+			spec["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					contentType: map[string]interface{}{
+						"schema": schemaOf(reflect.TypeOf(op.Request), schemas),
+					},
+				},
+			}
+		}
+
+		if op.Upload != "" {
+			spec["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"multipart/form-data": map[string]interface{}{
+						"schema": map[string]interface{}{
+							"type":     "object",
+							"required": []string{op.Upload},
+							"properties": map[string]interface{}{
+								op.Upload: map[string]interface{}{
+									"type": "string", "format": "binary",
+								},
+							},
+						},
+					},
+				},
+			}
+		}
+
+		if len(op.RawRequest) > 0 {
+			content := map[string]interface{}{}
+			for _, contentType := range op.RawRequest {
+				content[contentType] = map[string]interface{}{
+					"schema": map[string]interface{}{
+						"type": "string", "format": "binary",
+					},
+				}
+			}
+			spec["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  content,
+			}
+		}
+
+		if op.Auth {
+			spec["security"] = []interface{}{
+				map[string]interface{}{"bearer": []string{}},
+			}
+		}
+
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(method)] = spec
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "shipyard",
+			"version": version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "the session access_token",
+				},
+			},
+		},
+	}, nil
+}
+
+func responsesOf(method string, op operation,
+	rootProps map[string]interface{}) map[string]interface{} {
+	errResp := func(description string) map[string]interface{} {
+		return map[string]interface{}{
+			"description": description,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": map[string]interface{}{
+						"$ref": "#/components/schemas/Error",
+					},
+				},
+			},
+		}
+	}
+
+	responses := map[string]interface{}{
+		"400":     errResp("bad request"),
+		"default": errResp("unexpected error"),
+	}
+	if op.Auth {
+		responses["401"] = errResp("unauthenticated")
+		responses["403"] = errResp("unauthorized")
+	}
+	if method == "POST" && op.Auth {
+		responses["409"] = errResp("idempotency key in use by another request")
+		responses["413"] = errResp("idempotent request body is too large")
+		responses["422"] = errResp("idempotency key used with another request")
+	}
+
+	if op.IfNoneMatch {
+		responses["304"] = map[string]interface{}{"description": "not modified"}
+	}
+	if op.IfMatch {
+		responses["412"] = errResp("ETag doesn't match")
+	}
+	if method == "DELETE" {
+		responses["404"] = errResp("not found")
+		responses["409"] = errResp("conflicts with existing data")
+	}
+
+	for code, description := range op.Errors {
+		responses[code] = errResp(description)
+	}
+
+	if op.Redirect {
+		responses["302"] = map[string]interface{}{
+			"description": "redirect to the identity provider",
+		}
+		return responses
+	}
+
+	if op.Websocket {
+		responses["101"] = map[string]interface{}{
+			"description": "switched to a websocket",
+		}
+		return responses
+	}
+
+	content := map[string]interface{}{}
+	if op.Raw != "" {
+		content[op.Raw] = map[string]interface{}{
+			"schema": map[string]interface{}{"type": "string", "format": "binary"},
+		}
+	} else {
+		props := map[string]interface{}{}
+		for _, field := range op.Response {
+			props[field] = rootProps[field]
+		}
+
+		schema := map[string]interface{}{"type": "object"}
+		if len(props) > 0 {
+			schema["properties"] = props
+		}
+		content["application/json"] = map[string]interface{}{"schema": schema}
+	}
+
+	ok := map[string]interface{}{
+		"description": "okay",
+		"content":     content,
+	}
+	if op.ETag {
+		ok["headers"] = map[string]interface{}{
+			"ETag": map[string]interface{}{
+				"schema": map[string]interface{}{"type": "string"},
+			},
+		}
+	}
+	responses["200"] = ok
+	return responses
+}
+
+var unixTimeType = reflect.TypeOf(UnixTime{})
+
+// schemaOf converts a go type into a JSON schema. named structs are added to
+// schemas and referenced
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaOf(t.Elem(), schemas)
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": schemaOf(t.Elem(), schemas),
+		}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": schemaOf(t.Elem(), schemas),
+		}
+	case reflect.Struct:
+	default:
+		return map[string]interface{}{}
+	}
+
+	if t == unixTimeType {
+		return map[string]interface{}{
+			"type":        "integer",
+			"format":      "int64",
+			"nullable":    true,
+			"description": "unix time in seconds",
+		}
+	}
+
+	ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	if t.Name() != "" {
+		if _, exists := schemas[t.Name()]; exists {
+			return ref
+		}
+		// placeholder to stop recursive types from looping
+		schemas[t.Name()] = map[string]interface{}{}
+	}
+
+	props := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue // unexported
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		props[name] = schemaOf(field.Type, schemas)
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": props,
+	}
+	if t.Name() == "" {
+		return schema
+	}
+	schemas[t.Name()] = schema
+	return ref
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestOpenAPICoverage fails when a route is added to the router without also
+// being documented in operations, or when an operation is left behind for a
+// route that no longer exists
+func TestOpenAPICoverage(baseTest *testing.T) {
+	_, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	routes, ok := t.server.router.(chi.Routes)
+	assert.True(t, ok)
+
+	walked := map[string]bool{}
+	err := chi.Walk(routes, func(method, route string, _ http.Handler,
+		_ ...func(http.Handler) http.Handler) error {
+		key := method + " " + route
+		walked[key] = true
+
+		op, ok := operations[key]
+		if assert.True(t, ok, "%q has no entry in operations", key) {
+			assert.NotEqual(t, "", op.Summary, "%q has no summary", key)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	for key := range operations {
+		assert.True(t, walked[key], "%q is documented but not routed", key)
+	}
+}
+
+func TestOpenAPI(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/openapi.json", nil)
+	resp, err := t.server.OpenAPI(ctx, w, r)
+	assert.NoError(t, err)
+
+	// round trip through json to inspect the document as a client would
+	buf, err := json.Marshal(resp)
+	assert.NoError(t, err)
+	var spec struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]map[string]interface{} `json:"properties"`
+			} `json:"schemas"`
+		} `json:"components"`
+	}
+	assert.NoError(t, json.Unmarshal(buf, &spec))
+
+	assert.Equal(t, "3.0.3", spec.OpenAPI)
+	assert.Contains(t, spec.Paths["/api/item/{itemID}"], "post")
+	assert.Contains(t, spec.Paths["/api/item/{itemID}"]["post"], "security")
+	assert.NotContains(t, spec.Paths["/api/item"]["get"], "security")
+	assert.Contains(t, spec.Paths["/api"], "get")
+
+	created := spec.Components.Schemas["Item"].Properties["created"]
+	assert.Equal(t, "integer", created["type"])
+	assert.Equal(t, "int64", created["format"])
+}
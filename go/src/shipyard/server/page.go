@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	he "shipyard/httperror"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// page is the part of a list that was asked for with the limit and offset
+// query params. a page with fewer than limit results is the last one
+type page struct {
+	limit  int
+	offset int64
+}
+
+func parsePage(r *http.Request) (page, error) {
+	p := page{limit: defaultPageLimit}
+	query := r.URL.Query()
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return page{}, he.BadRequest.New("limit must be from 1 to %d",
+				maxPageLimit)
+		}
+		p.limit = n
+	}
+
+	if offset := query.Get("offset"); offset != "" {
+		n, err := strconv.ParseInt(offset, 10, 64)
+		if err != nil || n < 0 {
+			return page{}, he.BadRequest.New("offset can't be negative")
+		}
+		p.offset = n
+	}
+
+	return p, nil
+}
+
+// pageQuery describes the limit and offset query params for the openapi spec
+var pageQuery = map[string]string{
+	"limit":  "how many to list, from 1 to 1000. defaults to 100",
+	"offset": "how many to skip",
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	he "shipyard/httperror"
+)
+
+// mergePatch is a decoded JSON Merge Patch document (RFC 7396). fields that
+// are absent are left untouched and fields that are null are cleared
+type mergePatch map[string]json.RawMessage
+
+func decodeMergePatch(r *http.Request) (mergePatch, error) {
+	contentType := strings.TrimSpace(
+		strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	if contentType != "" && contentType != "application/merge-patch+json" &&
+		contentType != "application/json" {
+		return nil, he.BadRequest.New("unsupported patch content type %q",
+			contentType)
+	}
+
+	patch := mergePatch{}
+	err := json.NewDecoder(r.Body).Decode(&patch)
+	if err != nil {
+		return nil, he.BadRequest.Wrap(err)
+	}
+	return patch, nil
+}
+
+// only ensures that the patch doesn't modify any other fields
+func (p mergePatch) only(fields ...string) error {
+	allowed := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		allowed[field] = true
+	}
+
+	var unknown []string
+	for field := range p {
+		if !allowed[field] {
+			unknown = append(unknown, field)
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return he.BadRequest.New("can't patch %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// decode sets v to the patched value of the field. ok is false if the field
+// is absent from the patch. v is left as is if the field is null
+func (p mergePatch) decode(field string, v interface{}) (ok bool, err error) {
+	raw, ok := p[field]
+	if !ok {
+		return false, nil
+	}
+
+	if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+		return true, nil
+	}
+
+	err = json.Unmarshal(raw, v)
+	if err != nil {
+		return false, he.BadRequest.New("bad value for %s: %s", field, err)
+	}
+	return true, nil
+}
+
+// string returns the patched value of the field. null clears it to ""
+func (p mergePatch) string(field string) (v string, ok bool, err error) {
+	ok, err = p.decode(field, &v)
+	return v, ok, err
+}
+
+// int returns the patched value of the field. null clears it to 0
+func (p mergePatch) int(field string) (v int, ok bool, err error) {
+	ok, err = p.decode(field, &v)
+	return v, ok, err
+}
+
+// bool returns the patched value of the field. null clears it to false
+func (p mergePatch) bool(field string) (v bool, ok bool, err error) {
+	ok, err = p.decode(field, &v)
+	return v, ok, err
+}
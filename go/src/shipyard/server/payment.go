@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/zeebo/errs"
+
+	"shipyard/config"
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/money"
+	"shipyard/payment"
+	"shipyard/util"
+)
+
+// newPaymentProvider returns the configured payment provider. the fake
+// succeeds by default so that an unconfigured server can still take orders
+func newPaymentProvider(configs *config.Configs) payment.Provider {
+	outcome := configs.FakePaymentOutcome
+	if outcome == "" {
+		outcome = payment.Succeed
+	}
+	return payment.NewFake(outcome)
+}
+
+// charge is a payment in progress for an order. it's authorized with
+// authorizePayment before the order's transaction and recorded in it with
+// recordPayment. if the order fails it must be given to failPayment so the
+// authorization is released
+type charge struct {
+	id              string
+	userPk          int64
+	amount          money.Money
+	authorizationID string
+	record          *database.Payment
+}
+
+// captureJob is the payload of a JobCapturePayment job
+type captureJob struct {
+	PaymentID string `json:"payment_id"`
+}
+
+// authorizePayment holds the charge's amount for the user
+func (s *Server) authorizePayment(ctx context.Context, c *charge) (err error) {
+	providerCtx, cancel := s.paymentContext(ctx)
+	defer cancel()
+
+	c.authorizationID, err = s.Payments.Authorize(providerCtx, c.id, c.amount)
+	return err
+}
+
+// recordPayment records an authorized charge. the record is written in tx, so
+// it's only kept if the order is placed
+func (s *Server) recordPayment(ctx context.Context, tx *database.Tx,
+	c *charge) (err error) {
+
+	c.record, err = tx.Create_Payment(ctx,
+		database.Payment_Id(c.id),
+		database.Payment_Provider(s.Payments.Name()),
+		database.Payment_AuthorizationId(c.authorizationID),
+		database.Payment_Amount(c.amount.Amount),
+		database.Payment_Currency(c.amount.Currency.Code),
+		database.Payment_Refunded(0),
+		database.Payment_Status(string(payment.StatusAuthorized)),
+		database.Payment_Create_Fields{
+			UserPk: database.Payment_UserPk(c.userPk),
+		})
+	return err
+}
+
+// capturePayment settles the authorized payment p and records that it was.
+// p is left as it was if the provider fails
+func (s *Server) capturePayment(ctx context.Context,
+	p *database.Payment) error {
+
+	amount, err := money.New(p.Amount, p.Currency)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+
+	providerCtx, cancel := s.paymentContext(ctx)
+	defer cancel()
+
+	err = s.Payments.Capture(providerCtx, p.AuthorizationId, amount)
+	if err != nil {
+		return err
+	}
+
+	err = s.DB.UpdateNoReturn_Payment_By_Pk(ctx, database.Payment_Pk(p.Pk),
+		database.Payment_Update_Fields{
+			Status: database.Payment_Status(string(payment.StatusCaptured)),
+		})
+	if err != nil {
+		return err
+	}
+	p.Status = string(payment.StatusCaptured)
+	return nil
+}
+
+// retryCapture enqueues a job to capture the payment p, which failed to be
+// captured when its order was placed
+func (s *Server) retryCapture(ctx context.Context, p *database.Payment) error {
+	return s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		return enqueueJob(ctx, tx, JobCapturePayment,
+			captureJob{PaymentID: p.Id}, util.UTCNow().Add(jobBackoff))
+	})
+}
+
+// capturePaymentJob captures the job's payment, if it's still only
+// authorized
+func (s *Server) capturePaymentJob(ctx context.Context,
+	job *database.Job) error {
+
+	var payload captureJob
+	err := json.Unmarshal([]byte(job.Payload), &payload)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+
+	p, err := s.DB.Get_Payment_By_Id(ctx, database.Payment_Id(payload.PaymentID))
+	if err != nil {
+		return err
+	}
+
+	if p.Status != string(payment.StatusAuthorized) {
+		return nil
+	}
+	return s.capturePayment(ctx, p)
+}
+
+// failPayment releases whatever was taken by a charge whose order failed with
+// cause, then records the failed attempt. the order's transaction has already
+// been rolled back, so the record is written on its own
+func (s *Server) failPayment(c *charge, cause error) {
+	// only attempts that reached the provider are worth recording
+	if c.authorizationID == "" && !payment.Declined.Has(cause) &&
+		!payment.Unavailable.Has(cause) {
+		return
+	}
+
+	// the request's context may be the reason the order failed, but the money
+	// still has to be released
+	ctx, cancel := s.paymentContext(context.Background())
+	defer cancel()
+
+	status := payment.StatusFailed
+	switch {
+	case payment.Declined.Has(cause):
+		status = payment.StatusDeclined
+	case c.authorizationID != "":
+		err := s.Payments.Void(ctx, c.authorizationID)
+		if err != nil {
+			s.log.WithError(err).Errorf("voiding payment %s", c.id)
+			break
+		}
+		status = payment.StatusVoided
+	}
+
+	_, err := s.DB.Create_Payment(ctx,
+		database.Payment_Id(c.id),
+		database.Payment_Provider(s.Payments.Name()),
+		database.Payment_AuthorizationId(c.authorizationID),
+		database.Payment_Amount(c.amount.Amount),
+		database.Payment_Currency(c.amount.Currency.Code),
+		database.Payment_Refunded(0),
+		database.Payment_Status(string(status)),
+		database.Payment_Create_Fields{
+			UserPk: database.Payment_UserPk(c.userPk),
+		})
+	if err != nil {
+		s.log.WithError(err).Errorf("recording %s payment %s", status, c.id)
+	}
+}
+
+func (s *Server) paymentContext(ctx context.Context) (context.Context,
+	context.CancelFunc) {
+	if s.Config.PaymentTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, s.Config.PaymentTimeout)
+}
+
+// paymentError converts provider errors into their http errors
+func paymentError(err error) error {
+	switch {
+	case payment.Declined.Has(err):
+		return he.PaymentRequired.Wrap(err)
+	case payment.Unavailable.Has(err):
+		return he.Unavailable.Wrap(err)
+	case payment.Invalid.Has(err):
+		return he.Unexpected.Wrap(err)
+	}
+	return err
+}
+
+func newCharge(userPk int64) *charge {
+	return &charge{id: util.MustUUID4(), userPk: userPk}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/money"
+	"shipyard/payment"
+)
+
+func TestAddOrderPayment(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	ctx = t.addNewSession(ctx, "user@example.com")
+	i1 := newItem(ctx, t, "x", 5)
+
+	t.addAddress(ctx)
+
+	t.addCart(ctx, i1.Id, 3)
+
+	fake := payment.NewFake(payment.Decline)
+	t.server.Payments = fake
+	placeOrder := func() (*RootJSON, error) {
+		r := jsonPostRequest(t, "/api/order", PlaceOrder{
+			Orders: []OrderedItem{{ItemID: i1.Id}}})
+		resp, err := t.server.AddOrder(ctx, httptest.NewRecorder(), r)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON), nil
+	}
+	paymentStatuses := func() (statuses []string) {
+		rows, err := t.server.DB.QueryContext(ctx,
+			"SELECT status FROM payments ORDER BY pk")
+		assert.NoError(t, err)
+		defer func() { assert.NoError(t, rows.Close()) }()
+		for rows.Next() {
+			var status string
+			assert.NoError(t, rows.Scan(&status))
+			statuses = append(statuses, status)
+		}
+		return statuses
+	}
+	assertCartKept := func() {
+		r := httptest.NewRequest(http.MethodGet, "/api/cart", nil)
+		resp, err := t.server.ListCart(ctx, httptest.NewRecorder(), r)
+		assert.NoError(t, err)
+		assert.Len(t, resp.(*RootJSON).CartItems, 1)
+
+		item, err := t.server.DB.Get_Item_By_Pk(ctx, database.Item_Pk(i1.Pk))
+		assert.NoError(t, err)
+		assert.Equal(t, 2, item.RemainingQuantity)
+	}
+
+	// the same cart item can't be ordered, and charged for, twice
+	r := jsonPostRequest(t, "/api/order", PlaceOrder{
+		Orders: []OrderedItem{{ItemID: i1.Id}, {ItemID: i1.Id}}})
+	_, err := t.server.AddOrder(ctx, httptest.NewRecorder(), r)
+	assert.True(t, he.BadRequest.Has(err))
+	assertCartKept()
+	assert.Empty(t, paymentStatuses())
+
+	_, err = placeOrder()
+	assert.True(t, he.PaymentRequired.Has(err))
+	assertCartKept()
+	assert.Equal(t, []string{"declined"}, paymentStatuses())
+
+	fake.Outcome = payment.Timeout
+	_, err = placeOrder()
+	assert.True(t, he.Unavailable.Has(err))
+	assertCartKept()
+	assert.Equal(t, []string{"declined", "failed"}, paymentStatuses())
+
+	fake.Outcome = payment.Succeed
+	resp, err := placeOrder()
+	assert.NoError(t, err)
+	assert.Equal(t, "$0.30", resp.Payment.Amount.Formatted)
+	assert.Equal(t, "captured", resp.Payment.Status)
+	assert.Equal(t, []string{"declined", "failed", "captured"},
+		paymentStatuses())
+
+	r = httptest.NewRequest(http.MethodGet, "/api/cart", nil)
+	cart, err := t.server.ListCart(ctx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	assert.Len(t, cart.(*RootJSON).CartItems, 0)
+
+	// an order whose capture fails is still placed, and the payment is
+	// captured by a job later
+	t.addCart(ctx, i1.Id, 1)
+	t.server.Payments = failingCapture{fake}
+	resp, err = placeOrder()
+	assert.NoError(t, err)
+	assert.Equal(t, "authorized", resp.Payment.Status)
+
+	t.server.Payments = fake
+	t.dueJobs(ctx)
+	t.workJobs(ctx)
+	assert.Equal(t, []string{"declined", "failed", "captured", "captured"},
+		paymentStatuses())
+}
+
+// failingCapture is a payment provider that can't be reached to capture
+type failingCapture struct {
+	*payment.Fake
+}
+
+func (failingCapture) Capture(ctx context.Context, authorizationID string,
+	amount money.Money) error {
+	return payment.Unavailable.New("capture failed")
+}
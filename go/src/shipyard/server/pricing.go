@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/money"
+	"shipyard/pricing"
+)
+
+// orderLine is an item in the user's cart along with where it will be shipped.
+// address is nil when the user hasn't chosen one, and variant is nil for items
+// that were added to the cart before they had variants
+type orderLine struct {
+	cartItem *database.CartItem
+	item     *database.Item
+	variant  *database.Variant
+	address  *database.Address
+}
+
+func destinationOf(address *database.Address) pricing.Destination {
+	return pricing.Destination{Country: address.Country, State: address.State}
+}
+
+func (s *Server) defaultCurrency() (money.Currency, error) {
+	currency, err := money.ParseCurrency(s.Config.DefaultCurrency)
+	if err != nil {
+		return money.Currency{}, he.Unexpected.Wrap(err)
+	}
+	return currency, nil
+}
+
+// quote prices the lines, which must all have an address, including their
+// tax, shipping and the coupon's discount. coupon may be nil. the errors are
+// left as pricing errors, so use quoteError before returning them
+func (s *Server) quote(ctx context.Context, lines []orderLine,
+	coupon *pricing.Coupon) (*pricing.Quote, error) {
+
+	fallback, err := s.defaultCurrency()
+	if err != nil {
+		return nil, err
+	}
+
+	pricingLines, err := pricingLinesOf(lines)
+	if err != nil {
+		return nil, err
+	}
+
+	quoter := &pricing.Quoter{Taxes: s.Taxes, Shipping: s.Config.ShippingRates}
+	return quoter.Quote(ctx, pricingLines, fallback, coupon)
+}
+
+// quoteError converts pricing errors into their http errors
+func quoteError(err error) error {
+	switch {
+	case money.Mismatch.Has(err):
+		return he.Conflict.New("can't order items in more than one " +
+			"currency at once")
+	case pricing.NoShipping.Has(err), pricing.Ineligible.Has(err):
+		return he.BadRequest.Wrap(err)
+	}
+	return err
+}
+
+// summarizeCart totals the user's cart. without an address, only the
+// subtotal is known. problems with the address or the cart's coupon are
+// reported in the summary rather than failing, so the cart can still be shown
+func (s *Server) summarizeCart(ctx context.Context, tx *database.Tx,
+	userPk int64, lines []orderLine, address *database.Address) (
+	*CartSummary, error) {
+
+	summary := &CartSummary{}
+
+	var coupon *pricing.Coupon
+	dbCoupon, err := tx.Find_Coupon_By_CartCoupon_UserPk(ctx,
+		database.CartCoupon_UserPk(userPk))
+	if err != nil {
+		return nil, err
+	}
+	if dbCoupon != nil {
+		summary.Coupon = dbCoupon.Code
+		coupon, err = s.usableCoupon(ctx, tx, dbCoupon, userPk)
+		if he.BadRequest.Has(err) {
+			summary.CouponError = err.Error()
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if address != nil {
+		summary.AddressID = address.Id
+		for i := range lines {
+			lines[i].address = address
+		}
+
+		quote, err := s.quote(ctx, lines, coupon)
+		if pricing.Ineligible.Has(err) {
+			summary.CouponError = err.Error()
+			quote, err = s.quote(ctx, lines, nil)
+		}
+
+		switch {
+		case pricing.NoShipping.Has(err):
+			summary.ShippingError = "can't ship to this address"
+		case err != nil:
+			return nil, quoteError(err)
+		default:
+			summary.Subtotal = apiPrice(quote.Subtotal)
+			summary.Discount = apiPrice(quote.Discount)
+			summary.Tax = apiPrice(quote.Tax)
+			summary.Shipping = apiPrice(quote.Shipping)
+			summary.Total = apiPrice(quote.Total)
+			return summary, nil
+		}
+	}
+
+	fallback, err := s.defaultCurrency()
+	if err != nil {
+		return nil, err
+	}
+
+	pricingLines, err := pricingLinesOf(lines)
+	if err != nil {
+		return nil, err
+	}
+
+	subtotal, err := pricing.Subtotal(pricingLines, fallback)
+	if err != nil {
+		return nil, quoteError(err)
+	}
+	summary.Subtotal = apiPrice(subtotal)
+	return summary, nil
+}
+
+func pricingLinesOf(lines []orderLine) ([]pricing.Line, error) {
+	pricingLines := make([]pricing.Line, 0, len(lines))
+	for _, line := range lines {
+		price, err := variantPrice(line.item, line.variant)
+		if err != nil {
+			return nil, err
+		}
+
+		pricingLine := pricing.Line{
+			ItemID:    line.item.Id,
+			UnitPrice: price,
+			Quantity:  line.cartItem.Quantity,
+		}
+		if line.item.OwningUserPk != nil {
+			pricingLine.SellerPk = *line.item.OwningUserPk
+		}
+		if line.address != nil {
+			pricingLine.To = destinationOf(line.address)
+		}
+		pricingLines = append(pricingLines, pricingLine)
+	}
+	return pricingLines, nil
+}
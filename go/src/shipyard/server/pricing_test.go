@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	he "shipyard/httperror"
+	"shipyard/pricing"
+)
+
+func TestCartSummary(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	t.server.Taxes = pricing.TaxRules{{Country: "US", State: "CA", RateBPS: 1000}}
+	t.server.Config.ShippingRates = pricing.ShippingRates{
+		{Country: "US", Currency: "USD", Base: 500, PerItem: 100}}
+
+	ctx = t.addNewSession(ctx, "user@example.com")
+	i1 := newItem(ctx, t, "x", 5)
+
+	r := jsonPostRequest(t, "/api/cart", CartItem{ItemID: i1.Id, Quantity: 3})
+	resp, err := t.server.AddCart(ctx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	cart := resp.(*RootJSON)
+	assert.Equal(t, "$0.10", cart.CartItems[0].UnitPrice.Formatted)
+	assert.Equal(t, "$0.30", cart.CartItems[0].Price.Formatted)
+	assert.Equal(t, &CartSummary{
+		Subtotal: &Money{Amount: 30, Currency: "USD", Formatted: "$0.30"},
+	}, cart.CartSummary) // no address to ship to yet
+
+	addAddress := func(country, state string) *Address {
+		r := jsonPostRequest(t, "/api/address",
+			Address{Line1: "1 street", Country: country, State: state})
+		resp, err := t.server.AddAddress(ctx, httptest.NewRecorder(), r)
+		assert.NoError(t, err)
+		return resp.(*RootJSON).Address
+	}
+	listCart := func(target string) *CartSummary {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		resp, err := t.server.ListCart(ctx, httptest.NewRecorder(), r)
+		assert.NoError(t, err)
+		return resp.(*RootJSON).CartSummary
+	}
+
+	ca := addAddress("US", "CA")
+	summary := listCart("/api/cart")
+	assert.Equal(t, ca.ID, summary.AddressID)
+	assert.Equal(t, 3, summary.Tax.Amount)
+	assert.Equal(t, 700, summary.Shipping.Amount)
+	assert.Equal(t, 733, summary.Total.Amount)
+
+	fr := addAddress("FR", "")
+	summary = listCart("/api/cart?address_id=" + fr.ID)
+	assert.Equal(t, fr.ID, summary.AddressID)
+	assert.Nil(t, summary.Total)
+	assert.NotEmpty(t, summary.ShippingError)
+
+	placeOrder := func(addressID string, expected *Money) (*RootJSON, error) {
+		r := jsonPostRequest(t, "/api/order", PlaceOrder{
+			Orders:        []OrderedItem{{ItemID: i1.Id, AddressID: addressID}},
+			ExpectedTotal: expected,
+		})
+		resp, err := t.server.AddOrder(ctx, httptest.NewRecorder(), r)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON), nil
+	}
+
+	_, err = placeOrder(fr.ID, nil)
+	assert.True(t, he.BadRequest.Has(err))
+
+	_, err = placeOrder("", &Money{Amount: 30, Currency: "USD"})
+	assert.True(t, he.Conflict.Has(err))
+
+	order, err := placeOrder("", &Money{Amount: 733, Currency: "USD"})
+	assert.NoError(t, err)
+	assert.Equal(t, 733, order.Payment.Amount.Amount)
+}
@@ -0,0 +1,330 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+
+	"github.com/go-chi/chi"
+	"github.com/sirupsen/logrus"
+	"github.com/zeebo/errs"
+
+	"shipyard/config"
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/notify"
+	"shipyard/util"
+)
+
+// a subscription is waiting until its item is restocked, then queued until
+// its notification is sent, or has failed too many times to keep trying
+const (
+	subscriptionWaiting = "waiting"
+	subscriptionQueued  = "queued"
+	subscriptionSent    = "sent"
+	subscriptionFailed  = "failed"
+
+	restockKind        = "back_in_stock"
+	maxRestockAttempts = 5
+)
+
+// restockJob is the payload of a JobNotifyRestock job
+type restockJob struct {
+	SubscriptionID string `json:"subscription_id"`
+}
+
+func newNotifier(configs *config.Configs) notify.Notifier {
+	switch configs.Notifier {
+	case "email":
+		return notify.NewEmail(notify.NewSMTP(configs.SMTPAddress,
+			configs.SMTPUsername, configs.SMTPPassword, configs.MailFrom))
+	case "webhook":
+		return notify.NewWebhook(configs.NotifyWebhookURL)
+	}
+	return notify.NewLog(logrus.WithField("version", configs.Version))
+}
+
+// ListSubscription will return the items the active user wants to be told
+// about when they're back in stock, newest first
+func (s *Server) ListSubscription(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.DB.All_StockSubscription_ItemId_By_UserPk(ctx,
+		database.StockSubscription_UserPk(userPk))
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := make([]*Subscription, 0, len(rows))
+	for _, row := range rows {
+		subscriptions = append(subscriptions,
+			apiSubscription(row.Item_Id, &row.StockSubscription))
+	}
+	return &RootJSON{Subscriptions: subscriptions}, nil
+}
+
+// SubscribeItem will notify the active user when an out of stock item is back.
+// subscribing again after being notified waits for the next restock
+func (s *Server) SubscribeItem(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		item, err := tx.Find_Item_By_Id(ctx,
+			database.Item_Id(chi.URLParam(r, "itemID")))
+		if err != nil {
+			return err
+		}
+
+		if item == nil {
+			return he.NotFound.New("item not found")
+		}
+
+		if item.RemainingQuantity > 0 {
+			return he.Conflict.New("item is in stock")
+		}
+
+		subscription, err := tx.Find_StockSubscription_By_UserPk_And_ItemPk(ctx,
+			database.StockSubscription_UserPk(userPk),
+			database.StockSubscription_ItemPk(item.Pk))
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case subscription == nil:
+			subscription, err = tx.Create_StockSubscription(ctx,
+				database.StockSubscription_Id(util.MustUUID4()),
+				database.StockSubscription_Status(subscriptionWaiting),
+				database.StockSubscription_Attempts(0),
+				database.StockSubscription_LastError(""),
+				database.StockSubscription_UserPk(userPk),
+				database.StockSubscription_ItemPk(item.Pk),
+				database.StockSubscription_Create_Fields{})
+		case subscription.Status == subscriptionSent ||
+			subscription.Status == subscriptionFailed:
+			subscription, err = tx.Update_StockSubscription_By_Pk(ctx,
+				database.StockSubscription_Pk(subscription.Pk),
+				database.StockSubscription_Update_Fields{
+					Status:    database.StockSubscription_Status(subscriptionWaiting),
+					Queued:    database.StockSubscription_Queued_Null(),
+					Sent:      database.StockSubscription_Sent_Null(),
+					Attempts:  database.StockSubscription_Attempts(0),
+					LastError: database.StockSubscription_LastError(""),
+				})
+		}
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Subscription: apiSubscription(item.Id, subscription)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// UnsubscribeItem will stop the active user from being notified about an item
+func (s *Server) UnsubscribeItem(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		item, err := tx.Find_Item_By_Id(ctx,
+			database.Item_Id(chi.URLParam(r, "itemID")))
+		if err != nil {
+			return err
+		}
+
+		if item == nil {
+			return he.NotFound.New("item not found")
+		}
+
+		subscription, err := tx.Find_StockSubscription_By_UserPk_And_ItemPk(ctx,
+			database.StockSubscription_UserPk(userPk),
+			database.StockSubscription_ItemPk(item.Pk))
+		if err != nil {
+			return err
+		}
+
+		if subscription == nil {
+			return he.NotFound.New("subscription not found")
+		}
+
+		_, err = tx.Delete_StockSubscription_By_Pk(ctx,
+			database.StockSubscription_Pk(subscription.Pk))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// enqueueRestock queues the notifications of the users waiting for an item
+// that has just come back into stock. each is sent by a job, which is only
+// run once the transaction commits, so a rolled back restock doesn't notify
+// anyone
+func enqueueRestock(ctx context.Context, tx *database.Tx, before,
+	after *database.Item) error {
+
+	if before.RemainingQuantity > 0 || after.RemainingQuantity <= 0 {
+		return nil
+	}
+
+	subscriptions, err := tx.All_StockSubscription_By_ItemPk_And_Status(ctx,
+		database.StockSubscription_ItemPk(after.Pk),
+		database.StockSubscription_Status(subscriptionWaiting))
+	if err != nil {
+		return err
+	}
+
+	now := util.UTCNow()
+	for _, subscription := range subscriptions {
+		err = tx.UpdateNoReturn_StockSubscription_By_Pk(ctx,
+			database.StockSubscription_Pk(subscription.Pk),
+			database.StockSubscription_Update_Fields{
+				Status: database.StockSubscription_Status(subscriptionQueued),
+				Queued: database.StockSubscription_Queued(now),
+			})
+		if err != nil {
+			return err
+		}
+
+		err = enqueueJob(ctx, tx, JobNotifyRestock,
+			restockJob{SubscriptionID: subscription.Id}, now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyRestockJob sends the notification of the job's subscription, if
+// it's still queued. an item that sold out again before its notification was
+// sent puts the subscription back to waiting instead. a notification that
+// fails is retried by the job, up to maxRestockAttempts
+func (s *Server) notifyRestockJob(ctx context.Context,
+	job *database.Job) error {
+
+	var payload restockJob
+	err := json.Unmarshal([]byte(job.Payload), &payload)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+
+	row, err := s.DB.Find_StockSubscription_User_Item_By_Id(ctx,
+		database.StockSubscription_Id(payload.SubscriptionID))
+	if err != nil {
+		return err
+	}
+
+	// the user may have unsubscribed since, or an earlier run of the job may
+	// have got as far as notifying them
+	if row == nil || row.StockSubscription.Status != subscriptionQueued {
+		return nil
+	}
+	return s.notifyRestock(ctx, row)
+}
+
+// notifyRestock sends one subscription's notification. it returns the
+// notifier's error when the subscription is still queued to be tried again
+func (s *Server) notifyRestock(ctx context.Context,
+	row *database.StockSubscription_User_Item_Row) error {
+
+	pk := database.StockSubscription_Pk(row.StockSubscription.Pk)
+	if row.Item.RemainingQuantity <= 0 {
+		return s.DB.UpdateNoReturn_StockSubscription_By_Pk(ctx, pk,
+			database.StockSubscription_Update_Fields{
+				Status: database.StockSubscription_Status(subscriptionWaiting),
+				Queued: database.StockSubscription_Queued_Null(),
+			})
+	}
+
+	itemURL := s.itemURL(row.Item.Id)
+	notifyErr := s.Notifier.Notify(ctx, notify.Notification{
+		Kind:    restockKind,
+		UserID:  row.User.Id,
+		Email:   row.User.Email,
+		Subject: fmt.Sprintf("%s is back in stock", row.Item.Title),
+		Body: fmt.Sprintf("%s is back in stock. %d remain.\n\n%s\n",
+			row.Item.Title, row.Item.RemainingQuantity, itemURL),
+		Data: map[string]string{
+			"item_id":         row.Item.Id,
+			"item_url":        itemURL,
+			"subscription_id": row.StockSubscription.Id,
+		},
+	})
+	if notifyErr == nil {
+		return s.DB.UpdateNoReturn_StockSubscription_By_Pk(ctx, pk,
+			database.StockSubscription_Update_Fields{
+				Status: database.StockSubscription_Status(subscriptionSent),
+				Sent:   database.StockSubscription_Sent(util.UTCNow()),
+			})
+	}
+
+	attempts := row.StockSubscription.Attempts + 1
+	ups := database.StockSubscription_Update_Fields{
+		Attempts:  database.StockSubscription_Attempts(attempts),
+		LastError: database.StockSubscription_LastError(notifyErr.Error()),
+	}
+	queued := attempts < maxRestockAttempts
+	if !queued {
+		ups.Status = database.StockSubscription_Status(subscriptionFailed)
+	}
+
+	s.log.WithError(notifyErr).Warnf("failed to notify subscription %s "+
+		"(attempt %d)", row.StockSubscription.Id, attempts)
+	err := s.DB.UpdateNoReturn_StockSubscription_By_Pk(ctx, pk, ups)
+	if err != nil || !queued {
+		return err
+	}
+	return notifyErr
+}
+
+// itemURL is where the item is served by GetItem
+func (s *Server) itemURL(itemID string) string {
+	p := path.Join("/api/item", itemID)
+	if s.Config.PublicAPIURL == nil {
+		return p
+	}
+
+	root := s.PublicAPIURL()
+	root.Path = path.Join(root.Path, p)
+	return root.String()
+}
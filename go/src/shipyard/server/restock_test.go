@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/notify"
+)
+
+func TestStockNotifications(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	notifier := notify.NewMemory()
+	t.server.Notifier = notifier
+	sellerCtx := t.addNewSession(ctx, "seller@example.com")
+	buyerCtx := t.addNewSession(ctx, "buyer@example.com")
+	ctx = t.addNewSession(ctx, "waiter@example.com")
+
+	r := jsonPostRequest(t, "/api/item", Item{Price: &Money{Amount: 10},
+		Title: "lamp", RemainingQuantity: 1})
+	resp, err := t.server.AddItem(sellerCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	itemID := resp.(*RootJSON).Item.ID
+
+	subscribe := func() (*Subscription, error) {
+		r := jsonPostRequest(t, "/api/item/"+itemID+"/subscription", nil)
+		resp, err := t.server.SubscribeItem(ctx, httptest.NewRecorder(),
+			withURLParams(r, "itemID", itemID))
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Subscription, nil
+	}
+	setCart := func(quantity int) {
+		t.addCart(buyerCtx, itemID, quantity)
+	}
+	status := func() string {
+		r := httptest.NewRequest(http.MethodGet, "/api/subscription", nil)
+		resp, err := t.server.ListSubscription(ctx, httptest.NewRecorder(), r)
+		assert.NoError(t, err)
+		subscriptions := resp.(*RootJSON).Subscriptions
+		assert.Len(t, subscriptions, 1)
+		return subscriptions[0].Status
+	}
+
+	_, err = subscribe()
+	assert.True(t, he.Conflict.Has(err))
+
+	setCart(1)
+	subscription, err := subscribe()
+	assert.NoError(t, err)
+	assert.Equal(t, subscriptionWaiting, subscription.Status)
+	again, err := subscribe()
+	assert.NoError(t, err)
+	assert.Equal(t, subscription.ID, again.ID)
+
+	// releasing the cart restocks the item
+	r = jsonPostRequest(t, "/api/cart/"+itemID, CartItem{Quantity: 0})
+	_, err = t.server.UpdateCart(buyerCtx, httptest.NewRecorder(),
+		withURLParams(r, "cartItemID", itemID))
+	assert.NoError(t, err)
+	assert.Equal(t, subscriptionQueued, status())
+
+	t.workJobs(ctx)
+	assert.Equal(t, subscriptionSent, status())
+	notifications := notifier.Notifications()
+	assert.Len(t, notifications, 1)
+	assert.Equal(t, "waiter@example.com", notifications[0].Email)
+	assert.Equal(t, itemID, notifications[0].Data["item_id"])
+
+	// each subscription is only notified once, even by a job run again
+	jobs, err := t.server.DB.Limited_Job_By_Status(ctx,
+		database.Job_Status(database.JobSucceeded), 1, 0)
+	assert.NoError(t, err)
+	assert.Len(t, jobs, 1)
+	assert.NoError(t, t.server.notifyRestockJob(ctx, jobs[0]))
+	assert.Len(t, notifier.Notifications(), 1)
+
+	// selling out again before the notification is sent waits for the next
+	// restock
+	setCart(1)
+	_, err = subscribe()
+	assert.NoError(t, err)
+	patchQuantity := func(quantity int) {
+		r := httptest.NewRequest(http.MethodPatch, "/api/item/"+itemID,
+			strings.NewReader(fmt.Sprintf(`{"remaining_quantity": %d}`,
+				quantity)))
+		_, err := t.server.PatchItem(sellerCtx, httptest.NewRecorder(),
+			withURLParams(r, "itemID", itemID))
+		assert.NoError(t, err)
+	}
+	patchQuantity(2)
+	assert.Equal(t, subscriptionQueued, status())
+	patchQuantity(0)
+	t.workJobs(ctx)
+	assert.Equal(t, subscriptionWaiting, status())
+
+	// failures are retried until they've been tried too many times
+	notifier.Fail(true)
+	patchQuantity(2)
+	for i := 0; i < maxRestockAttempts; i++ {
+		assert.Equal(t, subscriptionQueued, status())
+		t.dueJobs(ctx)
+		t.workJobs(ctx)
+	}
+	assert.Equal(t, subscriptionFailed, status())
+	assert.Len(t, notifier.Notifications(), 1)
+
+	r = httptest.NewRequest(http.MethodDelete,
+		"/api/item/"+itemID+"/subscription", nil)
+	_, err = t.server.UnsubscribeItem(ctx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", itemID))
+	assert.NoError(t, err)
+	_, err = t.server.UnsubscribeItem(ctx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", itemID))
+	assert.True(t, he.NotFound.Has(err))
+}
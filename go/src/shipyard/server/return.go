@@ -0,0 +1,462 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/zeebo/errs"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/money"
+	"shipyard/payment"
+	"shipyard/util"
+)
+
+// the statuses of a return request
+const (
+	returnRequested = "requested"
+	returnApproved  = "approved"
+	returnRejected  = "rejected"
+)
+
+// the statuses of a refund
+const (
+	refundPending  = "pending"
+	refundRefunded = "refunded"
+)
+
+// refundJob is the payload of a JobRefundPayment job
+type refundJob struct {
+	RefundID string `json:"refund_id"`
+}
+
+// AddReturn will ask the seller to take back some of an ordered item. the
+// quantity of an item that is waiting on or approved for return can't be more
+// than was ordered
+func (s *Server) AddReturn(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := Return{}
+	err = json.NewDecoder(r.Body).Decode(&ret)
+	if err != nil {
+		return nil, he.BadRequest.Wrap(err)
+	}
+
+	if ret.Quantity < 1 {
+		return nil, he.BadRequest.New("at least 1 item must be returned")
+	}
+
+	ret.Reason = strings.TrimSpace(ret.Reason)
+	if ret.Reason == "" {
+		return nil, he.BadRequest.New("a return needs a reason")
+	}
+
+	orderedItemID := chi.URLParam(r, "orderedItemID")
+	var row *database.ReturnRequest_OrderedItem_Item_Id_Row
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		orderedItem, err := tx.Find_OrderedItem_By_Id(ctx,
+			database.OrderedItem_Id(orderedItemID))
+		if err != nil {
+			return err
+		}
+
+		if orderedItem == nil || orderedItem.UserPk == nil ||
+			*orderedItem.UserPk != userPk {
+			return he.NotFound.New("ordered item not found")
+		}
+
+		returns, err := tx.All_ReturnRequest_By_OrderedItemPk(ctx,
+			database.ReturnRequest_OrderedItemPk(orderedItem.Pk))
+		if err != nil {
+			return err
+		}
+
+		returnable := orderedItem.Quantity
+		for _, existing := range returns {
+			if existing.Status != returnRejected {
+				returnable -= existing.Quantity
+			}
+		}
+
+		if ret.Quantity > returnable {
+			return he.BadRequest.New("only %d of the item can be returned",
+				returnable)
+		}
+
+		returnRequest, err := tx.Create_ReturnRequest(ctx,
+			database.ReturnRequest_Id(util.MustUUID4()),
+			database.ReturnRequest_Quantity(ret.Quantity),
+			database.ReturnRequest_Reason(ret.Reason),
+			database.ReturnRequest_Status(returnRequested),
+			database.ReturnRequest_Response(""),
+			database.ReturnRequest_OrderedItemPk(orderedItem.Pk),
+			database.ReturnRequest_Create_Fields{})
+		if err != nil {
+			return err
+		}
+
+		row, err = tx.Find_ReturnRequest_OrderedItem_ItemId_By_Id(ctx,
+			database.ReturnRequest_Id(returnRequest.Id))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &RootJSON{
+		Return: apiReturn(row, 0),
+	}
+
+	return resp, nil
+}
+
+// ListReturn will return the return requests for the active user's items,
+// newest first
+func (s *Server) ListReturn(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.DB.All_ReturnRequest_OrderedItem_ItemId_By_SellerPk(ctx,
+		database.Item_OwningUserPk(userPk))
+	if err != nil {
+		return nil, err
+	}
+
+	// the refunds are only looked up for the approved returns, one query each
+	returns := make([]*Return, 0, len(rows))
+	for _, row := range rows {
+		refunded := 0
+		if row.ReturnRequest.Status == returnApproved {
+			refunded, err = s.returnRefunded(ctx, row.ReturnRequest.Pk)
+			if err != nil {
+				return nil, err
+			}
+		}
+		returns = append(returns, apiReturn(row, refunded))
+	}
+
+	resp := &RootJSON{
+		Returns: returns,
+	}
+
+	return resp, nil
+}
+
+// ResolveReturn will approve or reject a return request for one of the active
+// user's items. an approved return is restocked and refunded. the refund is
+// what the returned items were paid for unless a refund amount is given, which
+// may be anything up to what's left of the order's payment. the payment
+// provider gives it back in a job once the return is resolved
+func (s *Server) ResolveReturn(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	resolve := ResolveReturn{}
+	err = json.NewDecoder(r.Body).Decode(&resolve)
+	if err != nil {
+		return nil, he.BadRequest.Wrap(err)
+	}
+
+	switch resolve.Status {
+	case returnApproved:
+	case returnRejected:
+		if resolve.Refund != nil {
+			return nil, he.BadRequest.New("a rejected return can't be refunded")
+		}
+	default:
+		return nil, he.BadRequest.New("status must be %s or %s",
+			returnApproved, returnRejected)
+	}
+
+	returnID := chi.URLParam(r, "returnID")
+	var row *database.ReturnRequest_OrderedItem_Item_Id_Row
+	var restocked *database.Item
+	refunded := 0
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		row, err = tx.Find_ReturnRequest_OrderedItem_ItemId_By_Id(ctx,
+			database.ReturnRequest_Id(returnID))
+		if err != nil {
+			return err
+		}
+
+		if row == nil {
+			return he.NotFound.New("return not found")
+		}
+
+		item, err := tx.Get_Item_By_Pk(ctx,
+			database.Item_Pk(row.OrderedItem.ItemPk))
+		if err != nil {
+			return err
+		}
+
+		if item.OwningUserPk == nil || *item.OwningUserPk != userPk {
+			return he.NotFound.New("return not found")
+		}
+
+		if row.ReturnRequest.Status != returnRequested {
+			return he.Conflict.New("the return has already been %s",
+				row.ReturnRequest.Status)
+		}
+
+		now := util.UTCNow()
+		row.ReturnRequest.Status = resolve.Status
+		row.ReturnRequest.Response = resolve.Response
+		row.ReturnRequest.Resolved = &now
+		err = tx.UpdateNoReturn_ReturnRequest_By_Pk(ctx,
+			database.ReturnRequest_Pk(row.ReturnRequest.Pk),
+			database.ReturnRequest_Update_Fields{
+				Status:   database.ReturnRequest_Status(resolve.Status),
+				Response: database.ReturnRequest_Response(resolve.Response),
+				Resolved: database.ReturnRequest_Resolved(now),
+			})
+		if err != nil {
+			return err
+		}
+
+		if resolve.Status == returnRejected {
+			return nil
+		}
+
+		// items ordered before they had variants only restock the item
+		var variant *database.Variant
+		if row.OrderedItem.VariantPk != nil {
+			variant, err = tx.Get_Variant_By_Pk(ctx,
+				database.Variant_Pk(*row.OrderedItem.VariantPk))
+			if err != nil {
+				return err
+			}
+		}
+
+		restocked, _, err = adjustStock(ctx, tx, item, variant,
+			row.ReturnRequest.Quantity)
+		if err != nil {
+			return err
+		}
+
+		refund, err := returnRefund(row, resolve.Refund)
+		if err != nil {
+			return err
+		}
+		refunded = refund.Amount
+
+		return refundPayment(ctx, tx, row, refund)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// a rejected return leaves the stock alone
+	if restocked != nil {
+		s.publishInventory(restocked)
+	}
+
+	resp := &RootJSON{
+		Return: apiReturn(row, refunded),
+	}
+
+	return resp, nil
+}
+
+// returnRefund is what a return is refunded. by default it's what the returned
+// items cost after their share of the order's discount, with the tax paid on
+// them
+func returnRefund(row *database.ReturnRequest_OrderedItem_Item_Id_Row,
+	requested *Money) (money.Money, error) {
+
+	orderedItem := row.OrderedItem
+	quantity := row.ReturnRequest.Quantity
+	refund, err := money.New(orderedItem.Price*quantity+
+		(orderedItem.Tax-orderedItem.Discount)*quantity/orderedItem.Quantity,
+		orderedItem.Currency)
+	if err != nil {
+		return money.Money{}, he.Unexpected.Wrap(err)
+	}
+
+	if requested == nil {
+		return refund, nil
+	}
+
+	if requested.Currency != "" &&
+		!strings.EqualFold(requested.Currency, orderedItem.Currency) {
+		return money.Money{}, he.BadRequest.New("the item was paid for in %s",
+			orderedItem.Currency)
+	}
+
+	if requested.Amount < 0 {
+		return money.Money{}, he.BadRequest.New("a refund can't be negative")
+	}
+
+	refund.Amount = requested.Amount
+	return refund, nil
+}
+
+// refundPayment records refund from the payment for the return's order, and
+// enqueues the job that has the provider give it back. the payment's refunded
+// amount includes pending refunds, so they can't add up to more than was paid
+func refundPayment(ctx context.Context, tx *database.Tx,
+	row *database.ReturnRequest_OrderedItem_Item_Id_Row,
+	refund money.Money) error {
+
+	if refund.Amount == 0 {
+		return nil
+	}
+
+	if row.OrderedItem.PaymentPk == nil {
+		return he.BadRequest.New("the order has no payment to refund")
+	}
+
+	p, err := tx.Get_Payment_By_Pk(ctx,
+		database.Payment_Pk(*row.OrderedItem.PaymentPk))
+	if err != nil {
+		return err
+	}
+
+	if p.Currency != refund.Currency.Code {
+		return he.BadRequest.New("the order was paid for in %s", p.Currency)
+	}
+
+	if p.Refunded+refund.Amount > p.Amount {
+		return he.BadRequest.New("only %s of the payment is left to refund",
+			money.Money{Amount: p.Amount - p.Refunded, Currency: refund.Currency})
+	}
+
+	id := util.MustUUID4()
+	err = tx.CreateNoReturn_Refund(ctx,
+		database.Refund_Id(id),
+		database.Refund_Amount(refund.Amount),
+		database.Refund_Currency(refund.Currency.Code),
+		database.Refund_Status(refundPending),
+		database.Refund_PaymentPk(p.Pk),
+		database.Refund_Create_Fields{
+			ReturnRequestPk: database.Refund_ReturnRequestPk(
+				row.ReturnRequest.Pk),
+		})
+	if err != nil {
+		return err
+	}
+
+	err = tx.UpdateNoReturn_Payment_By_Pk(ctx, database.Payment_Pk(p.Pk),
+		database.Payment_Update_Fields{
+			Refunded: database.Payment_Refunded(p.Refunded + refund.Amount),
+		})
+	if err != nil {
+		return err
+	}
+
+	return enqueueJob(ctx, tx, JobRefundPayment, refundJob{RefundID: id},
+		util.UTCNow())
+}
+
+// refundPaymentJob has the payment provider give back the job's refund, if
+// it's still pending, and then marks it refunded. the payment is refunded
+// once none of its refunds are pending and they add up to all of it
+func (s *Server) refundPaymentJob(ctx context.Context,
+	job *database.Job) error {
+
+	var payload refundJob
+	err := json.Unmarshal([]byte(job.Payload), &payload)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+
+	row, err := s.DB.Find_Refund_Payment_By_Refund_Id(ctx,
+		database.Refund_Id(payload.RefundID))
+	if err != nil {
+		return err
+	}
+
+	if row == nil || row.Refund.Status != refundPending {
+		return nil
+	}
+
+	refund, err := money.New(row.Refund.Amount, row.Refund.Currency)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+
+	providerCtx, cancel := s.paymentContext(ctx)
+	defer cancel()
+
+	err = s.Payments.Refund(providerCtx, row.Payment.AuthorizationId, refund)
+	if err != nil {
+		return err
+	}
+
+	return s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		err := tx.UpdateNoReturn_Refund_By_Pk(ctx,
+			database.Refund_Pk(row.Refund.Pk),
+			database.Refund_Update_Fields{
+				Status: database.Refund_Status(refundRefunded),
+			})
+		if err != nil {
+			return err
+		}
+
+		p, err := tx.Get_Payment_By_Pk(ctx, database.Payment_Pk(row.Payment.Pk))
+		if err != nil {
+			return err
+		}
+
+		pending, err := tx.Count_Refund_By_PaymentPk_And_Status(ctx,
+			database.Refund_PaymentPk(p.Pk), database.Refund_Status(refundPending))
+		if err != nil {
+			return err
+		}
+
+		if pending > 0 || p.Refunded < p.Amount {
+			return nil
+		}
+		return tx.UpdateNoReturn_Payment_By_Pk(ctx, database.Payment_Pk(p.Pk),
+			database.Payment_Update_Fields{
+				Status: database.Payment_Status(string(payment.StatusRefunded)),
+			})
+	})
+}
+
+// returnRefunded sums the refunds given for a return
+func (s *Server) returnRefunded(ctx context.Context,
+	returnRequestPk int64) (int, error) {
+	refunds, err := s.DB.All_Refund_By_ReturnRequestPk(ctx,
+		database.Refund_ReturnRequestPk(returnRequestPk))
+	if err != nil {
+		return 0, err
+	}
+
+	refunded := 0
+	for _, refund := range refunds {
+		refunded += refund.Amount
+	}
+	return refunded, nil
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/payment"
+	"shipyard/pricing"
+)
+
+func TestReturns(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	fake := payment.NewFake(payment.Succeed)
+	t.server.Payments = fake
+	t.server.Taxes = pricing.TaxRules{{RateBPS: 1000}}
+	sellerCtx := t.addNewSession(ctx, "seller@example.com")
+	ctx = t.addNewSession(ctx, "user@example.com")
+
+	item := t.addItem(sellerCtx, Item{Description: "x",
+		Price: &Money{Amount: 100, Currency: "USD"}, RemainingQuantity: 5})
+
+	t.addAddress(ctx)
+	t.addCart(ctx, item.ID, 4)
+	r := jsonPostRequest(t, "/api/order", PlaceOrder{
+		Orders: []OrderedItem{{ItemID: item.ID}}})
+	resp, err := t.server.AddOrder(ctx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	paymentID := resp.(*RootJSON).Payment.ID
+
+	listOrder := func() *OrderedItem {
+		r := httptest.NewRequest(http.MethodGet, "/api/order", nil)
+		resp, err := t.server.ListOrder(ctx, httptest.NewRecorder(), r)
+		assert.NoError(t, err)
+		return resp.(*RootJSON).OrderedItems[0]
+	}
+	addReturn := func(ctx context.Context, quantity int) (*Return, error) {
+		orderedItemID := listOrder().ID
+		r := jsonPostRequest(t, "/api/order/"+orderedItemID+"/return",
+			Return{Quantity: quantity, Reason: "too small"})
+		resp, err := t.server.AddReturn(ctx, httptest.NewRecorder(),
+			withURLParams(r, "orderedItemID", orderedItemID))
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Return, nil
+	}
+	resolveReturn := func(ctx context.Context, id string,
+		resolve ResolveReturn) (*Return, error) {
+		r := jsonPostRequest(t, "/api/return/"+id, resolve)
+		resp, err := t.server.ResolveReturn(ctx, httptest.NewRecorder(),
+			withURLParams(r, "returnID", id))
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Return, nil
+	}
+	remaining := func() int {
+		i, err := t.server.DB.Find_Item_By_Id(ctx, database.Item_Id(item.ID))
+		assert.NoError(t, err)
+		return i.RemainingQuantity
+	}
+
+	_, err = addReturn(sellerCtx, 1)
+	assert.True(t, he.NotFound.Has(err))
+	_, err = addReturn(ctx, 5)
+	assert.True(t, he.BadRequest.Has(err))
+
+	r1, err := addReturn(ctx, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "requested", r1.Status)
+	r2, err := addReturn(ctx, 1)
+	assert.NoError(t, err)
+	_, err = addReturn(ctx, 2)
+	assert.True(t, he.BadRequest.Has(err))
+
+	r = httptest.NewRequest(http.MethodGet, "/api/return", nil)
+	resp, err = t.server.ListReturn(sellerCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	assert.Len(t, resp.(*RootJSON).Returns, 2)
+
+	// only the seller can resolve a return, and only once. the refund includes
+	// the tax paid on the returned items
+	_, err = resolveReturn(ctx, r1.ID, ResolveReturn{Status: "approved"})
+	assert.True(t, he.NotFound.Has(err))
+	approved, err := resolveReturn(sellerCtx, r1.ID,
+		ResolveReturn{Status: "approved"})
+	assert.NoError(t, err)
+	assert.Equal(t, 220, approved.Refund.Amount)
+	assert.Equal(t, 3, remaining())
+	_, err = resolveReturn(sellerCtx, r1.ID, ResolveReturn{Status: "rejected"})
+	assert.True(t, he.Conflict.Has(err))
+
+	// the provider gives the refund back in a job after the return is resolved
+	p, err := t.server.DB.Get_Payment_By_Id(ctx, database.Payment_Id(paymentID))
+	assert.NoError(t, err)
+	assert.Equal(t, 220, p.Refunded)
+	assert.Equal(t, 440, fake.Captured(p.AuthorizationId))
+	t.workJobs(ctx)
+	assert.Equal(t, 220, fake.Captured(p.AuthorizationId))
+
+	// the refund can be partial, but not more than is left of the payment
+	_, err = resolveReturn(sellerCtx, r2.ID, ResolveReturn{Status: "approved",
+		Refund: &Money{Amount: 300}})
+	assert.True(t, he.BadRequest.Has(err))
+	assert.Equal(t, 3, remaining())
+	_, err = resolveReturn(sellerCtx, r2.ID, ResolveReturn{Status: "approved",
+		Refund: &Money{Amount: 50}})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, remaining())
+	t.workJobs(ctx)
+	assert.Equal(t, 170, fake.Captured(p.AuthorizationId))
+
+	r3, err := addReturn(ctx, 1)
+	assert.NoError(t, err)
+	rejected, err := resolveReturn(sellerCtx, r3.ID, ResolveReturn{
+		Status: "rejected", Response: "it was worn"})
+	assert.NoError(t, err)
+	assert.Nil(t, rejected.Refund)
+	assert.Equal(t, 4, remaining())
+
+	returns := listOrder().Returns
+	assert.Len(t, returns, 3)
+	assert.Equal(t, []string{"approved", "approved", "rejected"},
+		[]string{returns[0].Status, returns[1].Status, returns[2].Status})
+	assert.Equal(t, 50, returns[1].Refund.Amount)
+	assert.Equal(t, "it was worn", returns[2].Response)
+}
@@ -0,0 +1,394 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/util"
+)
+
+const (
+	minRating       = 1
+	maxRating       = 5
+	maxReviewLength = 4000
+)
+
+// ListReview will return the reviews of an item, newest first
+func (s *Server) ListReview(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	p, err := parsePage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		item, err := tx.Find_Item_By_Id(ctx,
+			database.Item_Id(chi.URLParam(r, "itemID")))
+		if err != nil {
+			return err
+		}
+
+		if item == nil {
+			return he.NotFound.New("item not found")
+		}
+
+		reviews, err := tx.Limited_Review_By_ItemPk_OrderBy_Desc_Created(ctx,
+			database.Review_ItemPk(item.Pk), p.limit, p.offset)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Reviews: apiReviews(item.Id, reviews)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// AddReview will add the active user's review of an item they ordered. each
+// user can review an item once, and edit that review afterwards
+func (s *Server) AddReview(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	review := Review{}
+	err = json.NewDecoder(r.Body).Decode(&review)
+	if err != nil {
+		return nil, he.BadRequest.Wrap(err)
+	}
+
+	err = checkRating(review.Rating)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := reviewBody(review.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		item, err := tx.Find_Item_By_Id(ctx,
+			database.Item_Id(chi.URLParam(r, "itemID")))
+		if err != nil {
+			return err
+		}
+
+		if item == nil {
+			return he.NotFound.New("item not found")
+		}
+
+		ordered, err := tx.Has_OrderedItem_By_ItemPk_And_UserPk(ctx,
+			database.OrderedItem_ItemPk(item.Pk),
+			database.OrderedItem_UserPk(userPk))
+		if err != nil {
+			return err
+		}
+
+		if !ordered {
+			return he.Unauthorized.New("only users who ordered the item can " +
+				"review it")
+		}
+
+		reviewed, err := tx.Has_Review_By_UserPk_And_ItemPk(ctx,
+			database.Review_UserPk(userPk), database.Review_ItemPk(item.Pk))
+		if err != nil {
+			return err
+		}
+
+		if reviewed {
+			return he.Conflict.New("item has already been reviewed. edit the " +
+				"review instead")
+		}
+
+		dbReview, err := tx.Create_Review(ctx,
+			database.Review_Id(util.MustUUID4()),
+			database.Review_Rating(review.Rating),
+			database.Review_Body(body),
+			database.Review_Reply(""),
+			database.Review_UserPk(userPk),
+			database.Review_ItemPk(item.Pk),
+			database.Review_Create_Fields{})
+		if err != nil {
+			return err
+		}
+
+		err = adjustRating(ctx, tx, item, dbReview.Rating, 1)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Review: apiReview(item.Id, dbReview)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// PatchReview will edit the active user's review using JSON Merge Patch
+func (s *Server) PatchReview(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := decodeMergePatch(r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = patch.only("rating", "body")
+	if err != nil {
+		return nil, err
+	}
+
+	ups := database.Review_Update_Fields{
+		Edited: database.Review_Edited(util.UTCNow()),
+	}
+	rating, ratingOK, err := patch.int("rating")
+	if err != nil {
+		return nil, err
+	} else if ratingOK {
+		err = checkRating(rating)
+		if err != nil {
+			return nil, err
+		}
+		ups.Rating = database.Review_Rating(rating)
+	}
+
+	if body, ok, err := patch.string("body"); err != nil {
+		return nil, err
+	} else if ok {
+		body, err = reviewBody(body)
+		if err != nil {
+			return nil, err
+		}
+		ups.Body = database.Review_Body(body)
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		item, review, err := findReview(ctx, tx, chi.URLParam(r, "itemID"),
+			chi.URLParam(r, "reviewID"))
+		if err != nil {
+			return err
+		}
+
+		if review.UserPk != userPk {
+			return he.NotFound.New("review not found")
+		}
+
+		if ratingOK && rating != review.Rating {
+			err = adjustRating(ctx, tx, item, rating-review.Rating, 0)
+			if err != nil {
+				return err
+			}
+		}
+
+		review, err = tx.Update_Review_By_Pk(ctx,
+			database.Review_Pk(review.Pk), ups)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Review: apiReview(item.Id, review)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// DeleteReview will remove the active user's review
+func (s *Server) DeleteReview(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		item, review, err := findReview(ctx, tx, chi.URLParam(r, "itemID"),
+			chi.URLParam(r, "reviewID"))
+		if err != nil {
+			return err
+		}
+
+		if review.UserPk != userPk {
+			return he.NotFound.New("review not found")
+		}
+
+		_, err = tx.Delete_Review_By_Pk(ctx, database.Review_Pk(review.Pk))
+		if err != nil {
+			return err
+		}
+
+		return adjustRating(ctx, tx, item, -review.Rating, -1)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ReplyReview will set the seller's reply to a review of their item. an empty
+// reply removes it
+func (s *Server) ReplyReview(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := Review{}
+	err = json.NewDecoder(r.Body).Decode(&reply)
+	if err != nil {
+		return nil, he.BadRequest.Wrap(err)
+	}
+
+	text, err := reviewBody(reply.Reply)
+	if err != nil {
+		return nil, err
+	}
+
+	ups := database.Review_Update_Fields{
+		Reply:   database.Review_Reply(text),
+		Replied: database.Review_Replied(util.UTCNow()),
+	}
+	if text == "" {
+		ups.Replied = database.Review_Replied_Null()
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		item, review, err := findReview(ctx, tx, chi.URLParam(r, "itemID"),
+			chi.URLParam(r, "reviewID"))
+		if err != nil {
+			return err
+		}
+
+		if item.OwningUserPk == nil || *item.OwningUserPk != userPk {
+			return he.Unauthorized.New("only the item's seller can reply")
+		}
+
+		review, err = tx.Update_Review_By_Pk(ctx,
+			database.Review_Pk(review.Pk), ups)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Review: apiReview(item.Id, review)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func findReview(ctx context.Context, tx *database.Tx, itemID,
+	reviewID string) (*database.Item, *database.Review, error) {
+	item, err := tx.Find_Item_By_Id(ctx, database.Item_Id(itemID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if item == nil {
+		return nil, nil, he.NotFound.New("item not found")
+	}
+
+	review, err := tx.Find_Review_By_Id(ctx, database.Review_Id(reviewID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if review == nil || review.ItemPk != item.Pk {
+		return nil, nil, he.NotFound.New("review not found")
+	}
+	return item, review, nil
+}
+
+func checkRating(rating int) error {
+	if rating < minRating || rating > maxRating {
+		return he.BadRequest.New("rating must be from %d to %d", minRating,
+			maxRating)
+	}
+	return nil
+}
+
+func reviewBody(body string) (string, error) {
+	body = strings.TrimSpace(body)
+	if len(body) > maxReviewLength {
+		return "", he.BadRequest.New("reviews can be at most %d characters",
+			maxReviewLength)
+	}
+	return body, nil
+}
+
+// adjustRating changes the item's rating total and count as its reviews
+// change, so that its average rating doesn't need to be worked out each time
+// it's read. they're added to, like stock, since other reviews can change
+// them at the same time. the item's version is bumped because its rating is
+// shown with it
+func adjustRating(ctx context.Context, tx *database.Tx, item *database.Item,
+	totalDelta, countDelta int) error {
+	return tx.AdjustItemRating(ctx, item.Pk, totalDelta, countDelta)
+}
+
+// averageRating is the item's mean rating to two decimal places, or 0 if it
+// hasn't been reviewed
+func averageRating(item *database.Item) float64 {
+	if item.RatingCount == 0 {
+		return 0
+	}
+	mean := float64(item.RatingTotal) / float64(item.RatingCount)
+	return math.Round(mean*100) / 100
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/payment"
+)
+
+func TestReviews(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	t.server.Payments = payment.NewFake(payment.Succeed)
+	sellerCtx := t.addNewSession(ctx, "seller@example.com")
+	strangerCtx := t.addNewSession(ctx, "stranger@example.com")
+
+	item := t.addItem(sellerCtx, Item{Description: "x",
+		Price: &Money{Amount: 100, Currency: "USD"}, RemainingQuantity: 5})
+
+	var buyers []context.Context
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		buyerCtx := t.addNewSession(ctx, email)
+		t.addAddress(buyerCtx)
+		t.addCart(buyerCtx, item.ID, 1)
+		t.placeOrder(buyerCtx, item.ID)
+		buyers = append(buyers, buyerCtx)
+	}
+
+	addReview := func(ctx context.Context, review Review) (*Review, error) {
+		r := jsonPostRequest(t, "/api/item/"+item.ID+"/review", review)
+		resp, err := t.server.AddReview(ctx, httptest.NewRecorder(),
+			withURLParams(r, "itemID", item.ID))
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Review, nil
+	}
+	rating := func() (float64, int) {
+		r := httptest.NewRequest(http.MethodGet, "/api/item", nil)
+		resp, err := t.server.ListItem(ctx, httptest.NewRecorder(), r)
+		assert.NoError(t, err)
+		items := resp.(*RootJSON).Items
+		assert.Len(t, items, 1)
+		return items[0].Rating, items[0].ReviewCount
+	}
+
+	_, err := addReview(strangerCtx, Review{Rating: 5})
+	assert.True(t, he.Unauthorized.Has(err))
+	_, err = addReview(buyers[0], Review{Rating: 6})
+	assert.True(t, he.BadRequest.Has(err))
+
+	first, err := addReview(buyers[0], Review{Rating: 5, Body: " great "})
+	assert.NoError(t, err)
+	assert.Equal(t, "great", first.Body)
+	_, err = addReview(buyers[0], Review{Rating: 1})
+	assert.True(t, he.Conflict.Has(err))
+	second, err := addReview(buyers[1], Review{Rating: 2})
+	assert.NoError(t, err)
+	average, count := rating()
+	assert.Equal(t, 3.5, average)
+	assert.Equal(t, 2, count)
+
+	// only the author can edit their review
+	patchReview := func(ctx context.Context, patch string) (*Review, error) {
+		r := httptest.NewRequest(http.MethodPatch,
+			"/api/item/"+item.ID+"/review/"+second.ID, strings.NewReader(patch))
+		resp, err := t.server.PatchReview(ctx, httptest.NewRecorder(),
+			withURLParams(r, "itemID", item.ID, "reviewID", second.ID))
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Review, nil
+	}
+	_, err = patchReview(buyers[0], `{"rating": 1}`)
+	assert.True(t, he.NotFound.Has(err))
+	edited, err := patchReview(buyers[1], `{"rating": 4}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, edited.Rating)
+	assert.False(t, edited.Edited.IsZero())
+	average, count = rating()
+	assert.Equal(t, 4.5, average)
+	assert.Equal(t, 2, count)
+
+	// only the seller can reply
+	replyReview := func(ctx context.Context, reply string) (*Review, error) {
+		r := jsonPostRequest(t, "/api/item/"+item.ID+"/review/"+first.ID+
+			"/reply", Review{Reply: reply})
+		resp, err := t.server.ReplyReview(ctx, httptest.NewRecorder(),
+			withURLParams(r, "itemID", item.ID, "reviewID", first.ID))
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Review, nil
+	}
+	_, err = replyReview(buyers[0], "thanks")
+	assert.True(t, he.Unauthorized.Has(err))
+	replied, err := replyReview(sellerCtx, "thanks")
+	assert.NoError(t, err)
+	assert.Equal(t, "thanks", replied.Reply)
+	assert.False(t, replied.Replied.IsZero())
+
+	r := httptest.NewRequest(http.MethodGet, "/api/item/"+item.ID+"/review", nil)
+	resp, err := t.server.ListReview(ctx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", item.ID))
+	assert.NoError(t, err)
+	assert.Len(t, resp.(*RootJSON).Reviews, 2)
+
+	r = httptest.NewRequest(http.MethodDelete,
+		"/api/item/"+item.ID+"/review/"+first.ID, nil)
+	_, err = t.server.DeleteReview(buyers[0], httptest.NewRecorder(),
+		withURLParams(r, "itemID", item.ID, "reviewID", first.ID))
+	assert.NoError(t, err)
+	average, count = rating()
+	assert.Equal(t, 4.0, average)
+	assert.Equal(t, 1, count)
+
+	// the rating is added to, so reviews changing it from the same read of
+	// the item are all counted
+	dbItem, err := t.server.DB.Find_Item_By_Id(ctx, database.Item_Id(item.ID))
+	assert.NoError(t, err)
+	for _, stars := range []int{1, 3} {
+		err = t.server.DB.WithTx(ctx, func(ctx context.Context,
+			tx *database.Tx) error {
+			return adjustRating(ctx, tx, dbItem, stars, 1)
+		})
+		assert.NoError(t, err)
+	}
+	average, count = rating()
+	assert.Equal(t, 2.67, average)
+	assert.Equal(t, 3, count)
+}
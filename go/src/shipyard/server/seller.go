@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/go-chi/chi"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+)
+
+// items with this many or fewer remaining are low on stock, unless the
+// dashboard is asked for another threshold
+const defaultLowStock = 5
+
+// GetSeller will return a seller's public profile and the items they have
+// available
+func (s *Server) GetSeller(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	userID := chi.URLParam(r, "userID")
+	user, err := s.DB.Find_User_By_Id(ctx, database.User_Id(userID))
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		return nil, he.NotFound.New("seller not found")
+	}
+
+	items, err := s.DB.All_Item_By_Item_RemainingQuantity_Greater_Number_And_User_Id(
+		ctx, database.User_Id(userID))
+	if err != nil {
+		return nil, err
+	}
+
+	return &RootJSON{Seller: apiSeller(user, items)}, nil
+}
+
+// SellerDashboard will summarize the sales of the active user's items: how
+// many orders included them, how many units were sold and for how much, and
+// which items are low on stock. revenue is what buyers paid after discounts,
+// before any refunds, and is kept apart by currency
+func (s *Server) SellerDashboard(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	lowStock := defaultLowStock
+	if param := r.URL.Query().Get("low_stock"); param != "" {
+		lowStock, err = strconv.Atoi(param)
+		if err != nil || lowStock < 0 {
+			return nil, he.BadRequest.New("low_stock can't be negative")
+		}
+	}
+
+	var dashboard *Dashboard
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		items, err := tx.All_Item_By_SellerPk(ctx,
+			database.Item_OwningUserPk(userPk))
+		if err != nil {
+			return err
+		}
+
+		// the orders are summed here rather than by the database. it's worth
+		// moving into a query once sellers have more than a few of them
+		orderedItems, err := tx.All_OrderedItem_ItemId_By_SellerPk(ctx,
+			database.Item_OwningUserPk(userPk))
+		if err != nil {
+			return err
+		}
+
+		dashboard = sellerDashboard(items, orderedItems, lowStock)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &RootJSON{Dashboard: dashboard}, nil
+}
+
+// ListSellerOrder will return the ordered items of the active user's items,
+// newest first, with the addresses they're shipped to
+func (s *Server) ListSellerOrder(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := parsePage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	orderedItems, err := s.DB.Limited_OrderedItem_ItemId_By_SellerPk(ctx,
+		database.Item_OwningUserPk(userPk), p.limit, p.offset)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RootJSON{OrderedItems: apiOrderedItems(orderedItems)}, nil
+}
+
+func sellerDashboard(items []*database.Item,
+	orderedItems []*database.OrderedItem_Item_Id_Row,
+	lowStock int) *Dashboard {
+
+	type sales struct {
+		units   int
+		revenue map[string]int
+	}
+
+	orders := map[int64]bool{}
+	total := sales{revenue: map[string]int{}}
+	byItem := map[string]*sales{}
+	for _, row := range orderedItems {
+		orderedItem := &row.OrderedItem
+
+		// the items of an order share its payment
+		if orderedItem.PaymentPk != nil {
+			orders[*orderedItem.PaymentPk] = true
+		} else {
+			orders[-orderedItem.Pk] = true
+		}
+
+		itemSales := byItem[row.Item_Id]
+		if itemSales == nil {
+			itemSales = &sales{revenue: map[string]int{}}
+			byItem[row.Item_Id] = itemSales
+		}
+
+		paid := orderedItem.Price*orderedItem.Quantity - orderedItem.Discount
+		itemSales.units += orderedItem.Quantity
+		itemSales.revenue[orderedItem.Currency] += paid
+		total.units += orderedItem.Quantity
+		total.revenue[orderedItem.Currency] += paid
+	}
+
+	dashboard := &Dashboard{
+		Orders:            len(orders),
+		UnitsSold:         total.units,
+		Revenue:           apiRevenue(total.revenue),
+		Items:             make([]*DashboardItem, 0, len(items)),
+		LowStock:          []*DashboardItem{},
+		LowStockThreshold: lowStock,
+	}
+	for _, item := range items {
+		dashboardItem := &DashboardItem{
+			ItemID:            item.Id,
+			Title:             item.Title,
+			RemainingQuantity: item.RemainingQuantity,
+			Revenue:           []*Money{},
+		}
+		if itemSales := byItem[item.Id]; itemSales != nil {
+			dashboardItem.UnitsSold = itemSales.units
+			dashboardItem.Revenue = apiRevenue(itemSales.revenue)
+		}
+
+		dashboard.Items = append(dashboard.Items, dashboardItem)
+		if item.RemainingQuantity <= lowStock {
+			dashboard.LowStock = append(dashboard.LowStock, dashboardItem)
+		}
+	}
+
+	// the emptiest first, since they need restocking soonest
+	sort.SliceStable(dashboard.LowStock, func(i, j int) bool {
+		return dashboard.LowStock[i].RemainingQuantity <
+			dashboard.LowStock[j].RemainingQuantity
+	})
+	return dashboard
+}
+
+// apiRevenue lists amounts by currency in the order of their codes
+func apiRevenue(amounts map[string]int) []*Money {
+	currencies := make([]string, 0, len(amounts))
+	for currency := range amounts {
+		currencies = append(currencies, currency)
+	}
+	sort.Strings(currencies)
+
+	revenue := make([]*Money, 0, len(currencies))
+	for _, currency := range currencies {
+		revenue = append(revenue, apiMoney(amounts[currency], currency))
+	}
+	return revenue
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/payment"
+)
+
+func TestSeller(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	t.server.Payments = payment.NewFake(payment.Succeed)
+	sellerCtx := t.addNewSession(ctx, "seller@example.com")
+	buyerCtx := t.addNewSession(ctx, "buyer@example.com")
+
+	addItem := func(title string, price, quantity int) string {
+		r := jsonPostRequest(t, "/api/item", Item{Title: title,
+			Price: &Money{Amount: price, Currency: "USD"}, RemainingQuantity: quantity})
+		resp, err := t.server.AddItem(sellerCtx, httptest.NewRecorder(), r)
+		assert.NoError(t, err)
+		return resp.(*RootJSON).Item.ID
+	}
+	lampID := addItem("lamp", 100, 5)
+	chairID := addItem("chair", 250, 1)
+	addItem("table", 900, 20)
+
+	t.addAddress(buyerCtx)
+	for itemID, quantity := range map[string]int{lampID: 3, chairID: 1} {
+		t.addCart(buyerCtx, itemID, quantity)
+	}
+	r := jsonPostRequest(t, "/api/order", PlaceOrder{
+		Orders: []OrderedItem{{ItemID: lampID}, {ItemID: chairID}}})
+	_, err := t.server.AddOrder(buyerCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+
+	// the sold out chair isn't shown on the seller's profile
+	seller, err := t.server.DB.Find_User_By_Email(ctx,
+		database.User_Email("seller@example.com"))
+	assert.NoError(t, err)
+	r = httptest.NewRequest(http.MethodGet, "/api/seller/"+seller.Id, nil)
+	resp, err := t.server.GetSeller(ctx, httptest.NewRecorder(),
+		withURLParams(r, "userID", seller.Id))
+	assert.NoError(t, err)
+	profile := resp.(*RootJSON).Seller
+	assert.Equal(t, seller.Id, profile.ID)
+	assert.Len(t, profile.Items, 2)
+	for _, item := range profile.Items {
+		assert.NotEqual(t, chairID, item.ID)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/api/seller/nobody", nil)
+	_, err = t.server.GetSeller(ctx, httptest.NewRecorder(),
+		withURLParams(r, "userID", "nobody"))
+	assert.True(t, he.NotFound.Has(err))
+
+	r = httptest.NewRequest(http.MethodGet, "/api/seller/dashboard", nil)
+	resp, err = t.server.SellerDashboard(sellerCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	dashboard := resp.(*RootJSON).Dashboard
+	assert.Equal(t, 1, dashboard.Orders)
+	assert.Equal(t, 4, dashboard.UnitsSold)
+	assert.Equal(t, []*Money{{Amount: 550, Currency: "USD",
+		Formatted: "$5.50"}}, dashboard.Revenue)
+	assert.Len(t, dashboard.Items, 3)
+	assert.Equal(t, lampID, dashboard.Items[0].ItemID)
+	assert.Equal(t, 3, dashboard.Items[0].UnitsSold)
+	assert.Equal(t, 300, dashboard.Items[0].Revenue[0].Amount)
+	assert.Empty(t, dashboard.Items[2].Revenue)
+	assert.Len(t, dashboard.LowStock, 2)
+	assert.Equal(t, chairID, dashboard.LowStock[0].ItemID)
+	assert.Equal(t, lampID, dashboard.LowStock[1].ItemID)
+
+	r = httptest.NewRequest(http.MethodGet,
+		"/api/seller/dashboard?low_stock=0", nil)
+	resp, err = t.server.SellerDashboard(sellerCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	assert.Len(t, resp.(*RootJSON).Dashboard.LowStock, 1)
+
+	// only sellers see the orders of their items
+	r = httptest.NewRequest(http.MethodGet, "/api/seller/order?limit=1", nil)
+	resp, err = t.server.ListSellerOrder(sellerCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	orderedItems := resp.(*RootJSON).OrderedItems
+	assert.Len(t, orderedItems, 1)
+	assert.Equal(t, "1 street", orderedItems[0].Address.Line1)
+
+	resp, err = t.server.ListSellerOrder(buyerCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	assert.Empty(t, resp.(*RootJSON).OrderedItems)
+}
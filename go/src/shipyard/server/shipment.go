@@ -0,0 +1,663 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"shipyard/config"
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/tracking"
+	"shipyard/util"
+)
+
+// a shipment is pending until it's handed to the carrier, then in transit
+// until it's delivered. the carrier can report an exception at any point
+// before delivery, which is resolved by a later status
+const (
+	shipmentPending   = "pending"
+	shipmentInTransit = "in_transit"
+	shipmentDelivered = "delivered"
+	shipmentException = "exception"
+
+	trackBatchSize = 100
+)
+
+func newTracker(configs *config.Configs) tracking.Tracker {
+	return tracking.NewFake()
+}
+
+// ListShipment will return the shipments of a sub order to its buyer or its
+// seller
+func (s *Server) ListShipment(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		subOrder, err := tx.Find_SubOrder_By_Id(ctx,
+			database.SubOrder_Id(chi.URLParam(r, "subOrderID")))
+		if err != nil {
+			return err
+		}
+
+		if subOrder == nil || !(isUserPk(subOrder.UserPk, userPk) ||
+			isUserPk(subOrder.SellerPk, userPk)) {
+			return he.NotFound.New("sub order not found")
+		}
+
+		shipments, err := loadShipments(ctx, tx, subOrder)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Shipments: shipments}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// AddShipment will record a package the active user is sending for one of
+// their sub orders. without items, it holds everything not already in
+// another shipment. it's in transit unless it's added as pending
+func (s *Server) AddShipment(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	shipment := Shipment{}
+	err = json.NewDecoder(r.Body).Decode(&shipment)
+	if err != nil {
+		return nil, he.BadRequest.Wrap(err)
+	}
+
+	carrier := strings.TrimSpace(shipment.Carrier)
+	if carrier == "" {
+		return nil, he.BadRequest.New("carrier is required")
+	}
+
+	status := shipment.Status
+	switch status {
+	case "":
+		status = shipmentInTransit
+	case shipmentPending, shipmentInTransit:
+	default:
+		return nil, he.BadRequest.New("shipments can only be added as pending " +
+			"or in_transit")
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		subOrder, err := tx.Find_SubOrder_By_Id(ctx,
+			database.SubOrder_Id(chi.URLParam(r, "subOrderID")))
+		if err != nil {
+			return err
+		}
+
+		if subOrder == nil || !isUserPk(subOrder.SellerPk, userPk) {
+			return he.NotFound.New("sub order not found")
+		}
+
+		if subOrder.Status == subOrderDelivered {
+			return he.Conflict.New("sub order has been delivered")
+		}
+
+		contents, err := shipmentContents(ctx, tx, subOrder, shipment.Items)
+		if err != nil {
+			return err
+		}
+
+		optional := database.Shipment_Create_Fields{}
+		if status == shipmentInTransit {
+			optional.Shipped = database.Shipment_Shipped(util.UTCNow())
+		}
+		dbShipment, err := tx.Create_Shipment(ctx,
+			database.Shipment_Id(util.MustUUID4()),
+			database.Shipment_Carrier(carrier),
+			database.Shipment_TrackingNumber(
+				strings.TrimSpace(shipment.TrackingNumber)),
+			database.Shipment_Status(status),
+			database.Shipment_Detail(""),
+			database.Shipment_SubOrderPk(subOrder.Pk),
+			optional)
+		if err != nil {
+			return err
+		}
+
+		for orderedItemPk, quantity := range contents {
+			err = tx.CreateNoReturn_ShipmentItem(ctx,
+				database.ShipmentItem_Quantity(quantity),
+				database.ShipmentItem_ShipmentPk(dbShipment.Pk),
+				database.ShipmentItem_OrderedItemPk(orderedItemPk))
+			if err != nil {
+				return err
+			}
+		}
+
+		err = syncShipments(ctx, tx, subOrder)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{}
+		resp.Shipment, err = loadShipment(ctx, tx, subOrder, dbShipment)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// PatchShipment will correct a shipment's carrier or tracking number, or move
+// it on to another status, using JSON Merge Patch. delivered shipments can't
+// change status
+func (s *Server) PatchShipment(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := decodeMergePatch(r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = patch.only("carrier", "tracking_number", "status")
+	if err != nil {
+		return nil, err
+	}
+
+	ups := database.Shipment_Update_Fields{}
+	if carrier, ok, err := patch.string("carrier"); err != nil {
+		return nil, err
+	} else if ok {
+		carrier = strings.TrimSpace(carrier)
+		if carrier == "" {
+			return nil, he.BadRequest.New("carrier is required")
+		}
+		ups.Carrier = database.Shipment_Carrier(carrier)
+	}
+
+	if number, ok, err := patch.string("tracking_number"); err != nil {
+		return nil, err
+	} else if ok {
+		ups.TrackingNumber = database.Shipment_TrackingNumber(
+			strings.TrimSpace(number))
+	}
+
+	status, statusOK, err := patch.string("status")
+	if err != nil {
+		return nil, err
+	} else if statusOK {
+		switch status {
+		case shipmentPending, shipmentInTransit, shipmentDelivered,
+			shipmentException:
+		default:
+			return nil, he.BadRequest.New("unknown status %q", status)
+		}
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		shipment, subOrder, err := findSellerShipment(ctx, tx,
+			chi.URLParam(r, "shipmentID"), userPk)
+		if err != nil {
+			return err
+		}
+
+		if statusOK && status != shipment.Status {
+			if shipment.Status == shipmentDelivered {
+				return he.Conflict.New("shipment has been delivered")
+			}
+			setShipmentStatus(&ups, shipment, status, "", time.Time{})
+		}
+
+		shipment, err = tx.Update_Shipment_By_Pk(ctx,
+			database.Shipment_Pk(shipment.Pk), ups)
+		if err != nil {
+			return err
+		}
+
+		err = syncShipments(ctx, tx, subOrder)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{}
+		resp.Shipment, err = loadShipment(ctx, tx, subOrder, shipment)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// TrackShipment will update a shipment with what its carrier says about it
+func (s *Server) TrackShipment(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	shipment, _, err := findSellerShipment(ctx, s.DB,
+		chi.URLParam(r, "shipmentID"), userPk)
+	if err != nil {
+		return nil, err
+	}
+
+	if shipment.TrackingNumber == "" {
+		return nil, he.Conflict.New("shipment has no tracking number")
+	}
+
+	var resp *RootJSON
+	err = s.trackShipment(ctx, shipment, func(ctx context.Context,
+		tx *database.Tx, subOrder *database.SubOrder,
+		shipment *database.Shipment) (err error) {
+		resp = &RootJSON{}
+		resp.Shipment, err = loadShipment(ctx, tx, subOrder, shipment)
+		return err
+	})
+	if err != nil {
+		return nil, trackingError(err)
+	}
+
+	return resp, nil
+}
+
+// RunTracker tracks the shipments on their way every TrackInterval until ctx
+// is cancelled
+func (s *Server) RunTracker(ctx context.Context) {
+	ticker := time.NewTicker(s.Config.TrackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.TrackShipments(ctx)
+			if err != nil {
+				s.log.WithError(err).Errorf("failed to track shipments")
+			}
+		}
+	}
+}
+
+// TrackShipments updates every shipment that's in transit, or that had an
+// exception, with what its carrier says about it. shipments that can't be
+// tracked are tried again next time
+func (s *Server) TrackShipments(ctx context.Context) error {
+	for _, status := range []string{shipmentInTransit, shipmentException} {
+		offset := int64(0)
+		for {
+			shipments, err := s.DB.Limited_Shipment_By_Status(ctx,
+				database.Shipment_Status(status), trackBatchSize, offset)
+			if err != nil {
+				return err
+			}
+
+			for _, shipment := range shipments {
+				if shipment.TrackingNumber == "" {
+					offset++
+					continue
+				}
+
+				var tracked *database.Shipment
+				err = s.trackShipment(ctx, shipment, func(ctx context.Context,
+					tx *database.Tx, subOrder *database.SubOrder,
+					shipment *database.Shipment) error {
+					tracked = shipment
+					return nil
+				})
+				if tracking.NotFound.Has(err) || tracking.Unavailable.Has(err) {
+					s.log.WithError(err).Warnf("failed to track shipment %s",
+						shipment.Id)
+				} else if err != nil {
+					return err
+				}
+
+				if tracked == nil || tracked.Status == status {
+					offset++
+				}
+			}
+
+			if len(shipments) < trackBatchSize {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// trackShipment asks the carrier about the shipment, then updates it and its
+// sub order in a transaction that done is also called in. the carrier isn't
+// asked inside the transaction so that it isn't held open while waiting
+func (s *Server) trackShipment(ctx context.Context,
+	shipment *database.Shipment, done func(ctx context.Context,
+		tx *database.Tx, subOrder *database.SubOrder,
+		shipment *database.Shipment) error) error {
+
+	status, err := s.Tracker.Track(ctx, shipment.Carrier,
+		shipment.TrackingNumber)
+	if err != nil {
+		return err
+	}
+
+	return s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		// it may have changed while the carrier was asked
+		shipment, err := tx.Find_Shipment_By_Id(ctx,
+			database.Shipment_Id(shipment.Id))
+		if err != nil {
+			return err
+		}
+
+		if shipment == nil {
+			return he.NotFound.New("shipment not found")
+		}
+
+		subOrder, err := tx.Get_SubOrder_By_Pk(ctx,
+			database.SubOrder_Pk(shipment.SubOrderPk))
+		if err != nil {
+			return err
+		}
+
+		ups := database.Shipment_Update_Fields{
+			Tracked: database.Shipment_Tracked(util.UTCNow()),
+		}
+		if shipment.Status != shipmentDelivered {
+			setShipmentStatus(&ups, shipment, string(status.State),
+				status.Detail, status.Delivered)
+		}
+
+		shipment, err = tx.Update_Shipment_By_Pk(ctx,
+			database.Shipment_Pk(shipment.Pk), ups)
+		if err != nil {
+			return err
+		}
+
+		err = syncShipments(ctx, tx, subOrder)
+		if err != nil {
+			return err
+		}
+
+		return done(ctx, tx, subOrder, shipment)
+	})
+}
+
+// setShipmentStatus sets the status in ups, along with when the shipment was
+// shipped and delivered if it has just been. delivered is when the carrier
+// says it was, if it's known
+func setShipmentStatus(ups *database.Shipment_Update_Fields,
+	shipment *database.Shipment, status, detail string, delivered time.Time) {
+
+	now := util.UTCNow()
+	ups.Status = database.Shipment_Status(status)
+	ups.Detail = database.Shipment_Detail(detail)
+	if status != shipmentPending && shipment.Shipped == nil {
+		ups.Shipped = database.Shipment_Shipped(now)
+	}
+	if status == shipmentDelivered {
+		if delivered.IsZero() {
+			delivered = now
+		}
+		ups.Delivered = database.Shipment_Delivered(delivered.UTC())
+	}
+}
+
+// shipmentContents checks what's being shipped against what's left to ship of
+// the sub order, and returns the quantity of each ordered item by its pk
+func shipmentContents(ctx context.Context, tx *database.Tx,
+	subOrder *database.SubOrder, items []*ShipmentItem) (map[int64]int, error) {
+
+	orderedItems, err := tx.All_OrderedItem_ItemId_By_SubOrderPk(ctx,
+		database.OrderedItem_SubOrderPk(subOrder.Pk))
+	if err != nil {
+		return nil, err
+	}
+
+	shipped, err := tx.All_ShipmentItem_OrderedItemId_By_SubOrderPk(ctx,
+		database.Shipment_SubOrderPk(subOrder.Pk))
+	if err != nil {
+		return nil, err
+	}
+
+	unshipped := map[string]int{}
+	pks := map[string]int64{}
+	for _, row := range orderedItems {
+		unshipped[row.OrderedItem.Id] += row.OrderedItem.Quantity
+		pks[row.OrderedItem.Id] = row.OrderedItem.Pk
+	}
+	for _, row := range shipped {
+		unshipped[row.OrderedItem_Id] -= row.ShipmentItem.Quantity
+	}
+
+	contents := map[int64]int{}
+	if len(items) == 0 {
+		for id, quantity := range unshipped {
+			if quantity > 0 {
+				contents[pks[id]] = quantity
+			}
+		}
+		if len(contents) == 0 {
+			return nil, he.Conflict.New("everything has already been shipped")
+		}
+		return contents, nil
+	}
+
+	for _, item := range items {
+		pk, ok := pks[item.OrderedItemID]
+		if !ok {
+			return nil, he.BadRequest.New("ordered item %s isn't part of the "+
+				"sub order", item.OrderedItemID)
+		}
+		if _, ok := contents[pk]; ok {
+			return nil, he.BadRequest.New("ordered item %s is listed twice",
+				item.OrderedItemID)
+		}
+
+		quantity := item.Quantity
+		if quantity == 0 {
+			quantity = unshipped[item.OrderedItemID]
+		}
+		if quantity <= 0 || quantity > unshipped[item.OrderedItemID] {
+			return nil, he.BadRequest.New("only %d of ordered item %s are left "+
+				"to ship", unshipped[item.OrderedItemID], item.OrderedItemID)
+		}
+		contents[pk] = quantity
+	}
+	return contents, nil
+}
+
+// syncShipments derives whether each of the sub order's ordered items has
+// been delivered from its shipments, and moves the sub order on to
+// processing once some of it has been shipped, shipped once all of it has,
+// and delivered once all of it has been. it never moves the sub order back
+func syncShipments(ctx context.Context, tx *database.Tx,
+	subOrder *database.SubOrder) error {
+
+	orderedItems, err := tx.All_OrderedItem_ItemId_By_SubOrderPk(ctx,
+		database.OrderedItem_SubOrderPk(subOrder.Pk))
+	if err != nil {
+		return err
+	}
+
+	shipments, err := tx.All_Shipment_By_SubOrderPk(ctx,
+		database.Shipment_SubOrderPk(subOrder.Pk))
+	if err != nil {
+		return err
+	}
+
+	shipmentItems, err := tx.All_ShipmentItem_OrderedItemId_By_SubOrderPk(ctx,
+		database.Shipment_SubOrderPk(subOrder.Pk))
+	if err != nil {
+		return err
+	}
+
+	statuses := map[int64]string{}
+	for _, shipment := range shipments {
+		statuses[shipment.Pk] = shipment.Status
+	}
+
+	shipped, delivered := map[int64]int{}, map[int64]int{}
+	for _, row := range shipmentItems {
+		orderedItemPk := row.ShipmentItem.OrderedItemPk
+		switch statuses[row.ShipmentItem.ShipmentPk] {
+		case shipmentDelivered:
+			delivered[orderedItemPk] += row.ShipmentItem.Quantity
+			fallthrough
+		case shipmentInTransit, shipmentException:
+			shipped[orderedItemPk] += row.ShipmentItem.Quantity
+		}
+	}
+
+	anyShipped, allShipped, allDelivered := false, true, true
+	for _, row := range orderedItems {
+		orderedItem := &row.OrderedItem
+		isDelivered := delivered[orderedItem.Pk] >= orderedItem.Quantity
+		if isDelivered != orderedItem.Delivered {
+			err = tx.UpdateNoReturn_OrderedItem_By_Pk(ctx,
+				database.OrderedItem_Pk(orderedItem.Pk),
+				database.OrderedItem_Update_Fields{
+					Delivered: database.OrderedItem_Delivered(isDelivered),
+				})
+			if err != nil {
+				return err
+			}
+			orderedItem.Delivered = isDelivered
+		}
+
+		anyShipped = anyShipped || shipped[orderedItem.Pk] > 0
+		allShipped = allShipped && shipped[orderedItem.Pk] >= orderedItem.Quantity
+		allDelivered = allDelivered && isDelivered
+	}
+
+	status := ""
+	switch {
+	case allDelivered:
+		status = subOrderDelivered
+	case allShipped:
+		status = subOrderShipped
+	case anyShipped:
+		status = subOrderProcessing
+	}
+	if status == "" || subOrderSteps[status] <= subOrderSteps[subOrder.Status] {
+		return nil
+	}
+
+	_, err = advanceSubOrder(ctx, tx, subOrder, orderedItems, status)
+	return err
+}
+
+func findSellerShipment(ctx context.Context, db database.Methods,
+	shipmentID string, userPk int64) (*database.Shipment, *database.SubOrder,
+	error) {
+
+	shipment, err := db.Find_Shipment_By_Id(ctx, database.Shipment_Id(shipmentID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if shipment == nil {
+		return nil, nil, he.NotFound.New("shipment not found")
+	}
+
+	subOrder, err := db.Get_SubOrder_By_Pk(ctx,
+		database.SubOrder_Pk(shipment.SubOrderPk))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !isUserPk(subOrder.SellerPk, userPk) {
+		return nil, nil, he.NotFound.New("shipment not found")
+	}
+	return shipment, subOrder, nil
+}
+
+func loadShipments(ctx context.Context, tx *database.Tx,
+	subOrder *database.SubOrder) ([]*Shipment, error) {
+
+	shipments, err := tx.All_Shipment_By_SubOrderPk(ctx,
+		database.Shipment_SubOrderPk(subOrder.Pk))
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := tx.All_ShipmentItem_OrderedItemId_By_SubOrderPk(ctx,
+		database.Shipment_SubOrderPk(subOrder.Pk))
+	if err != nil {
+		return nil, err
+	}
+
+	s := make([]*Shipment, 0, len(shipments))
+	for _, shipment := range shipments {
+		s = append(s, apiShipment(subOrder.Id, shipment, items))
+	}
+	return s, nil
+}
+
+func loadShipment(ctx context.Context, tx *database.Tx,
+	subOrder *database.SubOrder, shipment *database.Shipment) (*Shipment,
+	error) {
+
+	items, err := tx.All_ShipmentItem_OrderedItemId_By_SubOrderPk(ctx,
+		database.Shipment_SubOrderPk(subOrder.Pk))
+	if err != nil {
+		return nil, err
+	}
+	return apiShipment(subOrder.Id, shipment, items), nil
+}
+
+// trackingError converts tracking errors into their http errors
+func trackingError(err error) error {
+	switch {
+	case tracking.NotFound.Has(err):
+		return he.Conflict.Wrap(err)
+	case tracking.Unavailable.Has(err):
+		return he.Unavailable.Wrap(err)
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	he "shipyard/httperror"
+	"shipyard/payment"
+	"shipyard/tracking"
+)
+
+func TestShipments(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	t.server.Payments = payment.NewFake(payment.Succeed)
+	tracker := tracking.NewFake()
+	t.server.Tracker = tracker
+	sellerCtx := t.addNewSession(ctx, "seller@example.com")
+	buyerCtx := t.addNewSession(ctx, "buyer@example.com")
+	strangerCtx := t.addNewSession(ctx, "stranger@example.com")
+
+	t.addAddress(buyerCtx)
+	var orders []OrderedItem
+	for i, quantity := range []int{2, 1} {
+		r := jsonPostRequest(t, "/api/item", Item{Price: &Money{Amount: 100 + i,
+			Currency: "USD"}, RemainingQuantity: 10})
+		resp, err := t.server.AddItem(sellerCtx, httptest.NewRecorder(), r)
+		assert.NoError(t, err)
+		itemID := resp.(*RootJSON).Item.ID
+
+		t.addCart(buyerCtx, itemID, quantity)
+		orders = append(orders, OrderedItem{ItemID: itemID})
+	}
+	r := jsonPostRequest(t, "/api/order", PlaceOrder{Orders: orders})
+	resp, err := t.server.AddOrder(buyerCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	subOrderID := resp.(*RootJSON).SubOrders[0].ID
+
+	getSubOrder := func() *SubOrder {
+		r := httptest.NewRequest(http.MethodGet, "/api/suborder/"+subOrderID,
+			nil)
+		resp, err := t.server.GetSubOrder(buyerCtx, httptest.NewRecorder(),
+			withURLParams(r, "subOrderID", subOrderID))
+		assert.NoError(t, err)
+		return resp.(*RootJSON).SubOrder
+	}
+	items := getSubOrder().Items
+	assert.Len(t, items, 2)
+
+	addShipment := func(ctx context.Context, shipment Shipment) (*Shipment,
+		error) {
+		r := jsonPostRequest(t, "/api/seller/suborder/"+subOrderID+"/shipment",
+			shipment)
+		resp, err := t.server.AddShipment(ctx, httptest.NewRecorder(),
+			withURLParams(r, "subOrderID", subOrderID))
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Shipment, nil
+	}
+	patchShipment := func(id, patch string) (*Shipment, error) {
+		r := httptest.NewRequest(http.MethodPatch, "/api/seller/shipment/"+id,
+			strings.NewReader(patch))
+		resp, err := t.server.PatchShipment(sellerCtx, httptest.NewRecorder(),
+			withURLParams(r, "shipmentID", id))
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Shipment, nil
+	}
+
+	_, err = addShipment(sellerCtx, Shipment{})
+	assert.True(t, he.BadRequest.Has(err))
+	_, err = addShipment(strangerCtx, Shipment{Carrier: "UPS"})
+	assert.True(t, he.NotFound.Has(err))
+	_, err = addShipment(sellerCtx, Shipment{Carrier: "UPS",
+		Items: []*ShipmentItem{{OrderedItemID: items[0].ID, Quantity: 3}}})
+	assert.True(t, he.BadRequest.Has(err))
+
+	// part of the sub order is shipped, then the rest once it's packed
+	first, err := addShipment(sellerCtx, Shipment{Carrier: "UPS",
+		TrackingNumber: "1Z1",
+		Items:          []*ShipmentItem{{OrderedItemID: items[0].ID, Quantity: 1}}})
+	assert.NoError(t, err)
+	assert.Equal(t, shipmentInTransit, first.Status)
+	assert.False(t, first.Shipped.IsZero())
+	assert.Equal(t, subOrderProcessing, getSubOrder().Status)
+
+	rest, err := addShipment(sellerCtx, Shipment{Carrier: "UPS",
+		Status: shipmentPending})
+	assert.NoError(t, err)
+	assert.Len(t, rest.Items, 2)
+	assert.True(t, rest.Shipped.IsZero())
+	_, err = addShipment(sellerCtx, Shipment{Carrier: "UPS"})
+	assert.True(t, he.Conflict.Has(err))
+
+	rest, err = patchShipment(rest.ID,
+		`{"status": "in_transit", "tracking_number": "1Z2"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, "1Z2", rest.TrackingNumber)
+	assert.Equal(t, subOrderShipped, getSubOrder().Status)
+
+	r = jsonPostRequest(t, "/api/seller/suborder/"+subOrderID,
+		SubOrder{Status: subOrderDelivered})
+	_, err = t.server.AdvanceSubOrder(sellerCtx, httptest.NewRecorder(),
+		withURLParams(r, "subOrderID", subOrderID))
+	assert.True(t, he.Conflict.Has(err))
+
+	// an ordered item is delivered once all of it has been
+	delivered := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tracker.Set("ups", "1Z1", tracking.Status{State: tracking.Delivered,
+		Delivered: delivered})
+	r = jsonPostRequest(t, "/api/seller/shipment/"+first.ID+"/track", nil)
+	resp, err = t.server.TrackShipment(sellerCtx, httptest.NewRecorder(),
+		withURLParams(r, "shipmentID", first.ID))
+	assert.NoError(t, err)
+	first = resp.(*RootJSON).Shipment
+	assert.Equal(t, shipmentDelivered, first.Status)
+	assert.Equal(t, delivered.Unix(), first.Delivered.Unix())
+	for _, item := range getSubOrder().Items {
+		assert.False(t, item.Delivered)
+	}
+
+	tracker.Set("UPS", "1Z2", tracking.Status{State: tracking.Exception,
+		Detail: "address not found"})
+	assert.NoError(t, t.server.TrackShipments(ctx))
+	tracker.Set("UPS", "1Z2", tracking.Status{State: tracking.Delivered})
+	assert.NoError(t, t.server.TrackShipments(ctx))
+	subOrder := getSubOrder()
+	assert.Equal(t, subOrderDelivered, subOrder.Status)
+	for _, item := range subOrder.Items {
+		assert.True(t, item.Delivered)
+	}
+
+	_, err = patchShipment(rest.ID, `{"status": "in_transit"}`)
+	assert.True(t, he.Conflict.Has(err))
+
+	listShipments := func(ctx context.Context) ([]*Shipment, error) {
+		r := httptest.NewRequest(http.MethodGet,
+			"/api/suborder/"+subOrderID+"/shipment", nil)
+		resp, err := t.server.ListShipment(ctx, httptest.NewRecorder(),
+			withURLParams(r, "subOrderID", subOrderID))
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Shipments, nil
+	}
+	shipments, err := listShipments(buyerCtx)
+	assert.NoError(t, err)
+	assert.Len(t, shipments, 2)
+	assert.Equal(t, shipmentDelivered, shipments[1].Status)
+	assert.Empty(t, shipments[1].Detail)
+	_, err = listShipments(strangerCtx)
+	assert.True(t, he.NotFound.Has(err))
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+)
+
+const (
+	// streamGapWait is how long an event recorded after a gap in the event
+	// pks is held back for, since the gap may be an event whose transaction
+	// hasn't committed yet. a gap older than this is taken to be a rolled
+	// back one, and skipped
+	streamGapWait = 5 * time.Second
+	// streamRetry is how long, in milliseconds, clients are told to wait
+	// before reconnecting
+	streamRetry = 1000
+)
+
+// streamedEvents are the kinds of events sent to /api/events. the user's own
+// are sent, along with stock changes of the items in their cart
+var streamedEvents = map[string]bool{
+	EventCartUpdated:      true,
+	EventOrderPlaced:      true,
+	EventSubOrderAdvanced: true,
+	EventStockChanged:     true,
+}
+
+// streamHub has the open event streams, which it wakes when events that may
+// be for them are dispatched, until the server shuts down
+type streamHub struct {
+	mu      sync.Mutex
+	streams map[*eventStream]bool
+	closed  bool
+}
+
+type eventStream struct {
+	userPk int64
+	wake   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (es *eventStream) end() {
+	es.once.Do(func() { close(es.done) })
+}
+
+// open adds a stream for the user, or returns nil once the hub is closed
+func (hub *streamHub) open(userPk int64) *eventStream {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	if hub.closed {
+		return nil
+	}
+	if hub.streams == nil {
+		hub.streams = map[*eventStream]bool{}
+	}
+
+	es := &eventStream{
+		userPk: userPk,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	hub.streams[es] = true
+	return es
+}
+
+func (hub *streamHub) remove(es *eventStream) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	delete(hub.streams, es)
+}
+
+// publish wakes the streams the event may be for, so they read it and any
+// others recorded before it. a stream that's already been woken is left to
+// read them all at once
+func (hub *streamHub) publish(event *database.Event) {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for es := range hub.streams {
+		if event.Kind != EventStockChanged &&
+			(event.UserPk == nil || *event.UserPk != es.userPk) {
+			continue
+		}
+
+		select {
+		case es.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// close ends every stream, and any opened after
+func (hub *streamHub) close() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	hub.closed = true
+	for es := range hub.streams {
+		es.end()
+	}
+}
+
+// publishStream is the subscriber that feeds the open event streams
+func (s *Server) publishStream(ctx context.Context,
+	event *database.Event) error {
+
+	if streamedEvents[event.Kind] {
+		s.streams.publish(event)
+	}
+	return nil
+}
+
+// RunStreams keeps the event streams and inventory feeds open until ctx is
+// cancelled, then ends them so the server can shut down without waiting on
+// them. the server's shutdown doesn't wait for the inventory feeds' hijacked
+// connections, so they'd otherwise be left open
+func (s *Server) RunStreams(ctx context.Context) {
+	<-ctx.Done()
+	s.streams.close()
+	s.inventory.close()
+}
+
+// Events will stream the active user's cart and order changes, and the stock
+// changes of the items in their cart, as server-sent events. events are
+// sent in the order they were recorded, however they're dispatched, so a
+// client that reconnects with the Last-Event-ID header is sent everything
+// after the last event it saw. one that doesn't is sent what's recorded once
+// it's connected
+func (s *Server) Events(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, he.Unexpected.New("streaming is unsupported")
+	}
+
+	// the last event is found before the stream is opened so a bad
+	// Last-Event-ID can still be responded to with an error. lastPk is the
+	// event everything up to has been sent
+	var lastPk int64
+	if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+		last, err := s.DB.Find_Event_By_Id(ctx, database.Event_Id(lastID))
+		if err != nil {
+			return nil, err
+		}
+		if last == nil {
+			return nil, he.NotFound.New("event %s not found", lastID)
+		}
+		lastPk = last.Pk
+	} else {
+		latest, err := s.DB.Limited_Event_Latest(ctx, 1, 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(latest) > 0 {
+			lastPk = latest[0].Pk
+		}
+	}
+
+	es := s.streams.open(userPk)
+	if es == nil {
+		return nil, he.Unavailable.New("the server is shutting down")
+	}
+	defer s.streams.remove(es)
+
+	// the stream is ended before the server's write timeout would cut it off
+	var lifetime <-chan time.Time
+	if s.Config.WriteTimeout > 0 {
+		timer := time.NewTimer(s.Config.WriteTimeout * 9 / 10)
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+	heartbeat := time.NewTicker(s.Config.StreamHeartbeat)
+	defer heartbeat.Stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event *database.Event) error {
+		mine, err := s.streamedTo(ctx, userPk, event)
+		if err != nil || !mine {
+			return err
+		}
+
+		data, err := json.Marshal(apiEvent(event))
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.Id,
+			event.Kind, data)
+		if err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	// catchUp sends the events recorded after lastPk, in order, up to the
+	// first gap that's too new to skip. it returns how long until that gap
+	// can be skipped, or 0 when there isn't one
+	catchUp := func() (time.Duration, error) {
+		for {
+			events, err := s.DB.Limited_Event_After_Pk(ctx,
+				database.Event_Pk(lastPk), eventBatchSize, 0)
+			if err != nil {
+				return 0, err
+			}
+
+			for _, event := range events {
+				if event.Pk != lastPk+1 {
+					age := time.Since(event.Created)
+					if age < streamGapWait {
+						return streamGapWait - age, nil
+					}
+				}
+				if streamedEvents[event.Kind] {
+					err = send(event)
+					if err != nil {
+						return 0, err
+					}
+				}
+				lastPk = event.Pk
+			}
+
+			if len(events) < eventBatchSize {
+				return 0, nil
+			}
+		}
+	}
+
+	_, err = fmt.Fprintf(w, "retry: %d\n\n", streamRetry)
+	if err != nil {
+		return []byte{}, nil
+	}
+	flusher.Flush()
+
+	// the stream catches up when it's woken, and on every heartbeat for the
+	// events recorded but not yet dispatched. a gap it's waiting out is
+	// retried once it can be skipped
+	for {
+		wait, err := catchUp()
+		if err != nil {
+			s.log.WithError(err).Warnf("ending event stream")
+			return []byte{}, nil
+		}
+		var gap <-chan time.Time
+		if wait > 0 {
+			gap = time.After(wait)
+		}
+
+		select {
+		case <-ctx.Done():
+			return []byte{}, nil
+		case <-es.done:
+			return []byte{}, nil
+		case <-lifetime:
+			return []byte{}, nil
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(w, ": heartbeat\n\n")
+			if err != nil {
+				return []byte{}, nil
+			}
+			flusher.Flush()
+		case <-es.wake:
+		case <-gap:
+		}
+	}
+}
+
+// streamedTo is whether the event is for the user's stream
+func (s *Server) streamedTo(ctx context.Context, userPk int64,
+	event *database.Event) (bool, error) {
+
+	if event.Kind != EventStockChanged {
+		return event.UserPk != nil && *event.UserPk == userPk, nil
+	}
+
+	return s.DB.Has_CartItem_By_Item_Id_And_CartItem_UserPk(ctx,
+		database.Item_Id(event.SubjectId), database.CartItem_UserPk(userPk))
+}
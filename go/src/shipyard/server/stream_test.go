@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventStream(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	// the stream queries the database while the test does, and every
+	// connection to an in-memory database would be a database of its own
+	t.server.DB.DB.SetMaxOpenConns(1)
+	t.server.Config.StreamHeartbeat = 10 * time.Millisecond
+	srv := httptest.NewServer(t.server)
+	defer srv.Close()
+
+	buyer := newSessionUser(ctx, t, "buyer@example.com")
+	buyerCtx := SetCtxSession(ctx, buyer)
+	otherCtx := t.addNewSession(ctx, "other@example.com")
+	lamp := newItem(ctx, t, "lamp", 10)
+	chair := newItem(ctx, t, "chair", 10)
+
+	addCart := func(ctx context.Context, itemID string) {
+		t.addCart(ctx, itemID, 1)
+	}
+
+	// a frame is an event, or a heartbeat when it has no id
+	type frame struct {
+		id    string
+		event Event
+	}
+	openStream := func(lastEventID string) (*http.Response, <-chan frame) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/events", nil)
+		assert.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer "+buyer.AccessToken)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+
+		frames := make(chan frame, 100)
+		go func() {
+			defer close(frames)
+			scanner := bufio.NewScanner(resp.Body)
+			f := frame{}
+			for scanner.Scan() {
+				line := scanner.Text()
+				switch {
+				case strings.HasPrefix(line, ": heartbeat"):
+					frames <- frame{}
+				case strings.HasPrefix(line, "id: "):
+					f.id = strings.TrimPrefix(line, "id: ")
+				case strings.HasPrefix(line, "data: "):
+					assert.NoError(t, json.Unmarshal(
+						[]byte(strings.TrimPrefix(line, "data: ")), &f.event))
+				case line == "" && f.id != "":
+					frames <- f
+					f = frame{}
+				}
+			}
+		}()
+		return resp, frames
+	}
+	next := func(frames <-chan frame) frame {
+		for {
+			select {
+			case f := <-frames:
+				if f.id != "" {
+					return f
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no event was streamed")
+			}
+		}
+	}
+	remaining := func(f frame) int {
+		var change stockChange
+		assert.NoError(t, json.Unmarshal(f.event.Data, &change))
+		return change.RemainingQuantity
+	}
+
+	// a new stream is sent what's recorded once it's connected
+	resp, frames := openStream("")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	addCart(buyerCtx, lamp.Id)
+	assert.NoError(t, t.server.DispatchEvents(ctx))
+	f := next(frames)
+	assert.Equal(t, EventStockChanged, f.event.Kind)
+	assert.Equal(t, lamp.Id, f.event.SubjectID)
+	assert.Equal(t, 9, remaining(f))
+	f = next(frames)
+	assert.Equal(t, EventCartUpdated, f.event.Kind)
+
+	// other users' carts aren't streamed, only the stock of the items in the
+	// buyer's cart that they take
+	addCart(otherCtx, lamp.Id)
+	addCart(otherCtx, chair.Id)
+	addCart(buyerCtx, lamp.Id)
+	assert.NoError(t, t.server.DispatchEvents(ctx))
+	seen := next(frames)
+	assert.Equal(t, EventStockChanged, seen.event.Kind)
+	assert.Equal(t, 8, remaining(seen))
+	f = next(frames)
+	assert.Equal(t, EventStockChanged, f.event.Kind)
+	assert.Equal(t, 7, remaining(f))
+	f = next(frames)
+	assert.Equal(t, EventCartUpdated, f.event.Kind)
+	var cartItem CartItem
+	assert.NoError(t, json.Unmarshal(f.event.Data, &cartItem))
+	assert.Equal(t, 2, cartItem.Quantity)
+
+	// a client that reconnects is sent what came after the last event it saw
+	assert.NoError(t, resp.Body.Close())
+	resp, frames = openStream(seen.id)
+	f = next(frames)
+	assert.Equal(t, EventStockChanged, f.event.Kind)
+	assert.Equal(t, 7, remaining(f))
+	assert.Equal(t, EventCartUpdated, next(frames).event.Kind)
+
+	// an event recorded after a gap is held back until the gap is filled,
+	// in case it's a transaction that hasn't committed yet, or until the gap
+	// is old enough to have been rolled back
+	latest, err := t.server.DB.Limited_Event_Latest(ctx, 1, 0)
+	assert.NoError(t, err)
+	recordEvent := func(pk int64, id string, created time.Time) {
+		_, err := t.server.DB.DB.ExecContext(ctx, t.server.DB.Rebind(
+			"INSERT INTO events (pk, id, created, kind, subject_id, payload, "+
+				"status, attempts, last_error, user_pk) "+
+				"VALUES (?, ?, ?, ?, '', '{}', ?, 0, '', ?)"),
+			pk, id, created, EventCartUpdated, eventPending, *buyer.UserPk)
+		assert.NoError(t, err)
+	}
+	heartbeats := func(n int) {
+		for n > 0 {
+			f, ok := <-frames
+			assert.True(t, ok)
+			assert.Empty(t, f.id)
+			n--
+		}
+	}
+	now := time.Now().UTC()
+	recordEvent(latest[0].Pk+2, "after-gap", now)
+	heartbeats(3)
+	recordEvent(latest[0].Pk+1, "gap", now)
+	assert.Equal(t, "gap", next(frames).id)
+	assert.Equal(t, "after-gap", next(frames).id)
+	recordEvent(latest[0].Pk+4, "after-old-gap", now.Add(-time.Minute))
+	assert.Equal(t, "after-old-gap", next(frames).id)
+
+	heartbeat := false
+	for !heartbeat {
+		f, ok := <-frames
+		assert.True(t, ok)
+		heartbeat = f.id == ""
+	}
+
+	// shutting down ends the stream, and no more can be opened
+	shutdownCtx, shutdown := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		t.server.RunStreams(shutdownCtx)
+		close(done)
+	}()
+	shutdown()
+	<-done
+	for range frames {
+	}
+	assert.NoError(t, resp.Body.Close())
+
+	resp, _ = openStream("")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.NoError(t, resp.Body.Close())
+}
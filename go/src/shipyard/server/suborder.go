@@ -0,0 +1,394 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/pricing"
+	"shipyard/util"
+)
+
+// a sub order is fulfilled by its seller in these steps, in order. a seller
+// can skip steps, but can't go back
+const (
+	subOrderPlaced     = "placed"
+	subOrderProcessing = "processing"
+	subOrderShipped    = "shipped"
+	subOrderDelivered  = "delivered"
+)
+
+var subOrderSteps = map[string]int{
+	subOrderPlaced:     0,
+	subOrderProcessing: 1,
+	subOrderShipped:    2,
+	subOrderDelivered:  3,
+}
+
+// ListSubOrder will return the active user's sub orders, newest first. each
+// order is split into one sub order for each seller it was bought from
+func (s *Server) ListSubOrder(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := parsePage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		subOrders, err := tx.Limited_SubOrder_By_UserPk(ctx,
+			database.SubOrder_UserPk(userPk), p.limit, p.offset)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{}
+		resp.SubOrders, err = subOrdersWithItems(ctx, tx, subOrders)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// GetSubOrder will return a sub order to its buyer or its seller
+func (s *Server) GetSubOrder(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		subOrder, err := tx.Find_SubOrder_By_Id(ctx,
+			database.SubOrder_Id(chi.URLParam(r, "subOrderID")))
+		if err != nil {
+			return err
+		}
+
+		if subOrder == nil || !(isUserPk(subOrder.UserPk, userPk) ||
+			isUserPk(subOrder.SellerPk, userPk)) {
+			return he.NotFound.New("sub order not found")
+		}
+
+		items, err := tx.All_OrderedItem_ItemId_By_SubOrderPk(ctx,
+			database.OrderedItem_SubOrderPk(subOrder.Pk))
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{SubOrder: apiSubOrder(subOrder, items)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// ListSellerSubOrder will return the sub orders the active user is selling,
+// newest first, optionally only those with a status
+func (s *Server) ListSellerSubOrder(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := parsePage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	status := r.URL.Query().Get("status")
+	if _, ok := subOrderSteps[status]; status != "" && !ok {
+		return nil, he.BadRequest.New("unknown status %q", status)
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		var subOrders []*database.SubOrder
+		if status == "" {
+			subOrders, err = tx.Limited_SubOrder_By_SellerPk(ctx,
+				database.SubOrder_SellerPk(userPk), p.limit, p.offset)
+		} else {
+			subOrders, err = tx.Limited_SubOrder_By_SellerPk_And_Status(ctx,
+				database.SubOrder_Status(status),
+				database.SubOrder_SellerPk(userPk), p.limit, p.offset)
+		}
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{}
+		resp.SubOrders, err = subOrdersWithItems(ctx, tx, subOrders)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// AdvanceSubOrder will move one of the active user's sub orders on to a later
+// status. once it's delivered, so are its ordered items. sub orders with
+// shipments are delivered when their shipments are instead
+func (s *Server) AdvanceSubOrder(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	advance := SubOrder{}
+	err = json.NewDecoder(r.Body).Decode(&advance)
+	if err != nil {
+		return nil, he.BadRequest.Wrap(err)
+	}
+
+	step, ok := subOrderSteps[advance.Status]
+	if !ok {
+		return nil, he.BadRequest.New("status must be processing, shipped " +
+			"or delivered")
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		subOrder, err := tx.Find_SubOrder_By_Id(ctx,
+			database.SubOrder_Id(chi.URLParam(r, "subOrderID")))
+		if err != nil {
+			return err
+		}
+
+		if subOrder == nil || !isUserPk(subOrder.SellerPk, userPk) {
+			return he.NotFound.New("sub order not found")
+		}
+
+		if step <= subOrderSteps[subOrder.Status] {
+			return he.Conflict.New("sub order is already %s", subOrder.Status)
+		}
+
+		if advance.Status == subOrderDelivered {
+			tracked, err := tx.Has_Shipment_By_SubOrderPk(ctx,
+				database.Shipment_SubOrderPk(subOrder.Pk))
+			if err != nil {
+				return err
+			}
+
+			if tracked {
+				return he.Conflict.New("sub order is delivered when its " +
+					"shipments are")
+			}
+		}
+
+		items, err := tx.All_OrderedItem_ItemId_By_SubOrderPk(ctx,
+			database.OrderedItem_SubOrderPk(subOrder.Pk))
+		if err != nil {
+			return err
+		}
+
+		subOrder, err = advanceSubOrder(ctx, tx, subOrder, items,
+			advance.Status)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{SubOrder: apiSubOrder(subOrder, items)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// advanceSubOrder sets the sub order's status, and the times it was shipped
+// and delivered if it has just been. its items are marked delivered with it
+func advanceSubOrder(ctx context.Context, tx *database.Tx,
+	subOrder *database.SubOrder, items []*database.OrderedItem_Item_Id_Row,
+	status string) (*database.SubOrder, error) {
+
+	now := util.UTCNow()
+	ups := database.SubOrder_Update_Fields{
+		Status: database.SubOrder_Status(status),
+	}
+	step := subOrderSteps[status]
+	if step >= subOrderSteps[subOrderShipped] && subOrder.Shipped == nil {
+		ups.Shipped = database.SubOrder_Shipped(now)
+	}
+	if step >= subOrderSteps[subOrderDelivered] && subOrder.Delivered == nil {
+		ups.Delivered = database.SubOrder_Delivered(now)
+
+		for _, item := range items {
+			if item.OrderedItem.Delivered {
+				continue
+			}
+			err := tx.UpdateNoReturn_OrderedItem_By_Pk(ctx,
+				database.OrderedItem_Pk(item.OrderedItem.Pk),
+				database.OrderedItem_Update_Fields{
+					Delivered: database.OrderedItem_Delivered(true),
+				})
+			if err != nil {
+				return nil, err
+			}
+			item.OrderedItem.Delivered = true
+		}
+	}
+
+	advanced, err := tx.Update_SubOrder_By_Pk(ctx,
+		database.SubOrder_Pk(subOrder.Pk), ups)
+	if err != nil {
+		return nil, err
+	}
+
+	err = recordEvent(ctx, tx, EventSubOrderAdvanced, subOrder.Id,
+		subOrder.UserPk, subOrderAdvance{
+			SubOrderID: subOrder.Id,
+			From:       subOrder.Status,
+			To:         status,
+		})
+	if err != nil {
+		return nil, err
+	}
+	return advanced, nil
+}
+
+// createSubOrders splits a placed order into a sub order for each seller,
+// in the order their items were listed, and returns the sub order of each
+// line. the sub orders' totals are their lines' shares of the quote, so
+// they add up to what was paid
+func createSubOrders(ctx context.Context, tx *database.Tx, userPk int64,
+	payment *database.Payment, lines []orderLine, quote *pricing.Quote) (
+	subOrders []*database.SubOrder, lineSubOrders []*database.SubOrder,
+	err error) {
+
+	type sellerLines struct {
+		sellerPk *int64
+		lines    []int
+	}
+
+	var sellers []*sellerLines
+	bySeller := map[int64]*sellerLines{}
+	for i, line := range lines {
+		// items without an owner are all sold by the marketplace
+		key := int64(0)
+		if line.item.OwningUserPk != nil {
+			key = *line.item.OwningUserPk
+		}
+		seller := bySeller[key]
+		if seller == nil {
+			seller = &sellerLines{sellerPk: line.item.OwningUserPk}
+			bySeller[key] = seller
+			sellers = append(sellers, seller)
+		}
+		seller.lines = append(seller.lines, i)
+	}
+
+	lineSubOrders = make([]*database.SubOrder, len(lines))
+	for _, seller := range sellers {
+		var subtotal, discount, tax, shipping int
+		for _, i := range seller.lines {
+			subtotal += unitAmount(lines[i].item, lines[i].variant) *
+				lines[i].cartItem.Quantity
+			discount += quote.LineDiscounts[i].Amount
+			tax += quote.LineTax[i].Amount
+			shipping += quote.LineShipping[i].Amount
+		}
+
+		optional := database.SubOrder_Create_Fields{
+			UserPk:    database.SubOrder_UserPk(userPk),
+			PaymentPk: database.SubOrder_PaymentPk(payment.Pk),
+		}
+		sellerID := ""
+		if seller.sellerPk != nil {
+			optional.SellerPk = database.SubOrder_SellerPk(*seller.sellerPk)
+			user, err := tx.Get_User_By_Pk(ctx, database.User_Pk(*seller.sellerPk))
+			if err != nil {
+				return nil, nil, err
+			}
+			sellerID = user.Id
+		}
+
+		subOrder, err := tx.Create_SubOrder(ctx,
+			database.SubOrder_Id(util.MustUUID4()),
+			database.SubOrder_Status(subOrderPlaced),
+			database.SubOrder_Currency(quote.Total.Currency.Code),
+			database.SubOrder_Subtotal(subtotal),
+			database.SubOrder_Discount(discount),
+			database.SubOrder_Tax(tax),
+			database.SubOrder_Shipping(shipping),
+			database.SubOrder_Total(subtotal-discount+tax+shipping),
+			database.SubOrder_PaymentId(payment.Id),
+			database.SubOrder_SellerId(sellerID),
+			optional)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		subOrders = append(subOrders, subOrder)
+		for _, i := range seller.lines {
+			lineSubOrders[i] = subOrder
+		}
+	}
+	return subOrders, lineSubOrders, nil
+}
+
+// subOrdersWithItems translates sub orders along with their ordered items,
+// which are read with a query for each
+func subOrdersWithItems(ctx context.Context, tx *database.Tx,
+	subOrders []*database.SubOrder) ([]*SubOrder, error) {
+
+	s := make([]*SubOrder, 0, len(subOrders))
+	for _, subOrder := range subOrders {
+		items, err := tx.All_OrderedItem_ItemId_By_SubOrderPk(ctx,
+			database.OrderedItem_SubOrderPk(subOrder.Pk))
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, apiSubOrder(subOrder, items))
+	}
+	return s, nil
+}
+
+func isUserPk(pk *int64, userPk int64) bool {
+	return pk != nil && *pk == userPk
+}
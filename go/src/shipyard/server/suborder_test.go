@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	he "shipyard/httperror"
+	"shipyard/payment"
+)
+
+func TestSubOrders(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	t.server.Payments = payment.NewFake(payment.Succeed)
+	lampSellerCtx := t.addNewSession(ctx, "lamps@example.com")
+	chairSellerCtx := t.addNewSession(ctx, "chairs@example.com")
+	buyerCtx := t.addNewSession(ctx, "buyer@example.com")
+
+	addItem := func(ctx context.Context, price int) string {
+		r := jsonPostRequest(t, "/api/item", Item{Price: &Money{Amount: price,
+			Currency: "USD"}, RemainingQuantity: 10})
+		resp, err := t.server.AddItem(ctx, httptest.NewRecorder(), r)
+		assert.NoError(t, err)
+		return resp.(*RootJSON).Item.ID
+	}
+	lampID := addItem(lampSellerCtx, 100)
+	shadeID := addItem(lampSellerCtx, 50)
+	chairID := addItem(chairSellerCtx, 333)
+
+	t.addAddress(buyerCtx)
+	var orders []OrderedItem
+	for _, itemID := range []string{lampID, chairID, shadeID} {
+		t.addCart(buyerCtx, itemID, 2)
+		orders = append(orders, OrderedItem{ItemID: itemID})
+	}
+	r := jsonPostRequest(t, "/api/order", PlaceOrder{Orders: orders})
+	resp, err := t.server.AddOrder(buyerCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+
+	// the sub orders add up to what was paid
+	paid := resp.(*RootJSON).Payment
+	subOrders := resp.(*RootJSON).SubOrders
+	assert.Len(t, subOrders, 2)
+	assert.Equal(t, 300, subOrders[0].Subtotal.Amount)
+	assert.Equal(t, 666, subOrders[1].Subtotal.Amount)
+	assert.Equal(t, paid.Amount.Amount,
+		subOrders[0].Total.Amount+subOrders[1].Total.Amount)
+	for _, subOrder := range subOrders {
+		assert.Equal(t, paid.ID, subOrder.PaymentID)
+		assert.Equal(t, subOrderPlaced, subOrder.Status)
+	}
+
+	sellerSubOrders := func(ctx context.Context, query string) []*SubOrder {
+		r := httptest.NewRequest(http.MethodGet, "/api/seller/suborder"+query,
+			nil)
+		resp, err := t.server.ListSellerSubOrder(ctx, httptest.NewRecorder(), r)
+		assert.NoError(t, err)
+		return resp.(*RootJSON).SubOrders
+	}
+	lampOrders := sellerSubOrders(lampSellerCtx, "")
+	assert.Len(t, lampOrders, 1)
+	assert.Len(t, lampOrders[0].Items, 2)
+	lampOrderID := lampOrders[0].ID
+
+	advance := func(ctx context.Context, status string) (*SubOrder, error) {
+		r := jsonPostRequest(t, "/api/seller/suborder/"+lampOrderID,
+			SubOrder{Status: status})
+		resp, err := t.server.AdvanceSubOrder(ctx, httptest.NewRecorder(),
+			withURLParams(r, "subOrderID", lampOrderID))
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).SubOrder, nil
+	}
+
+	// sellers can only advance their own sub orders, and only forwards
+	_, err = advance(chairSellerCtx, subOrderShipped)
+	assert.True(t, he.NotFound.Has(err))
+	_, err = advance(lampSellerCtx, "lost")
+	assert.True(t, he.BadRequest.Has(err))
+
+	shipped, err := advance(lampSellerCtx, subOrderShipped)
+	assert.NoError(t, err)
+	assert.Equal(t, subOrderShipped, shipped.Status)
+	assert.False(t, shipped.Shipped.IsZero())
+	assert.False(t, shipped.Items[0].Delivered)
+	_, err = advance(lampSellerCtx, subOrderProcessing)
+	assert.True(t, he.Conflict.Has(err))
+
+	assert.Len(t, sellerSubOrders(lampSellerCtx, "?status=shipped"), 1)
+	assert.Empty(t, sellerSubOrders(chairSellerCtx, "?status=shipped"))
+
+	delivered, err := advance(lampSellerCtx, subOrderDelivered)
+	assert.NoError(t, err)
+	assert.False(t, delivered.Delivered.IsZero())
+	for _, item := range delivered.Items {
+		assert.True(t, item.Delivered)
+	}
+
+	// buyers see every part of their order, and its items
+	r = httptest.NewRequest(http.MethodGet, "/api/suborder", nil)
+	resp, err = t.server.ListSubOrder(buyerCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	assert.Len(t, resp.(*RootJSON).SubOrders, 2)
+
+	getSubOrder := func(ctx context.Context) error {
+		r := httptest.NewRequest(http.MethodGet, "/api/suborder/"+lampOrderID,
+			nil)
+		_, err := t.server.GetSubOrder(ctx, httptest.NewRecorder(),
+			withURLParams(r, "subOrderID", lampOrderID))
+		return err
+	}
+	assert.NoError(t, getSubOrder(buyerCtx))
+	assert.NoError(t, getSubOrder(lampSellerCtx))
+	assert.True(t, he.NotFound.Has(getSubOrder(chairSellerCtx)))
+}
@@ -0,0 +1,548 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/util"
+)
+
+// ListVariant will return the variants of an item, oldest first
+func (s *Server) ListVariant(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	var resp *RootJSON
+	err := s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		item, err := tx.Find_Item_By_Id(ctx,
+			database.Item_Id(chi.URLParam(r, "itemID")))
+		if err != nil {
+			return err
+		}
+
+		if item == nil {
+			return he.NotFound.New("item not found")
+		}
+
+		variants, err := tx.All_Variant_By_ItemPk(ctx,
+			database.Variant_ItemPk(item.Pk))
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Variants: apiVariants(item, variants)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// AddVariant will add a variant to an item owned by the active user. its
+// remaining_quantity is added to the item's
+func (s *Server) AddVariant(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	variant := Variant{}
+	err = json.NewDecoder(r.Body).Decode(&variant)
+	if err != nil {
+		return nil, he.BadRequest.Wrap(err)
+	}
+
+	var resp *RootJSON
+	var item *database.Item
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		found, err := findOwnedItem(ctx, tx, chi.URLParam(r, "itemID"),
+			userPk)
+		if err != nil {
+			return err
+		}
+
+		dbVariant, err := addVariant(ctx, tx, found, &variant)
+		if err != nil {
+			return err
+		}
+
+		item, _, err = adjustStock(ctx, tx, found, nil,
+			dbVariant.RemainingQuantity)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Variant: apiVariant(item, dbVariant)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.publishInventory(item)
+	return resp, nil
+}
+
+// PatchVariant will update a variant of an item owned by the active user using
+// JSON Merge Patch. a null price uses the item's price again, and attributes
+// are merged like an item's
+func (s *Server) PatchVariant(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := decodeMergePatch(r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = patch.only("sku", "price", "remaining_quantity", "attributes")
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *RootJSON
+	var restocked *database.Item
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		item, variant, err := findOwnedVariant(ctx, tx,
+			chi.URLParam(r, "itemID"), chi.URLParam(r, "variantID"), userPk)
+		if err != nil {
+			return err
+		}
+
+		ups := database.Variant_Update_Fields{}
+		changed := false
+		if sku, ok, err := patch.string("sku"); err != nil {
+			return err
+		} else if ok {
+			sku = strings.TrimSpace(sku)
+			if sku != variant.Sku {
+				err = checkSKU(ctx, tx, sku, userPk)
+				if err != nil {
+					return err
+				}
+			}
+			ups.Sku = database.Variant_Sku(sku)
+			changed = true
+		}
+
+		var price *Money
+		if ok, err := patch.decode("price", &price); err != nil {
+			return err
+		} else if ok {
+			override, err := variantPriceOverride(item, price)
+			if err != nil {
+				return err
+			}
+			ups.Price = database.Variant_Price_Raw(override)
+			changed = true
+		}
+
+		var attributes map[string]interface{}
+		if ok, err := patch.decode("attributes", &attributes); err != nil {
+			return err
+		} else if ok {
+			merged, err := mergeAttributes(variant.Attributes, attributes)
+			if err != nil {
+				return err
+			}
+			ups.Attributes = database.Variant_Attributes(merged)
+			changed = true
+		}
+
+		if changed {
+			variant, err = tx.Update_Variant_By_Pk(ctx,
+				database.Variant_Pk(variant.Pk), ups)
+			if err != nil {
+				return err
+			}
+		}
+
+		if rq, ok, err := patch.int("remaining_quantity"); err != nil {
+			return err
+		} else if ok {
+			if rq < 0 {
+				return he.BadRequest.New("remaining_quantity can't be negative")
+			}
+
+			item, variant, err = adjustStock(ctx, tx, item, variant,
+				rq-variant.RemainingQuantity)
+			if err != nil {
+				return err
+			}
+			restocked = item
+		}
+
+		resp = &RootJSON{Variant: apiVariant(item, variant)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// the stock is left alone when the quantity isn't changed
+	if restocked != nil {
+		s.publishInventory(restocked)
+	}
+
+	return resp, nil
+}
+
+// DeleteVariant will remove a variant of an item owned by the active user, and
+// remove it from any carts it is in. like items, variants that have been
+// ordered can't be deleted, and neither can an item's last variant
+func (s *Server) DeleteVariant(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed *database.Item
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		item, variant, err := findOwnedVariant(ctx, tx,
+			chi.URLParam(r, "itemID"), chi.URLParam(r, "variantID"), userPk)
+		if err != nil {
+			return err
+		}
+
+		variants, err := tx.All_Variant_By_ItemPk(ctx,
+			database.Variant_ItemPk(item.Pk))
+		if err != nil {
+			return err
+		}
+
+		if len(variants) == 1 {
+			return he.Conflict.New("an item needs at least one variant. delete " +
+				"the item instead")
+		}
+
+		orders, err := tx.Count_OrderedItem_By_VariantPk(ctx,
+			database.OrderedItem_VariantPk(variant.Pk))
+		if err != nil {
+			return err
+		}
+
+		if orders > 0 {
+			return he.Conflict.New("variant has been ordered. set its " +
+				"remaining_quantity to 0 instead")
+		}
+
+		// what's held in carts was already taken from the item's quantity, so
+		// only what's left is taken off
+		_, err = tx.Delete_CartItem_By_VariantPk(ctx,
+			database.CartItem_VariantPk(variant.Pk))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Delete_Variant_By_Pk(ctx, database.Variant_Pk(variant.Pk))
+		if err != nil {
+			return err
+		}
+
+		changed, _, err = adjustStock(ctx, tx, item, nil,
+			-variant.RemainingQuantity)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.publishInventory(changed)
+	return nil, nil
+}
+
+func findOwnedItem(ctx context.Context, tx *database.Tx, itemID string,
+	userPk int64) (*database.Item, error) {
+	item, err := tx.Find_Item_By_Id(ctx, database.Item_Id(itemID))
+	if err != nil {
+		return nil, err
+	}
+
+	if item == nil || item.OwningUserPk == nil || *item.OwningUserPk != userPk {
+		return nil, he.NotFound.New("item not found")
+	}
+	return item, nil
+}
+
+func findOwnedVariant(ctx context.Context, tx *database.Tx, itemID,
+	variantID string, userPk int64) (*database.Item, *database.Variant, error) {
+	item, err := findOwnedItem(ctx, tx, itemID, userPk)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	variant, err := tx.Find_Variant_By_Id(ctx, database.Variant_Id(variantID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if variant == nil || variant.ItemPk != item.Pk {
+		return nil, nil, he.NotFound.New("variant not found")
+	}
+	return item, variant, nil
+}
+
+// addVariant creates a variant of the item. it doesn't change the item's
+// remaining_quantity, which is up to the caller
+func addVariant(ctx context.Context, tx *database.Tx, item *database.Item,
+	variant *Variant) (*database.Variant, error) {
+
+	if variant.RemainingQuantity < 0 {
+		return nil, he.BadRequest.New("remaining_quantity can't be negative")
+	}
+
+	sku := strings.TrimSpace(variant.SKU)
+	if item.OwningUserPk != nil {
+		err := checkSKU(ctx, tx, sku, *item.OwningUserPk)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	price, err := variantPriceOverride(item, variant.Price)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes, err := encodeAttributes(variant.Attributes)
+	if err != nil {
+		return nil, err
+	}
+
+	return tx.Create_Variant(ctx,
+		database.Variant_Id(util.MustUUID4()),
+		database.Variant_Sku(sku),
+		database.Variant_RemainingQuantity(variant.RemainingQuantity),
+		database.Variant_Attributes(attributes),
+		database.Variant_ItemPk(item.Pk),
+		database.Variant_Create_Fields{
+			Price: database.Variant_Price_Raw(price),
+		})
+}
+
+// checkSKU ensures that none of the seller's variants already use the sku. an
+// empty sku is never taken
+func checkSKU(ctx context.Context, tx *database.Tx, sku string,
+	sellerPk int64) error {
+	if sku == "" {
+		return nil
+	}
+
+	existing, err := tx.Find_Variant_By_Sku_And_SellerPk(ctx,
+		database.Variant_Sku(sku), database.Item_OwningUserPk(sellerPk))
+	if err != nil {
+		return err
+	}
+
+	if existing != nil {
+		return he.Conflict.New("sku %s is already used", sku)
+	}
+	return nil
+}
+
+// variantPriceOverride checks a variant's price, which must be in the item's
+// currency. nil uses the item's price
+func variantPriceOverride(item *database.Item, price *Money) (*int, error) {
+	if price == nil {
+		return nil, nil
+	}
+
+	if price.Amount < 0 {
+		return nil, he.BadRequest.New("price can't be negative")
+	}
+
+	if price.Currency != "" && !strings.EqualFold(price.Currency, item.Currency) {
+		return nil, he.BadRequest.New("a variant must be priced in its item's "+
+			"currency, %s", item.Currency)
+	}
+
+	amount := price.Amount
+	return &amount, nil
+}
+
+// adjustStock changes the remaining quantity of the variant, and of its item
+// which is the sum of its variants', by delta, and returns them as they now
+// are. variant is nil when only the item's sum needs to change. the
+// quantities are added to rather than set, since other requests change them
+// at the same time
+func adjustStock(ctx context.Context, tx *database.Tx, item *database.Item,
+	variant *database.Variant, delta int) (*database.Item,
+	*database.Variant, error) {
+
+	var err error
+	if variant != nil {
+		err = tx.AdjustVariantStock(ctx, variant.Pk, delta)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		variant, err = tx.Get_Variant_By_Pk(ctx, database.Variant_Pk(variant.Pk))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = tx.AdjustItemStock(ctx, item.Pk, delta)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	item, err = tx.Get_Item_By_Pk(ctx, database.Item_Pk(item.Pk))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	before := *item
+	before.RemainingQuantity -= delta
+	err = enqueueRestock(ctx, tx, &before, item)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	change := stockChange{ItemID: item.Id,
+		RemainingQuantity: item.RemainingQuantity}
+	if variant != nil {
+		change.VariantID = variant.Id
+		change.VariantQuantity = variant.RemainingQuantity
+	}
+	err = recordEvent(ctx, tx, EventStockChanged, item.Id, item.OwningUserPk,
+		change)
+	if err != nil {
+		return nil, nil, err
+	}
+	return item, variant, nil
+}
+
+// findCartVariant finds the variant being added to or ordered from the cart.
+// an item with only one variant can be given by the item's id alone
+func findCartVariant(ctx context.Context, tx *database.Tx, itemID,
+	variantID string) (*database.Item, *database.Variant, error) {
+
+	if variantID != "" {
+		variant, err := tx.Find_Variant_By_Id(ctx, database.Variant_Id(variantID))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if variant == nil {
+			return nil, nil, he.NotFound.New("variant %s not found", variantID)
+		}
+
+		item, err := tx.Get_Item_By_Pk(ctx, database.Item_Pk(variant.ItemPk))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if itemID != "" && itemID != item.Id {
+			return nil, nil, he.BadRequest.New("variant %s isn't of item %s",
+				variantID, itemID)
+		}
+		return item, variant, nil
+	}
+
+	item, err := tx.Find_Item_By_Id(ctx, database.Item_Id(itemID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if item == nil {
+		return nil, nil, he.NotFound.New("item %s not found", itemID)
+	}
+
+	variants, err := tx.All_Variant_By_ItemPk(ctx,
+		database.Variant_ItemPk(item.Pk))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(variants) != 1 {
+		return nil, nil, he.BadRequest.New("item %s has %d variants. choose "+
+			"one with variant_id", itemID, len(variants))
+	}
+	return item, variants[0], nil
+}
+
+// findCartItem finds the user's cart item by its variant's id. an item's id
+// can be used instead when only one of its variants is in the cart
+func findCartItem(ctx context.Context, tx *database.Tx, id string,
+	userPk int64) (*database.CartItem, error) {
+
+	cartItem, err := tx.Find_CartItem_By_Variant_Id_And_CartItem_UserPk(ctx,
+		database.Variant_Id(id), database.CartItem_UserPk(userPk))
+	if err != nil {
+		return nil, err
+	}
+
+	if cartItem == nil {
+		cartItem, err = tx.Find_CartItem_By_Item_Id_And_CartItem_UserPk(ctx,
+			database.Item_Id(id), database.CartItem_UserPk(userPk))
+		var dbErr *database.Error
+		if errors.As(err, &dbErr) && dbErr.Code == database.ErrorCode_TooManyRows {
+			return nil, he.BadRequest.New("more than one variant of %s is in "+
+				"your cart. choose one with its variant_id", id)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cartItem == nil {
+		return nil, he.NotFound.New("%s is not in your cart", id)
+	}
+	return cartItem, nil
+}
+
+// setOnlyVariantQuantity sets the remaining_quantity of an item that has one
+// variant, through its variant. items with more variants must have each
+// variant's quantity set instead
+func setOnlyVariantQuantity(ctx context.Context, tx *database.Tx,
+	item *database.Item, rq int) error {
+
+	variants, err := tx.All_Variant_By_ItemPk(ctx,
+		database.Variant_ItemPk(item.Pk))
+	if err != nil {
+		return err
+	}
+
+	if len(variants) != 1 {
+		return he.BadRequest.New("item has %d variants. set each variant's "+
+			"remaining_quantity instead", len(variants))
+	}
+
+	_, err = tx.Update_Variant_By_Pk(ctx, database.Variant_Pk(variants[0].Pk),
+		database.Variant_Update_Fields{
+			RemainingQuantity: database.Variant_RemainingQuantity(rq),
+		})
+	return err
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+)
+
+func TestVariants(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	sellerCtx := t.addNewSession(ctx, "seller@example.com")
+	ctx = t.addNewSession(ctx, "user@example.com")
+
+	addItem := func(item Item) (*Item, error) {
+		r := jsonPostRequest(t, "/api/item", item)
+		resp, err := t.server.AddItem(sellerCtx, httptest.NewRecorder(), r)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Item, nil
+	}
+	shirt, err := addItem(Item{Title: "shirt", Price: &Money{Amount: 10},
+		Variants: []*Variant{
+			{SKU: "TS-S", RemainingQuantity: 2,
+				Attributes: map[string]interface{}{"size": "S"}},
+			{SKU: "TS-L", RemainingQuantity: 3, Price: &Money{Amount: 15}},
+		}})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, shirt.RemainingQuantity)
+	assert.Len(t, shirt.Variants, 2)
+	small, large := shirt.Variants[0], shirt.Variants[1]
+	assert.Equal(t, 10, small.Price.Amount)
+	assert.Equal(t, 15, large.Price.Amount)
+	_, err = addItem(Item{Title: "hat", RemainingQuantity: 1,
+		Variants: []*Variant{{SKU: "TS-S", RemainingQuantity: 1}}})
+	assert.True(t, he.Conflict.Has(err))
+
+	getItem := func() *Item {
+		r := httptest.NewRequest(http.MethodGet, "/api/item/"+shirt.ID, nil)
+		resp, err := t.server.GetItem(ctx, httptest.NewRecorder(),
+			withURLParams(r, "itemID", shirt.ID))
+		assert.NoError(t, err)
+		return resp.(*RootJSON).Item
+	}
+
+	// an item with more than one variant needs the variant to be chosen
+	addCart := func(ci CartItem) (*RootJSON, error) {
+		r := jsonPostRequest(t, "/api/cart", ci)
+		resp, err := t.server.AddCart(ctx, httptest.NewRecorder(), r)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON), nil
+	}
+	_, err = addCart(CartItem{ItemID: shirt.ID, Quantity: 1})
+	assert.True(t, he.BadRequest.Has(err))
+	cart, err := addCart(CartItem{VariantID: large.ID, Quantity: 3})
+	assert.NoError(t, err)
+	assert.Len(t, cart.CartItems, 1)
+	assert.Equal(t, "TS-L", cart.CartItems[0].SKU)
+	assert.Equal(t, 45, cart.CartItems[0].Price.Amount)
+	_, err = addCart(CartItem{VariantID: large.ID, Quantity: 1})
+	assert.True(t, he.BadRequest.Has(err)) // none left
+	assert.Equal(t, 2, getItem().RemainingQuantity)
+
+	r := jsonPostRequest(t, "/api/cart/"+large.ID, CartItem{Quantity: 1})
+	_, err = t.server.UpdateCart(ctx, httptest.NewRecorder(),
+		withURLParams(r, "cartItemID", large.ID))
+	assert.NoError(t, err)
+	item := getItem()
+	assert.Equal(t, 4, item.RemainingQuantity)
+	assert.Equal(t, 2, item.Variants[1].RemainingQuantity)
+
+	// the item's quantity is its variants', so it's set on each of them
+	r = httptest.NewRequest(http.MethodPatch, "/api/item/"+shirt.ID,
+		strings.NewReader(`{"remaining_quantity": 10}`))
+	_, err = t.server.PatchItem(sellerCtx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", shirt.ID))
+	assert.True(t, he.BadRequest.Has(err))
+
+	patchVariant := func(id, patch string) (*Variant, error) {
+		r := httptest.NewRequest(http.MethodPatch,
+			"/api/item/"+shirt.ID+"/variant/"+id, strings.NewReader(patch))
+		resp, err := t.server.PatchVariant(sellerCtx, httptest.NewRecorder(),
+			withURLParams(r, "itemID", shirt.ID, "variantID", id))
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Variant, nil
+	}
+	_, err = patchVariant(small.ID, `{"sku": "TS-L"}`)
+	assert.True(t, he.Conflict.Has(err))
+	_, err = patchVariant(small.ID, `{"price": {"amount": 12, "currency": "EUR"}}`)
+	assert.True(t, he.BadRequest.Has(err))
+	patched, err := patchVariant(small.ID, `{"price": {"amount": 12},
+		"remaining_quantity": 4, "attributes": {"color": "red"}}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 12, patched.Price.Amount)
+	assert.Equal(t, map[string]interface{}{"size": "S", "color": "red"},
+		patched.Attributes)
+	assert.Equal(t, 6, getItem().RemainingQuantity)
+	patched, err = patchVariant(small.ID, `{"remaining_quantity": 5}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, patched.RemainingQuantity)
+	assert.Equal(t, 7, getItem().RemainingQuantity)
+	_, err = patchVariant(small.ID, `{"remaining_quantity": 4}`)
+	assert.NoError(t, err)
+	patched, err = patchVariant(small.ID, `{"price": null}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 10, patched.Price.Amount)
+
+	// the order is for the variant at its price
+	t.addAddress(ctx)
+	r = jsonPostRequest(t, "/api/order", PlaceOrder{
+		Orders: []OrderedItem{{VariantID: large.ID}}})
+	_, err = t.server.AddOrder(ctx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	r = httptest.NewRequest(http.MethodGet, "/api/order", nil)
+	resp, err := t.server.ListOrder(ctx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	ordered := resp.(*RootJSON).OrderedItems
+	assert.Len(t, ordered, 1)
+	assert.Equal(t, large.ID, ordered[0].VariantID)
+	assert.Equal(t, "TS-L", ordered[0].SKU)
+	assert.Equal(t, 15, ordered[0].Price.Amount)
+
+	deleteVariant := func(id string) error {
+		r := httptest.NewRequest(http.MethodDelete,
+			"/api/item/"+shirt.ID+"/variant/"+id, nil)
+		_, err := t.server.DeleteVariant(sellerCtx, httptest.NewRecorder(),
+			withURLParams(r, "itemID", shirt.ID, "variantID", id))
+		return err
+	}
+	assert.True(t, he.Conflict.Has(deleteVariant(large.ID)))
+	assert.NoError(t, deleteVariant(small.ID))
+	assert.Equal(t, 2, getItem().RemainingQuantity)
+
+	r = httptest.NewRequest(http.MethodGet, "/api/item/"+shirt.ID+"/variant", nil)
+	resp, err = t.server.ListVariant(ctx, httptest.NewRecorder(),
+		withURLParams(r, "itemID", shirt.ID))
+	assert.NoError(t, err)
+	assert.Len(t, resp.(*RootJSON).Variants, 1)
+
+	// stock is added to rather than set, so a change made since the item was
+	// read isn't lost
+	dbItem, err := t.server.DB.Find_Item_By_Id(ctx, database.Item_Id(shirt.ID))
+	assert.NoError(t, err)
+	dbVariant, err := t.server.DB.Find_Variant_By_Id(ctx,
+		database.Variant_Id(large.ID))
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		err = t.server.DB.WithTx(ctx, func(ctx context.Context,
+			tx *database.Tx) error {
+			_, _, err := adjustStock(ctx, tx, dbItem, dbVariant, 5)
+			return err
+		})
+		assert.NoError(t, err)
+	}
+	item = getItem()
+	assert.Equal(t, 12, item.RemainingQuantity)
+	assert.Equal(t, 12, item.Variants[0].RemainingQuantity)
+	assert.Equal(t, dbItem.Version+2, item.Version)
+}
@@ -0,0 +1,622 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/zeebo/errs"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/util"
+)
+
+// a delivery is pending until the webhook responds with a 2xx status, and is
+// tried again with a backoff that doubles each time until it's failed
+// maxDeliveryAttempts times. a webhook whose deliveries have failed
+// maxWebhookFailures times in a row is deactivated until it's patched active
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+
+	webhookTimeout      = 10 * time.Second
+	deliveryBackoff     = time.Minute
+	maxDeliveryAttempts = 8
+	maxWebhookFailures  = 20
+
+	webhookEventHeader     = "X-Shipyard-Event"
+	webhookDeliveryHeader  = "X-Shipyard-Delivery"
+	webhookTimestampHeader = "X-Shipyard-Timestamp"
+	webhookSignatureHeader = "X-Shipyard-Signature"
+)
+
+// ListWebhook will return every webhook. admins only
+func (s *Server) ListWebhook(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	webhooks, err := s.DB.All_Webhook_OrderBy_Asc_Pk(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RootJSON{Webhooks: apiWebhooks(webhooks)}, nil
+}
+
+// AddWebhook will POST events of the kinds listed to a URL. a secret to sign
+// them with is made up if one isn't given. admins only
+func (s *Server) AddWebhook(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	webhook := Webhook{}
+	err := json.NewDecoder(r.Body).Decode(&webhook)
+	if err != nil {
+		return nil, he.BadRequest.Wrap(err)
+	}
+
+	webhookURL, err := parseWebhookURL(webhook.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := parseWebhookEvents(webhook.Events)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := webhook.Secret
+	if secret == "" {
+		secret, err = newWebhookSecret()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dbWebhook, err := s.DB.Create_Webhook(ctx,
+		database.Webhook_Id(util.MustUUID4()),
+		database.Webhook_Url(webhookURL),
+		database.Webhook_Secret(secret),
+		database.Webhook_Events(events),
+		database.Webhook_Active(true),
+		database.Webhook_Failures(0),
+		database.Webhook_Create_Fields{})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &RootJSON{Webhook: apiWebhook(dbWebhook)}
+	resp.Webhook.Secret = secret
+	return resp, nil
+}
+
+// GetWebhook will return a webhook. admins only
+func (s *Server) GetWebhook(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	webhook, err := findWebhook(ctx, s.DB, chi.URLParam(r, "webhookID"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &RootJSON{Webhook: apiWebhook(webhook)}, nil
+}
+
+// PatchWebhook will change a webhook's url, secret, events or whether it's
+// active. making it active again clears its failures. admins only
+func (s *Server) PatchWebhook(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	patch, err := decodeMergePatch(r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = patch.only("url", "secret", "events", "active")
+	if err != nil {
+		return nil, err
+	}
+
+	ups := database.Webhook_Update_Fields{}
+	if raw, ok, err := patch.string("url"); err != nil {
+		return nil, err
+	} else if ok {
+		webhookURL, err := parseWebhookURL(raw)
+		if err != nil {
+			return nil, err
+		}
+		ups.Url = database.Webhook_Url(webhookURL)
+	}
+
+	secret, secretOK, err := patch.string("secret")
+	if err != nil {
+		return nil, err
+	} else if secretOK {
+		if secret == "" {
+			secret, err = newWebhookSecret()
+			if err != nil {
+				return nil, err
+			}
+		}
+		ups.Secret = database.Webhook_Secret(secret)
+	}
+
+	var kinds []string
+	if ok, err := patch.decode("events", &kinds); err != nil {
+		return nil, err
+	} else if ok {
+		events, err := parseWebhookEvents(kinds)
+		if err != nil {
+			return nil, err
+		}
+		ups.Events = database.Webhook_Events(events)
+	}
+
+	activated := false
+	if active, ok, err := patch.bool("active"); err != nil {
+		return nil, err
+	} else if ok {
+		activated = active
+		ups.Active = database.Webhook_Active(active)
+		ups.Failures = database.Webhook_Failures(0)
+		if active {
+			ups.Disabled = database.Webhook_Disabled_Null()
+		} else {
+			ups.Disabled = database.Webhook_Disabled(util.UTCNow())
+		}
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		webhook, err := findWebhook(ctx, tx, chi.URLParam(r, "webhookID"))
+		if err != nil {
+			return err
+		}
+
+		// the deliveries left pending while the webhook was inactive are
+		// picked up where they were left
+		if activated && !webhook.Active {
+			err = enqueuePendingDeliveries(ctx, tx, webhook)
+			if err != nil {
+				return err
+			}
+		}
+
+		webhook, err = tx.Update_Webhook_By_Pk(ctx,
+			database.Webhook_Pk(webhook.Pk), ups)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Webhook: apiWebhook(webhook)}
+		if secretOK {
+			resp.Webhook.Secret = secret
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// DeleteWebhook will remove a webhook along with its deliveries. admins only
+func (s *Server) DeleteWebhook(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	err := s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		webhook, err := findWebhook(ctx, tx, chi.URLParam(r, "webhookID"))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Delete_Webhook_By_Pk(ctx, database.Webhook_Pk(webhook.Pk))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// ListWebhookDelivery will return a page of what's been sent to a webhook,
+// newest first. admins only
+func (s *Server) ListWebhookDelivery(ctx context.Context,
+	w http.ResponseWriter, r *http.Request) (interface{}, error) {
+
+	p, err := parsePage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	webhook, err := findWebhook(ctx, s.DB, chi.URLParam(r, "webhookID"))
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries, err := s.DB.Limited_WebhookDelivery_By_WebhookPk(ctx,
+		database.WebhookDelivery_WebhookPk(webhook.Pk), p.limit, p.offset)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &RootJSON{Deliveries: make([]*Delivery, 0, len(deliveries))}
+	for _, delivery := range deliveries {
+		resp.Deliveries = append(resp.Deliveries, apiDelivery(delivery))
+	}
+	return resp, nil
+}
+
+// RedeliverWebhook will send a delivery again right away, whatever became of
+// it before. it starts over with all of its attempts. admins only
+func (s *Server) RedeliverWebhook(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	webhook, err := findWebhook(ctx, s.DB, chi.URLParam(r, "webhookID"))
+	if err != nil {
+		return nil, err
+	}
+
+	if !webhook.Active {
+		return nil, he.Conflict.New("webhook isn't active")
+	}
+
+	delivery, err := s.DB.Find_WebhookDelivery_By_WebhookPk_And_Id(ctx,
+		database.WebhookDelivery_WebhookPk(webhook.Pk),
+		database.WebhookDelivery_Id(chi.URLParam(r, "deliveryID")))
+	if err != nil {
+		return nil, err
+	}
+
+	if delivery == nil {
+		return nil, he.NotFound.New("delivery not found")
+	}
+
+	delivery.Attempts = 0
+	delivery, err = s.deliverWebhook(ctx, webhook, delivery)
+	if err != nil && err != errWebhookDeactivated {
+		return nil, err
+	}
+
+	return &RootJSON{Delivery: apiDelivery(delivery)}, nil
+}
+
+// webhookJob is the payload of a JobDeliverWebhook job
+type webhookJob struct {
+	DeliveryID string `json:"delivery_id"`
+}
+
+// enqueueDelivery has the delivery attempted by a job at runAt
+func enqueueDelivery(ctx context.Context, tx *database.Tx, deliveryID string,
+	runAt time.Time) error {
+
+	return enqueueJob(ctx, tx, JobDeliverWebhook,
+		webhookJob{DeliveryID: deliveryID}, runAt)
+}
+
+// enqueuePendingDeliveries has each of the webhook's pending deliveries
+// attempted at its next attempt
+func enqueuePendingDeliveries(ctx context.Context, tx *database.Tx,
+	webhook *database.Webhook) error {
+
+	deliveries, err := tx.All_WebhookDelivery_By_WebhookPk_And_Status(ctx,
+		database.WebhookDelivery_WebhookPk(webhook.Pk),
+		database.WebhookDelivery_Status(deliveryPending))
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		err = enqueueDelivery(ctx, tx, delivery.Id, delivery.NextAttempt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findWebhook finds the webhook by its id
+func findWebhook(ctx context.Context, db database.Methods,
+	id string) (*database.Webhook, error) {
+
+	webhook, err := db.Find_Webhook_By_Id(ctx, database.Webhook_Id(id))
+	if err != nil {
+		return nil, err
+	}
+
+	if webhook == nil {
+		return nil, he.NotFound.New("webhook not found")
+	}
+	return webhook, nil
+}
+
+func parseWebhookURL(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.Host == "" {
+		return "", he.BadRequest.New("url must be an http or https url")
+	}
+	return u.String(), nil
+}
+
+// parseWebhookEvents checks the kinds of events a webhook is sent, and joins
+// them to be stored
+func parseWebhookEvents(kinds []string) (string, error) {
+	if len(kinds) == 0 {
+		return "", he.BadRequest.New("a webhook needs at least one event")
+	}
+
+	seen := make(map[string]bool, len(kinds))
+	events := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		if !eventKinds[kind] {
+			return "", he.BadRequest.New("unknown event %q", kind)
+		}
+		if !seen[kind] {
+			seen[kind] = true
+			events = append(events, kind)
+		}
+	}
+	return strings.Join(events, ","), nil
+}
+
+func newWebhookSecret() (string, error) {
+	var buf [32]byte
+	_, err := rand.Read(buf[:])
+	if err != nil {
+		return "", errs.Wrap(err)
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
+// signWebhook is the signature of a delivery's body sent at timestamp. it's
+// the hex HMAC-SHA256, keyed by the webhook's secret, of the timestamp and
+// the body joined by a "."
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(timestamp + "."))
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// queueWebhooks adds a delivery of the event to each active webhook that
+// wants it, and a job to send it. an event dispatched again isn't delivered
+// again
+func (s *Server) queueWebhooks(ctx context.Context,
+	event *database.Event) error {
+
+	return s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		webhooks, err := tx.All_Webhook_By_Active(ctx,
+			database.Webhook_Active(true))
+		if err != nil {
+			return err
+		}
+
+		var payload []byte
+		for _, webhook := range webhooks {
+			if !webhookWants(webhook, event.Kind) {
+				continue
+			}
+
+			queued, err := tx.Has_WebhookDelivery_By_WebhookPk_And_EventId(ctx,
+				database.WebhookDelivery_WebhookPk(webhook.Pk),
+				database.WebhookDelivery_EventId(event.Id))
+			if err != nil {
+				return err
+			}
+			if queued {
+				continue
+			}
+
+			if payload == nil {
+				payload, err = json.Marshal(apiEvent(event))
+				if err != nil {
+					return errs.Wrap(err)
+				}
+			}
+
+			deliveryID := util.MustUUID4()
+			err = tx.CreateNoReturn_WebhookDelivery(ctx,
+				database.WebhookDelivery_Id(deliveryID),
+				database.WebhookDelivery_EventId(event.Id),
+				database.WebhookDelivery_EventKind(event.Kind),
+				database.WebhookDelivery_Payload(string(payload)),
+				database.WebhookDelivery_Status(deliveryPending),
+				database.WebhookDelivery_Attempts(0),
+				database.WebhookDelivery_ResponseCode(0),
+				database.WebhookDelivery_LastError(""),
+				database.WebhookDelivery_NextAttempt(event.Created),
+				database.WebhookDelivery_WebhookPk(webhook.Pk),
+				database.WebhookDelivery_Create_Fields{})
+			if err != nil {
+				return err
+			}
+
+			err = enqueueDelivery(ctx, tx, deliveryID, event.Created)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func webhookWants(webhook *database.Webhook, kind string) bool {
+	for _, event := range strings.Split(webhook.Events, ",") {
+		if event == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverWebhookJob makes the attempt at the job's delivery. the delivery is
+// left alone once it's been delivered or failed, while its webhook is
+// inactive, and before its next attempt, which has a job of its own. a
+// failed attempt enqueues the job for the next one, so the job itself only
+// fails when the attempt can't be recorded
+func (s *Server) deliverWebhookJob(ctx context.Context,
+	job *database.Job) error {
+
+	var payload webhookJob
+	err := json.Unmarshal([]byte(job.Payload), &payload)
+	if err != nil {
+		return errs.Wrap(err)
+	}
+
+	row, err := s.DB.Find_WebhookDelivery_Webhook_By_Id(ctx,
+		database.WebhookDelivery_Id(payload.DeliveryID))
+	if err != nil {
+		return err
+	}
+
+	if row == nil || row.WebhookDelivery.Status != deliveryPending ||
+		!row.Webhook.Active ||
+		row.WebhookDelivery.NextAttempt.After(util.UTCNow()) {
+		return nil
+	}
+
+	_, err = s.deliverWebhook(ctx, &row.Webhook, &row.WebhookDelivery)
+	if err == errWebhookDeactivated {
+		return nil
+	}
+	return err
+}
+
+// errWebhookDeactivated is returned by deliverWebhook when the delivery was
+// the webhook's last failure before it was deactivated
+var errWebhookDeactivated = errors.New("webhook deactivated")
+
+// deliverWebhook makes an attempt at a delivery and records how it went, on
+// the delivery and on the webhook's failures in a row
+func (s *Server) deliverWebhook(ctx context.Context, webhook *database.Webhook,
+	delivery *database.WebhookDelivery) (*database.WebhookDelivery, error) {
+
+	code, sendErr := s.postWebhook(ctx, webhook, delivery)
+
+	now := util.UTCNow()
+	attempts := delivery.Attempts + 1
+	ups := database.WebhookDelivery_Update_Fields{
+		Attempts:     database.WebhookDelivery_Attempts(attempts),
+		ResponseCode: database.WebhookDelivery_ResponseCode(code),
+	}
+	switch {
+	case sendErr == nil:
+		ups.Status = database.WebhookDelivery_Status(deliveryDelivered)
+		ups.LastError = database.WebhookDelivery_LastError("")
+		ups.Delivered = database.WebhookDelivery_Delivered(now)
+	case attempts >= maxDeliveryAttempts:
+		ups.Status = database.WebhookDelivery_Status(deliveryFailed)
+		ups.LastError = database.WebhookDelivery_LastError(sendErr.Error())
+	default:
+		ups.Status = database.WebhookDelivery_Status(deliveryPending)
+		ups.LastError = database.WebhookDelivery_LastError(sendErr.Error())
+		ups.NextAttempt = database.WebhookDelivery_NextAttempt(
+			now.Add(deliveryBackoff << uint(attempts-1)))
+	}
+
+	deactivated := false
+	err := s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) (
+		err error) {
+		delivery, err = tx.Update_WebhookDelivery_By_Pk(ctx,
+			database.WebhookDelivery_Pk(delivery.Pk), ups)
+		if err != nil {
+			return err
+		}
+
+		if delivery.Status == deliveryPending {
+			err = enqueueDelivery(ctx, tx, delivery.Id, delivery.NextAttempt)
+			if err != nil {
+				return err
+			}
+		}
+
+		// the webhook is read again because its failures may have changed
+		// since the delivery was found
+		webhook, err := tx.Get_Webhook_By_Pk(ctx, database.Webhook_Pk(webhook.Pk))
+		if err != nil {
+			return err
+		}
+
+		hookUps := database.Webhook_Update_Fields{}
+		switch {
+		case sendErr == nil && webhook.Failures == 0:
+			return nil
+		case sendErr == nil:
+			hookUps.Failures = database.Webhook_Failures(0)
+		case webhook.Failures+1 >= maxWebhookFailures:
+			deactivated = true
+			hookUps.Failures = database.Webhook_Failures(webhook.Failures + 1)
+			hookUps.Active = database.Webhook_Active(false)
+			hookUps.Disabled = database.Webhook_Disabled(now)
+		default:
+			hookUps.Failures = database.Webhook_Failures(webhook.Failures + 1)
+		}
+		return tx.UpdateNoReturn_Webhook_By_Pk(ctx,
+			database.Webhook_Pk(webhook.Pk), hookUps)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if sendErr != nil {
+		s.log.WithError(sendErr).Warnf("failed to deliver %s to webhook %s "+
+			"(attempt %d)", delivery.Id, webhook.Id, attempts)
+	}
+	if deactivated {
+		s.log.Warnf("deactivated webhook %s after %d failures in a row",
+			webhook.Id, maxWebhookFailures)
+		return delivery, errWebhookDeactivated
+	}
+	return delivery, nil
+}
+
+// postWebhook sends the delivery's event to the webhook, and returns the
+// status code it responded with, or 0 if it didn't
+func (s *Server) postWebhook(ctx context.Context, webhook *database.Webhook,
+	delivery *database.WebhookDelivery) (int, error) {
+
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, webhook.Url,
+		bytes.NewReader(body))
+	if err != nil {
+		return 0, errs.Wrap(err)
+	}
+	req = req.WithContext(ctx)
+
+	timestamp := strconv.FormatInt(util.UTCNow().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, delivery.EventKind)
+	req.Header.Set(webhookDeliveryHeader, delivery.Id)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader,
+		signWebhook(webhook.Secret, timestamp, body))
+
+	resp, err := s.webhookClient.Do(req)
+	if err != nil {
+		return 0, errs.Wrap(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, errs.New("webhook responded %s: %s",
+			resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp.StatusCode, nil
+}
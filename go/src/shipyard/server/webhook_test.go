@@ -0,0 +1,272 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/util"
+)
+
+func TestWebhooks(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	t.server.Config.AdminEmails = []string{"admin@example.com"}
+	adminCtx := t.addNewSession(ctx, "admin@example.com")
+	sellerCtx := t.addNewSession(ctx, "seller@example.com")
+
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+	var requests []received
+	status := http.StatusOK
+	receiver := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			assert.NoError(t, err)
+			requests = append(requests, received{header: r.Header, body: body})
+			w.WriteHeader(status)
+		}))
+	defer receiver.Close()
+
+	addWebhook := func(webhook Webhook) (*Webhook, error) {
+		r := jsonPostRequest(t, "/api/webhook", webhook)
+		resp, err := t.server.AddWebhook(adminCtx, httptest.NewRecorder(), r)
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Webhook, nil
+	}
+	_, err := addWebhook(Webhook{URL: "ftp://example.com",
+		Events: []string{EventItemCreated}})
+	assert.True(t, he.BadRequest.Has(err))
+	_, err = addWebhook(Webhook{URL: receiver.URL})
+	assert.True(t, he.BadRequest.Has(err))
+	_, err = addWebhook(Webhook{URL: receiver.URL,
+		Events: []string{"item.sold"}})
+	assert.True(t, he.BadRequest.Has(err))
+
+	webhook, err := addWebhook(Webhook{URL: receiver.URL,
+		Events: []string{EventItemCreated, EventOrderPlaced}})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, webhook.Secret)
+	assert.True(t, webhook.Active)
+
+	addItem := func() string {
+		r := jsonPostRequest(t, "/api/item", Item{Price: &Money{Amount: 100,
+			Currency: "USD"}, RemainingQuantity: 10})
+		resp, err := t.server.AddItem(sellerCtx, httptest.NewRecorder(), r)
+		assert.NoError(t, err)
+		return resp.(*RootJSON).Item.ID
+	}
+	listDeliveries := func() []*Delivery {
+		r := httptest.NewRequest(http.MethodGet,
+			"/api/webhook/"+webhook.ID+"/delivery", nil)
+		resp, err := t.server.ListWebhookDelivery(adminCtx,
+			httptest.NewRecorder(), withURLParams(r, "webhookID", webhook.ID))
+		assert.NoError(t, err)
+		return resp.(*RootJSON).Deliveries
+	}
+	getWebhook := func() *Webhook {
+		r := httptest.NewRequest(http.MethodGet, "/api/webhook/"+webhook.ID, nil)
+		resp, err := t.server.GetWebhook(adminCtx, httptest.NewRecorder(),
+			withURLParams(r, "webhookID", webhook.ID))
+		assert.NoError(t, err)
+		return resp.(*RootJSON).Webhook
+	}
+	redeliver := func(deliveryID string) (*Delivery, error) {
+		r := jsonPostRequest(t, "/api/webhook/"+webhook.ID+"/delivery/"+
+			deliveryID, nil)
+		resp, err := t.server.RedeliverWebhook(adminCtx, httptest.NewRecorder(),
+			withURLParams(r, "webhookID", webhook.ID, "deliveryID", deliveryID))
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Delivery, nil
+	}
+
+	// an event dispatched twice is only delivered once
+	failing := true
+	t.server.Subscribe(EventItemCreated, func(ctx context.Context,
+		event *database.Event) error {
+		if failing {
+			failing = false
+			return fmt.Errorf("subscriber is down")
+		}
+		return nil
+	})
+	itemID := addItem()
+	assert.NoError(t, t.server.DispatchEvents(ctx))
+	assert.NoError(t, t.server.DispatchEvents(ctx))
+	t.workJobs(ctx)
+	assert.Len(t, requests, 1)
+
+	req := requests[0]
+	assert.Equal(t, EventItemCreated, req.header.Get(webhookEventHeader))
+	mac := hmac.New(sha256.New, []byte(webhook.Secret))
+	_, _ = mac.Write([]byte(req.header.Get(webhookTimestampHeader) + "."))
+	_, _ = mac.Write(req.body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)),
+		req.header.Get(webhookSignatureHeader))
+	var event Event
+	assert.NoError(t, json.Unmarshal(req.body, &event))
+	assert.Equal(t, EventItemCreated, event.Kind)
+	assert.Equal(t, itemID, event.SubjectID)
+	var item Item
+	assert.NoError(t, json.Unmarshal(event.Data, &item))
+	assert.Equal(t, itemID, item.ID)
+
+	deliveries := listDeliveries()
+	assert.Len(t, deliveries, 1)
+	assert.Equal(t, deliveryDelivered, deliveries[0].Status)
+	assert.Equal(t, http.StatusOK, deliveries[0].ResponseCode)
+	assert.Equal(t, req.header.Get(webhookDeliveryHeader), deliveries[0].ID)
+
+	// a failed delivery waits before it's tried again
+	status = http.StatusInternalServerError
+	addItem()
+	assert.NoError(t, t.server.DispatchEvents(ctx))
+	t.workJobs(ctx)
+	assert.Len(t, requests, 2)
+	deliveries = listDeliveries()
+	assert.Len(t, deliveries, 2)
+	failed := deliveries[0]
+	assert.Equal(t, deliveryPending, failed.Status)
+	assert.Equal(t, 1, failed.Attempts)
+	assert.Equal(t, http.StatusInternalServerError, failed.ResponseCode)
+	assert.NotEmpty(t, failed.LastError)
+	assert.True(t, failed.NextAttempt.After(time.Now()))
+	assert.Equal(t, 1, getWebhook().Failures)
+
+	dbWebhook, err := t.server.DB.Find_Webhook_By_Id(ctx,
+		database.Webhook_Id(webhook.ID))
+	assert.NoError(t, err)
+	findDelivery := func(deliveryID string) *database.WebhookDelivery {
+		delivery, err := t.server.DB.Find_WebhookDelivery_By_WebhookPk_And_Id(
+			ctx, database.WebhookDelivery_WebhookPk(dbWebhook.Pk),
+			database.WebhookDelivery_Id(deliveryID))
+		assert.NoError(t, err)
+		return delivery
+	}
+	// makeDue has a delivery's backoff over with
+	makeDue := func(deliveryID string) {
+		assert.NoError(t, t.server.DB.UpdateNoReturn_WebhookDelivery_By_Pk(ctx,
+			database.WebhookDelivery_Pk(findDelivery(deliveryID).Pk),
+			database.WebhookDelivery_Update_Fields{
+				NextAttempt: database.WebhookDelivery_NextAttempt(
+					util.UTCNow()),
+			}))
+		t.dueJobs(ctx)
+	}
+
+	status = http.StatusNoContent
+	makeDue(failed.ID)
+	t.workJobs(ctx)
+	assert.Len(t, requests, 3)
+	retried := listDeliveries()[0]
+	assert.Equal(t, deliveryDelivered, retried.Status)
+	assert.Equal(t, 2, retried.Attempts)
+	assert.Equal(t, 0, getWebhook().Failures)
+
+	// and can be sent again by hand
+	delivery, err := redeliver(failed.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, deliveryDelivered, delivery.Status)
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.Equal(t, 0, getWebhook().Failures)
+
+	// a delivery is given up on once it's out of attempts
+	status = http.StatusBadGateway
+	addItem()
+	assert.NoError(t, t.server.DispatchEvents(ctx))
+	deliveries = listDeliveries()
+	assert.NoError(t, t.server.DB.UpdateNoReturn_WebhookDelivery_By_Pk(ctx,
+		database.WebhookDelivery_Pk(findDelivery(deliveries[0].ID).Pk),
+		database.WebhookDelivery_Update_Fields{
+			Attempts: database.WebhookDelivery_Attempts(maxDeliveryAttempts - 1),
+		}))
+	t.workJobs(ctx)
+	deliveries = listDeliveries()
+	assert.Equal(t, deliveryFailed, deliveries[0].Status)
+	assert.Equal(t, maxDeliveryAttempts, deliveries[0].Attempts)
+
+	// too many failures in a row deactivates the webhook
+	assert.NoError(t, t.server.DB.UpdateNoReturn_Webhook_By_Pk(ctx,
+		database.Webhook_Pk(dbWebhook.Pk), database.Webhook_Update_Fields{
+			Failures: database.Webhook_Failures(maxWebhookFailures - 1),
+		}))
+	delivery, err = redeliver(deliveries[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, deliveryPending, delivery.Status)
+	disabled := getWebhook()
+	assert.False(t, disabled.Active)
+	assert.False(t, disabled.Disabled.IsZero())
+	_, err = redeliver(deliveries[0].ID)
+	assert.True(t, he.Conflict.Has(err))
+
+	// an inactive webhook isn't sent anything
+	requests = nil
+	addItem()
+	assert.NoError(t, t.server.DispatchEvents(ctx))
+	makeDue(deliveries[0].ID)
+	t.workJobs(ctx)
+	assert.Empty(t, requests)
+	assert.Len(t, listDeliveries(), 3)
+
+	patchWebhook := func(patch string) (*Webhook, error) {
+		r := httptest.NewRequest(http.MethodPatch, "/api/webhook/"+webhook.ID,
+			strings.NewReader(patch))
+		resp, err := t.server.PatchWebhook(adminCtx, httptest.NewRecorder(),
+			withURLParams(r, "webhookID", webhook.ID))
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Webhook, nil
+	}
+	_, err = patchWebhook(`{"events": []}`)
+	assert.True(t, he.BadRequest.Has(err))
+	patched, err := patchWebhook(`{"active": true, "secret": "",
+		"events": ["order.placed"]}`)
+	assert.NoError(t, err)
+	assert.True(t, patched.Active)
+	assert.Equal(t, 0, patched.Failures)
+	assert.True(t, patched.Disabled.IsZero())
+	assert.Equal(t, []string{EventOrderPlaced}, patched.Events)
+	assert.NotEmpty(t, patched.Secret)
+	assert.NotEqual(t, webhook.Secret, patched.Secret)
+	assert.Empty(t, getWebhook().Secret)
+
+	// making it active again sends what it was left owed
+	status = http.StatusNoContent
+	t.workJobs(ctx)
+	assert.Len(t, requests, 1)
+	assert.Equal(t, deliveryDelivered, listDeliveries()[0].Status)
+	_, err = patchWebhook(`{"active": true}`)
+	assert.NoError(t, err)
+	t.workJobs(ctx)
+	assert.Len(t, requests, 1)
+
+	r := httptest.NewRequest(http.MethodDelete, "/api/webhook/"+webhook.ID, nil)
+	_, err = t.server.DeleteWebhook(adminCtx, httptest.NewRecorder(),
+		withURLParams(r, "webhookID", webhook.ID))
+	assert.NoError(t, err)
+	r = httptest.NewRequest(http.MethodGet, "/api/webhook", nil)
+	resp, err := t.server.ListWebhook(adminCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	assert.Empty(t, resp.(*RootJSON).Webhooks)
+}
@@ -0,0 +1,321 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeebo/errs"
+
+	he "shipyard/httperror"
+)
+
+// the parts of RFC 6455 used by the websockets the server accepts. messages
+// are small json objects, so anything bigger than wsMaxMessage is refused
+const (
+	wsAcceptGUID     = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsMaxMessage     = 4096
+	wsWriteTimeout   = 10 * time.Second
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsCloseNormal        = 1000
+	wsCloseGoingAway     = 1001
+	wsCloseProtocolError = 1002
+	wsCloseInvalidData   = 1007
+	wsClosePolicy        = 1008
+	wsCloseTooBig        = 1009
+)
+
+var errWSClosed = errors.New("websocket closed")
+
+// wsError ends a websocket with a close frame of code
+type wsError struct {
+	code   int
+	reason string
+}
+
+func (e *wsError) Error() string {
+	return fmt.Sprintf("websocket closed (%d): %s", e.code, e.reason)
+}
+
+// wsConn is the server's end of a websocket. its messages are read by one
+// goroutine, while any number of them can write
+type wsConn struct {
+	conn        net.Conn
+	rw          *bufio.ReadWriter
+	readTimeout time.Duration
+
+	mu        sync.Mutex
+	closeSent bool
+}
+
+// acceptWebsocket completes the opening handshake of the request, and takes
+// over its connection. the errors returned before then can still be
+// responded to. a connection that doesn't send anything, not even a pong, for
+// readTimeout is closed
+func acceptWebsocket(w http.ResponseWriter, r *http.Request,
+	readTimeout time.Duration) (*wsConn, error) {
+
+	if !headerHasToken(r.Header, "Connection", "upgrade") ||
+		!headerHasToken(r.Header, "Upgrade", "websocket") {
+		return nil, he.BadRequest.New("expected a websocket upgrade")
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, he.BadRequest.New("unsupported websocket version")
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	nonce, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(nonce) != 16 {
+		return nil, he.BadRequest.New("invalid Sec-WebSocket-Key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, he.Unexpected.New("websockets are unsupported")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, he.Unexpected.Wrap(err)
+	}
+
+	// the server's read and write timeouts stay set on hijacked connections.
+	// a websocket sets its own before each frame instead
+	err = conn.SetDeadline(time.Time{})
+	if err == nil {
+		err = conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	}
+	if err == nil {
+		_, err = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Upgrade: websocket\r\n" +
+			"Connection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n")
+	}
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, errs.Wrap(err)
+	}
+
+	return &wsConn{conn: conn, rw: rw, readTimeout: readTimeout}, nil
+}
+
+// wsAccept is the Sec-WebSocket-Accept that proves the handshake was
+// understood
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken is whether the comma separated header has the token, in any
+// case
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readMessage returns the next text or binary message, answering any pings
+// on the way. io.EOF is returned once the client has closed the websocket,
+// and a *wsError when the client broke the protocol
+func (ws *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	fragmented := false
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch opcode {
+		case wsOpPing:
+			err = ws.writeFrame(wsOpPong, payload)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			// the client's close is echoed back with its status code
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			_ = ws.close(code, "")
+			return nil, io.EOF
+		case wsOpText, wsOpBinary:
+			if fragmented {
+				return nil, &wsError{wsCloseProtocolError,
+					"expected a continuation frame"}
+			}
+			message = payload
+		case wsOpContinuation:
+			if !fragmented {
+				return nil, &wsError{wsCloseProtocolError,
+					"unexpected continuation frame"}
+			}
+			message = append(message, payload...)
+		default:
+			return nil, &wsError{wsCloseProtocolError, "unknown opcode"}
+		}
+
+		if len(message) > wsMaxMessage {
+			return nil, &wsError{wsCloseTooBig, "message too big"}
+		}
+		if fin {
+			return message, nil
+		}
+		fragmented = true
+	}
+}
+
+// readFrame reads one frame from the client, unmasking its payload
+func (ws *wsConn) readFrame() (fin bool, opcode byte, payload []byte,
+	err error) {
+
+	err = ws.conn.SetReadDeadline(time.Now().Add(ws.readTimeout))
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	var header [2]byte
+	_, err = io.ReadFull(ws.rw, header[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &wsError{wsCloseProtocolError,
+			"reserved bits are set"}
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, &wsError{wsCloseProtocolError,
+			"client frames must be masked"}
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		_, err = io.ReadFull(ws.rw, extended[:])
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		_, err = io.ReadFull(ws.rw, extended[:])
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	if opcode >= wsOpClose && (length > 125 || !fin) {
+		return false, 0, nil, &wsError{wsCloseProtocolError,
+			"invalid control frame"}
+	}
+	if length > wsMaxMessage {
+		return false, 0, nil, &wsError{wsCloseTooBig, "message too big"}
+	}
+
+	var mask [4]byte
+	_, err = io.ReadFull(ws.rw, mask[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	payload = make([]byte, length)
+	_, err = io.ReadFull(ws.rw, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame sends one unfragmented frame. nothing more can be written once
+// the websocket has been closed
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.closeSent {
+		return errWSClosed
+	}
+	if opcode == wsOpClose {
+		ws.closeSent = true
+	}
+
+	header := []byte{0x80 | opcode, 0}
+	switch length := len(payload); {
+	case length < 126:
+		header[1] = byte(length)
+	case length <= 0xffff:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header[1] = 127
+		header = append(header, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	err := ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err != nil {
+		return err
+	}
+	_, err = ws.rw.Write(header)
+	if err != nil {
+		return err
+	}
+	_, err = ws.rw.Write(payload)
+	if err != nil {
+		return err
+	}
+	return ws.rw.Flush()
+}
+
+// close sends a close frame with the code and reason, unless one has been
+// sent already
+func (ws *wsConn) close(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	err := ws.writeFrame(wsOpClose, append(payload, reason...))
+	if err == errWSClosed {
+		return nil
+	}
+	return err
+}
+
+// Close closes the connection, sending a close frame first if the websocket
+// hasn't been closed yet
+func (ws *wsConn) Close() error {
+	_ = ws.close(wsCloseGoingAway, "")
+	return ws.conn.Close()
+}
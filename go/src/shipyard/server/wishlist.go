@@ -0,0 +1,749 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-chi/chi"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+	"shipyard/util"
+)
+
+// the kinds of wishlist. each user has at most one saved for later list,
+// which is added the first time something is saved to it
+const (
+	wishlistNamed = "wishlist"
+	wishlistSaved = "saved"
+)
+
+const (
+	maxWishlists          = 20
+	maxWishlistItems      = 100
+	maxWishlistNameLength = 100
+	savedWishlistName     = "Saved for later"
+)
+
+// ListWishlist will return the active user's wishlists, oldest first
+func (s *Server) ListWishlist(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &RootJSON{Wishlists: []*Wishlist{}}
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		wishlists, err := tx.All_Wishlist_By_UserPk(ctx,
+			database.Wishlist_UserPk(userPk))
+		if err != nil {
+			return err
+		}
+
+		for _, wishlist := range wishlists {
+			apiWishlist, err := s.loadWishlist(ctx, tx, wishlist)
+			if err != nil {
+				return err
+			}
+			resp.Wishlists = append(resp.Wishlists, apiWishlist)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// AddWishlist will add a named wishlist for the active user. it's private
+// unless public is set
+func (s *Server) AddWishlist(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	wishlist := Wishlist{}
+	err = json.NewDecoder(r.Body).Decode(&wishlist)
+	if err != nil {
+		return nil, he.BadRequest.Wrap(err)
+	}
+
+	name, err := wishlistName(wishlist.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		// the user is locked so that wishlists added at the same time can't
+		// both be under the cap when they're counted
+		err := tx.LockUser(ctx, userPk)
+		if err != nil {
+			return err
+		}
+
+		count, err := tx.Count_Wishlist_By_UserPk(ctx,
+			database.Wishlist_UserPk(userPk))
+		if err != nil {
+			return err
+		}
+
+		if count >= maxWishlists {
+			return he.Conflict.New("a user can have at most %d wishlists",
+				maxWishlists)
+		}
+
+		dbWishlist, err := tx.Create_Wishlist(ctx,
+			database.Wishlist_Id(util.MustUUID4()),
+			database.Wishlist_Kind(wishlistNamed),
+			database.Wishlist_Name(name),
+			database.Wishlist_Public(wishlist.Public),
+			database.Wishlist_ShareToken(util.MustUUID4()),
+			database.Wishlist_UserPk(userPk))
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Wishlist: s.apiWishlist(dbWishlist, nil)}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// GetWishlist will return one of the active user's wishlists
+func (s *Server) GetWishlist(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		wishlist, err := findOwnedWishlist(ctx, tx,
+			chi.URLParam(r, "wishlistID"), userPk)
+		if err != nil {
+			return err
+		}
+
+		apiWishlist, err := s.loadWishlist(ctx, tx, wishlist)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Wishlist: apiWishlist}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// GetSharedWishlist will return a public wishlist by the token in its
+// share_url. private wishlists are never found
+func (s *Server) GetSharedWishlist(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	var resp *RootJSON
+	err := s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		wishlist, err := tx.Find_Wishlist_By_ShareToken(ctx,
+			database.Wishlist_ShareToken(chi.URLParam(r, "shareToken")))
+		if err != nil {
+			return err
+		}
+
+		if wishlist == nil || !wishlist.Public {
+			return he.NotFound.New("wishlist not found")
+		}
+
+		apiWishlist, err := s.loadWishlist(ctx, tx, wishlist)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Wishlist: apiWishlist}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// PatchWishlist will rename a wishlist, or make it public or private, using
+// JSON Merge Patch. the saved for later list is always private
+func (s *Server) PatchWishlist(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	patch, err := decodeMergePatch(r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = patch.only("name", "public")
+	if err != nil {
+		return nil, err
+	}
+
+	ups := database.Wishlist_Update_Fields{}
+	if name, ok, err := patch.string("name"); err != nil {
+		return nil, err
+	} else if ok {
+		name, err = wishlistName(name)
+		if err != nil {
+			return nil, err
+		}
+		ups.Name = database.Wishlist_Name(name)
+	}
+
+	public, publicOK, err := patch.bool("public")
+	if err != nil {
+		return nil, err
+	} else if publicOK {
+		ups.Public = database.Wishlist_Public(public)
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		wishlist, err := findOwnedWishlist(ctx, tx,
+			chi.URLParam(r, "wishlistID"), userPk)
+		if err != nil {
+			return err
+		}
+
+		if public && wishlist.Kind == wishlistSaved {
+			return he.BadRequest.New("the saved for later list can't be public")
+		}
+
+		wishlist, err = tx.Update_Wishlist_By_Pk(ctx,
+			database.Wishlist_Pk(wishlist.Pk), ups)
+		if err != nil {
+			return err
+		}
+
+		apiWishlist, err := s.loadWishlist(ctx, tx, wishlist)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Wishlist: apiWishlist}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// DeleteWishlist will remove one of the active user's wishlists and everything
+// on it. the saved for later list can't be removed
+func (s *Server) DeleteWishlist(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		wishlist, err := findOwnedWishlist(ctx, tx,
+			chi.URLParam(r, "wishlistID"), userPk)
+		if err != nil {
+			return err
+		}
+
+		if wishlist.Kind == wishlistSaved {
+			return he.Conflict.New("the saved for later list can't be deleted")
+		}
+
+		_, err = tx.Delete_Wishlist_By_Pk(ctx, database.Wishlist_Pk(wishlist.Pk))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// AddWishlistItem will add a variant to one of the active user's wishlists.
+// like the cart, items with more than one variant need a variant_id. adding
+// what's already on the list leaves it alone
+func (s *Server) AddWishlistItem(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	wishlistItem := WishlistItem{}
+	err = json.NewDecoder(r.Body).Decode(&wishlistItem)
+	if err != nil {
+		return nil, he.BadRequest.Wrap(err)
+	}
+
+	if wishlistItem.Quantity == 0 {
+		wishlistItem.Quantity = 1
+	}
+
+	if wishlistItem.Quantity < 1 {
+		return nil, he.BadRequest.New("quantity must be at least 1")
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		wishlist, err := findOwnedWishlist(ctx, tx,
+			chi.URLParam(r, "wishlistID"), userPk)
+		if err != nil {
+			return err
+		}
+
+		item, variant, err := findCartVariant(ctx, tx, wishlistItem.ItemID,
+			wishlistItem.VariantID)
+		if err != nil {
+			return err
+		}
+
+		existing, err := tx.Find_WishlistItem_By_WishlistPk_And_VariantPk(ctx,
+			database.WishlistItem_WishlistPk(wishlist.Pk),
+			database.WishlistItem_VariantPk(variant.Pk))
+		if err != nil {
+			return err
+		}
+
+		if existing == nil {
+			err = addWishlistItem(ctx, tx, wishlist, item, variant,
+				wishlistItem.Quantity)
+			if err != nil {
+				return err
+			}
+		}
+
+		apiWishlist, err := s.loadWishlist(ctx, tx, wishlist)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Wishlist: apiWishlist}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// DeleteWishlistItem will remove a variant from one of the active user's
+// wishlists
+func (s *Server) DeleteWishlistItem(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp *RootJSON
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		wishlist, wishlistItem, err := findOwnedWishlistItem(ctx, tx,
+			chi.URLParam(r, "wishlistID"), chi.URLParam(r, "wishlistItemID"),
+			userPk)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Delete_WishlistItem_By_Pk(ctx,
+			database.WishlistItem_Pk(wishlistItem.Pk))
+		if err != nil {
+			return err
+		}
+
+		apiWishlist, err := s.loadWishlist(ctx, tx, wishlist)
+		if err != nil {
+			return err
+		}
+
+		resp = &RootJSON{Wishlist: apiWishlist}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// SaveCart will move an item out of the active user's cart and onto their
+// saved for later list, releasing what it held of the item's remaining
+// quantity. the cart item is found like UpdateCart finds it
+func (s *Server) SaveCart(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	var wishlist *Wishlist
+	var released *database.Item
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		cartItem, err := findCartItem(ctx, tx, chi.URLParam(r, "cartItemID"),
+			userPk)
+		if err != nil {
+			return err
+		}
+
+		// TODO(sam): nil check
+		item, err := tx.Get_Item_By_Pk(ctx, database.Item_Pk(*cartItem.ItemPk))
+		if err != nil {
+			return err
+		}
+
+		// items added to the cart before they had variants are saved as their
+		// only variant, but their quantity was only taken from the item
+		var variant, saved *database.Variant
+		if cartItem.VariantPk != nil {
+			variant, err = tx.Get_Variant_By_Pk(ctx,
+				database.Variant_Pk(*cartItem.VariantPk))
+			if err != nil {
+				return err
+			}
+			saved = variant
+		} else {
+			_, saved, err = findCartVariant(ctx, tx, item.Id, "")
+			if err != nil {
+				return err
+			}
+		}
+
+		dbWishlist, err := savedWishlist(ctx, tx, userPk)
+		if err != nil {
+			return err
+		}
+
+		existing, err := tx.Find_WishlistItem_By_WishlistPk_And_VariantPk(ctx,
+			database.WishlistItem_WishlistPk(dbWishlist.Pk),
+			database.WishlistItem_VariantPk(saved.Pk))
+		if err != nil {
+			return err
+		}
+
+		if existing == nil {
+			err = addWishlistItem(ctx, tx, dbWishlist, item, saved,
+				cartItem.Quantity)
+		} else {
+			err = tx.UpdateNoReturn_WishlistItem_By_Pk(ctx,
+				database.WishlistItem_Pk(existing.Pk),
+				database.WishlistItem_Update_Fields{
+					Quantity: database.WishlistItem_Quantity(existing.Quantity +
+						cartItem.Quantity),
+				})
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Delete_CartItem_By_Pk(ctx, database.CartItem_Pk(cartItem.Pk))
+		if err != nil {
+			return err
+		}
+
+		released, _, err = adjustStock(ctx, tx, item, variant,
+			cartItem.Quantity)
+		if err != nil {
+			return err
+		}
+
+		err = recordCartEvent(ctx, tx, userPk, item, variant, 0)
+		if err != nil {
+			return err
+		}
+
+		wishlist, err = s.loadWishlist(ctx, tx, dbWishlist)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.publishInventory(released)
+	return s.cartWithWishlist(ctx, w, r, wishlist)
+}
+
+// CartWishlistItem will add a wishlist item to the active user's cart, if
+// enough of it remains. items saved for later are moved off of their list,
+// while other wishlists keep them
+func (s *Server) CartWishlistItem(ctx context.Context, w http.ResponseWriter,
+	r *http.Request) (interface{}, error) {
+
+	ss, err := GetCtxSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	userPk, err := sessionUserPk(ss)
+	if err != nil {
+		return nil, err
+	}
+
+	var wishlist *Wishlist
+	var taken *database.Item
+	err = s.DB.WithTx(ctx, func(ctx context.Context, tx *database.Tx) error {
+		dbWishlist, wishlistItem, err := findOwnedWishlistItem(ctx, tx,
+			chi.URLParam(r, "wishlistID"), chi.URLParam(r, "wishlistItemID"),
+			userPk)
+		if err != nil {
+			return err
+		}
+
+		item, err := tx.Get_Item_By_Pk(ctx,
+			database.Item_Pk(wishlistItem.ItemPk))
+		if err != nil {
+			return err
+		}
+
+		variant, err := tx.Get_Variant_By_Pk(ctx,
+			database.Variant_Pk(wishlistItem.VariantPk))
+		if err != nil {
+			return err
+		}
+
+		if variant.RemainingQuantity < wishlistItem.Quantity {
+			return he.BadRequest.New("only %d of the item remain",
+				variant.RemainingQuantity)
+		}
+
+		taken, err = addToCart(ctx, tx, userPk, item, variant,
+			wishlistItem.Quantity)
+		if err != nil {
+			return err
+		}
+
+		if dbWishlist.Kind == wishlistSaved {
+			_, err = tx.Delete_WishlistItem_By_Pk(ctx,
+				database.WishlistItem_Pk(wishlistItem.Pk))
+			if err != nil {
+				return err
+			}
+		}
+
+		wishlist, err = s.loadWishlist(ctx, tx, dbWishlist)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.publishInventory(taken)
+	return s.cartWithWishlist(ctx, w, r, wishlist)
+}
+
+// cartWithWishlist responds with the cart, like the other cart handlers, along
+// with the wishlist that an item was moved to or from
+func (s *Server) cartWithWishlist(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, wishlist *Wishlist) (interface{}, error) {
+	resp, err := s.ListCart(ctx, w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	root := resp.(*RootJSON)
+	root.Wishlist = wishlist
+	return root, nil
+}
+
+func (s *Server) loadWishlist(ctx context.Context, tx *database.Tx,
+	wishlist *database.Wishlist) (*Wishlist, error) {
+	items, err := tx.All_WishlistItem_Variant_Item_By_WishlistPk(ctx,
+		database.WishlistItem_WishlistPk(wishlist.Pk))
+	if err != nil {
+		return nil, err
+	}
+	return s.apiWishlist(wishlist, items), nil
+}
+
+func (s *Server) wishlistURL(shareToken string) string {
+	p := path.Join("/api/wishlist/shared", shareToken)
+	if s.Config.PublicAPIURL == nil {
+		return p
+	}
+
+	root := s.PublicAPIURL()
+	root.Path = path.Join(root.Path, p)
+	return root.String()
+}
+
+func findOwnedWishlist(ctx context.Context, tx *database.Tx, wishlistID string,
+	userPk int64) (*database.Wishlist, error) {
+	wishlist, err := tx.Find_Wishlist_By_Id(ctx,
+		database.Wishlist_Id(wishlistID))
+	if err != nil {
+		return nil, err
+	}
+
+	if wishlist == nil || wishlist.UserPk != userPk {
+		return nil, he.NotFound.New("wishlist not found")
+	}
+	return wishlist, nil
+}
+
+func findOwnedWishlistItem(ctx context.Context, tx *database.Tx, wishlistID,
+	wishlistItemID string, userPk int64) (*database.Wishlist,
+	*database.WishlistItem, error) {
+	wishlist, err := findOwnedWishlist(ctx, tx, wishlistID, userPk)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wishlistItem, err := tx.Find_WishlistItem_By_Id(ctx,
+		database.WishlistItem_Id(wishlistItemID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if wishlistItem == nil || wishlistItem.WishlistPk != wishlist.Pk {
+		return nil, nil, he.NotFound.New("wishlist item not found")
+	}
+	return wishlist, wishlistItem, nil
+}
+
+// savedWishlist finds the user's saved for later list, adding it if this is
+// the first time they've saved anything
+func savedWishlist(ctx context.Context, tx *database.Tx, userPk int64) (
+	*database.Wishlist, error) {
+	find := func() (*database.Wishlist, error) {
+		return tx.Find_Wishlist_By_UserPk_And_Kind(ctx,
+			database.Wishlist_UserPk(userPk), database.Wishlist_Kind(wishlistSaved))
+	}
+	wishlist, err := find()
+	if err != nil || wishlist != nil {
+		return wishlist, err
+	}
+
+	// another request saving the user's first item could be adding the list
+	// too, so it's looked for again once the user is locked
+	err = tx.LockUser(ctx, userPk)
+	if err != nil {
+		return nil, err
+	}
+	wishlist, err = find()
+	if err != nil || wishlist != nil {
+		return wishlist, err
+	}
+
+	return tx.Create_Wishlist(ctx,
+		database.Wishlist_Id(util.MustUUID4()),
+		database.Wishlist_Kind(wishlistSaved),
+		database.Wishlist_Name(savedWishlistName),
+		database.Wishlist_Public(false),
+		database.Wishlist_ShareToken(util.MustUUID4()),
+		database.Wishlist_UserPk(userPk))
+}
+
+func addWishlistItem(ctx context.Context, tx *database.Tx,
+	wishlist *database.Wishlist, item *database.Item, variant *database.Variant,
+	quantity int) error {
+	// the wishlist's owner is locked so that items added at the same time
+	// can't both be under the cap when they're counted
+	err := tx.LockUser(ctx, wishlist.UserPk)
+	if err != nil {
+		return err
+	}
+
+	count, err := tx.Count_WishlistItem_By_WishlistPk(ctx,
+		database.WishlistItem_WishlistPk(wishlist.Pk))
+	if err != nil {
+		return err
+	}
+
+	if count >= maxWishlistItems {
+		return he.Conflict.New("a wishlist can have at most %d items",
+			maxWishlistItems)
+	}
+
+	_, err = tx.Create_WishlistItem(ctx,
+		database.WishlistItem_Id(util.MustUUID4()),
+		database.WishlistItem_Quantity(quantity),
+		database.WishlistItem_WishlistPk(wishlist.Pk),
+		database.WishlistItem_ItemPk(item.Pk),
+		database.WishlistItem_VariantPk(variant.Pk))
+	return err
+}
+
+func wishlistName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", he.BadRequest.New("a wishlist needs a name")
+	}
+
+	if len(name) > maxWishlistNameLength {
+		return "", he.BadRequest.New("wishlist names can be at most %d "+
+			"characters", maxWishlistNameLength)
+	}
+	return name, nil
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"shipyard/database"
+	he "shipyard/httperror"
+)
+
+func TestWishlists(baseTest *testing.T) {
+	ctx, t := newServerTest(baseTest)
+	defer t.cleanup()
+
+	ownerCtx := t.addNewSession(ctx, "owner@example.com")
+	ctx = t.addNewSession(ctx, "friend@example.com")
+	item := newItem(ctx, t, "lamp", 3)
+
+	r := jsonPostRequest(t, "/api/wishlist", Wishlist{Name: " birthday "})
+	resp, err := t.server.AddWishlist(ownerCtx, httptest.NewRecorder(), r)
+	assert.NoError(t, err)
+	wishlist := resp.(*RootJSON).Wishlist
+	assert.Equal(t, "birthday", wishlist.Name)
+	assert.Empty(t, wishlist.ShareURL)
+
+	r = jsonPostRequest(t, "/api/wishlist/"+wishlist.ID+"/item",
+		WishlistItem{ItemID: item.Id})
+	resp, err = t.server.AddWishlistItem(ownerCtx, httptest.NewRecorder(),
+		withURLParams(r, "wishlistID", wishlist.ID))
+	assert.NoError(t, err)
+	assert.Len(t, resp.(*RootJSON).Wishlist.Items, 1)
+	assert.True(t, resp.(*RootJSON).Wishlist.Items[0].Available)
+
+	// wishlists are private until they're made public
+	r = jsonPostRequest(t, "/api/wishlist/"+wishlist.ID+"/item",
+		WishlistItem{ItemID: item.Id})
+	_, err = t.server.AddWishlistItem(ctx, httptest.NewRecorder(),
+		withURLParams(r, "wishlistID", wishlist.ID))
+	assert.True(t, he.NotFound.Has(err))
+
+	r = httptest.NewRequest(http.MethodPatch, "/api/wishlist/"+wishlist.ID,
+		strings.NewReader(`{"public": true}`))
+	resp, err = t.server.PatchWishlist(ownerCtx, httptest.NewRecorder(),
+		withURLParams(r, "wishlistID", wishlist.ID))
+	assert.NoError(t, err)
+	shareURL := resp.(*RootJSON).Wishlist.ShareURL
+	assert.NotEmpty(t, shareURL)
+
+	getShared := func() (*Wishlist, error) {
+		token := shareURL[strings.LastIndex(shareURL, "/")+1:]
+		r := httptest.NewRequest(http.MethodGet, shareURL, nil)
+		resp, err := t.server.GetSharedWishlist(ctx, httptest.NewRecorder(),
+			withURLParams(r, "shareToken", token))
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON).Wishlist, nil
+	}
+	shared, err := getShared()
+	assert.NoError(t, err)
+	assert.Equal(t, "birthday", shared.Name)
+	assert.Len(t, shared.Items, 1)
+
+	r = httptest.NewRequest(http.MethodPatch, "/api/wishlist/"+wishlist.ID,
+		strings.NewReader(`{"public": false}`))
+	_, err = t.server.PatchWishlist(ownerCtx, httptest.NewRecorder(),
+		withURLParams(r, "wishlistID", wishlist.ID))
+	assert.NoError(t, err)
+	_, err = getShared()
+	assert.True(t, he.NotFound.Has(err))
+
+	// saving for later releases what the cart held
+	remaining := func() int {
+		i, err := t.server.DB.Find_Item_By_Id(ctx, database.Item_Id(item.Id))
+		assert.NoError(t, err)
+		return i.RemainingQuantity
+	}
+	t.addCart(ctx, item.Id, 2)
+	assert.Equal(t, 1, remaining())
+
+	r = jsonPostRequest(t, "/api/cart/"+item.Id+"/save", nil)
+	resp, err = t.server.SaveCart(ctx, httptest.NewRecorder(),
+		withURLParams(r, "cartItemID", item.Id))
+	assert.NoError(t, err)
+	assert.Empty(t, resp.(*RootJSON).CartItems)
+	saved := resp.(*RootJSON).Wishlist
+	assert.True(t, saved.SavedForLater)
+	assert.Len(t, saved.Items, 1)
+	assert.Equal(t, 2, saved.Items[0].Quantity)
+	assert.Equal(t, 3, remaining())
+
+	r = httptest.NewRequest(http.MethodDelete, "/api/wishlist/"+saved.ID, nil)
+	_, err = t.server.DeleteWishlist(ctx, httptest.NewRecorder(),
+		withURLParams(r, "wishlistID", saved.ID))
+	assert.True(t, he.Conflict.Has(err))
+
+	// moving it back checks that enough remain
+	moveToCart := func() (*RootJSON, error) {
+		savedItemID := saved.Items[0].ID
+		r := jsonPostRequest(t, "/api/wishlist/"+saved.ID+"/item/"+
+			savedItemID+"/cart", nil)
+		resp, err := t.server.CartWishlistItem(ctx, httptest.NewRecorder(),
+			withURLParams(r, "wishlistID", saved.ID,
+				"wishlistItemID", savedItemID))
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*RootJSON), nil
+	}
+	t.addCart(ownerCtx, item.Id, 2)
+	_, err = moveToCart()
+	assert.True(t, he.BadRequest.Has(err))
+
+	r = jsonPostRequest(t, "/api/cart/"+item.Id, CartItem{Quantity: 0})
+	_, err = t.server.UpdateCart(ownerCtx, httptest.NewRecorder(),
+		withURLParams(r, "cartItemID", item.Id))
+	assert.NoError(t, err)
+	moved, err := moveToCart()
+	assert.NoError(t, err)
+	assert.Len(t, moved.CartItems, 1)
+	assert.Equal(t, 2, moved.CartItems[0].Quantity)
+	assert.Empty(t, moved.Wishlist.Items)
+	assert.Equal(t, 1, remaining())
+}
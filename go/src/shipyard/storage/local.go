@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Local stores blobs as files under a directory
+type Local struct {
+	Dir string
+}
+
+var _ BlobStore = (*Local)(nil)
+
+func NewLocal(dir string) *Local {
+	return &Local{Dir: dir}
+}
+
+func (l *Local) path(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(l.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file first so that a partly written blob is
+// never read
+func (l *Local) Put(ctx context.Context, key string, data []byte,
+	contentType string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return Error.Wrap(err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".upload-")
+	if err != nil {
+		return Error.Wrap(err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		_ = tmp.Close()
+		return Error.Wrap(err)
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return Error.Wrap(err)
+	}
+
+	return Error.Wrap(os.Rename(tmp.Name(), p))
+}
+
+func (l *Local) Get(ctx context.Context, key string) ([]byte, error) {
+	p, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, NotFound.New("%s", key)
+	}
+	if err != nil {
+		return nil, Error.Wrap(err)
+	}
+	return data, nil
+}
+
+func (l *Local) Delete(ctx context.Context, key string) error {
+	p, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if err != nil && !os.IsNotExist(err) {
+		return Error.Wrap(err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory is an in-process BlobStore for tests and local development. its
+// blobs are lost when the process exits
+type Memory struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+var _ BlobStore = (*Memory)(nil)
+
+func NewMemory() *Memory {
+	return &Memory{blobs: map[string][]byte{}}
+}
+
+func (m *Memory) Put(ctx context.Context, key string, data []byte,
+	contentType string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *Memory) Get(ctx context.Context, key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.blobs[key]
+	if !ok {
+		return nil, NotFound.New("%s", key)
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (m *Memory) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.blobs, key)
+	return nil
+}
+
+// Len returns how many blobs are stored
+func (m *Memory) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.blobs)
+}
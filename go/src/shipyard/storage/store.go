@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/zeebo/errs"
+)
+
+var (
+	// Error is returned when the store can't be read or written
+	Error = errs.Class("storage")
+
+	// NotFound is returned when there's no blob with the key
+	NotFound = errs.Class("blob not found")
+)
+
+// BlobStore keeps the bytes of uploaded files, like item images, by key. keys
+// are slash separated paths, like "items/<item id>/<image id>"
+type BlobStore interface {
+	// Put stores data under key, replacing anything already there
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+
+	// Get returns what was stored under key
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Delete removes what was stored under key. deleting a missing key isn't
+	// an error
+	Delete(ctx context.Context, key string) error
+}
+
+// checkKey ensures the key can't escape the store, like with ".."
+func checkKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key ||
+		key == ".." || strings.HasPrefix(key, "../") {
+		return Error.New("invalid key %q", key)
+	}
+	return nil
+}
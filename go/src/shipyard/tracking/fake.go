@@ -0,0 +1,53 @@
+package tracking
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// Fake is an in-process Tracker for local development and tests. every
+// package is in transit until it's given another status with Set
+type Fake struct {
+	mu       sync.Mutex
+	statuses map[string]Status
+}
+
+var _ Tracker = (*Fake)(nil)
+
+func NewFake() *Fake {
+	return &Fake{statuses: map[string]Status{}}
+}
+
+func (f *Fake) Name() string { return "fake" }
+
+func (f *Fake) Track(ctx context.Context, carrier, trackingNumber string) (
+	Status, error) {
+
+	if err := ctx.Err(); err != nil {
+		return Status{}, Unavailable.Wrap(err)
+	}
+	if trackingNumber == "" {
+		return Status{}, NotFound.New("%s has no tracking number", carrier)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	status, ok := f.statuses[fakeKey(carrier, trackingNumber)]
+	if !ok {
+		return Status{State: InTransit}, nil
+	}
+	return status, nil
+}
+
+// Set gives a package the status that Track returns for it
+func (f *Fake) Set(carrier, trackingNumber string, status Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statuses[fakeKey(carrier, trackingNumber)] = status
+}
+
+// carriers are matched however they're capitalized
+func fakeKey(carrier, trackingNumber string) string {
+	return strings.ToLower(carrier) + "/" + trackingNumber
+}
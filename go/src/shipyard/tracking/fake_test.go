@@ -0,0 +1,33 @@
+package tracking
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFake(t *testing.T) {
+	ctx := context.Background()
+	fake := NewFake()
+
+	status, err := fake.Track(ctx, "UPS", "1Z")
+	assert.NoError(t, err)
+	assert.Equal(t, InTransit, status.State)
+
+	delivered := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	fake.Set("ups", "1Z", Status{State: Delivered, Delivered: delivered})
+	status, err = fake.Track(ctx, "UPS", "1Z")
+	assert.NoError(t, err)
+	assert.Equal(t, Delivered, status.State)
+	assert.Equal(t, delivered, status.Delivered)
+
+	_, err = fake.Track(ctx, "UPS", "")
+	assert.True(t, NotFound.Has(err))
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = fake.Track(ctx, "UPS", "1Z")
+	assert.True(t, Unavailable.Has(err))
+}
@@ -0,0 +1,45 @@
+package tracking
+
+import (
+	"context"
+	"time"
+
+	"github.com/zeebo/errs"
+)
+
+var (
+	// NotFound is returned when the carrier doesn't know the tracking number.
+	// carriers often take a while to know about new packages
+	NotFound = errs.Class("tracking number not found")
+
+	// Unavailable is returned when the carrier can't be reached
+	Unavailable = errs.Class("carrier unavailable")
+)
+
+// State is where a package is on its way
+type State string
+
+const (
+	InTransit State = "in_transit"
+	Delivered State = "delivered"
+	Exception State = "exception"
+)
+
+// Status is what the carrier last said about a package. Delivered is only
+// set once it has been, and Detail is the carrier's description, like where
+// the package is or what went wrong
+type Status struct {
+	State     State
+	Delivered time.Time
+	Detail    string
+}
+
+// Tracker looks up packages with their carriers
+type Tracker interface {
+	// Name identifies the tracker in logs
+	Name() string
+
+	// Track returns the status of the package with the carrier's tracking
+	// number
+	Track(ctx context.Context, carrier, trackingNumber string) (Status, error)
+}